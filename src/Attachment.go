@@ -1,7 +1,267 @@
 package main
 
+import (
+	"bytes"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+)
+
+const defaultContentType = "application/octet-stream"
+
+var errUploadLimitExceeded = errors.New("upload limit exceeded")
+
 // Attachment defines a file attached to an incident.
+// The Id is used to find the attachment and its content, the FileName is the name it was uploaded with.
 type Attachment struct {
-	FileName string `json:"filename"` // The file name.
-	Time     string `json:"time"`     // The time the file was attached.
+	Id          string `json:"id"`          // The generated id of the attachment.
+	FileName    string `json:"filename"`    // The file name.
+	Time        string `json:"time"`        // The time the file was attached.
+	Size        int64  `json:"size"`        // The size of the file in bytes.
+	ContentType string `json:"contentType"` // The detected MIME type of the file.
+	Checksum    string `json:"sha256"`      // The hex encoded SHA-256 checksum of the file.
+	UploaderId  int64  `json:"uploaderId"`  // The id of the user that uploaded the file, -1 if a service account did.
+	Version     int    `json:"version"`     // The current version of the file.
+	// The id of the service account that uploaded the file, if one did.
+	ServiceAccountId string `json:"serviceAccountId,omitempty"`
+	// The id the file manager gave the current version, if it keeps versions itself.
+	StorageVersion string              `json:"storageVersion,omitempty"`
+	ScanStatus     string              `json:"scanStatus,omitempty"`    // The result of scanning the current version for malware.
+	ScanSignature  string              `json:"scanSignature,omitempty"` // The malware found in the current version.
+	Versions       []AttachmentVersion `json:"versions,omitempty"`      // The previous versions of the file.
+}
+
+// AttachmentVersion defines a single uploaded version of an attachment.
+type AttachmentVersion struct {
+	Version        int    `json:"version"`                  // The version number, starting at 1.
+	FileName       string `json:"filename"`                 // The file name.
+	Time           string `json:"time"`                     // The time the version was uploaded.
+	Size           int64  `json:"size"`                     // The size of the file in bytes.
+	ContentType    string `json:"contentType"`              // The detected MIME type of the file.
+	Checksum       string `json:"sha256"`                   // The hex encoded SHA-256 checksum of the file.
+	UploaderId     int64  `json:"uploaderId"`               // The id of the user that uploaded the version, -1 if a service account did.
+	StorageVersion string `json:"storageVersion,omitempty"` // The id the file manager gave the version.
+	ScanStatus     string `json:"scanStatus,omitempty"`     // The result of scanning the version for malware.
+	ScanSignature  string `json:"scanSignature,omitempty"`  // The malware found in the version.
+	// The id of the service account that uploaded the version, if one did.
+	ServiceAccountId string `json:"serviceAccountId,omitempty"`
+}
+
+// getId returns the id used to find the attachment and its content.
+// Attachments added before ids were generated are identified by their file name.
+func (attachment Attachment) getId() string {
+	if len(attachment.Id) > 0 {
+		return attachment.Id
+	}
+
+	return attachment.FileName
+}
+
+// getVersion returns the current version of the attachment.
+// Attachments added before versioning are on their first version.
+func (attachment Attachment) getVersion() int {
+	if attachment.Version > 0 {
+		return attachment.Version
+	}
+
+	return 1
+}
+
+// getCurrentVersion returns the metadata of the current version.
+func (attachment Attachment) getCurrentVersion() AttachmentVersion {
+	return AttachmentVersion{
+		Version:          attachment.getVersion(),
+		FileName:         attachment.FileName,
+		Time:             attachment.Time,
+		Size:             attachment.Size,
+		ContentType:      attachment.ContentType,
+		Checksum:         attachment.Checksum,
+		UploaderId:       attachment.UploaderId,
+		StorageVersion:   attachment.StorageVersion,
+		ScanStatus:       attachment.ScanStatus,
+		ScanSignature:    attachment.ScanSignature,
+		ServiceAccountId: attachment.ServiceAccountId,
+	}
+}
+
+// getVersions returns every version of the attachment, oldest first.
+func (attachment Attachment) getVersions() []AttachmentVersion {
+	versions := make([]AttachmentVersion, 0, len(attachment.Versions)+1)
+	versions = append(versions, attachment.Versions...)
+	return append(versions, attachment.getCurrentVersion())
+}
+
+// findVersion looks up a version of the attachment by its number.
+func (attachment Attachment) findVersion(version int) (AttachmentVersion, bool) {
+	for _, v := range attachment.getVersions() {
+		if v.Version == version {
+			return v, true
+		}
+	}
+
+	return AttachmentVersion{}, false
+}
+
+// addVersion makes a new upload the current version, keeping the previous one.
+func (attachment *Attachment) addVersion(version AttachmentVersion) {
+	attachment.Versions = append(attachment.Versions, attachment.getCurrentVersion())
+	attachment.setCurrentVersion(version)
+}
+
+// setCurrentVersion replaces the metadata of the current version.
+func (attachment *Attachment) setCurrentVersion(version AttachmentVersion) {
+	attachment.Version = version.Version
+	attachment.FileName = version.FileName
+	attachment.Time = version.Time
+	attachment.Size = version.Size
+	attachment.ContentType = version.ContentType
+	attachment.Checksum = version.Checksum
+	attachment.UploaderId = version.UploaderId
+	attachment.StorageVersion = version.StorageVersion
+	attachment.ScanStatus = version.ScanStatus
+	attachment.ScanSignature = version.ScanSignature
+	attachment.ServiceAccountId = version.ServiceAccountId
+}
+
+// updateVersion replaces the metadata of an existing version.
+func (attachment *Attachment) updateVersion(version AttachmentVersion) {
+	if version.Version == attachment.getVersion() {
+		attachment.setCurrentVersion(version)
+		return
+	}
+
+	for i := range attachment.Versions {
+		if attachment.Versions[i].Version == version.Version {
+			attachment.Versions[i] = version
+		}
+	}
+}
+
+// getVersionKey returns the name a version of an attachment is stored under.
+// The first version, and any version kept by the file manager, is stored under the attachment id.
+// Other versions are stored next to it with the version number appended.
+func (attachment Attachment) getVersionKey(version AttachmentVersion) string {
+	if version.Version <= 1 || len(version.StorageVersion) > 0 {
+		return attachment.getId()
+	}
+
+	return fmt.Sprintf("%v.v%v", attachment.getId(), version.Version)
+}
+
+// getUploader returns the user or service account that uploaded the version.
+func (version AttachmentVersion) getUploader() Principal {
+	return Principal{version.UploaderId, version.ServiceAccountId}
+}
+
+// getContentDisposition returns the Content-Disposition header that names the downloaded file.
+func (version AttachmentVersion) getContentDisposition() string {
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": version.FileName})
+	if len(disposition) == 0 {
+		return "attachment"
+	}
+
+	return disposition
+}
+
+// getETag returns a strong entity tag for the version based on its checksum.
+// An empty string is returned if the version has no checksum.
+func (version AttachmentVersion) getETag() string {
+	if len(version.Checksum) == 0 {
+		return ""
+	}
+
+	return "\"" + version.Checksum + "\""
+}
+
+// getDigest returns the checksum in the format used by the Digest header.
+// An empty string is returned if the version has no checksum.
+func (version AttachmentVersion) getDigest() string {
+	sum, err := hex.DecodeString(version.Checksum)
+	if err != nil || len(sum) == 0 {
+		return ""
+	}
+
+	return "sha-256=" + b64.StdEncoding.EncodeToString(sum)
+}
+
+// attachmentReader works out the size, content type and checksum of a file as it is read.
+// When there is a reserve function it is given the size read so far, reading fails once it returns a problem.
+type attachmentReader struct {
+	reader      io.Reader
+	hash        hash.Hash
+	size        int64
+	contentType string
+	sniffedType string
+	reserve     func(size int64) *ProblemDetails
+	problem     *ProblemDetails
+}
+
+// newAttachmentReader wraps a file so its metadata is collected as it is saved.
+// The content type is sniffed from the file, if that is not conclusive the declared
+// type and then the file extension are used.
+// The sniffedType is only what was detected from the file, since the declared type and extension are chosen by the client.
+func newAttachmentReader(file io.Reader, fileName string, declaredType string) (*attachmentReader, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	sniffedType := http.DetectContentType(head)
+	contentType := sniffedType
+	if contentType == defaultContentType {
+		contentType = getDeclaredContentType(fileName, declaredType)
+	}
+
+	return &attachmentReader{
+		reader:      io.MultiReader(bytes.NewReader(head), file),
+		hash:        sha256.New(),
+		contentType: contentType,
+		sniffedType: sniffedType,
+	}, nil
+}
+
+func getDeclaredContentType(fileName string, declaredType string) string {
+	if len(declaredType) > 0 {
+		if mediaType, _, err := mime.ParseMediaType(declaredType); err == nil {
+			return mediaType
+		}
+	}
+
+	if byExtension := mime.TypeByExtension(filepath.Ext(fileName)); len(byExtension) > 0 {
+		return byExtension
+	}
+
+	return defaultContentType
+}
+
+func (r *attachmentReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.hash.Write(p[:n])
+	r.size += int64(n)
+	if r.reserve == nil {
+		return n, err
+	}
+
+	if r.problem = r.reserve(r.size); r.problem != nil {
+		return n, errUploadLimitExceeded
+	}
+
+	return n, err
+}
+
+// fill records the collected metadata on a version.
+// This should only be called once the whole file has been read.
+func (r *attachmentReader) fill(version *AttachmentVersion) {
+	version.Size = r.size
+	version.ContentType = r.contentType
+	version.Checksum = hex.EncodeToString(r.hash.Sum(nil))
 }
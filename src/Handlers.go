@@ -4,9 +4,11 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"sort"
 	"strconv"
 	"time"
 
+	guuid "github.com/google/uuid"
 	"github.com/gorilla/mux"
 )
 
@@ -26,18 +28,11 @@ func HandleCreateIncident(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	incident.Type = "Incident"
-	incident.State = "open"
-
-	passed := incidentManager.AddIncident(&incident)
-	if !passed {
+	if !createIncident(&incident) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	logManager.LogPrintf("Created incident %v\n", incident.Id)
-	go hookManager.CallAddedHooks(incident)
-
 	data, err := json.Marshal(incident)
 	if err != nil {
 		panic(err)
@@ -76,8 +71,13 @@ func HandleIncidentUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if incidentManager.UpdateIncident(incidentId, update) {
-		go hookManager.CallUpdatedHooks(incidentId, update)
+	status := checkIncidentUpdate(incidentId, update)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+
+	if applyIncidentUpdate(incidentId, update) {
 		w.WriteHeader(http.StatusOK)
 		return
 	}
@@ -86,6 +86,195 @@ func HandleIncidentUpdate(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNotFound)
 }
 
+// checkIncidentUpdate verifies that an update can be applied to an incident.
+// The returned status is not found if the incident does not exist and conflict if the
+// state change is not an allowed transition.
+func checkIncidentUpdate(incidentId int, update IncidentUpdate) int {
+	inc, found := incidentManager.GetIncident(incidentId)
+	if !found {
+		logManager.LogPrintf("Incident %v not found\n", incidentId)
+		return http.StatusNotFound
+	}
+
+	if !canTransitionIncident(inc.State, update.State) {
+		logManager.LogPrintf("Incident %v cannot move from %v to %v\n", incidentId, inc.State, update.State)
+		return http.StatusConflict
+	}
+
+	return http.StatusOK
+}
+
+// createIncident adds a new open incident and notifies any listeners.
+func createIncident(incident *Incident) bool {
+	incident.Type = "Incident"
+	incident.State = "open"
+
+	if !incidentManager.AddIncident(incident) {
+		return false
+	}
+
+	logManager.LogPrintf("Created incident %v\n", incident.Id)
+	go hookManager.CallAddedHooks(*incident)
+
+	created := *incident
+	eventManager.Publish(IncidentEvent{Type: incidentCreatedEvent, IncidentId: created.Id, Incident: &created})
+	return true
+}
+
+// applyIncidentUpdate updates an incident and notifies any listeners.
+// If the incident cannot be found a false will be returned.
+func applyIncidentUpdate(incidentId int, update IncidentUpdate) bool {
+	if !incidentManager.UpdateIncident(incidentId, update) {
+		return false
+	}
+
+	go hookManager.CallUpdatedHooks(incidentId, update)
+	eventManager.Publish(IncidentEvent{Type: incidentUpdatedEvent, IncidentId: int64(incidentId), Update: &update})
+	return true
+}
+
+// attachFile stores a file and associates it with an incident.
+// The declared content type is only used if the type cannot be detected from the file.
+// Once the attachment is recorded any listeners are notified.
+func attachFile(incidentId int, fileName string, file io.Reader, declaredType string, uploaderId int64) (Attachment, bool) {
+	attach, _, ok := storeAttachment(incidentId, Attachment{Id: guuid.New().String()}, false, fileName, file, declaredType, userPrincipal(uploaderId), nil)
+	return attach, ok
+}
+
+// attachFileVersion stores a file as the new version of an existing attachment.
+// The previous versions are kept and can still be downloaded.
+func attachFileVersion(incidentId int, attach Attachment, fileName string, file io.Reader, declaredType string, uploaderId int64) (Attachment, bool) {
+	attach, _, ok := storeAttachment(incidentId, attach, true, fileName, file, declaredType, userPrincipal(uploaderId), nil)
+	return attach, ok
+}
+
+// attachUpload stores a file uploaded by a user or service account and associates it with an incident.
+// If the file breaks the upload policy it is not stored and the problem is returned.
+func attachUpload(incidentId int, fileName string, file io.Reader, declaredType string, uploader Principal) (Attachment, *ProblemDetails, bool) {
+	return storeAttachment(incidentId, Attachment{Id: guuid.New().String()}, false, fileName, file, declaredType, uploader, &uploadPolicy)
+}
+
+// attachUploadVersion stores a file uploaded by a user or service account as the new version of an existing attachment.
+// If the file breaks the upload policy it is not stored and the problem is returned.
+func attachUploadVersion(incidentId int, attach Attachment, fileName string, file io.Reader, declaredType string, uploader Principal) (Attachment, *ProblemDetails, bool) {
+	return storeAttachment(incidentId, attach, true, fileName, file, declaredType, uploader, &uploadPolicy)
+}
+
+// storeAttachment saves a file and records it as an attachment, or a version of one, on an incident.
+// When a policy is given the file is checked against it as it is saved.
+// The bytes read are reserved against the quotas until the attachment is recorded or the upload fails.
+func storeAttachment(incidentId int, attach Attachment, existing bool, fileName string, file io.Reader, declaredType string, uploader Principal, policy *UploadPolicy) (Attachment, *ProblemDetails, bool) {
+	fileName = sanitizeFileName(fileName)
+	reader, err := newAttachmentReader(file, fileName, declaredType)
+	if err != nil {
+		logManager.LogPrintf("Unable to read file %v\n", err)
+		return Attachment{}, nil, false
+	}
+
+	if policy != nil {
+		problem := policy.checkFileName(fileName)
+		if problem == nil {
+			problem = policy.checkContentType(reader.sniffedType)
+		}
+
+		if problem != nil {
+			return Attachment{}, problem, false
+		}
+
+		reservation := &uploadReservation{incidentId: incidentId, uploader: uploader}
+		defer userUploadUsage.Release(reservation)
+		reader.reserve = func(size int64) *ProblemDetails {
+			return userUploadUsage.Reserve(*policy, reservation, size)
+		}
+	}
+
+	version := AttachmentVersion{
+		Version:          1,
+		FileName:         fileName,
+		Time:             time.Now().Format(time.RFC3339),
+		UploaderId:       uploader.UserId,
+		ServiceAccountId: uploader.ServiceAccountId,
+	}
+	var ok bool
+	if existing {
+		version.Version = attach.getVersion() + 1
+		ok = saveAttachmentVersion(int64(incidentId), &attach, &version, reader)
+	} else {
+		_, ok = fileManager.SaveFile(strconv.Itoa(incidentId), attach.Id, reader)
+	}
+
+	if !ok && reader.problem != nil {
+		// A file manager that keeps versions itself does not store a version it failed to save.
+		if _, versioned := getVersionedFileManager(); !existing || !versioned {
+			fileManager.DeleteFile(strconv.Itoa(incidentId), attach.getVersionKey(version))
+		}
+
+		return Attachment{}, reader.problem, false
+	}
+
+	if !ok {
+		logManager.LogPrintln("Unable to save file")
+		return Attachment{}, nil, false
+	}
+
+	io.Copy(io.Discard, reader)
+	logManager.LogPrintf("Attachment %v version %v uploaded\n", attach.Id, version.Version)
+	reader.fill(&version)
+
+	// The version is quarantined until it has been scanned.
+	if attachmentScanner != nil {
+		version.ScanStatus = scanPending
+	}
+
+	if existing {
+		attach.addVersion(version)
+		ok = incidentManager.UpdateAttachment(incidentId, attach)
+	} else {
+		attach.setCurrentVersion(version)
+		ok = incidentManager.AddAttachment(incidentId, attach)
+	}
+
+	if !ok {
+		return attach, nil, false
+	}
+
+	logManager.LogPrintln("Updated incident with attachment")
+	userUploadUsage.Add(uploader, version.Size)
+
+	if attachmentScanner != nil {
+		attach = scanAttachmentVersion(incidentId, attach, attach.getCurrentVersion())
+	}
+
+	notifyAttached(incidentId, attach)
+	return attach, nil, true
+}
+
+// notifyAttached lets hooks and subscribers know about a new version of an attachment.
+// Versions that are quarantined are only announced once they are found to be clean.
+func notifyAttached(incidentId int, attach Attachment) {
+	switch attach.ScanStatus {
+	case scanInfected:
+		go hookManager.CallInfectedHooks(incidentId, attach)
+	case scanPending, scanFailed:
+		logManager.LogPrintf("Attachment %v version %v is quarantined\n", attach.getId(), attach.getVersion())
+	default:
+		go hookManager.CallAttachedHooks(incidentId, attach)
+		eventManager.Publish(IncidentEvent{Type: incidentAttachedEvent, IncidentId: int64(incidentId), Attachment: &attach})
+	}
+}
+
+// findAttachment looks up the metadata of an attachment on an incident.
+func findAttachment(incidentId int, attachmentId string) (Attachment, bool) {
+	attachments, _ := incidentManager.GetAttachments(incidentId)
+	for _, attachment := range attachments {
+		if attachment.getId() == attachmentId {
+			return attachment, true
+		}
+	}
+
+	return Attachment{}, false
+}
+
 func convertUpdate(body io.ReadCloser) (IncidentUpdate, bool) {
 	decoder := json.NewDecoder(body)
 
@@ -155,12 +344,43 @@ func HandleGetAttachments(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// HandleGetIncidentUsage handles the get incident attachment usage web request.
+func HandleGetIncidentUsage(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Getting incident usage")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if !validateRequest(w, r, availablePermissions.viewIncident) {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	incidentId, err := strconv.Atoi(vars["incidentId"])
+	if err != nil {
+		logManager.LogPrintf("Error converting incidentId %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := incidentManager.GetIncident(incidentId); !ok {
+		logManager.LogPrintf("Got Invalid usage request for %v.", incidentId)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(getIncidentUsage(incidentId)); err != nil {
+		panic(err)
+	}
+}
+
 // HandleUploadAttachment handles the upload attachment web request.
 func HandleUploadAttachment(w http.ResponseWriter, r *http.Request) {
 	logManager.LogPrintln("Got upload attachment request")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	if !validateRequest(w, r, availablePermissions.modifyIncident) {
+	uploader, valid := validatePrincipal(w, r, availablePermissions.modifyIncident)
+	if !valid {
 		return
 	}
 
@@ -187,28 +407,108 @@ func HandleUploadAttachment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	path, ok := fileManager.SaveFile(strconv.Itoa(incidentId), handler.Filename, file)
+	defer file.Close()
+
+	attach, problem, ok := attachUpload(incidentId, handler.Filename, file, handler.Header.Get("Content-Type"), uploader)
+	if problem != nil {
+		writeProblem(w, problem)
+		return
+	}
+
 	if !ok {
-		logManager.LogPrintln("Unable to save file")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	logManager.LogPrintf("Attachment uploaded to %v\n.", path)
-	attach := Attachment{handler.Filename, time.Now().Format(time.RFC3339)}
-	if !incidentManager.AddAttachment(incidentId, attach) {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(attach); err != nil {
+		panic(err)
+	}
+}
+
+// HandleUploadAttachmentVersion handles the upload attachment version web request.
+func HandleUploadAttachmentVersion(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got upload attachment version request")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	uploader, valid := validatePrincipal(w, r, availablePermissions.modifyIncident)
+	if !valid {
+		return
+	}
+
+	vars := mux.Vars(r)
+	incidentId, err := strconv.Atoi(vars["incidentId"])
+
+	if err != nil {
+		logManager.LogPrintf("Error converting incidentId %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	attachment, found := findAttachment(incidentId, vars["attachmentId"])
+	if !found {
+		logManager.LogPrintf("Got invalid attachment version request for %v.\n", vars["attachmentId"])
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	file, handler, err := r.FormFile("uploadfile")
+	if err != nil {
+		logManager.LogPrintln("Unable to get file")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	defer file.Close()
+
+	attach, problem, ok := attachUploadVersion(incidentId, attachment, handler.Filename, file, handler.Header.Get("Content-Type"), uploader)
+	if problem != nil {
+		writeProblem(w, problem)
+		return
+	}
+
+	if !ok {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	logManager.LogPrintln("Updated incident with attachment")
-	go hookManager.CallAttachedHooks(incidentId, attach)
 	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
 	if err := json.NewEncoder(w).Encode(attach); err != nil {
 		panic(err)
 	}
 }
 
+// HandleGetAttachmentVersions handles the get attachment versions web request.
+func HandleGetAttachmentVersions(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got attachment versions request")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if !validateRequest(w, r, availablePermissions.viewIncident) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	incidentId, err := strconv.Atoi(vars["incidentId"])
+
+	if err != nil {
+		logManager.LogPrintf("Error converting incidentId %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	attachment, found := findAttachment(incidentId, vars["attachmentId"])
+	if !found {
+		logManager.LogPrintf("Got invalid attachment versions request for %v.\n", vars["attachmentId"])
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(attachment.getVersions()); err != nil {
+		panic(err)
+	}
+}
+
 // HandleDownloadAttachment handles the download attachment web request.
 func HandleDownloadAttachment(w http.ResponseWriter, r *http.Request) {
 	logManager.LogPrintln("Got download request.")
@@ -234,7 +534,65 @@ func HandleDownloadAttachment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	f, d, passed, callback := fileManager.LoadFile(incidentId, attachmentId)
+	id, err := strconv.Atoi(incidentId)
+	if err != nil {
+		logManager.LogPrintf("Error converting incidentId %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	attachment, found := findAttachment(id, attachmentId)
+	if !found {
+		logManager.LogPrintf("Got invalid attachment request for attachment id %v.\n", attachmentId)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	version, found := findRequestedVersion(w, r, attachment)
+	if !found {
+		return
+	}
+
+	serveAttachmentVersion(w, r, id, attachment, version)
+}
+
+// findRequestedVersion finds the version of an attachment named by the version query parameter.
+// The current version is used if no version is requested. If the version is not valid the response is written.
+func findRequestedVersion(w http.ResponseWriter, r *http.Request, attachment Attachment) (AttachmentVersion, bool) {
+	requested := r.URL.Query().Get("version")
+	if len(requested) == 0 {
+		return attachment.getCurrentVersion(), true
+	}
+
+	number, err := strconv.Atoi(requested)
+	if err != nil {
+		logManager.LogPrintf("Error converting version %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return AttachmentVersion{}, false
+	}
+
+	version, found := attachment.findVersion(number)
+	if !found {
+		logManager.LogPrintf("Got invalid attachment request for version %v.\n", number)
+		w.WriteHeader(http.StatusNotFound)
+	}
+
+	return version, found
+}
+
+// serveAttachmentVersion responds with the content of a version of an attachment.
+func serveAttachmentVersion(w http.ResponseWriter, r *http.Request, id int, attachment Attachment, version AttachmentVersion) {
+	if version.isQuarantined() {
+		writeProblem(w, version.getQuarantineProblem())
+		return
+	}
+
+	if url, ok := presignAttachmentVersion(int64(id), attachment, version); ok {
+		http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+		return
+	}
+
+	f, d, passed, callback := loadAttachmentVersion(int64(id), attachment, version)
 	if !passed {
 		logManager.LogPrintln("File not found")
 		w.WriteHeader(http.StatusNotFound)
@@ -243,7 +601,21 @@ func HandleDownloadAttachment(w http.ResponseWriter, r *http.Request) {
 
 	defer callback()
 
-	http.ServeContent(w, r, d.Name(), d.ModTime(), f)
+	if etag := version.getETag(); len(etag) > 0 {
+		w.Header().Set("ETag", etag)
+	}
+
+	if len(version.ContentType) > 0 {
+		w.Header().Set("Content-Type", version.ContentType)
+	}
+
+	if digest := version.getDigest(); len(digest) > 0 {
+		w.Header().Set("Digest", digest)
+	}
+
+	w.Header().Set("Content-Disposition", version.getContentDisposition())
+
+	http.ServeContent(w, r, version.FileName, d.ModTime(), f)
 }
 
 func HandleRemoveAttachment(w http.ResponseWriter, r *http.Request) {
@@ -287,9 +659,11 @@ func HandleRemoveAttachment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var attachment Attachment
 	found := false
 	for _, v := range attachments {
-		if v.FileName == attachmentId {
+		if v.getId() == attachmentId {
+			attachment = v
 			found = true
 			break
 		}
@@ -307,7 +681,9 @@ func HandleRemoveAttachment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fileManager.DeleteFile(incident, attachmentId)
+	deleteAttachmentFiles(int64(incidentId), attachment)
+	previewGenerator.deletePreviews(int64(incidentId), attachment)
+	userUploadUsage.RemoveAttachment(attachment)
 }
 
 // HandleGetIncident handles the get incident web request.
@@ -345,6 +721,7 @@ func HandleGetIncident(w http.ResponseWriter, r *http.Request) {
 }
 
 // HandleGetIncidents handles the get incidents web request.
+// The response format is negotiated from the Accept header and can be limited with the fields parameter.
 func HandleGetIncidents(w http.ResponseWriter, r *http.Request) {
 	logManager.LogPrintln("Got incidents request")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -354,6 +731,13 @@ func HandleGetIncidents(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	format := negotiateIncidentFormat(r)
+	if len(format) == 0 {
+		logManager.LogPrintf("Unable to provide incidents as %v\n", r.Header.Get("Accept"))
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+
 	filter, passed := convertFilter(r)
 
 	if !passed {
@@ -366,14 +750,23 @@ func HandleGetIncidents(w http.ResponseWriter, r *http.Request) {
 		logManager.LogPrintf("Using filter %+v\n", *filter)
 	}
 
+	projection := convertFields(r)
+
 	if val, ok := incidentManager.GetIncidents(filter); ok {
 		logManager.LogPrintf("Found %v incidents\n", len(val))
 
+		sort.Slice(val, func(i, j int) bool {
+			return val[i].Id < val[j].Id
+		})
+
+		if format != jsonFormat {
+			w.Header().Set("Content-Type", format+";charset=UTF-8")
+		}
+
 		w.WriteHeader(http.StatusOK)
 
-		if err := json.NewEncoder(w).Encode(val); err != nil {
-			logManager.LogPrintln("Unable to encode incidents")
-			panic(err)
+		if err := writeIncidents(w, format, projection, val); err != nil {
+			logManager.LogPrintf("Unable to encode incidents %v\n", err)
 		}
 
 		return
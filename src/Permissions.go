@@ -21,3 +21,20 @@ var availablePermissions = AvailablePermissions{
 	"user-delete",
 	"*",
 }
+
+// isKnownPermission checks if a permission is one of the available permissions.
+func isKnownPermission(permission string) bool {
+	switch permission {
+	case availablePermissions.viewIncident,
+		availablePermissions.modifyIncident,
+		availablePermissions.deleteIncident,
+		availablePermissions.createIncident,
+		availablePermissions.viewUser,
+		availablePermissions.modifyUser,
+		availablePermissions.deleteUser,
+		availablePermissions.master:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	scanPending  = "pending"  // The version is quarantined until it has been scanned.
+	scanClean    = "clean"    // The version was scanned and nothing was found.
+	scanInfected = "infected" // The version was scanned and malware was found.
+	scanFailed   = "failed"   // The version could not be scanned and stays quarantined.
+)
+
+const (
+	problemAttachmentInfected    = "urn:sona:problem:attachment-infected"
+	problemAttachmentQuarantined = "urn:sona:problem:attachment-quarantined"
+)
+
+const defaultScanTimeout = time.Minute
+
+// clamdChunkSize is the size of each chunk streamed to clamd.
+const clamdChunkSize = 64 * 1024
+
+// ScanResult is the outcome of scanning a file.
+// The Signature names the malware found in an infected file.
+type ScanResult struct {
+	Infected  bool
+	Signature string
+}
+
+// AttachmentScanner defines a minimal implementation required for scanning attachments for malware.
+// Scan should read the whole file and report if it is infected.
+// An error should be returned if the file could not be scanned.
+type AttachmentScanner interface {
+	Scan(file io.Reader) (ScanResult, error)
+}
+
+var attachmentScanner AttachmentScanner
+
+// ClamdScanner scans files by streaming them to a ClamAV daemon.
+type ClamdScanner struct {
+	Network string        // The network to connect over, tcp or unix.
+	Address string        // The address of clamd, a host and port or a socket path.
+	Timeout time.Duration // How long clamd can go without responding.
+}
+
+// NewClamdScanner creates a scanner for an address like tcp://127.0.0.1:3310 or unix:///var/run/clamav/clamd.ctl.
+// An address without a scheme is a tcp address.
+func NewClamdScanner(address string, timeout time.Duration) ClamdScanner {
+	network, path, found := strings.Cut(address, "://")
+	if !found {
+		network, path = "tcp", address
+	}
+
+	if timeout <= 0 {
+		timeout = defaultScanTimeout
+	}
+
+	return ClamdScanner{network, path, timeout}
+}
+
+// Scan streams a file to clamd using the INSTREAM command.
+func (scanner ClamdScanner) Scan(file io.Reader) (ScanResult, error) {
+	conn, err := net.DialTimeout(scanner.Network, scanner.Address, scanner.Timeout)
+	if err != nil {
+		return ScanResult{}, err
+	}
+
+	defer conn.Close()
+
+	if err := scanner.stream(conn, file); err != nil {
+		// clamd stops reading and replies with an error when a file is too large, so the reply is more useful than the write error.
+		if result, replyErr := scanner.readReply(conn); replyErr == nil || !errors.Is(replyErr, io.EOF) {
+			return result, replyErr
+		}
+
+		return ScanResult{}, err
+	}
+
+	return scanner.readReply(conn)
+}
+
+func (scanner ClamdScanner) stream(conn net.Conn, file io.Reader) error {
+	conn.SetDeadline(time.Now().Add(scanner.Timeout))
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return err
+	}
+
+	chunk := make([]byte, clamdChunkSize+4)
+	for {
+		n, err := file.Read(chunk[4:])
+		if n > 0 {
+			conn.SetDeadline(time.Now().Add(scanner.Timeout))
+			binary.BigEndian.PutUint32(chunk, uint32(n))
+			if _, err := conn.Write(chunk[:n+4]); err != nil {
+				return err
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := conn.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+func (scanner ClamdScanner) readReply(conn net.Conn) (ScanResult, error) {
+	conn.SetDeadline(time.Now().Add(scanner.Timeout))
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && len(reply) == 0 {
+		return ScanResult{}, err
+	}
+
+	return parseClamdReply(reply)
+}
+
+// parseClamdReply converts a reply like "stream: OK" or "stream: Eicar-Signature FOUND".
+func parseClamdReply(reply string) (ScanResult, error) {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	status := strings.TrimPrefix(reply, "stream: ")
+
+	if status == "OK" {
+		return ScanResult{}, nil
+	}
+
+	if signature, found := strings.CutSuffix(status, " FOUND"); found {
+		return ScanResult{Infected: true, Signature: signature}, nil
+	}
+
+	return ScanResult{}, fmt.Errorf("clamd scan failed: %v", reply)
+}
+
+// ExecScanner scans files by running a command on them.
+// The file is written to a temporary file whose path replaces {file} in the arguments, or is added as the last argument.
+// Like clamscan an exit code of 0 is clean, 1 is infected and anything else is a failure.
+type ExecScanner struct {
+	Command string        // The command to run.
+	Args    []string      // The arguments to pass to the command.
+	Timeout time.Duration // How long the command can run.
+}
+
+// Scan runs the command on a copy of the file.
+func (scanner ExecScanner) Scan(file io.Reader) (ScanResult, error) {
+	temp, err := os.CreateTemp("", "sona-scan-*")
+	if err != nil {
+		return ScanResult{}, err
+	}
+
+	defer os.Remove(temp.Name())
+
+	_, err = io.Copy(temp, file)
+	temp.Close()
+	if err != nil {
+		return ScanResult{}, err
+	}
+
+	timeout := scanner.Timeout
+	if timeout <= 0 {
+		timeout = defaultScanTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, scanner.Command, scanner.getArgs(temp.Name())...).CombinedOutput()
+	if err == nil {
+		return ScanResult{}, nil
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return ScanResult{Infected: true, Signature: parseScanOutput(string(output))}, nil
+	}
+
+	return ScanResult{}, fmt.Errorf("scan command failed: %v %v", err, strings.TrimSpace(string(output)))
+}
+
+func (scanner ExecScanner) getArgs(path string) []string {
+	args := make([]string, 0, len(scanner.Args)+1)
+	substituted := false
+	for _, arg := range scanner.Args {
+		if strings.Contains(arg, "{file}") {
+			substituted = true
+		}
+
+		args = append(args, strings.ReplaceAll(arg, "{file}", path))
+	}
+
+	if !substituted {
+		args = append(args, path)
+	}
+
+	return args
+}
+
+// parseScanOutput finds the signature in output like "/tmp/file: Eicar-Signature FOUND".
+// If there is no signature the output is used.
+func parseScanOutput(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		if found, ok := strings.CutSuffix(strings.TrimSpace(line), " FOUND"); ok {
+			if _, signature, hasPath := strings.Cut(found, ": "); hasPath {
+				return signature
+			}
+
+			return found
+		}
+	}
+
+	return strings.TrimSpace(output)
+}
+
+// scanAttachmentVersion scans a version of an attachment and records the result.
+// The updated attachment is returned.
+func scanAttachmentVersion(incidentId int, attach Attachment, version AttachmentVersion) Attachment {
+	version.ScanStatus = scanFailed
+	version.ScanSignature = ""
+
+	file, _, found, closer := loadAttachmentVersion(int64(incidentId), attach, version)
+	if closer != nil {
+		defer closer()
+	}
+
+	if found && file != nil {
+		result, err := attachmentScanner.Scan(file)
+
+		if err != nil {
+			logManager.LogPrintf("Unable to scan attachment %v version %v %v\n", attach.getId(), version.Version, err)
+		} else if result.Infected {
+			logManager.LogPrintf("Attachment %v version %v is infected with %v\n", attach.getId(), version.Version, result.Signature)
+			version.ScanStatus = scanInfected
+			version.ScanSignature = result.Signature
+		} else {
+			version.ScanStatus = scanClean
+		}
+	} else {
+		logManager.LogPrintf("Unable to load attachment %v version %v to scan\n", attach.getId(), version.Version)
+	}
+
+	attach.updateVersion(version)
+	if !incidentManager.UpdateAttachment(incidentId, attach) {
+		logManager.LogPrintf("Unable to record scan of attachment %v\n", attach.getId())
+	}
+
+	return attach
+}
+
+// rescanAttachment scans every version of an attachment that has not been found to be clean.
+// When the current version changes from quarantined to clean it is announced like a new upload.
+func rescanAttachment(incidentId int, attach Attachment) Attachment {
+	for _, version := range attach.getVersions() {
+		if version.ScanStatus == scanClean {
+			continue
+		}
+
+		previous := version.ScanStatus
+		attach = scanAttachmentVersion(incidentId, attach, version)
+
+		current := attach.getCurrentVersion()
+		if current.Version != version.Version || current.ScanStatus == previous {
+			continue
+		}
+
+		if previous == scanPending || previous == scanFailed || current.ScanStatus == scanInfected {
+			notifyAttached(incidentId, attach)
+		}
+	}
+
+	return attach
+}
+
+// isQuarantined reports if a version cannot be downloaded because it has not been found to be clean.
+// Versions uploaded before scanning was set up have no scan status and can be downloaded.
+func (version AttachmentVersion) isQuarantined() bool {
+	return len(version.ScanStatus) > 0 && version.ScanStatus != scanClean
+}
+
+// getQuarantineProblem describes why a quarantined version cannot be downloaded.
+func (version AttachmentVersion) getQuarantineProblem() *ProblemDetails {
+	if version.ScanStatus == scanInfected {
+		return &ProblemDetails{
+			Type:   problemAttachmentInfected,
+			Title:  "Attachment infected",
+			Status: http.StatusForbidden,
+			Detail: fmt.Sprintf("Version %v was found to contain %v.", version.Version, version.ScanSignature),
+		}
+	}
+
+	return &ProblemDetails{
+		Type:   problemAttachmentQuarantined,
+		Title:  "Attachment quarantined",
+		Status: http.StatusForbidden,
+		Detail: fmt.Sprintf("Version %v has not been scanned successfully.", version.Version),
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// HandleScanAttachment handles the scan attachment web request.
+// Every version of the attachment that has not been found to be clean is scanned again.
+func HandleScanAttachment(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got scan attachment request.")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if !validateRequest(w, r, availablePermissions.modifyIncident) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	incidentId, err := strconv.Atoi(vars["incidentId"])
+	if err != nil {
+		logManager.LogPrintf("Error converting incidentId %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	attachment, found := findAttachment(incidentId, vars["attachmentId"])
+	if !found {
+		logManager.LogPrintf("Got invalid scan request for attachment id %v.\n", vars["attachmentId"])
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if attachmentScanner == nil {
+		logManager.LogPrintln("Unable to scan attachment, no scanner is configured")
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	attachment = rescanAttachment(incidentId, attachment)
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(attachment.getVersions()); err != nil {
+		panic(err)
+	}
+}
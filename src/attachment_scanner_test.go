@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// FakeScanner reports any file containing EICAR as infected, or fails every scan when an error is set.
+type FakeScanner struct {
+	err error
+}
+
+func (scanner FakeScanner) Scan(file io.Reader) (ScanResult, error) {
+	if scanner.err != nil {
+		return ScanResult{}, scanner.err
+	}
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return ScanResult{}, err
+	}
+
+	if bytes.Contains(content, []byte("EICAR")) {
+		return ScanResult{Infected: true, Signature: "Eicar-Test-Signature"}, nil
+	}
+
+	return ScanResult{}, nil
+}
+
+// startFakeClamd listens like clamd and reports any stream containing EICAR as infected.
+// If a reply is given it is sent in place of the scan result.
+func startFakeClamd(t *testing.T, reply string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen %v", err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go serveFakeClamd(conn, reply)
+		}
+	}()
+
+	return "tcp://" + listener.Addr().String()
+}
+
+func serveFakeClamd(conn net.Conn, reply string) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	if command, err := reader.ReadString(0); err != nil || command != "zINSTREAM\x00" {
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+
+	var content bytes.Buffer
+	for {
+		var size uint32
+		if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+			return
+		}
+
+		if size == 0 {
+			break
+		}
+
+		if _, err := io.CopyN(&content, reader, int64(size)); err != nil {
+			return
+		}
+	}
+
+	if len(reply) == 0 {
+		reply = "stream: OK"
+		if bytes.Contains(content.Bytes(), []byte("EICAR")) {
+			reply = "stream: Eicar-Test-Signature FOUND"
+		}
+	}
+
+	conn.Write([]byte(reply + "\x00"))
+}
+
+func TestClamdScannerClean(t *testing.T) {
+	scanner := NewClamdScanner(startFakeClamd(t, ""), time.Second)
+
+	result, err := scanner.Scan(strings.NewReader(strings.Repeat("clean ", clamdChunkSize)))
+
+	if err != nil || result.Infected {
+		t.Errorf("Expected clean result got %v %v", result, err)
+	}
+}
+
+func TestClamdScannerInfected(t *testing.T) {
+	scanner := NewClamdScanner(startFakeClamd(t, ""), time.Second)
+
+	result, err := scanner.Scan(strings.NewReader("X5O!P%@AP EICAR test file"))
+
+	if err != nil || !result.Infected || result.Signature != "Eicar-Test-Signature" {
+		t.Errorf("Expected infected result got %v %v", result, err)
+	}
+}
+
+func TestClamdScannerError(t *testing.T) {
+	scanner := NewClamdScanner(startFakeClamd(t, "INSTREAM size limit exceeded. ERROR"), time.Second)
+
+	if result, err := scanner.Scan(strings.NewReader("content")); err == nil {
+		t.Errorf("Expected error got %v", result)
+	}
+}
+
+func TestClamdScannerUnavailable(t *testing.T) {
+	scanner := NewClamdScanner("127.0.0.1:1", time.Second)
+
+	if result, err := scanner.Scan(strings.NewReader("content")); err == nil {
+		t.Errorf("Expected error got %v", result)
+	}
+}
+
+func TestExecScanner(t *testing.T) {
+	scanner := ExecScanner{
+		Command: "sh",
+		Args:    []string{"-c", `if grep -q EICAR "$0"; then echo "$0: Eicar-Test-Signature FOUND"; exit 1; fi`, "{file}"},
+		Timeout: time.Second * 5,
+	}
+
+	if result, err := scanner.Scan(strings.NewReader("clean")); err != nil || result.Infected {
+		t.Errorf("Expected clean result got %v %v", result, err)
+	}
+
+	result, err := scanner.Scan(strings.NewReader("EICAR"))
+	if err != nil || !result.Infected || result.Signature != "Eicar-Test-Signature" {
+		t.Errorf("Expected infected result got %v %v", result, err)
+	}
+}
+
+func TestExecScannerFailure(t *testing.T) {
+	scanner := ExecScanner{Command: "sh", Args: []string{"-c", "exit 2"}}
+
+	if result, err := scanner.Scan(strings.NewReader("content")); err == nil {
+		t.Errorf("Expected error got %v", result)
+	}
+}
+
+func readUploadedAttachment(t *testing.T, w *httptest.ResponseRecorder) Attachment {
+	if w.Result().StatusCode != 200 {
+		t.Fatalf("Expected 200 status code got %v", w.Result())
+	}
+
+	var attachment Attachment
+	if err := json.Unmarshal(w.Body.Bytes(), &attachment); err != nil {
+		t.Fatalf("Failed to convert response %v error %v", w.Body, err)
+	}
+
+	return attachment
+}
+
+func TestUploadCleanAttachment(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	attachmentScanner = FakeScanner{}
+
+	attachment := readUploadedAttachment(t, uploadAttachment(token, "notes.txt", "hello"))
+
+	if attachment.ScanStatus != scanClean {
+		t.Errorf("Expected clean attachment got %v", attachment)
+	}
+
+	if w := downloadAttachment(token, attachment.Id, nil); w.Result().StatusCode != 200 || w.Body.String() != "hello" {
+		t.Errorf("Expected download got %v %v", w.Result(), w.Body)
+	}
+}
+
+func TestUploadInfectedAttachment(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	attachmentScanner = FakeScanner{}
+
+	called := make(chan map[string]string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		called <- body
+	}))
+	defer server.Close()
+
+	hook := WebHook{"POST", server.URL, WebBody{[]WebBodyItem{{"signature", "signature", true}}}}
+	hookManager.InfectedWebHooks = []WebHook{hook}
+	hookManager.AttachedWebHooks = []WebHook{{"POST", server.URL + "/attached", WebBody{}}}
+
+	attachment := readUploadedAttachment(t, uploadAttachment(token, "notes.txt", "EICAR"))
+
+	if attachment.ScanStatus != scanInfected || attachment.ScanSignature != "Eicar-Test-Signature" {
+		t.Errorf("Expected infected attachment got %v", attachment)
+	}
+
+	w := downloadAttachment(token, attachment.Id, nil)
+	if w.Result().StatusCode != 403 {
+		t.Fatalf("Expected 403 status code got %v", w.Result())
+	}
+
+	if problem := readProblem(t, w); problem.Type != problemAttachmentInfected {
+		t.Errorf("Unexpected problem %v", problem)
+	}
+
+	select {
+	case body := <-called:
+		if body["signature"] != "Eicar-Test-Signature" {
+			t.Errorf("Expected infected hook got %v", body)
+		}
+	case <-time.After(time.Second * 5):
+		t.Errorf("Expected infected hook to be called")
+	}
+}
+
+func TestUploadQuarantinedWhenScanFails(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	attachmentScanner = FakeScanner{errors.New("scanner unavailable")}
+
+	attachment := readUploadedAttachment(t, uploadAttachment(token, "notes.txt", "hello"))
+
+	if attachment.ScanStatus != scanFailed {
+		t.Errorf("Expected failed scan got %v", attachment)
+	}
+
+	w := downloadAttachment(token, attachment.Id, nil)
+	if w.Result().StatusCode != 403 {
+		t.Fatalf("Expected 403 status code got %v", w.Result())
+	}
+
+	if problem := readProblem(t, w); problem.Type != problemAttachmentQuarantined {
+		t.Errorf("Unexpected problem %v", problem)
+	}
+}
+
+func scanAttachment(token string, attachmentId string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("POST", "/sona/v1/incidents/0/attachment/"+attachmentId+"/scan", nil)
+	r.Header.Set("X-Sona-Token", token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestRescanAttachment(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	attachmentScanner = FakeScanner{errors.New("scanner unavailable")}
+	attachment := readUploadedAttachment(t, uploadAttachment(token, "notes.txt", "hello"))
+
+	attachmentScanner = FakeScanner{}
+	w := scanAttachment(token, attachment.Id)
+
+	if w.Result().StatusCode != 200 {
+		t.Fatalf("Expected 200 status code got %v", w.Result())
+	}
+
+	var versions []AttachmentVersion
+	if err := json.Unmarshal(w.Body.Bytes(), &versions); err != nil || len(versions) != 1 || versions[0].ScanStatus != scanClean {
+		t.Errorf("Expected clean version got %v %v", w.Body, err)
+	}
+
+	if w := downloadAttachment(token, attachment.Id, nil); w.Result().StatusCode != 200 {
+		t.Errorf("Expected download got %v", w.Result())
+	}
+}
+
+func TestRescanAttachmentWithoutScanner(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	attachment := readUploadedAttachment(t, uploadAttachment(token, "notes.txt", "hello"))
+
+	if w := scanAttachment(token, attachment.Id); w.Result().StatusCode != 409 {
+		t.Errorf("Expected 409 status code got %v", w.Result())
+	}
+}
+
+func TestUploadBeforeScanningCanBeDownloaded(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	attachment := readUploadedAttachment(t, uploadAttachment(token, "notes.txt", "hello"))
+
+	attachmentScanner = FakeScanner{}
+
+	if w := downloadAttachment(token, attachment.Id, nil); w.Result().StatusCode != 200 {
+		t.Errorf("Expected download got %v", w.Result())
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+)
+
+// AzureBlobFileManager provides the ability to store attachments in Azure Blob Storage.
+type AzureBlobFileManager struct {
+	AccountName string // The storage account to store blobs in.
+	AccountKey  string // The shared key of the storage account.
+	Container   string // The container to store blobs in.
+	Endpoint    string // The blob service url, if empty https://{AccountName}.blob.core.windows.net/ is used.
+	client      *azblob.Client
+}
+
+// Initialize will setup Azure Blob Storage. This will make sure the container can be connected to.
+// This will also create the configured container if it does not already exist.
+func (manager *AzureBlobFileManager) Initialize() {
+	endpoint := manager.Endpoint
+	if len(endpoint) == 0 {
+		endpoint = fmt.Sprintf("https://%v.blob.core.windows.net/", manager.AccountName)
+	}
+
+	credential, err := azblob.NewSharedKeyCredential(manager.AccountName, manager.AccountKey)
+	if err != nil {
+		logManager.LogPrintf("Unable to read azure storage account key %v\n", err)
+		panic(err)
+	}
+
+	client, err := azblob.NewClientWithSharedKeyCredential(endpoint, credential, nil)
+	if err != nil {
+		logManager.LogPrintf("Unable to create azure blob client %v\n", err)
+		panic(err)
+	}
+
+	manager.client = client
+	_, err = client.CreateContainer(context.Background(), manager.Container, nil)
+	if err != nil && !bloberror.HasCode(err, bloberror.ContainerAlreadyExists) {
+		logManager.LogPrintf("Unable to create container %v. Error %v\n", manager.Container, err)
+		panic(err)
+	}
+
+	logManager.LogPrintf("Container %v exists starting azure blob file manager\n", manager.Container)
+}
+
+func (manager *AzureBlobFileManager) blob(incident string, fileName string) *blob.Client {
+	return manager.client.ServiceClient().NewContainerClient(manager.Container).NewBlobClient(incident + "/" + fileName)
+}
+
+// SaveFile will attempt to save an attachment to the configured container.
+// If the attempt fails a false will be returned.
+func (manager *AzureBlobFileManager) SaveFile(incident string, fileName string, file io.Reader) (string, bool) {
+	_, err := manager.client.UploadStream(context.Background(), manager.Container, incident+"/"+fileName, file, nil)
+	if err != nil {
+		logManager.LogPrintf("Unable to save blob in azure %v\n", err)
+		return "", false
+	}
+
+	return manager.blob(incident, fileName).URL(), true
+}
+
+// LoadFile will attempt to load an attachment out of the configured container.
+// The blob is streamed as it is read. If the file cannot be returned a false will be returned.
+func (manager *AzureBlobFileManager) LoadFile(incident string, fileName string) (io.ReadSeeker, os.FileInfo, bool, func()) {
+	client := manager.blob(incident, fileName)
+	properties, err := client.GetProperties(context.Background(), nil)
+	if err != nil {
+		logManager.LogPrintf("Unable to find blob in azure %v\n", err)
+		return nil, nil, false, nil
+	}
+
+	// If the blob is replaced while it is being read azure will fail the request rather than mixing content.
+	conditions := &blob.AccessConditions{ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfMatch: properties.ETag}}
+	size := valueOf(properties.ContentLength)
+	object := &rangedObject{
+		open: func(offset int64) (io.ReadCloser, error) {
+			result, err := client.DownloadStream(context.Background(), &blob.DownloadStreamOptions{
+				Range:            blob.HTTPRange{Offset: offset},
+				AccessConditions: conditions,
+			})
+
+			if err != nil {
+				return nil, err
+			}
+
+			return result.Body, nil
+		},
+		size: size,
+	}
+
+	info := objectFileInfo{fileName, size, valueOf(properties.LastModified)}
+	return object, info, true, object.close
+}
+
+// DeleteFile should attempt to remove the file assoicated with an incident.
+func (manager *AzureBlobFileManager) DeleteFile(incident string, fileName string) bool {
+	if _, err := manager.client.DeleteBlob(context.Background(), manager.Container, incident+"/"+fileName, nil); err != nil {
+		logManager.LogPrintf("Error deleting blob in azure %v\n", err)
+		return false
+	}
+
+	logManager.LogPrintln("Deleted blob in azure")
+	return true
+}
+
+// ListFiles will list every blob in the configured container.
+func (manager *AzureBlobFileManager) ListFiles() ([]StoredFile, bool) {
+	files := make([]StoredFile, 0)
+	pager := manager.client.NewListBlobsFlatPager(manager.Container, nil)
+	for pager.More() {
+		page, err := pager.NextPage(context.Background())
+		if err != nil {
+			logManager.LogPrintf("Unable to list blobs in azure %v\n", err)
+			return nil, false
+		}
+
+		for _, item := range page.Segment.BlobItems {
+			if file, ok := parseStoredFileKey(valueOf(item.Name)); ok {
+				files = append(files, file)
+			}
+		}
+	}
+
+	return files, true
+}
+
+// valueOf returns the value of an optional property returned by azure, or its zero value if it was not returned.
+func valueOf[T any](value *T) T {
+	if value == nil {
+		var zero T
+		return zero
+	}
+
+	return *value
+}
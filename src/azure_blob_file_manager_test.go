@@ -0,0 +1,22 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// azuriteAccountKey is the well known key of the Azurite development account.
+const azuriteAccountKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+// TestAzureBlobFileManager runs against the Azurite emulator.
+// Start it with azurite-blob --skipApiVersionCheck and set AZURITE_BLOB_ENDPOINT=http://127.0.0.1:10000/devstoreaccount1.
+func TestAzureBlobFileManager(t *testing.T) {
+	endpoint := os.Getenv("AZURITE_BLOB_ENDPOINT")
+	if len(endpoint) == 0 {
+		t.Skip("AZURITE_BLOB_ENDPOINT is not set")
+	}
+
+	manager := &AzureBlobFileManager{AccountName: "devstoreaccount1", AccountKey: azuriteAccountKey, Container: "sona-test", Endpoint: endpoint}
+	manager.Initialize()
+	testFileManager(t, manager)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+const (
+	bulkHookModeEach  = "each"
+	bulkHookModeBatch = "batch"
+)
+
+// BulkIncidentRequest defines an update to apply to many incidents.
+// Either the Ids or the Filter should be provided to select the incidents to update.
+// When DryRun is set the incidents are checked but not updated.
+// The HookMode controls if update hooks are fired for each incident or once as a batch.
+type BulkIncidentRequest struct {
+	Ids      []int          `json:"ids"`
+	Filter   *FilterRequest `json:"filter"`
+	Update   IncidentUpdate `json:"update"`
+	DryRun   bool           `json:"dryRun"`
+	HookMode string         `json:"hookMode"`
+}
+
+// BulkIncidentResult defines the outcome of a bulk update for a single incident.
+// The Status is the http status that the same update would have had on its own.
+type BulkIncidentResult struct {
+	Id     int    `json:"id"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BulkIncidentResponse defines the result of a bulk update.
+type BulkIncidentResponse struct {
+	DryRun  bool                 `json:"dryRun"`
+	Results []BulkIncidentResult `json:"results"`
+}
+
+// HandleBulkIncidentUpdate handles the bulk update incidents web request.
+func HandleBulkIncidentUpdate(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrint("Got Bulk Incident Update")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	if !validateRequest(w, r, availablePermissions.modifyIncident) {
+		return
+	}
+
+	request, passed := convertBulkRequest(r)
+	if !passed {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ids, passed := getBulkIncidentIds(request)
+	if !passed {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	response := BulkIncidentResponse{request.DryRun, make([]BulkIncidentResult, 0, len(ids))}
+	pending := make([]int, 0, len(ids))
+	for _, id := range ids {
+		status := checkIncidentUpdate(id, request.Update)
+		if status != http.StatusOK {
+			response.Results = append(response.Results, BulkIncidentResult{id, status, http.StatusText(status)})
+			continue
+		}
+
+		pending = append(pending, id)
+	}
+
+	updated := make([]int, 0, len(pending))
+	if request.DryRun {
+		updated = pending
+	} else if len(pending) > 0 {
+		results := incidentManager.UpdateIncidents(pending, request.Update)
+		for _, id := range pending {
+			if results[id] {
+				updated = append(updated, id)
+				continue
+			}
+
+			logManager.LogPrintf("Unable to update incident %v\n", id)
+			if status := checkIncidentUpdate(id, request.Update); status != http.StatusOK {
+				response.Results = append(response.Results, BulkIncidentResult{id, status, http.StatusText(status)})
+				continue
+			}
+
+			response.Results = append(response.Results, BulkIncidentResult{id, http.StatusInternalServerError, "incident was not updated"})
+		}
+	}
+
+	for _, id := range updated {
+		response.Results = append(response.Results, BulkIncidentResult{Id: id, Status: http.StatusOK})
+	}
+
+	sort.Slice(response.Results, func(i, j int) bool {
+		return response.Results[i].Id < response.Results[j].Id
+	})
+
+	if !request.DryRun {
+		notifyBulkUpdate(updated, request)
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		logManager.LogPrintf("Unable to convert bulk response %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func convertBulkRequest(r *http.Request) (BulkIncidentRequest, bool) {
+	var request BulkIncidentRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		logManager.LogPrintf("Got error when attempting to decode body %v", err)
+		return request, false
+	}
+
+	if (len(request.Ids) == 0) == (request.Filter == nil) {
+		logManager.LogPrintln("Bulk update requires either ids or a filter")
+		return request, false
+	}
+
+	if len(request.HookMode) == 0 {
+		request.HookMode = bulkHookModeEach
+	}
+
+	if request.HookMode != bulkHookModeEach && request.HookMode != bulkHookModeBatch {
+		logManager.LogPrintf("Invalid hook mode %v\n", request.HookMode)
+		return request, false
+	}
+
+	return request, true
+}
+
+// getBulkIncidentIds finds the unique ids of the incidents a bulk request applies to.
+func getBulkIncidentIds(request BulkIncidentRequest) ([]int, bool) {
+	found := make(map[int]bool, 0)
+	ids := make([]int, 0)
+
+	if request.Filter == nil {
+		for _, id := range request.Ids {
+			if !found[id] {
+				found[id] = true
+				ids = append(ids, id)
+			}
+		}
+
+		return ids, true
+	}
+
+	incidents, passed := incidentManager.GetIncidents(request.Filter)
+	if !passed {
+		logManager.LogPrintln("Unable to get incidents for bulk update")
+		return nil, false
+	}
+
+	for _, incident := range incidents {
+		id := int(incident.Id)
+		if !found[id] {
+			found[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Ints(ids)
+	return ids, true
+}
+
+// notifyBulkUpdate lets any listeners know about the incidents that were updated.
+func notifyBulkUpdate(ids []int, request BulkIncidentRequest) {
+	if len(ids) == 0 {
+		return
+	}
+
+	if request.HookMode == bulkHookModeBatch {
+		go hookManager.CallBulkUpdatedHooks(ids, request.Update)
+	}
+
+	for _, id := range ids {
+		if request.HookMode == bulkHookModeEach {
+			go hookManager.CallUpdatedHooks(id, request.Update)
+		}
+
+		update := request.Update
+		eventManager.Publish(IncidentEvent{Type: incidentUpdatedEvent, IncidentId: int64(id), Update: &update})
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func runBulkUpdate(t *testing.T, token string, request BulkIncidentRequest) BulkIncidentResponse {
+	body, _ := json.Marshal(request)
+
+	r, _ := http.NewRequest("POST", "/sona/v1/incidents/bulk", bytes.NewBuffer(body))
+	r.Header.Set("X-Sona-Token", token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 200 {
+		t.Fatalf("Expected 200 status code got %v", w.Result())
+	}
+
+	var retVal BulkIncidentResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &retVal); err != nil {
+		t.Fatalf("Failed to convert response %v error %v", w.Body, err)
+	}
+
+	return retVal
+}
+
+// ConflictingIncidentManager closes an incident before rejecting a bulk update, like a store that finds the state changed inside its transaction.
+type ConflictingIncidentManager struct {
+	RuntimeIncidentManager
+}
+
+func (manager ConflictingIncidentManager) UpdateIncidents(ids []int, update IncidentUpdate) map[int]bool {
+	manager.UpdateIncident(ids[0], IncidentUpdate{State: "closed"})
+	return make(map[int]bool, 0)
+}
+
+func TestBulkUpdateWithIds(t *testing.T) {
+	setup()
+	user1.Permissions = append(user1.Permissions, availablePermissions.modifyIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
+	incidentManager.AddIncident(&Incident{"Incident", 1, "Other", "Tester", "open", make(map[string]string, 0)})
+	_, token := user1.Authenticate("1234")
+
+	response := runBulkUpdate(t, token.Token, BulkIncidentRequest{Ids: []int{0, 1, 5}, Update: IncidentUpdate{State: "closed"}})
+
+	if len(response.Results) != 3 {
+		t.Fatalf("Expected 3 results got %v", response.Results)
+	}
+
+	if response.Results[0].Status != 200 || response.Results[1].Status != 200 || response.Results[2].Status != 404 {
+		t.Errorf("Expected 200, 200, 404 got %v", response.Results)
+	}
+
+	for _, id := range []int{0, 1} {
+		if inc, _ := incidentManager.GetIncident(id); inc.State != "closed" {
+			t.Errorf("Expected incident %v to be closed got %v", id, inc.State)
+		}
+	}
+}
+
+func TestBulkUpdateWithFilter(t *testing.T) {
+	setup()
+	user1.Permissions = append(user1.Permissions, availablePermissions.modifyIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
+	incidentManager.AddIncident(&Incident{"Incident", 1, "Other", "Someone", "open", make(map[string]string, 0)})
+	_, token := user1.Authenticate("1234")
+
+	filter := &FilterRequest{[]ComplexFilter{ComplexFilter{nil, []Filter{Filter{"reporter", "equals", "Tester"}}, "and"}}, "and"}
+	response := runBulkUpdate(t, token.Token, BulkIncidentRequest{Filter: filter, Update: IncidentUpdate{State: "closed"}})
+
+	if len(response.Results) != 1 || response.Results[0].Id != 0 {
+		t.Fatalf("Expected only incident 0 got %v", response.Results)
+	}
+
+	if inc, _ := incidentManager.GetIncident(1); inc.State != "open" {
+		t.Errorf("Expected incident 1 to be open got %v", inc.State)
+	}
+}
+
+func TestBulkUpdateWithDryRun(t *testing.T) {
+	setup()
+	incidentTransitions = map[string][]string{"open": {"closed"}}
+	user1.Permissions = append(user1.Permissions, availablePermissions.modifyIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
+	incidentManager.AddIncident(&Incident{"Incident", 1, "Other", "Tester", "closed", make(map[string]string, 0)})
+	_, token := user1.Authenticate("1234")
+
+	response := runBulkUpdate(t, token.Token, BulkIncidentRequest{Ids: []int{0, 1}, Update: IncidentUpdate{State: "triaged"}, DryRun: true})
+
+	if !response.DryRun || len(response.Results) != 2 {
+		t.Fatalf("Expected 2 dry run results got %v", response)
+	}
+
+	if response.Results[0].Status != 409 || response.Results[1].Status != 409 {
+		t.Errorf("Expected 409 for both incidents got %v", response.Results)
+	}
+
+	response = runBulkUpdate(t, token.Token, BulkIncidentRequest{Ids: []int{0}, Update: IncidentUpdate{State: "closed"}, DryRun: true})
+
+	if response.Results[0].Status != 200 {
+		t.Errorf("Expected 200 got %v", response.Results)
+	}
+
+	if inc, _ := incidentManager.GetIncident(0); inc.State != "open" {
+		t.Errorf("Expected dry run to leave incident open got %v", inc.State)
+	}
+}
+
+func TestBulkUpdateWithoutSelection(t *testing.T) {
+	setup()
+	user1.Permissions = append(user1.Permissions, availablePermissions.modifyIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	_, token := user1.Authenticate("1234")
+	body, _ := json.Marshal(BulkIncidentRequest{Update: IncidentUpdate{State: "closed"}})
+
+	r, _ := http.NewRequest("POST", "/sona/v1/incidents/bulk", bytes.NewBuffer(body))
+	r.Header.Set("X-Sona-Token", token.Token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 400 {
+		t.Errorf("Expected 400 status code got %v", w.Result())
+	}
+}
+
+func TestBulkUpdateWithInvalidPermissions(t *testing.T) {
+	setup()
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
+	_, token := user1.Authenticate("1234")
+	body, _ := json.Marshal(BulkIncidentRequest{Ids: []int{0}, Update: IncidentUpdate{State: "closed"}})
+
+	r, _ := http.NewRequest("POST", "/sona/v1/incidents/bulk", bytes.NewBuffer(body))
+	r.Header.Set("X-Sona-Token", token.Token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 401 {
+		t.Errorf("Expected 401 status code got %v", w.Result())
+	}
+}
+
+func TestBulkUpdateWithStateChangedDuringUpdate(t *testing.T) {
+	setup()
+	incidentTransitions = map[string][]string{"open": {"triaged"}}
+	user1.Permissions = append(user1.Permissions, availablePermissions.modifyIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
+	incidentManager.AddIncident(&Incident{"Incident", 1, "Other", "Tester", "open", make(map[string]string, 0)})
+	incidentManager = ConflictingIncidentManager{incidentManager.(RuntimeIncidentManager)}
+	_, token := user1.Authenticate("1234")
+
+	response := runBulkUpdate(t, token.Token, BulkIncidentRequest{Ids: []int{0, 1}, Update: IncidentUpdate{State: "triaged"}})
+
+	if len(response.Results) != 2 || response.Results[0].Status != 409 || response.Results[1].Status != 500 {
+		t.Errorf("Expected 409, 500 got %v", response.Results)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+)
+
+// fileChunkSize is how much of a file is stored in each database row or item.
+// DynamoDB items cannot be larger than 400KB, so chunks need to stay below that.
+const fileChunkSize = 256 * 1024
+
+// saveChunks splits a file into chunks as it is read, so only one chunk is in memory at a time.
+// The data passed to save is reused for the next chunk once save returns. The size of the file is returned.
+func saveChunks(file io.Reader, chunkSize int, save func(index int, data []byte) error) (int64, error) {
+	buffer := make([]byte, chunkSize)
+	var size int64
+	for index := 0; ; index++ {
+		n, err := io.ReadFull(file, buffer)
+		if n > 0 {
+			if saveErr := save(index, buffer[:n]); saveErr != nil {
+				return size, saveErr
+			}
+
+			size += int64(n)
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return size, nil
+		}
+
+		if err != nil {
+			return size, err
+		}
+	}
+}
+
+// getChunkCount returns how many chunks a file of the given size was saved in.
+func getChunkCount(size int64, chunkSize int) int {
+	return int((size + int64(chunkSize) - 1) / int64(chunkSize))
+}
+
+// chunkReader streams the chunks of a file in order.
+// The next function returns the following chunk, or io.EOF after the last one.
+type chunkReader struct {
+	next  func() ([]byte, error)
+	done  func() error
+	chunk []byte
+	skip  int
+}
+
+// newChunkReader streams chunks starting part way into the first chunk.
+func newChunkReader(skip int, next func() ([]byte, error), done func() error) *chunkReader {
+	return &chunkReader{next: next, done: done, skip: skip}
+}
+
+func (reader *chunkReader) Read(p []byte) (int, error) {
+	for len(reader.chunk) == 0 {
+		chunk, err := reader.next()
+		if err != nil {
+			return 0, err
+		}
+
+		if reader.skip > 0 {
+			chunk = chunk[min(reader.skip, len(chunk)):]
+			reader.skip = 0
+		}
+
+		reader.chunk = chunk
+	}
+
+	n := copy(p, reader.chunk)
+	reader.chunk = reader.chunk[n:]
+	return n, nil
+}
+
+func (reader *chunkReader) Close() error {
+	if reader.done != nil {
+		return reader.done()
+	}
+
+	return nil
+}
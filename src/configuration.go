@@ -2,20 +2,191 @@ package main
 
 // Config defines the configuration that can be used on this web service.
 // The ManagerType controls what manager to use (0 = runtime, 1 = dynamodb, 2 = mysql, 3 = datastore)
-// The FileManagerType controls what file manager to use (0 = local, 1 = S3)
+// The FileManagerType controls what file manager to use (0 = local, 1 = S3, 2 = google cloud storage, 3 = azure blob storage, 4 = mysql, 5 = dynamodb)
+// The Deduplicate controls if attachments with the same content are only stored once.
+// The MigrationTarget is the file manager attachments can be migrated to, configured with the same file manager fields as this config.
 type Config struct {
 	ManagerType     int                    `json:"managertype"`
 	FileManagerType int                    `json:"filemanagertype"`
+	Deduplicate     bool                   `json:"deduplicate"`
 	DynamoConfig    DynamoDBConfig         `json:"dynamodb"`
 	MYSQL           MySQLConfig            `json:"mysql"`
 	DataStore       DataStoreConfig        `json:"datastore"`
 	LocalFileConfig LocalFileManagerConfig `json:"fileconfig"`
 	S3Config        S3FileManagerConfig    `json:"s3config"`
+	GCSConfig       GCSFileManagerConfig   `json:"gcsconfig"`
+	AzureConfig     AzureFileManagerConfig `json:"azureconfig"`
 	Hooks           WebHooks               `json:"webhooks"`
 	Logging         LogConfig              `json:"logging"`
 	User            UserConfig             `json:"userconfig"`
 	Admin           AdminConfig            `json:"adminConfig"`
 	Security        SecurityConfig         `json:"securityConfig"`
+	Passwords       PasswordConfig         `json:"passwords"`
+	Tokens          TokenConfig            `json:"tokens"`
+	Incidents       IncidentConfig         `json:"incidentconfig"`
+	Search          SearchConfig           `json:"search"`
+	Uploads         UploadConfig           `json:"uploads"`
+	Links           DownloadLinkConfig     `json:"downloadlinks"`
+	Scanner         ScannerConfig          `json:"scanner"`
+	Previews        PreviewConfig          `json:"previews"`
+	Encryption      EncryptionConfig       `json:"encryption"`
+	MigrationTarget *Config                `json:"migrationtarget"`
+}
+
+// redactedValue replaces secrets when a config is logged.
+const redactedValue = "[redacted]"
+
+// redacted copies a config with its passwords, keys and secrets replaced so it can be logged.
+func (config Config) redacted() Config {
+	redactString(&config.MYSQL.Password)
+	redactString(&config.AzureConfig.AccountKey)
+	redactString(&config.Admin.Password)
+	redactString(&config.Security.Key)
+	redactString(&config.Links.Secret)
+
+	if config.Tokens.Keys != nil {
+		keys := make(map[string]TokenKeyConfig, len(config.Tokens.Keys))
+		for id, key := range config.Tokens.Keys {
+			redactString(&key.Key)
+			keys[id] = key
+		}
+		config.Tokens.Keys = keys
+	}
+
+	if config.Encryption.Keys != nil {
+		keys := make(map[string]string, len(config.Encryption.Keys))
+		for id := range config.Encryption.Keys {
+			keys[id] = redactedValue
+		}
+		config.Encryption.Keys = keys
+	}
+
+	if config.MigrationTarget != nil {
+		target := config.MigrationTarget.redacted()
+		config.MigrationTarget = &target
+	}
+
+	return config
+}
+
+func redactString(value *string) {
+	if len(*value) > 0 {
+		*value = redactedValue
+	}
+}
+
+// PasswordConfig controls how user passwords are hashed.
+// The Algorithm controls what algorithm new hashes use (argon2id or bcrypt), if empty argon2id is used.
+// The Memory is how much memory in KiB argon2id uses, if 0 19456 is used.
+// The Iterations is how many passes argon2id makes over the memory, if 0 2 are used.
+// The Parallelism is how many threads argon2id uses, if 0 1 is used.
+// The Cost is the bcrypt cost, if 0 10 is used.
+type PasswordConfig struct {
+	Algorithm   string `json:"algorithm"`
+	Memory      uint32 `json:"memory"`
+	Iterations  uint32 `json:"iterations"`
+	Parallelism uint8  `json:"parallelism"`
+	Cost        int    `json:"cost"`
+}
+
+// TokenConfig controls how access tokens and refresh tokens are signed and how long they last.
+// The ActiveKey is the id of the key new tokens are signed with, if empty a random key is used and tokens stop working when the server restarts.
+// The Keys are the signing keys by id, older keys are kept so tokens signed with them can still be checked.
+// The KeyFile is the path of a json file with the same activekey and keys fields, it is used instead of the keys in this config.
+// The ExpirationMinutes is how long access tokens last, if 0 they last 3 hours.
+// The RefreshExpirationHours is how long refresh tokens last, if 0 they last 30 days.
+type TokenConfig struct {
+	ActiveKey              string                    `json:"activekey"`
+	Keys                   map[string]TokenKeyConfig `json:"keys"`
+	KeyFile                string                    `json:"keyfile"`
+	ExpirationMinutes      int                       `json:"expirationminutes"`
+	RefreshExpirationHours int                       `json:"refreshexpirationhours"`
+}
+
+// TokenKeyConfig is a key tokens are signed with.
+// The Algorithm is HS256 or EdDSA.
+// The Key is the base64 encoded HS256 secret of at least 32 bytes, or the 32 byte seed of an ed25519 key.
+type TokenKeyConfig struct {
+	Algorithm string `json:"algorithm"`
+	Key       string `json:"key"`
+}
+
+// EncryptionConfig controls encryption of attachments at rest.
+// The ActiveKey is the id of the key new files are encrypted with, if empty attachments are not encrypted.
+// The Keys are the base64 encoded 32 byte master keys by id, older keys are kept so files encrypted with them can still be read.
+// The KeyFile is the path of a json file with the same activekey and keys fields, it is used instead of the keys in this config.
+type EncryptionConfig struct {
+	ActiveKey string            `json:"activekey"`
+	Keys      map[string]string `json:"keys"`
+	KeyFile   string            `json:"keyfile"`
+}
+
+// PreviewConfig controls the previews created for attachments.
+// The ThumbnailSizes are the widths and heights in pixels that image thumbnails are fit within, if empty 128 and 512 are used.
+// The Lines is how many lines from the start and end of a text file are previewed, if 0 20 are used.
+// The MaxPixels is the largest image in pixels a thumbnail will be created for, if 0 40 million is used.
+type PreviewConfig struct {
+	ThumbnailSizes []int `json:"thumbnailsizes"`
+	Lines          int   `json:"lines"`
+	MaxPixels      int   `json:"maxpixels"`
+}
+
+// ScannerConfig controls malware scanning of attachments.
+// The Type controls what scanner to use (clamd or exec), if empty attachments are not scanned.
+// The Address is the clamd address like tcp://127.0.0.1:3310 or unix:///var/run/clamav/clamd.ctl.
+// The Command and Args are the command to run for the exec scanner, {file} in the args is replaced with the path of the file to scan.
+// The TimeoutSeconds is how long a scan can take, if 0 a minute is used.
+type ScannerConfig struct {
+	Type           string   `json:"type"`
+	Address        string   `json:"address"`
+	Command        string   `json:"command"`
+	Args           []string `json:"args"`
+	TimeoutSeconds int      `json:"timeoutseconds"`
+}
+
+// DownloadLinkConfig controls signed attachment download links.
+// The Secret signs the links, every server behind a load balancer needs the same secret. If empty a random secret is used and links stop working on restart.
+// The ExpirationMinutes is how long a link lasts when no expiration is requested, if 0 15 minutes is used.
+// The MaxExpirationMinutes is the longest expiration that can be requested, if 0 a day is used.
+type DownloadLinkConfig struct {
+	Secret               string `json:"secret"`
+	ExpirationMinutes    int    `json:"expirationminutes"`
+	MaxExpirationMinutes int    `json:"maxexpirationminutes"`
+}
+
+// UploadConfig controls uploads.
+// The MaxSize is the largest resumable upload in bytes that can be started, if 0 any size is allowed.
+// The ExpirationHours is how long a resumable upload can go without receiving data before it is removed, if 0 a day is used.
+// The MaxFileSize is the largest attachment in bytes that can be uploaded, if 0 any size is allowed.
+// The MaxIncidentSize is the most bytes the attachments of an incident can use including their previous versions, if 0 there is no limit.
+// The MaxUserSize is the most bytes of attachments a user can upload, if 0 there is no limit.
+// The AllowedTypes and DeniedTypes are MIME types detected from file content, image/* matches every image type.
+// Files whose type cannot be detected are application/octet-stream, which wildcards do not allow.
+// The AllowedExtensions and DeniedExtensions are file name extensions like .exe.
+// If any types or extensions are allowed every other type or extension is denied.
+type UploadConfig struct {
+	MaxSize           int64    `json:"maxsize"`
+	ExpirationHours   int      `json:"expirationhours"`
+	MaxFileSize       int64    `json:"maxfilesize"`
+	MaxIncidentSize   int64    `json:"maxincidentsize"`
+	MaxUserSize       int64    `json:"maxusersize"`
+	AllowedTypes      []string `json:"allowedtypes"`
+	DeniedTypes       []string `json:"deniedtypes"`
+	AllowedExtensions []string `json:"allowedextensions"`
+	DeniedExtensions  []string `json:"deniedextensions"`
+}
+
+// SearchConfig controls the full text search index.
+// The Path is the file the index is saved to, if empty the index is only kept in memory.
+type SearchConfig struct {
+	Path string `json:"path"`
+}
+
+// IncidentConfig controls how incidents are managed.
+// The Transitions map a state to the states an incident in that state can move to.
+// If no transitions are defined an incident can move to any state.
+type IncidentConfig struct {
+	Transitions map[string][]string `json:"transitions"`
 }
 
 // SecurityConfig defines the security to use at runtime.
@@ -73,24 +244,32 @@ type WebBodyItem struct {
 // The UpdatedHooks are web hooks to call when an incident has been updated.
 // The AttachedHooks are web hooks to call when an attachment has been added to an incident.
 // The UpdatedUserHooks are web hooks to call when a user is updated.
+// The BulkUpdatedHooks are web hooks to call once when a bulk update is done in batch mode.
+// The InfectedHooks are web hooks to call when malware is found in an attachment.
 type WebHooks struct {
 	AddedHooks       []WebHook `json:"addedhooks"`
 	UpdatedHooks     []WebHook `json:"updatedhooks"`
 	AttachedHooks    []WebHook `json:"attachedhooks"`
 	AddedUserHooks   []WebHook `json:"addedUserHooks"`
 	UpdatedUserHooks []WebHook `json:"updatedUserHooks"`
+	BulkUpdatedHooks []WebHook `json:"bulkupdatedhooks"`
+	InfectedHooks    []WebHook `json:"infectedhooks"`
 }
 
 // DynamoDBConfig is the configuration to use if the dynamodb mananger is in use.
 // The Region controls what AWS region your db will be created/maintained in.
 // The IncidentTableOverride will override the default incident table name and use that instead.
 // The AttachmentTableOverride will override the default attachment table name and use that instead.
+// The FileTableOverride will override the default file table name, used when files are stored in dynamodb, and use that instead.
+// The ServiceAccountTableOverride will override the default service account table name and use that instead.
 type DynamoDBConfig struct {
-	Region                  string `json:"region"`
-	Endpoint                string `json:"endpoint"`
-	IncidentTableOverride   string `json:"incidenttableoverride"`
-	AttachmentTableOverride string `json:"attachmenttableoverride"`
-	UserTableOverride       string `json:"usertableoverride"`
+	Region                      string `json:"region"`
+	Endpoint                    string `json:"endpoint"`
+	IncidentTableOverride       string `json:"incidenttableoverride"`
+	AttachmentTableOverride     string `json:"attachmenttableoverride"`
+	UserTableOverride           string `json:"usertableoverride"`
+	FileTableOverride           string `json:"filetableoverride"`
+	ServiceAccountTableOverride string `json:"serviceaccounttableoverride"`
 }
 
 // LocalFileManagerConfig controls the configuration of the local file manager if it is in use.
@@ -102,9 +281,32 @@ type LocalFileManagerConfig struct {
 // S3FileManagerConfig controls the configuration of the s3 file manager if it is in use.
 // The Region controls what region your bucket will be stored/maintained in.
 // The Bucket is the bucket to use of incident attachments.
+// The PresignMinutes controls how long presigned download urls last, when set downloads are redirected to s3 instead of going through sona.
 type S3FileManagerConfig struct {
-	Region string `json:"region"`
-	Bucket string `json:"bucket"`
+	Region         string `json:"region"`
+	Bucket         string `json:"bucket"`
+	PresignMinutes int    `json:"presignminutes"`
+}
+
+// GCSFileManagerConfig controls the configuration of the google cloud storage file manager if it is in use.
+// The ProjectName controls what google cloud project the bucket will be created in.
+// The Bucket is the bucket to use of incident attachments.
+// The AuthFile controls what json file to use for authentication, if empty the default credentials are used.
+type GCSFileManagerConfig struct {
+	ProjectName string `json:"projectname"`
+	Bucket      string `json:"bucket"`
+	AuthFile    string `json:"authfile"`
+}
+
+// AzureFileManagerConfig controls the configuration of the azure blob storage file manager if it is in use.
+// The AccountName and AccountKey are the storage account to use and its shared key.
+// The Container is the container to use of incident attachments.
+// The Endpoint controls the blob service url, if empty the public azure url of the account is used.
+type AzureFileManagerConfig struct {
+	AccountName string `json:"accountname"`
+	AccountKey  string `json:"accountkey"`
+	Container   string `json:"container"`
+	Endpoint    string `json:"endpoint"`
 }
 
 // LogConfig controls how logging is handled.
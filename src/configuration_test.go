@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRedactedConfig(t *testing.T) {
+	config := Config{
+		MYSQL:       MySQLConfig{UserName: "sona", Password: "mysql-secret"},
+		AzureConfig: AzureFileManagerConfig{AccountName: "account", AccountKey: "azure-secret"},
+		Admin:       AdminConfig{EmailAddress: "admin@b.c", Password: "admin-secret"},
+		Security:    SecurityConfig{Certificate: "cert", Key: "tls-secret"},
+		Links:       DownloadLinkConfig{Secret: "link-secret"},
+		Tokens:      TokenConfig{ActiveKey: "2024", Keys: map[string]TokenKeyConfig{"2024": {"HS256", "token-secret"}}},
+		Encryption:  EncryptionConfig{ActiveKey: "2024", Keys: map[string]string{"2024": "encryption-secret"}},
+		MigrationTarget: &Config{
+			AzureConfig: AzureFileManagerConfig{AccountKey: "target-secret"},
+		},
+	}
+
+	logged := fmt.Sprintf("%v", config.redacted())
+	if strings.Contains(logged, "secret") {
+		t.Errorf("Expected secrets to be redacted got %v", logged)
+	}
+
+	for _, value := range []string{"sona", "account", "admin@b.c", "cert", "HS256", "2024"} {
+		if !strings.Contains(logged, value) {
+			t.Errorf("Expected %v to be logged got %v", value, logged)
+		}
+	}
+
+	if config.Tokens.Keys["2024"].Key != "token-secret" || config.Encryption.Keys["2024"] != "encryption-secret" || config.MigrationTarget.AzureConfig.AccountKey != "target-secret" {
+		t.Errorf("Expected the original config to be unchanged got %v", config)
+	}
+}
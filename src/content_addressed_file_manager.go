@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"sync"
+)
+
+// blobIncident is where blobs are stored in the underlying file manager.
+// Incident ids are numbers so this cannot be confused with an incident.
+const blobIncident = "blobs"
+
+// blobPointerPrefix starts every pointer file, it is followed by the hex encoded hash of the blob.
+const blobPointerPrefix = "sona-blob sha256:"
+
+// blobPointerSize is the size of a pointer file, the prefix, the hash and a new line.
+const blobPointerSize = len(blobPointerPrefix) + sha256.Size*2 + 1
+
+var blobHashPattern = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// ContentAddressedFileManager stores each distinct file only once.
+// The content of a file is stored as a blob named by its SHA-256 hash and the file itself is a small pointer to the blob.
+// Every blob has a list of the files that reference it and is deleted once no file references it.
+// Files saved before deduplication was turned on are not pointers and are loaded and deleted as they are.
+type ContentAddressedFileManager struct {
+	lock  *sync.Mutex
+	Store FileManager // The file manager the blobs and pointers are stored in.
+}
+
+// NewContentAddressedFileManager creates a deduplicating file manager on top of another file manager.
+func NewContentAddressedFileManager(store FileManager) ContentAddressedFileManager {
+	return ContentAddressedFileManager{&sync.Mutex{}, store}
+}
+
+// SaveFile stores the content of a file as a blob, unless the same content has already been stored, and points the file at it.
+// The content is staged in a temporary file while it is hashed, since the hash is needed to know where to store it.
+func (manager ContentAddressedFileManager) SaveFile(incident string, fileName string, file io.Reader) (string, bool) {
+	staged, err := os.CreateTemp("", "sona-blob-*")
+	if err != nil {
+		logManager.LogPrintf("Unable to stage file %v\n", err)
+		return "", false
+	}
+
+	defer os.Remove(staged.Name())
+	defer staged.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(staged, hash), file); err != nil {
+		logManager.LogPrintf("Unable to stage file %v/%v %v\n", incident, fileName, err)
+		return "", false
+	}
+
+	blob := hex.EncodeToString(hash.Sum(nil))
+	key := incident + "/" + fileName
+
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	refs, err := manager.loadRefs(blob)
+	if err != nil {
+		logManager.LogPrintln(err)
+		return "", false
+	}
+
+	if len(refs) == 0 {
+		if _, err := staged.Seek(0, io.SeekStart); err != nil {
+			return "", false
+		}
+
+		if _, saved := manager.Store.SaveFile(blobIncident, blob, staged); !saved {
+			logManager.LogPrintf("Unable to save blob %v\n", blob)
+			return "", false
+		}
+	} else {
+		logManager.LogPrintf("Blob %v already stored, skipping upload\n", blob)
+	}
+
+	previous, isPointer := manager.readPointer(incident, fileName)
+
+	location, saved := manager.Store.SaveFile(incident, fileName, bytes.NewReader(createBlobPointer(blob)))
+	if !saved {
+		if len(refs) == 0 {
+			manager.Store.DeleteFile(blobIncident, blob)
+		}
+
+		return location, false
+	}
+
+	if !slices.Contains(refs, key) {
+		refs = append(refs, key)
+	}
+
+	if !manager.saveRefs(blob, refs) {
+		return location, false
+	}
+
+	if isPointer && previous != blob {
+		if previousRefs, err := manager.loadRefs(previous); err != nil {
+			logManager.LogPrintf("Keeping blob %v %v\n", previous, err)
+		} else {
+			manager.removeRef(previous, previousRefs, key)
+		}
+	}
+
+	return location, true
+}
+
+// LoadFile loads the blob a file points to.
+func (manager ContentAddressedFileManager) LoadFile(incident string, fileName string) (io.ReadSeeker, os.FileInfo, bool, func()) {
+	file, info, found, closer := manager.Store.LoadFile(incident, fileName)
+	if !found || file == nil {
+		return file, info, found, closer
+	}
+
+	blob, isPointer := parseBlobPointer(file)
+	if !isPointer {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			if closer != nil {
+				closer()
+			}
+
+			return nil, nil, false, nil
+		}
+
+		return file, info, true, closer
+	}
+
+	if closer != nil {
+		closer()
+	}
+
+	return manager.Store.LoadFile(blobIncident, blob)
+}
+
+// DeleteFile removes a file and deletes its blob if nothing else references it.
+// The file is kept if the references of its blob cannot be read, since the blob may still be used by other files.
+func (manager ContentAddressedFileManager) DeleteFile(incident string, fileName string) bool {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	blob, isPointer := manager.readPointer(incident, fileName)
+	var refs []string
+	if isPointer {
+		loaded, err := manager.loadRefs(blob)
+		if err != nil {
+			logManager.LogPrintf("Unable to delete %v/%v %v\n", incident, fileName, err)
+			return false
+		}
+
+		refs = loaded
+	}
+
+	if !manager.Store.DeleteFile(incident, fileName) {
+		return false
+	}
+
+	if isPointer {
+		manager.removeRef(blob, refs, incident+"/"+fileName)
+	}
+
+	return true
+}
+
+// SupportsVersions is always false so that every version is stored as its own deduplicated file.
+// Versions kept by the underlying file manager before deduplication was turned on can still be loaded and deleted.
+func (manager ContentAddressedFileManager) SupportsVersions() bool {
+	return false
+}
+
+// SaveFileVersion is not supported, versions are saved as separate files.
+func (manager ContentAddressedFileManager) SaveFileVersion(incident string, fileName string, file io.Reader) (string, bool) {
+	return "", false
+}
+
+// GetFileVersion finds the version of a file kept by the underlying file manager.
+func (manager ContentAddressedFileManager) GetFileVersion(incident string, fileName string) (string, bool) {
+	if versioned, ok := manager.Store.(VersionedFileManager); ok {
+		return versioned.GetFileVersion(incident, fileName)
+	}
+
+	return "", false
+}
+
+// LoadFileVersion loads a version of a file kept by the underlying file manager.
+func (manager ContentAddressedFileManager) LoadFileVersion(incident string, fileName string, version string) (io.ReadSeeker, os.FileInfo, bool, func()) {
+	if versioned, ok := manager.Store.(VersionedFileManager); ok {
+		return versioned.LoadFileVersion(incident, fileName, version)
+	}
+
+	return nil, nil, false, nil
+}
+
+// DeleteFileVersion deletes a version of a file kept by the underlying file manager.
+func (manager ContentAddressedFileManager) DeleteFileVersion(incident string, fileName string, version string) bool {
+	if versioned, ok := manager.Store.(VersionedFileManager); ok {
+		return versioned.DeleteFileVersion(incident, fileName, version)
+	}
+
+	return false
+}
+
+// PresignFile creates a url that downloads the blob a file points to directly from the underlying file manager.
+func (manager ContentAddressedFileManager) PresignFile(incident string, fileName string, version string, disposition string, contentType string) (string, bool) {
+	presigned, ok := manager.Store.(PresignedFileManager)
+	if !ok {
+		return "", false
+	}
+
+	if len(version) == 0 {
+		if blob, isPointer := manager.readPointer(incident, fileName); isPointer {
+			return presigned.PresignFile(blobIncident, blob, "", disposition, contentType)
+		}
+	}
+
+	return presigned.PresignFile(incident, fileName, version, disposition, contentType)
+}
+
+// ListFiles lists the files of the underlying file manager.
+// Blobs are left out, they are removed once nothing references them.
+func (manager ContentAddressedFileManager) ListFiles() ([]StoredFile, bool) {
+	listable, ok := manager.Store.(ListableFileManager)
+	if !ok {
+		return nil, false
+	}
+
+	files, listed := listable.ListFiles()
+	return slices.DeleteFunc(files, func(file StoredFile) bool {
+		return file.Incident == blobIncident
+	}), listed
+}
+
+// RewrapFile rewraps a pointer file and the blob it points to when the underlying file manager is encrypted.
+func (manager ContentAddressedFileManager) RewrapFile(incident string, fileName string) (bool, error) {
+	rewrappable, ok := manager.Store.(RewrappableFileManager)
+	if !ok {
+		return false, errors.New("file manager is not encrypted")
+	}
+
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	rewrapped, err := rewrappable.RewrapFile(incident, fileName)
+	if err != nil {
+		return false, err
+	}
+
+	blob, isPointer := manager.readPointer(incident, fileName)
+	if !isPointer {
+		return rewrapped, nil
+	}
+
+	for _, name := range []string{blob, blob + ".refs"} {
+		changed, err := rewrappable.RewrapFile(blobIncident, name)
+		if err != nil {
+			return rewrapped, err
+		}
+
+		rewrapped = rewrapped || changed
+	}
+
+	return rewrapped, nil
+}
+
+func createBlobPointer(blob string) []byte {
+	return []byte(blobPointerPrefix + blob + "\n")
+}
+
+// parseBlobPointer reads the hash of the blob out of a pointer file.
+// A false is returned if the file is not a pointer.
+func parseBlobPointer(file io.Reader) (string, bool) {
+	data := make([]byte, blobPointerSize+1)
+	n, _ := io.ReadFull(file, data)
+	if n != blobPointerSize || !bytes.HasPrefix(data, []byte(blobPointerPrefix)) || data[n-1] != '\n' {
+		return "", false
+	}
+
+	blob := string(data[len(blobPointerPrefix) : n-1])
+	return blob, blobHashPattern.MatchString(blob)
+}
+
+// readPointer finds the blob a file points to.
+func (manager ContentAddressedFileManager) readPointer(incident string, fileName string) (string, bool) {
+	file, _, found, closer := manager.Store.LoadFile(incident, fileName)
+	if closer != nil {
+		defer closer()
+	}
+
+	if !found || file == nil {
+		return "", false
+	}
+
+	return parseBlobPointer(file)
+}
+
+// loadRefs finds the files that reference a blob.
+// An error is returned if the blob is stored but its references cannot be read,
+// treating it as unreferenced would delete it while other files still point to it.
+func (manager ContentAddressedFileManager) loadRefs(blob string) ([]string, error) {
+	file, _, found, closer := manager.Store.LoadFile(blobIncident, blob+".refs")
+	if closer != nil {
+		defer closer()
+	}
+
+	if !found || file == nil {
+		if manager.hasBlob(blob) {
+			return nil, fmt.Errorf("unable to load references of blob %v", blob)
+		}
+
+		return make([]string, 0), nil
+	}
+
+	refs := make([]string, 0)
+	if err := json.NewDecoder(file).Decode(&refs); err != nil {
+		return nil, fmt.Errorf("unable to read references of blob %v %v", blob, err)
+	}
+
+	return refs, nil
+}
+
+func (manager ContentAddressedFileManager) hasBlob(blob string) bool {
+	_, _, found, closer := manager.Store.LoadFile(blobIncident, blob)
+	if closer != nil {
+		closer()
+	}
+
+	return found
+}
+
+func (manager ContentAddressedFileManager) saveRefs(blob string, refs []string) bool {
+	data, err := json.Marshal(refs)
+	if err != nil {
+		return false
+	}
+
+	_, saved := manager.Store.SaveFile(blobIncident, blob+".refs", bytes.NewReader(data))
+	if !saved {
+		logManager.LogPrintf("Unable to save references of blob %v\n", blob)
+	}
+
+	return saved
+}
+
+// removeRef removes a file from the loaded references of a blob, deleting the blob once nothing references it.
+func (manager ContentAddressedFileManager) removeRef(blob string, refs []string, key string) {
+	refs = slices.DeleteFunc(refs, func(ref string) bool {
+		return ref == key
+	})
+
+	if len(refs) > 0 {
+		manager.saveRefs(blob, refs)
+		return
+	}
+
+	logManager.LogPrintf("Blob %v is no longer referenced, deleting it\n", blob)
+	manager.Store.DeleteFile(blobIncident, blob)
+	manager.Store.DeleteFile(blobIncident, blob+".refs")
+}
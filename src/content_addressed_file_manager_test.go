@@ -0,0 +1,214 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// CountingFileManager counts how many blobs are saved to a local file manager.
+type CountingFileManager struct {
+	LocalFileManager
+	blobSaves *int
+}
+
+func (manager CountingFileManager) SaveFile(incident string, fileName string, file io.Reader) (string, bool) {
+	if incident == blobIncident && !strings.HasSuffix(fileName, ".refs") {
+		*manager.blobSaves++
+	}
+
+	return manager.LocalFileManager.SaveFile(incident, fileName, file)
+}
+
+func readFile(t *testing.T, manager FileManager, incident string, fileName string) string {
+	file, _, found, closer := manager.LoadFile(incident, fileName)
+	if !found {
+		t.Fatalf("Expected %v/%v to be found", incident, fileName)
+	}
+
+	defer closer()
+	content, _ := io.ReadAll(file)
+	return string(content)
+}
+
+func getBlobs(t *testing.T, root string) []string {
+	blobs, _ := filepath.Glob(filepath.Join(root, "incidents", blobIncident, "*[0-9a-f]"))
+	return blobs
+}
+
+func TestContentAddressedSaveDeduplicates(t *testing.T) {
+	root := t.TempDir()
+	blobSaves := 0
+	manager := NewContentAddressedFileManager(CountingFileManager{LocalFileManager{root}, &blobSaves})
+
+	manager.SaveFile("0", "a", strings.NewReader("the same log"))
+	manager.SaveFile("1", "b", strings.NewReader("the same log"))
+
+	if blobs := getBlobs(t, root); len(blobs) != 1 || blobSaves != 1 {
+		t.Errorf("Expected one blob to be saved got %v saves of %v", blobSaves, blobs)
+	}
+
+	if content := readFile(t, manager, "0", "a"); content != "the same log" {
+		t.Errorf("Unexpected content %v", content)
+	}
+
+	if content := readFile(t, manager, "1", "b"); content != "the same log" {
+		t.Errorf("Unexpected content %v", content)
+	}
+}
+
+func TestContentAddressedDeleteKeepsReferencedBlob(t *testing.T) {
+	root := t.TempDir()
+	manager := NewContentAddressedFileManager(LocalFileManager{root})
+	manager.SaveFile("0", "a", strings.NewReader("the same log"))
+	manager.SaveFile("1", "b", strings.NewReader("the same log"))
+
+	if !manager.DeleteFile("0", "a") {
+		t.Fatalf("Expected file to be deleted")
+	}
+
+	if content := readFile(t, manager, "1", "b"); content != "the same log" {
+		t.Errorf("Expected blob to be kept got %v", content)
+	}
+
+	manager.DeleteFile("1", "b")
+
+	if files, _ := filepath.Glob(filepath.Join(root, "incidents", blobIncident, "*")); len(files) != 0 {
+		t.Errorf("Expected unreferenced blob to be deleted got %v", files)
+	}
+}
+
+func TestContentAddressedOverwriteReleasesPreviousBlob(t *testing.T) {
+	root := t.TempDir()
+	manager := NewContentAddressedFileManager(LocalFileManager{root})
+	manager.SaveFile("0", "a", strings.NewReader("first"))
+	manager.SaveFile("0", "a", strings.NewReader("second"))
+
+	if blobs := getBlobs(t, root); len(blobs) != 1 {
+		t.Errorf("Expected previous blob to be deleted got %v", blobs)
+	}
+
+	if content := readFile(t, manager, "0", "a"); content != "second" {
+		t.Errorf("Unexpected content %v", content)
+	}
+}
+
+func TestContentAddressedSaveSameFileTwice(t *testing.T) {
+	root := t.TempDir()
+	manager := NewContentAddressedFileManager(LocalFileManager{root})
+	manager.SaveFile("0", "a", strings.NewReader("content"))
+	manager.SaveFile("0", "a", strings.NewReader("content"))
+	manager.DeleteFile("0", "a")
+
+	if blobs := getBlobs(t, root); len(blobs) != 0 {
+		t.Errorf("Expected blob to be deleted got %v", blobs)
+	}
+}
+
+func TestContentAddressedLoadsFilesSavedBefore(t *testing.T) {
+	root := t.TempDir()
+	LocalFileManager{root}.SaveFile("0", "a", strings.NewReader("saved before deduplication"))
+	manager := NewContentAddressedFileManager(LocalFileManager{root})
+
+	if content := readFile(t, manager, "0", "a"); content != "saved before deduplication" {
+		t.Errorf("Unexpected content %v", content)
+	}
+
+	if !manager.DeleteFile("0", "a") {
+		t.Errorf("Expected file to be deleted")
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "incidents", "0", "a")); !os.IsNotExist(err) {
+		t.Errorf("Expected file to be removed got %v", err)
+	}
+}
+
+func TestContentAddressedLoadsVersionsKeptByStore(t *testing.T) {
+	store := FakeVersionedFileManager{&sync.Mutex{}, make(map[string][]string)}
+	store.SaveFileVersion("0", "a", strings.NewReader("first"))
+	store.SaveFileVersion("0", "a", strings.NewReader("second"))
+	manager := NewContentAddressedFileManager(store)
+
+	file, _, found, _ := manager.LoadFileVersion("0", "a", "0")
+	if !found {
+		t.Fatalf("Expected version to be found")
+	}
+
+	if content, _ := io.ReadAll(file); string(content) != "first" {
+		t.Errorf("Unexpected content %v", string(content))
+	}
+}
+
+func TestContentAddressedPresignsBlob(t *testing.T) {
+	manager := NewContentAddressedFileManager(FakePresignedFileManager{LocalFileManager{t.TempDir()}})
+	manager.SaveFile("0", "a", strings.NewReader("content"))
+
+	url, ok := manager.PresignFile("0", "a", "", "attachment", "text/plain")
+
+	if !ok || !strings.HasPrefix(url, "https://files.example.com/"+blobIncident+"/") {
+		t.Errorf("Expected blob to be presigned got %v", url)
+	}
+}
+
+func TestUploadDeduplicatedAttachments(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	root := t.TempDir()
+	fileManager = NewContentAddressedFileManager(LocalFileManager{root})
+
+	first := readUploadedAttachment(t, uploadAttachment(token, "app.log", "the same log"))
+	second := readUploadedAttachment(t, uploadAttachment(token, "copy.log", "the same log"))
+	previewGenerator.Wait()
+
+	if first.Checksum != second.Checksum {
+		t.Errorf("Expected the same checksum got %v and %v", first.Checksum, second.Checksum)
+	}
+
+	if blobs := getBlobs(t, root); len(blobs) != 2 {
+		t.Errorf("Expected one blob for the attachments and one for their preview got %v", blobs)
+	}
+
+	r, _ := http.NewRequest("DELETE", "/sona/v1/incidents/0/attachment/"+first.Id, nil)
+	r.Header.Set("X-Sona-Token", token)
+	router.ServeHTTP(httptest.NewRecorder(), r)
+
+	if w := downloadAttachment(token, second.Id, nil); w.Result().StatusCode != 200 || w.Body.String() != "the same log" {
+		t.Errorf("Expected download got %v %v", w.Result(), w.Body)
+	}
+}
+
+func TestContentAddressedKeepsBlobWithUnreadableRefs(t *testing.T) {
+	root := t.TempDir()
+	manager := NewContentAddressedFileManager(LocalFileManager{root})
+	manager.SaveFile("0", "a", strings.NewReader("the same log"))
+	manager.SaveFile("1", "b", strings.NewReader("the same log"))
+
+	refs, _ := filepath.Glob(filepath.Join(root, "incidents", blobIncident, "*.refs"))
+	if len(refs) != 1 {
+		t.Fatalf("Expected one refs file got %v", refs)
+	}
+
+	os.WriteFile(refs[0], []byte("not json"), 0644)
+
+	if _, saved := manager.SaveFile("2", "c", strings.NewReader("the same log")); saved {
+		t.Errorf("Expected save to fail when the references cannot be read")
+	}
+
+	if manager.DeleteFile("0", "a") {
+		t.Errorf("Expected delete to fail when the references cannot be read")
+	}
+
+	os.Remove(refs[0])
+
+	if manager.DeleteFile("0", "a") {
+		t.Errorf("Expected delete to fail when the references are missing")
+	}
+
+	if content := readFile(t, manager, "1", "b"); content != "the same log" {
+		t.Errorf("Expected blob to be kept got %v", content)
+	}
+}
@@ -187,9 +187,14 @@ func (manager DataStoreIncidentManager) UpdateIncident(id int, incident Incident
 	return true
 }
 
+// UpdateIncidents will update a set of incidents in the datastore.
+func (manager DataStoreIncidentManager) UpdateIncidents(ids []int, update IncidentUpdate) map[int]bool {
+	return updateIncidents(manager, ids, update)
+}
+
 func (manager DataStoreIncidentManager) AddAttachment(incidentId int, attachment Attachment) bool {
 	parentKey := datastore.NameKey("incidents", strconv.Itoa(incidentId), nil)
-	taskKey := datastore.NameKey("incidentattachments", attachment.FileName, parentKey)
+	taskKey := datastore.NameKey("incidentattachments", attachment.getId(), parentKey)
 
 	logManager.LogPrintln("Attempting to put incident attachment into database")
 
@@ -207,9 +212,9 @@ func (manager DataStoreIncidentManager) GetAttachments(incidentId int) ([]Attach
 	q := datastore.NewQuery("incidentattachments").Ancestor(datastore.NameKey("incidents", strconv.Itoa(incidentId), nil))
 	iter := manager.Connection.Run(*manager.Context, q)
 
-	var att Attachment
 	for {
-		_, err := iter.Next(&att)
+		var att Attachment
+		key, err := iter.Next(&att)
 
 		if err == iterator.Done {
 			break
@@ -220,15 +225,25 @@ func (manager DataStoreIncidentManager) GetAttachments(incidentId int) ([]Attach
 			break
 		}
 
+		// Attachments added before ids were generated are keyed by their file name.
+		if len(att.Id) == 0 {
+			att.Id = key.Name
+		}
+
 		retVal = append(retVal, att)
 	}
 
 	return retVal, true
 }
 
-func (manager DataStoreIncidentManager) RemoveAttachment(incidentId int, fileName string) bool {
+// UpdateAttachment replaces the attachment entity, which is keyed by the attachment id.
+func (manager DataStoreIncidentManager) UpdateAttachment(incidentId int, attachment Attachment) bool {
+	return manager.AddAttachment(incidentId, attachment)
+}
+
+func (manager DataStoreIncidentManager) RemoveAttachment(incidentId int, attachmentId string) bool {
 	parentKey := datastore.NameKey("incidents", strconv.Itoa(incidentId), nil)
-	taskKey := datastore.NameKey("incidentattachments", fileName, parentKey)
+	taskKey := datastore.NameKey("incidentattachments", attachmentId, parentKey)
 
 	logManager.LogPrintln("Attempting to remove incident attachment from database")
 
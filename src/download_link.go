@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultLinkExpiration is how long a download link lasts if no expiration is requested or configured.
+const defaultLinkExpiration = time.Minute * 15
+
+// defaultMaxLinkExpiration is the longest a download link can last if no maximum is configured.
+const defaultMaxLinkExpiration = time.Hour * 24
+
+// DownloadLink is a url that downloads an attachment without a token.
+type DownloadLink struct {
+	Url       string `json:"url"`
+	Expires   string `json:"expires"`
+	SingleUse bool   `json:"singleUse"`
+}
+
+// DownloadLinkSigner signs and checks download links.
+// A link is only valid on servers that share the same secret.
+// The Expiration is how long a link lasts when no expiration is requested and MaxExpiration is the longest that can be requested.
+// The nonces of single use links that have been downloaded are kept in memory until the link expires.
+// They are not stored or shared, so a single use link can be used again on another server or after a restart.
+type DownloadLinkSigner struct {
+	lock          sync.Mutex
+	secret        []byte
+	used          map[string]time.Time
+	Expiration    time.Duration
+	MaxExpiration time.Duration
+}
+
+var downloadLinks = NewDownloadLinkSigner("", defaultLinkExpiration, defaultMaxLinkExpiration)
+
+// NewDownloadLinkSigner creates a signer using a secret.
+// If there is no secret a random one is used, so links stop working when the server restarts.
+func NewDownloadLinkSigner(secret string, expiration time.Duration, maxExpiration time.Duration) *DownloadLinkSigner {
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+	}
+
+	if expiration <= 0 {
+		expiration = defaultLinkExpiration
+	}
+
+	if maxExpiration <= 0 {
+		maxExpiration = defaultMaxLinkExpiration
+	}
+
+	if expiration > maxExpiration {
+		expiration = maxExpiration
+	}
+
+	return &DownloadLinkSigner{
+		secret:        key,
+		used:          make(map[string]time.Time),
+		Expiration:    expiration,
+		MaxExpiration: maxExpiration,
+	}
+}
+
+func getDownloadLinkPath(incidentId int, attachmentId string) string {
+	return fmt.Sprintf("/sona/v1/links/%v/%v", incidentId, url.PathEscape(attachmentId))
+}
+
+// sign creates the signature of everything a link is scoped to.
+func (signer *DownloadLinkSigner) sign(incidentId int, attachmentId string, version int, expires int64, nonce string) string {
+	mac := hmac.New(sha256.New, signer.secret)
+	fmt.Fprintf(mac, "%v\n%v\n%v\n%v\n%v", incidentId, attachmentId, version, expires, nonce)
+	return b64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// CreateLink creates a link to download an attachment until it expires.
+// A version of 0 downloads whatever the current version is when the link is used.
+func (signer *DownloadLinkSigner) CreateLink(incidentId int, attachmentId string, version int, expiration time.Duration, singleUse bool) DownloadLink {
+	if expiration <= 0 {
+		expiration = signer.Expiration
+	}
+
+	expires := time.Now().Add(expiration).Unix()
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+
+	if version > 0 {
+		query.Set("version", strconv.Itoa(version))
+	}
+
+	nonce := ""
+	if singleUse {
+		nonce = newLinkNonce()
+		query.Set("nonce", nonce)
+	}
+
+	query.Set("signature", signer.sign(incidentId, attachmentId, version, expires, nonce))
+
+	return DownloadLink{
+		Url:       getDownloadLinkPath(incidentId, attachmentId) + "?" + query.Encode(),
+		Expires:   time.Unix(expires, 0).UTC().Format(time.RFC3339),
+		SingleUse: singleUse,
+	}
+}
+
+// CheckLink makes sure a link was signed by this signer for the attachment and has not expired.
+// A single use link is used up by being checked.
+// The version the link is scoped to is returned.
+func (signer *DownloadLinkSigner) CheckLink(incidentId int, attachmentId string, query url.Values) (int, bool) {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	version := 0
+	if len(query.Get("version")) > 0 {
+		if version, err = strconv.Atoi(query.Get("version")); err != nil {
+			return 0, false
+		}
+	}
+
+	nonce := query.Get("nonce")
+	expected := signer.sign(incidentId, attachmentId, version, expires, nonce)
+	if !hmac.Equal([]byte(expected), []byte(query.Get("signature"))) {
+		return 0, false
+	}
+
+	now := time.Now()
+	if now.After(time.Unix(expires, 0)) {
+		return 0, false
+	}
+
+	if len(nonce) == 0 {
+		return version, true
+	}
+
+	signer.lock.Lock()
+	defer signer.lock.Unlock()
+
+	for used, expiry := range signer.used {
+		if now.After(expiry) {
+			delete(signer.used, used)
+		}
+	}
+
+	if _, used := signer.used[nonce]; used {
+		return 0, false
+	}
+
+	signer.used[nonce] = time.Unix(expires, 0)
+	return version, true
+}
+
+func newLinkNonce() string {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+
+	return b64.RawURLEncoding.EncodeToString(nonce)
+}
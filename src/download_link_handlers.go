@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// DownloadLinkRequest defines the link to create for an attachment.
+// The ExpiresIn is how many seconds the link lasts, 0 uses the configured default.
+// The Version is the version of the attachment to download, 0 downloads the current version when the link is used.
+// When SingleUse is set the link can only be downloaded once from each running server.
+type DownloadLinkRequest struct {
+	ExpiresIn int  `json:"expiresIn"`
+	Version   int  `json:"version"`
+	SingleUse bool `json:"singleUse"`
+}
+
+func convertDownloadLinkRequest(body io.Reader) (DownloadLinkRequest, bool) {
+	var request DownloadLinkRequest
+	if err := json.NewDecoder(body).Decode(&request); err != nil && err != io.EOF {
+		logManager.LogPrintf("Got error when attempting to decode body %v", err)
+		return request, false
+	}
+
+	if request.ExpiresIn < 0 || request.Version < 0 {
+		return request, false
+	}
+
+	if time.Duration(request.ExpiresIn)*time.Second > downloadLinks.MaxExpiration {
+		logManager.LogPrintf("Link expiration %v is longer than %v\n", request.ExpiresIn, downloadLinks.MaxExpiration)
+		return request, false
+	}
+
+	return request, true
+}
+
+// HandleCreateDownloadLink handles the create download link web request.
+func HandleCreateDownloadLink(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got create download link request.")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if !validateRequest(w, r, availablePermissions.viewIncident) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["incidentId"])
+	if err != nil {
+		logManager.LogPrintf("Error converting incidentId %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	request, ok := convertDownloadLinkRequest(r.Body)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	attachment, found := findAttachment(id, vars["attachmentId"])
+	if !found {
+		logManager.LogPrintf("Got invalid link request for attachment id %v.\n", vars["attachmentId"])
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if _, found = attachment.findVersion(request.Version); request.Version > 0 && !found {
+		logManager.LogPrintf("Got invalid link request for version %v.\n", request.Version)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	link := downloadLinks.CreateLink(id, attachment.getId(), request.Version, time.Duration(request.ExpiresIn)*time.Second, request.SingleUse)
+
+	data, err := json.Marshal(link)
+	if err != nil {
+		logManager.LogPrintf("Unable to convert download link %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(data)
+}
+
+// HandleLinkDownload handles the download attachment web request for a download link.
+// The signature of the link is used in place of a token.
+// Single use links are only used up on the server that handles the download and until it restarts.
+func HandleLinkDownload(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got download link request.")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("Cache-Control", "private")
+
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["incidentId"])
+	if err != nil {
+		logManager.LogPrintf("Error converting incidentId %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	versionNumber, valid := downloadLinks.CheckLink(id, vars["attachmentId"], r.URL.Query())
+	if !valid {
+		logManager.LogPrintf("Invalid or expired link used for attachment %v\n", vars["attachmentId"])
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	attachment, found := findAttachment(id, vars["attachmentId"])
+	if !found {
+		logManager.LogPrintf("Got invalid download link for attachment id %v.\n", vars["attachmentId"])
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	version := attachment.getCurrentVersion()
+	if versionNumber > 0 {
+		if version, found = attachment.findVersion(versionNumber); !found {
+			logManager.LogPrintf("Got invalid download link for version %v.\n", versionNumber)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+
+	serveAttachmentVersion(w, r, id, attachment, version)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func createDownloadLink(t *testing.T, token string, attachmentId string, body string) DownloadLink {
+	r, _ := http.NewRequest("POST", "/sona/v1/incidents/0/attachment/"+attachmentId+"/link", strings.NewReader(body))
+	r.Header.Set("X-Sona-Token", token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 201 {
+		t.Fatalf("Expected 201 status code got %v", w.Result())
+	}
+
+	var link DownloadLink
+	if err := json.Unmarshal(w.Body.Bytes(), &link); err != nil {
+		t.Fatalf("Failed to convert response %v error %v", w.Body, err)
+	}
+
+	return link
+}
+
+func useDownloadLink(url string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("GET", url, nil)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestDownloadLink(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.viewIncident)
+	attachment, _ := attachFile(0, "app.log", strings.NewReader("first run"), "", 0)
+	link := createDownloadLink(t, token, attachment.Id, "")
+
+	w := useDownloadLink(link.Url)
+	if w.Result().StatusCode != 200 || w.Body.String() != "first run" {
+		t.Fatalf("Expected attachment got %v %v", w.Result().StatusCode, w.Body.String())
+	}
+
+	w = useDownloadLink(link.Url)
+	if w.Result().StatusCode != 200 {
+		t.Errorf("Expected link to be reusable got %v", w.Result())
+	}
+}
+
+func TestDownloadLinkForVersion(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.viewIncident)
+	attachment, _ := attachFile(0, "app.log", strings.NewReader("first run"), "", 0)
+	attachFileVersion(0, attachment, "app.log", strings.NewReader("second run"), "", 0)
+	link := createDownloadLink(t, token, attachment.Id, `{"version": 1}`)
+
+	w := useDownloadLink(link.Url)
+	if w.Result().StatusCode != 200 || w.Body.String() != "first run" {
+		t.Errorf("Expected first version got %v %v", w.Result().StatusCode, w.Body.String())
+	}
+}
+
+func TestSingleUseDownloadLink(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.viewIncident)
+	attachment, _ := attachFile(0, "app.log", strings.NewReader("first run"), "", 0)
+	link := createDownloadLink(t, token, attachment.Id, `{"singleUse": true}`)
+
+	w := useDownloadLink(link.Url)
+	if w.Result().StatusCode != 200 {
+		t.Fatalf("Expected 200 status code got %v", w.Result())
+	}
+
+	w = useDownloadLink(link.Url)
+	if w.Result().StatusCode != 403 {
+		t.Errorf("Expected 403 status code got %v", w.Result())
+	}
+}
+
+func TestTamperedDownloadLink(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.viewIncident)
+	attachment, _ := attachFile(0, "app.log", strings.NewReader("first run"), "", 0)
+	other, _ := attachFile(0, "other.log", strings.NewReader("other"), "", 0)
+	link := createDownloadLink(t, token, attachment.Id, "")
+
+	tampered := []string{
+		strings.Replace(link.Url, attachment.Id, other.Id, 1),
+		strings.Replace(link.Url, "expires=", "expires=9", 1),
+		strings.Replace(link.Url, "signature=", "signature=a", 1),
+	}
+
+	for _, url := range tampered {
+		if w := useDownloadLink(url); w.Result().StatusCode != 403 {
+			t.Errorf("Expected 403 status code for %v got %v", url, w.Result())
+		}
+	}
+}
+
+func TestExpiredDownloadLink(t *testing.T) {
+	setupAttachmentTest(t, availablePermissions.viewIncident)
+	attachment, _ := attachFile(0, "app.log", strings.NewReader("first run"), "", 0)
+	expires := time.Now().Add(-time.Minute).Unix()
+	url := fmt.Sprintf("%v?expires=%v&signature=%v", getDownloadLinkPath(0, attachment.Id), expires, downloadLinks.sign(0, attachment.Id, 0, expires, ""))
+
+	w := useDownloadLink(url)
+	if w.Result().StatusCode != 403 {
+		t.Errorf("Expected 403 status code got %v", w.Result())
+	}
+}
+
+func TestDownloadLinkWithInvalidExpiration(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.viewIncident)
+	attachment, _ := attachFile(0, "app.log", strings.NewReader("first run"), "", 0)
+
+	r, _ := http.NewRequest("POST", "/sona/v1/incidents/0/attachment/"+attachment.Id+"/link", strings.NewReader(`{"expiresIn": 604800}`))
+	r.Header.Set("X-Sona-Token", token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 400 {
+		t.Errorf("Expected 400 status code got %v", w.Result())
+	}
+}
+
+func TestDownloadLinkWithInvalidPermissions(t *testing.T) {
+	setup()
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
+	_, token := user1.Authenticate("1234")
+
+	r, _ := http.NewRequest("POST", "/sona/v1/incidents/0/attachment/app.log/link", nil)
+	r.Header.Set("X-Sona-Token", token.Token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 401 {
+		t.Errorf("Expected 401 status code got %v", w.Result())
+	}
+}
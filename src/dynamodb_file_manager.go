@@ -0,0 +1,282 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	guuid "github.com/google/uuid"
+)
+
+// dynamoFileHeader is the range key of the item that describes a file, chunks are numbered from 0.
+const dynamoFileHeader = -1
+
+// dynamoChunksPerPage is how many chunks are requested at a time while a file is read.
+const dynamoChunksPerPage = 4
+
+// DynamoDBFileManager stores attachments in the same DynamoDB region as incidents, so a single backup captures everything.
+// Each file has an item keyed by incident/fileName that points to a generation of chunk items keyed by a generated id.
+// Every save writes a new generation of chunks and only then points the file at it, so readers never see a partly saved file.
+type DynamoDBFileManager struct {
+	Table string // The table to store files in.
+	svc   dynamodbiface.DynamoDBAPI
+}
+
+// NewDynamoDBFileManager creates a file manager for a DynamoDB region.
+func NewDynamoDBFileManager(region string, endpoint string, table string) DynamoDBFileManager {
+	return DynamoDBFileManager{table, CreateService(region, endpoint)}
+}
+
+// Initialize creates the file table if it does not already exist.
+// Chunks are large, so the table is billed per request instead of using provisioned throughput.
+func (manager DynamoDBFileManager) Initialize() {
+	_, err := manager.svc.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(manager.Table)})
+	if err == nil {
+		logManager.LogPrintf("Found file table %v\n", manager.Table)
+		return
+	}
+
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != dynamodb.ErrCodeResourceNotFoundException {
+		logManager.LogFatal(err.Error())
+	}
+
+	result, err := manager.svc.CreateTable(&dynamodb.CreateTableInput{
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("key"), AttributeType: aws.String("S")},
+			{AttributeName: aws.String("chunk"), AttributeType: aws.String("N")},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("key"), KeyType: aws.String("HASH")},
+			{AttributeName: aws.String("chunk"), KeyType: aws.String("RANGE")},
+		},
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+		TableName:   aws.String(manager.Table),
+	})
+
+	if err != nil {
+		logManager.LogFatal(err.Error())
+	}
+
+	logManager.LogPrintf("Table Created %v\n", result)
+}
+
+func dynamoChunkKey(key string, chunk int) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"key":   {S: aws.String(key)},
+		"chunk": {N: aws.String(strconv.Itoa(chunk))},
+	}
+}
+
+// SaveFile stores a file one chunk at a time and then points the file at the new chunks.
+// If the attempt fails a false will be returned.
+func (manager DynamoDBFileManager) SaveFile(incident string, fileName string, file io.Reader) (string, bool) {
+	generation := guuid.New().String()
+	count := 0
+	size, err := saveChunks(file, fileChunkSize, func(index int, data []byte) error {
+		item := dynamoChunkKey(generation, index)
+		item["data"] = &dynamodb.AttributeValue{B: data}
+		count++
+
+		_, err := manager.svc.PutItem(&dynamodb.PutItemInput{TableName: aws.String(manager.Table), Item: item})
+		return err
+	})
+
+	if err != nil {
+		logManager.LogPrintf("Unable to save file %v/%v %v\n", incident, fileName, err)
+		manager.deleteChunks(generation, count)
+		return "", false
+	}
+
+	item := dynamoChunkKey(incident+"/"+fileName, dynamoFileHeader)
+	item["generation"] = &dynamodb.AttributeValue{S: aws.String(generation)}
+	item["size"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(size, 10))}
+	item["chunksize"] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(fileChunkSize))}
+	item["modified"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))}
+
+	result, err := manager.svc.PutItem(&dynamodb.PutItemInput{
+		TableName:    aws.String(manager.Table),
+		Item:         item,
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+	})
+
+	if err != nil {
+		logManager.LogPrintf("Unable to save file %v/%v %v\n", incident, fileName, err)
+		manager.deleteChunks(generation, count)
+		return "", false
+	}
+
+	if previous, found := readDynamoFileHeader(result.Attributes); found {
+		manager.deleteChunks(previous.generation, getChunkCount(previous.size, previous.chunkSize))
+	}
+
+	return "dynamodb:" + incident + "/" + fileName, true
+}
+
+// dynamoFile describes where the chunks of a file are.
+type dynamoFile struct {
+	generation string
+	size       int64
+	chunkSize  int
+	modified   time.Time
+}
+
+func readDynamoFileHeader(item map[string]*dynamodb.AttributeValue) (dynamoFile, bool) {
+	if item["generation"] == nil || item["size"] == nil || item["chunksize"] == nil {
+		return dynamoFile{}, false
+	}
+
+	size, _ := strconv.ParseInt(aws.StringValue(item["size"].N), 10, 64)
+	chunkSize, _ := strconv.Atoi(aws.StringValue(item["chunksize"].N))
+	var modified int64
+	if item["modified"] != nil {
+		modified, _ = strconv.ParseInt(aws.StringValue(item["modified"].N), 10, 64)
+	}
+
+	return dynamoFile{aws.StringValue(item["generation"].S), size, chunkSize, time.Unix(modified, 0)}, chunkSize > 0
+}
+
+func (manager DynamoDBFileManager) getFile(incident string, fileName string) (dynamoFile, bool) {
+	result, err := manager.svc.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(manager.Table),
+		Key:            dynamoChunkKey(incident+"/"+fileName, dynamoFileHeader),
+		ConsistentRead: aws.Bool(true),
+	})
+
+	if err != nil {
+		logManager.LogPrintf("Unable to find file %v/%v %v\n", incident, fileName, err)
+		return dynamoFile{}, false
+	}
+
+	return readDynamoFileHeader(result.Item)
+}
+
+// LoadFile streams a file out of DynamoDB as it is read.
+// Chunks are queried a few at a time, starting from the chunk that holds the offset being read.
+func (manager DynamoDBFileManager) LoadFile(incident string, fileName string) (io.ReadSeeker, os.FileInfo, bool, func()) {
+	file, found := manager.getFile(incident, fileName)
+	if !found {
+		return nil, nil, false, nil
+	}
+
+	object := &rangedObject{
+		open: func(offset int64) (io.ReadCloser, error) {
+			input := &dynamodb.QueryInput{
+				TableName:              aws.String(manager.Table),
+				KeyConditionExpression: aws.String("#key = :key AND #chunk >= :chunk"),
+				ExpressionAttributeNames: map[string]*string{
+					"#key":   aws.String("key"),
+					"#chunk": aws.String("chunk"),
+				},
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":key":   {S: aws.String(file.generation)},
+					":chunk": {N: aws.String(strconv.FormatInt(offset/int64(file.chunkSize), 10))},
+				},
+				Limit:          aws.Int64(dynamoChunksPerPage),
+				ConsistentRead: aws.Bool(true),
+			}
+
+			var page []map[string]*dynamodb.AttributeValue
+			done := false
+			next := func() ([]byte, error) {
+				for len(page) == 0 {
+					if done {
+						return nil, io.EOF
+					}
+
+					result, err := manager.svc.Query(input)
+					if err != nil {
+						return nil, err
+					}
+
+					page = result.Items
+					input.ExclusiveStartKey = result.LastEvaluatedKey
+					done = len(result.LastEvaluatedKey) == 0
+				}
+
+				item := page[0]
+				page = page[1:]
+				if item["data"] == nil {
+					return nil, io.ErrUnexpectedEOF
+				}
+
+				return item["data"].B, nil
+			}
+
+			return newChunkReader(int(offset%int64(file.chunkSize)), next, nil), nil
+		},
+		size: file.size,
+	}
+
+	info := objectFileInfo{fileName, file.size, file.modified}
+	return object, info, true, object.close
+}
+
+// DeleteFile removes a file and its chunks.
+func (manager DynamoDBFileManager) DeleteFile(incident string, fileName string) bool {
+	result, err := manager.svc.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:    aws.String(manager.Table),
+		Key:          dynamoChunkKey(incident+"/"+fileName, dynamoFileHeader),
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+	})
+
+	if err != nil {
+		logManager.LogPrintf("Unable to delete file %v/%v %v\n", incident, fileName, err)
+		return false
+	}
+
+	file, found := readDynamoFileHeader(result.Attributes)
+	if !found {
+		return false
+	}
+
+	manager.deleteChunks(file.generation, getChunkCount(file.size, file.chunkSize))
+	return true
+}
+
+// ListFiles will list every file stored in the table.
+// Only the items describing files are returned by the scan, but every chunk is still read by it.
+func (manager DynamoDBFileManager) ListFiles() ([]StoredFile, bool) {
+	files := make([]StoredFile, 0)
+	err := manager.svc.ScanPages(&dynamodb.ScanInput{
+		TableName:                aws.String(manager.Table),
+		FilterExpression:         aws.String("#chunk = :header"),
+		ProjectionExpression:     aws.String("#key"),
+		ExpressionAttributeNames: map[string]*string{"#key": aws.String("key"), "#chunk": aws.String("chunk")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":header": {N: aws.String(strconv.Itoa(dynamoFileHeader))},
+		},
+	}, func(page *dynamodb.ScanOutput, last bool) bool {
+		for _, item := range page.Items {
+			if file, ok := parseStoredFileKey(aws.StringValue(item["key"].S)); ok {
+				files = append(files, file)
+			}
+		}
+
+		return true
+	})
+
+	if err != nil {
+		logManager.LogPrintf("Unable to list files in dynamodb %v\n", err)
+		return nil, false
+	}
+
+	return files, true
+}
+
+func (manager DynamoDBFileManager) deleteChunks(generation string, count int) {
+	for index := 0; index < count; index++ {
+		_, err := manager.svc.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName: aws.String(manager.Table),
+			Key:       dynamoChunkKey(generation, index),
+		})
+
+		if err != nil {
+			logManager.LogPrintf("Unable to delete file chunk %v/%v %v\n", generation, index, err)
+		}
+	}
+}
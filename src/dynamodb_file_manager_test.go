@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"maps"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// FakeDynamoDB keeps the items of a single table in memory in the same way as dynamodb.
+type FakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	lock    *sync.Mutex
+	items   map[string]map[string]*dynamodb.AttributeValue
+	queries []string
+}
+
+func NewFakeDynamoDB() *FakeDynamoDB {
+	return &FakeDynamoDB{lock: &sync.Mutex{}, items: make(map[string]map[string]*dynamodb.AttributeValue)}
+}
+
+func getFakeItemKey(item map[string]*dynamodb.AttributeValue) string {
+	return aws.StringValue(item["key"].S) + "#" + aws.StringValue(item["chunk"].N)
+}
+
+func (svc *FakeDynamoDB) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+	key := getFakeItemKey(input.Item)
+	previous := svc.items[key]
+	item := maps.Clone(input.Item)
+	if item["data"] != nil {
+		item["data"] = &dynamodb.AttributeValue{B: bytes.Clone(item["data"].B)}
+	}
+
+	svc.items[key] = item
+	return &dynamodb.PutItemOutput{Attributes: previous}, nil
+}
+
+func (svc *FakeDynamoDB) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+	return &dynamodb.GetItemOutput{Item: svc.items[getFakeItemKey(input.Key)]}, nil
+}
+
+func (svc *FakeDynamoDB) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+	key := getFakeItemKey(input.Key)
+	previous := svc.items[key]
+	delete(svc.items, key)
+	return &dynamodb.DeleteItemOutput{Attributes: previous}, nil
+}
+
+func (svc *FakeDynamoDB) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+	key := aws.StringValue(input.ExpressionAttributeValues[":key"].S)
+	start, _ := strconv.Atoi(aws.StringValue(input.ExpressionAttributeValues[":chunk"].N))
+	if input.ExclusiveStartKey != nil {
+		start, _ = strconv.Atoi(aws.StringValue(input.ExclusiveStartKey["chunk"].N))
+		start++
+	}
+
+	svc.queries = append(svc.queries, strconv.Itoa(start))
+	chunks := make([]int, 0)
+	for _, item := range svc.items {
+		chunk, _ := strconv.Atoi(aws.StringValue(item["chunk"].N))
+		if aws.StringValue(item["key"].S) == key && chunk >= start {
+			chunks = append(chunks, chunk)
+		}
+	}
+
+	sort.Ints(chunks)
+	output := &dynamodb.QueryOutput{}
+	for _, chunk := range chunks {
+		if int64(len(output.Items)) == aws.Int64Value(input.Limit) {
+			output.LastEvaluatedKey = dynamoChunkKey(key, chunk-1)
+			break
+		}
+
+		output.Items = append(output.Items, svc.items[key+"#"+strconv.Itoa(chunk)])
+	}
+
+	return output, nil
+}
+
+func TestDynamoDBFileManager(t *testing.T) {
+	testFileManager(t, DynamoDBFileManager{"IncidentFiles", NewFakeDynamoDB()})
+}
+
+func TestDynamoDBFileManagerChunks(t *testing.T) {
+	svc := NewFakeDynamoDB()
+	manager := DynamoDBFileManager{"IncidentFiles", svc}
+	content := strings.Repeat("0123456789", fileChunkSize)
+
+	manager.SaveFile("0", "app.log", strings.NewReader(content))
+
+	if len(svc.items) != 11 {
+		t.Errorf("Expected a header and 10 chunks got %v items", len(svc.items))
+	}
+
+	if read := readFile(t, manager, "0", "app.log"); read != content {
+		t.Errorf("Unexpected content of length %v", len(read))
+	}
+
+	svc.queries = nil
+	file, _, _, closer := manager.LoadFile("0", "app.log")
+	defer closer()
+
+	offset := int64(fileChunkSize*7 + 3)
+	file.Seek(offset, io.SeekStart)
+	data := make([]byte, 10)
+	io.ReadFull(file, data)
+
+	if string(data) != content[offset:offset+10] {
+		t.Errorf("Expected %v got %v", content[offset:offset+10], string(data))
+	}
+
+	if len(svc.queries) != 1 || svc.queries[0] != "7" {
+		t.Errorf("Expected a single query from chunk 7 got %v", svc.queries)
+	}
+}
+
+func TestDynamoDBFileManagerReplaceDeletesChunks(t *testing.T) {
+	svc := NewFakeDynamoDB()
+	manager := DynamoDBFileManager{"IncidentFiles", svc}
+	manager.SaveFile("0", "app.log", strings.NewReader(strings.Repeat("a", fileChunkSize*3)))
+	manager.SaveFile("0", "app.log", strings.NewReader("replaced"))
+
+	if len(svc.items) != 2 {
+		t.Errorf("Expected previous chunks to be deleted got %v items", len(svc.items))
+	}
+
+	manager.DeleteFile("0", "app.log")
+
+	if len(svc.items) != 0 {
+		t.Errorf("Expected every item to be deleted got %v items", len(svc.items))
+	}
+}
+
+func TestDynamoDBFileManagerEmptyFile(t *testing.T) {
+	manager := DynamoDBFileManager{"IncidentFiles", NewFakeDynamoDB()}
+	manager.SaveFile("0", "empty", strings.NewReader(""))
+
+	if content := readFile(t, manager, "0", "empty"); content != "" {
+		t.Errorf("Unexpected content %v", content)
+	}
+}
@@ -383,6 +383,11 @@ func (manager DynamoDBIncidentManager) UpdateIncident(id int, update IncidentUpd
 	return manager.updateItemInDataBase(*inc)
 }
 
+// UpdateIncidents will update a set of incidents in the dynamodb.
+func (manager DynamoDBIncidentManager) UpdateIncidents(ids []int, update IncidentUpdate) map[int]bool {
+	return updateIncidents(manager, ids, update)
+}
+
 func (manager DynamoDBIncidentManager) getIncidentFromDataBase(incidentId int) (*Incident, bool) {
 	svc := CreateService(*manager.Region, *manager.Endpoint)
 
@@ -596,7 +601,7 @@ func (manager DynamoDBIncidentManager) updateItemInDataBase(incident Incident) b
 // AddAttachment will attempt to add an association between an incident and an attachment.
 // If the attempt fails a false will be returned.
 func (manager DynamoDBIncidentManager) AddAttachment(incidentId int, attachment Attachment) bool {
-	av, err := dynamodbattribute.MarshalMap(attachment)
+	av, err := marshalDynamoAttachment(attachment)
 	if err != nil {
 		logManager.LogPrintf("Unable to marshal incident, %v", err)
 		return false
@@ -627,7 +632,7 @@ func (manager DynamoDBIncidentManager) AddAttachment(incidentId int, attachment
 // If the attempt fails an empty array an a false will be returned.
 // If the attempt passes a array of attachments associated with the incident and a true will be returned.
 func (manager DynamoDBIncidentManager) GetAttachments(incidentId int) ([]Attachment, bool) {
-	var attachments []Attachment
+	attachments := make([]Attachment, 0)
 
 	svc := CreateService(*manager.Region, *manager.Endpoint)
 
@@ -664,13 +669,28 @@ func (manager DynamoDBIncidentManager) GetAttachments(incidentId int) ([]Attachm
 		return make([]Attachment, 0), false
 	}
 
-	dynamodbattribute.UnmarshalListOfMaps(resp.Items, &attachments)
+	for _, item := range resp.Items {
+		attachment, err := unmarshalDynamoAttachment(item)
+		if err != nil {
+			logManager.LogPrintf("Unable to unmarshal attachment, %v\n", err)
+			continue
+		}
+
+		attachments = append(attachments, attachment)
+	}
+
 	logManager.LogPrintf("Found %v attachments\n", len(attachments))
 	return attachments, true
 }
 
+// UpdateAttachment will replace the attachment item, which is keyed by the attachment id.
+// If the attempt fails a false will be returned.
+func (manager DynamoDBIncidentManager) UpdateAttachment(incidentId int, attachment Attachment) bool {
+	return manager.AddAttachment(incidentId, attachment)
+}
+
 // RemoveAttachment will find and remove an attachment associated with an incident.
-func (manager DynamoDBIncidentManager) RemoveAttachment(incidentId int, fileName string) bool {
+func (manager DynamoDBIncidentManager) RemoveAttachment(incidentId int, attachmentId string) bool {
 	svc := CreateService(*manager.Region, *manager.Endpoint)
 	input := &dynamodb.DeleteItemInput{
 		Key: map[string]*dynamodb.AttributeValue{
@@ -678,7 +698,7 @@ func (manager DynamoDBIncidentManager) RemoveAttachment(incidentId int, fileName
 				N: aws.String(strconv.Itoa(incidentId)),
 			},
 			"filename": {
-				S: aws.String(fileName),
+				S: aws.String(attachmentId),
 			},
 		},
 		TableName: aws.String(*manager.AttachmentTable),
@@ -730,3 +750,34 @@ func CreateService(region string, endpoint string) *dynamodb.DynamoDB {
 	sess := session.Must(session.NewSession(config))
 	return dynamodb.New(sess)
 }
+
+// marshalDynamoAttachment converts an attachment to a dynamodb item.
+// The attachment table uses filename as its range key, so it holds the attachment id
+// and the original file name is stored as name.
+func marshalDynamoAttachment(attachment Attachment) (map[string]*dynamodb.AttributeValue, error) {
+	av, err := dynamodbattribute.MarshalMap(attachment)
+	if err != nil {
+		return nil, err
+	}
+
+	delete(av, "id")
+	av["filename"] = &dynamodb.AttributeValue{S: aws.String(attachment.getId())}
+	av["name"] = &dynamodb.AttributeValue{S: aws.String(attachment.FileName)}
+	return av, nil
+}
+
+// unmarshalDynamoAttachment converts a dynamodb item to an attachment.
+// Items added before ids were generated have no name and use their file name as their id.
+func unmarshalDynamoAttachment(item map[string]*dynamodb.AttributeValue) (Attachment, error) {
+	var attachment Attachment
+	if err := dynamodbattribute.UnmarshalMap(item, &attachment); err != nil {
+		return attachment, err
+	}
+
+	attachment.Id = attachment.FileName
+	if name, ok := item["name"]; ok && name.S != nil {
+		attachment.FileName = *name.S
+	}
+
+	return attachment, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// DynamoDBServiceAccountManager stores service accounts in the same DynamoDB region as users.
+// Each account is an item keyed by its id that holds its keys.
+type DynamoDBServiceAccountManager struct {
+	Table string // The table to store service accounts in.
+	svc   dynamodbiface.DynamoDBAPI
+}
+
+// NewDynamoDBServiceAccountManager creates a service account manager for a DynamoDB region.
+func NewDynamoDBServiceAccountManager(region string, endpoint string, table string) DynamoDBServiceAccountManager {
+	return DynamoDBServiceAccountManager{table, CreateService(region, endpoint)}
+}
+
+// Initialize creates the service account table if it does not already exist.
+func (manager DynamoDBServiceAccountManager) Initialize() {
+	_, err := manager.svc.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(manager.Table)})
+	if err == nil {
+		logManager.LogPrintf("Found service account table %v\n", manager.Table)
+		return
+	}
+
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != dynamodb.ErrCodeResourceNotFoundException {
+		logManager.LogFatal(err.Error())
+	}
+
+	result, err := manager.svc.CreateTable(&dynamodb.CreateTableInput{
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("id"), AttributeType: aws.String("S")},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("id"), KeyType: aws.String("HASH")},
+		},
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+		TableName:   aws.String(manager.Table),
+	})
+
+	if err != nil {
+		logManager.LogFatal(err.Error())
+	}
+
+	logManager.LogPrintf("Table Created %v\n", result)
+}
+
+func (manager DynamoDBServiceAccountManager) putServiceAccount(account ServiceAccount, condition string) bool {
+	item, err := dynamodbattribute.MarshalMap(account)
+	if err != nil {
+		logManager.LogPrintf("Unable to convert service account %v\n", err)
+		return false
+	}
+
+	_, err = manager.svc.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(manager.Table),
+		Item:                item,
+		ConditionExpression: aws.String(condition),
+	})
+
+	if err != nil {
+		logManager.LogPrintf("Unable to store service account %v %v\n", account.Id, err)
+		return false
+	}
+
+	return true
+}
+
+func (manager DynamoDBServiceAccountManager) AddServiceAccount(account ServiceAccount) bool {
+	return manager.putServiceAccount(account, "attribute_not_exists(id)")
+}
+
+func (manager DynamoDBServiceAccountManager) GetServiceAccount(id string) (ServiceAccount, bool) {
+	result, err := manager.svc.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(manager.Table),
+		Key:       map[string]*dynamodb.AttributeValue{"id": {S: aws.String(id)}},
+	})
+
+	if err != nil {
+		logManager.LogPrintf("Unable to get service account %v %v\n", id, err)
+		return ServiceAccount{}, false
+	}
+
+	if result.Item == nil {
+		return ServiceAccount{}, false
+	}
+
+	return readDynamoServiceAccount(result.Item)
+}
+
+func readDynamoServiceAccount(item map[string]*dynamodb.AttributeValue) (ServiceAccount, bool) {
+	var account ServiceAccount
+	if err := dynamodbattribute.UnmarshalMap(item, &account); err != nil {
+		logManager.LogPrintf("Unable to read service account %v\n", err)
+		return ServiceAccount{}, false
+	}
+
+	if account.Permissions == nil {
+		account.Permissions = make([]string, 0)
+	}
+
+	if account.Keys == nil {
+		account.Keys = make([]APIKey, 0)
+	}
+
+	return account, true
+}
+
+func (manager DynamoDBServiceAccountManager) GetServiceAccounts() ([]ServiceAccount, bool) {
+	accounts := make([]ServiceAccount, 0)
+	passed := true
+	err := manager.svc.ScanPages(&dynamodb.ScanInput{
+		TableName: aws.String(manager.Table),
+	}, func(page *dynamodb.ScanOutput, last bool) bool {
+		for _, item := range page.Items {
+			account, read := readDynamoServiceAccount(item)
+			if !read {
+				passed = false
+				return false
+			}
+
+			accounts = append(accounts, account)
+		}
+
+		return true
+	})
+
+	if err != nil {
+		logManager.LogPrintf("Unable to list service accounts %v\n", err)
+		return nil, false
+	}
+
+	sortServiceAccounts(accounts)
+	return accounts, passed
+}
+
+func (manager DynamoDBServiceAccountManager) UpdateServiceAccount(account ServiceAccount) bool {
+	return manager.putServiceAccount(account, "attribute_exists(id)")
+}
+
+func (manager DynamoDBServiceAccountManager) RemoveServiceAccount(id string) bool {
+	result, err := manager.svc.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:    aws.String(manager.Table),
+		Key:          map[string]*dynamodb.AttributeValue{"id": {S: aws.String(id)}},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+	})
+
+	if err != nil {
+		logManager.LogPrintf("Unable to remove service account %v %v\n", id, err)
+		return false
+	}
+
+	return result.Attributes != nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	b64 "encoding/base64"
 	"fmt"
+	"sort"
 	"strconv"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -148,7 +149,7 @@ func (manager DynamoDBUserManager) AddUser(user *AddUser) (bool, User) {
 	}
 
 	logManager.LogPrintf("Created user %v attempting to set password\n", usr)
-	manager.SetUserPassword(usr, createPasswordHash(usr, user.Password))
+	manager.SetUserPassword(usr, user.Password)
 
 	return true, usr
 }
@@ -219,6 +220,32 @@ func (manager DynamoDBUserManager) getAllUsers() ([]User, error) {
 	return users, err
 }
 
+func (manager DynamoDBUserManager) GetUsers() ([]User, bool) {
+	users, err := manager.getAllUsers()
+	if err != nil {
+		logManager.LogPrintf("Unable to get users %v\n", err)
+		return nil, false
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Id < users[j].Id
+	})
+
+	return users, true
+}
+
+// ListUsers finds a page of the users matching the query.
+// Filters ignore case, which dynamodb filter expressions cannot do, so the table is scanned and filtered here.
+func (manager DynamoDBUserManager) ListUsers(query UserQuery) (UserPage, bool) {
+	users, err := manager.getAllUsers()
+	if err != nil {
+		logManager.LogPrintf("Unable to list users %v\n", err)
+		return UserPage{}, false
+	}
+
+	return queryUsers(users, query), true
+}
+
 func (manager DynamoDBUserManager) GetUser(userId int64) (User, bool) {
 	logManager.LogPrintln("Got Get user request.")
 	usr, pass := manager.getUserFromDataBase(userId)
@@ -484,7 +511,11 @@ func (manager DynamoDBUserManager) RemoveUser(userId int64) bool {
 }
 
 func (manager DynamoDBUserManager) SetUserPassword(user User, password string) {
-	pw := b64.StdEncoding.EncodeToString([]byte(password))
+	manager.SetPasswordHash(user, createPasswordHash(password))
+}
+
+func (manager DynamoDBUserManager) storePasswordHash(user User, hash string) bool {
+	pw := b64.StdEncoding.EncodeToString([]byte(hash))
 	logManager.LogPrintf("Setting password for %v\n", user)
 	svc := CreateService(*manager.Region, *manager.Endpoint)
 
@@ -530,9 +561,25 @@ func (manager DynamoDBUserManager) SetUserPassword(user User, password string) {
 		} else {
 			logManager.LogPrintln(err.Error())
 		}
+
+		return false
 	}
 
 	logManager.LogPrintln(result)
+	return true
+}
+
+func (manager DynamoDBUserManager) GetPasswordHash(user User) (string, bool) {
+	hash, err := b64.StdEncoding.DecodeString(manager.getUserPassword(user))
+	if err != nil || len(hash) == 0 {
+		return "", false
+	}
+
+	return string(hash), true
+}
+
+func (manager DynamoDBUserManager) SetPasswordHash(user User, hash string) bool {
+	return manager.storePasswordHash(user, hash)
 }
 
 func (manager DynamoDBUserManager) SetPermissions(userId int64, permissions []string) bool {
@@ -647,7 +694,7 @@ func (manager DynamoDBUserManager) getUserPassword(user User) string {
 	return retVal
 }
 
-func (manager DynamoDBUserManager) getUserTokens(userId int64) []string {
+func (manager DynamoDBUserManager) GetTokens(userId int64) ([]string, bool) {
 	retVal := make([]string, 0)
 	svc := CreateService(*manager.Region, *manager.Endpoint)
 
@@ -678,11 +725,11 @@ func (manager DynamoDBUserManager) getUserTokens(userId int64) []string {
 		} else {
 			logManager.LogPrintln(err.Error())
 		}
-		return retVal
+		return retVal, false
 	}
 
 	if len(result.Items) == 0 {
-		return retVal
+		return retVal, true
 	}
 
 	for k, v := range result.Items[0] {
@@ -694,23 +741,21 @@ func (manager DynamoDBUserManager) getUserTokens(userId int64) []string {
 
 			if err2 != nil {
 				logManager.LogPrintln(fmt.Sprintf("failed to unmarshal items, %v", err2))
+				return retVal, false
 			}
 			retVal = umVal
 		}
 	}
 
-	return retVal
+	return retVal, true
 }
 
-func (manager DynamoDBUserManager) storeToken(user User, token string) bool {
-	tokens := manager.getUserTokens(user.Id)
-	reconciledTokens := make([]string, 0)
-	reconciledTokens = append(reconciledTokens, token)
-
-	for _, t := range tokens {
-		if !TokenExpired(t) {
-			reconciledTokens = append(reconciledTokens, t)
-		}
+// SetTokens replaces the tokens of a user.
+// String sets cannot be empty so the tokens attribute is removed when there are no tokens.
+func (manager DynamoDBUserManager) SetTokens(userId int64, tokens []string) bool {
+	user, found := manager.GetUser(userId)
+	if !found {
+		return false
 	}
 
 	svc := CreateService(*manager.Region, *manager.Endpoint)
@@ -719,11 +764,6 @@ func (manager DynamoDBUserManager) storeToken(user User, token string) bool {
 		ExpressionAttributeNames: map[string]*string{
 			"#t": aws.String("tokens"),
 		},
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-			":t": {
-				SS: aws.StringSlice(reconciledTokens),
-			},
-		},
 		Key: map[string]*dynamodb.AttributeValue{
 			"emailAddress": {
 				S: aws.String(user.EmailAddress),
@@ -734,7 +774,16 @@ func (manager DynamoDBUserManager) storeToken(user User, token string) bool {
 		},
 		ReturnValues:     aws.String("ALL_NEW"),
 		TableName:        aws.String(*manager.UsersTable),
-		UpdateExpression: aws.String("SET #t = :t"),
+		UpdateExpression: aws.String("REMOVE #t"),
+	}
+
+	if len(tokens) > 0 {
+		input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+			":t": {
+				SS: aws.StringSlice(tokens),
+			},
+		}
+		input.UpdateExpression = aws.String("SET #t = :t")
 	}
 
 	result, err := svc.UpdateItem(input)
@@ -757,6 +806,7 @@ func (manager DynamoDBUserManager) storeToken(user User, token string) bool {
 		} else {
 			logManager.LogPrintln(err.Error())
 		}
+		return false
 	}
 
 	logManager.LogPrintln(result)
@@ -764,106 +814,21 @@ func (manager DynamoDBUserManager) storeToken(user User, token string) bool {
 }
 
 func (manager DynamoDBUserManager) AuthenticateUser(user User, password string) (bool, TokenResponse) {
-	formattedPassword := b64.StdEncoding.EncodeToString([]byte(createPasswordHash(user, password)))
-	originalPassword := manager.getUserPassword(user)
+	originalPassword, _ := manager.GetPasswordHash(user)
+	auth := checkPassword(user, password, originalPassword, func(hash string) bool {
+		return manager.SetPasswordHash(user, hash)
+	})
 
-	if originalPassword != formattedPassword {
+	if !auth {
 		return false, TokenResponse{}
 	}
 
-	token := GenerateToken(user)
-	manager.storeToken(user, token.Token)
-
-	return true, token
-}
-
-func (manager DynamoDBUserManager) pruneTokens(userId int64, tokens []string) {
-	logManager.LogPrintf("Attempting to prune user %v tokens", userId)
-	user, pass := manager.GetUser(userId)
-
-	if !pass {
-		return
-	}
-
-	reconciledTokens := make([]string, 0)
-
-	for _, t := range tokens {
-		if !TokenExpired(t) {
-			reconciledTokens = append(reconciledTokens, t)
-		}
-	}
-
-	svc := CreateService(*manager.Region, *manager.Endpoint)
-
-	input := &dynamodb.UpdateItemInput{
-		ExpressionAttributeNames: map[string]*string{
-			"#t": aws.String("tokens"),
-		},
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-			":t": {
-				SS: aws.StringSlice(reconciledTokens),
-			},
-		},
-		Key: map[string]*dynamodb.AttributeValue{
-			"emailAddress": {
-				S: aws.String(user.EmailAddress),
-			},
-			"id": {
-				N: aws.String(strconv.FormatInt(user.Id, 10)),
-			},
-		},
-		ReturnValues:     aws.String("ALL_NEW"),
-		TableName:        aws.String(*manager.UsersTable),
-		UpdateExpression: aws.String("SET #t = :t"),
-	}
-
-	result, err := svc.UpdateItem(input)
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case dynamodb.ErrCodeConditionalCheckFailedException:
-				logManager.LogPrintln(dynamodb.ErrCodeConditionalCheckFailedException, aerr.Error())
-			case dynamodb.ErrCodeProvisionedThroughputExceededException:
-				logManager.LogPrintln(dynamodb.ErrCodeProvisionedThroughputExceededException, aerr.Error())
-			case dynamodb.ErrCodeResourceNotFoundException:
-				logManager.LogPrintln(dynamodb.ErrCodeResourceNotFoundException, aerr.Error())
-			case dynamodb.ErrCodeItemCollectionSizeLimitExceededException:
-				logManager.LogPrintln(dynamodb.ErrCodeItemCollectionSizeLimitExceededException, aerr.Error())
-			case dynamodb.ErrCodeInternalServerError:
-				logManager.LogPrintln(dynamodb.ErrCodeInternalServerError, aerr.Error())
-			default:
-				logManager.LogPrintln(aerr.Error())
-			}
-		} else {
-			logManager.LogPrintln(err.Error())
-		}
-	}
-
-	logManager.LogPrintln(result)
+	token, issued := issueTokens(manager, user)
+	return issued, token
 }
 
 func (manager DynamoDBUserManager) ValidateUser(token string) bool {
-	userId := GetTokenUser(token)
-	tokens := manager.getUserTokens(userId)
-
-	found := -1
-
-	for i, v := range tokens {
-		if v == token {
-			found = i
-		}
-	}
-
-	if found == -1 {
-		logManager.LogPrintf("Token not found for user %v", userId)
-		return false
-	}
-
-	expired := TokenExpired(token)
-	logManager.LogPrintf("Token expired %v", expired)
-	go manager.pruneTokens(userId, tokens)
-
-	return !expired
+	return validateToken(manager, token)
 }
 
 // CleanUp will do any required cleanup actions on the incident manager.
@@ -0,0 +1,627 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// encryptedMagic starts every encrypted file so files saved before encryption was turned on can be told apart.
+const encryptedMagic = "SONAENC1"
+
+// encryptedChunkSize is how much of a file is encrypted at a time.
+// Each chunk can be decrypted on its own, so a range of a file can be read without decrypting all of it.
+const encryptedChunkSize = 64 * 1024
+
+const (
+	dataKeySize      = 32
+	noncePrefixSize  = 8
+	gcmNonceSize     = 12
+	gcmTagSize       = 16
+	wrappedKeySize   = gcmNonceSize + dataKeySize + gcmTagSize
+	maxEncryptionKey = 255
+)
+
+var errNotEncrypted = errors.New("file is not encrypted")
+
+// EncryptionKeys are the master keys that wrap the data key of each file.
+// Files are encrypted with the Active key. The other keys are kept so files wrapped by them can still be read until they are rewrapped.
+type EncryptionKeys struct {
+	Active string
+	Keys   map[string][]byte
+}
+
+// NewEncryptionKeys checks that the active key exists and every key is 32 bytes long, for AES-256.
+func NewEncryptionKeys(active string, keys map[string][]byte) (EncryptionKeys, error) {
+	for id, key := range keys {
+		if len(id) == 0 || len(id) > maxEncryptionKey {
+			return EncryptionKeys{}, fmt.Errorf("encryption key id %q must be between 1 and %v characters", id, maxEncryptionKey)
+		}
+
+		if len(key) != 32 {
+			return EncryptionKeys{}, fmt.Errorf("encryption key %v must be 32 bytes, it is %v bytes", id, len(key))
+		}
+	}
+
+	if _, found := keys[active]; !found {
+		return EncryptionKeys{}, fmt.Errorf("active encryption key %v is not defined", active)
+	}
+
+	return EncryptionKeys{active, keys}, nil
+}
+
+// wrap encrypts a data key with the active master key.
+func (keys EncryptionKeys) wrap(dataKey []byte) ([]byte, error) {
+	aead, err := newGCM(keys.Keys[keys.Active])
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcmNonceSize, wrappedKeySize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, dataKey, []byte(keys.Active)), nil
+}
+
+// unwrap decrypts a data key with the master key that wrapped it.
+func (keys EncryptionKeys) unwrap(id string, wrapped []byte) ([]byte, error) {
+	key, found := keys.Keys[id]
+	if !found {
+		return nil, fmt.Errorf("encryption key %v is not defined", id)
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrapped) != wrappedKeySize {
+		return nil, errors.New("wrapped data key is the wrong size")
+	}
+
+	return aead.Open(nil, wrapped[:gcmNonceSize], wrapped[gcmNonceSize:], []byte(id))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// encryptedHeader starts every encrypted file.
+// The data key of the file is wrapped by the master key named by KeyId.
+// Each chunk uses the NoncePrefix followed by the number of the chunk as its nonce.
+type encryptedHeader struct {
+	KeyId       string
+	WrappedKey  []byte
+	NoncePrefix []byte
+	ChunkSize   int64
+}
+
+func (header encryptedHeader) size() int64 {
+	return int64(len(encryptedMagic) + 1 + len(header.KeyId) + wrappedKeySize + noncePrefixSize + 4)
+}
+
+func (header encryptedHeader) marshal() []byte {
+	data := make([]byte, 0, header.size())
+	data = append(data, encryptedMagic...)
+	data = append(data, byte(len(header.KeyId)))
+	data = append(data, header.KeyId...)
+	data = append(data, header.WrappedKey...)
+	data = append(data, header.NoncePrefix...)
+	return binary.BigEndian.AppendUint32(data, uint32(header.ChunkSize))
+}
+
+// readEncryptedHeader reads the header of a file, errNotEncrypted is returned if the file was not encrypted.
+func readEncryptedHeader(file io.Reader) (encryptedHeader, error) {
+	var header encryptedHeader
+	prefix := make([]byte, len(encryptedMagic)+1)
+	if _, err := io.ReadFull(file, prefix); err != nil || string(prefix[:len(encryptedMagic)]) != encryptedMagic {
+		return header, errNotEncrypted
+	}
+
+	rest := make([]byte, int(prefix[len(encryptedMagic)])+wrappedKeySize+noncePrefixSize+4)
+	if _, err := io.ReadFull(file, rest); err != nil {
+		return header, fmt.Errorf("encrypted header is incomplete %v", err)
+	}
+
+	idSize := len(rest) - wrappedKeySize - noncePrefixSize - 4
+	header.KeyId = string(rest[:idSize])
+	header.WrappedKey = rest[idSize : idSize+wrappedKeySize]
+	header.NoncePrefix = rest[idSize+wrappedKeySize : idSize+wrappedKeySize+noncePrefixSize]
+	header.ChunkSize = int64(binary.BigEndian.Uint32(rest[idSize+wrappedKeySize+noncePrefixSize:]))
+	if header.ChunkSize <= 0 {
+		return header, errors.New("encrypted header has no chunk size")
+	}
+
+	return header, nil
+}
+
+// chunkNonce returns the nonce of a chunk.
+func (header encryptedHeader) chunkNonce(chunk int64) []byte {
+	nonce := make([]byte, 0, gcmNonceSize)
+	nonce = append(nonce, header.NoncePrefix...)
+	return binary.BigEndian.AppendUint32(nonce, uint32(chunk))
+}
+
+// chunkData returns the additional data of a chunk, which marks the last chunk so a file cannot be cut short.
+func chunkData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+
+	return []byte{0}
+}
+
+// encryptingReader encrypts a file as it is read.
+type encryptingReader struct {
+	source  *bufio.Reader
+	aead    cipher.AEAD
+	header  encryptedHeader
+	chunk   int64
+	plain   []byte
+	pending []byte
+	done    bool
+}
+
+// newEncryptingReader creates a new data key for a file and wraps it with the active master key.
+func newEncryptingReader(keys EncryptionKeys, source io.Reader) (*encryptingReader, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+
+	wrapped, err := keys.wrap(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	header := encryptedHeader{keys.Active, wrapped, prefix, encryptedChunkSize}
+	return &encryptingReader{
+		source:  bufio.NewReaderSize(source, encryptedChunkSize),
+		aead:    aead,
+		header:  header,
+		plain:   make([]byte, encryptedChunkSize),
+		pending: header.marshal(),
+	}, nil
+}
+
+func (reader *encryptingReader) Read(p []byte) (int, error) {
+	for len(reader.pending) == 0 {
+		if reader.done {
+			return 0, io.EOF
+		}
+
+		if err := reader.encryptChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, reader.pending)
+	reader.pending = reader.pending[n:]
+	return n, nil
+}
+
+func (reader *encryptingReader) encryptChunk() error {
+	n, err := io.ReadFull(reader.source, reader.plain)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	last := err != nil
+	if !last {
+		// A full chunk is only the last one if nothing follows it.
+		if _, peekErr := reader.source.Peek(1); peekErr == io.EOF {
+			last = true
+		} else if peekErr != nil {
+			return peekErr
+		}
+	}
+
+	reader.pending = reader.aead.Seal(reader.pending[:0], reader.header.chunkNonce(reader.chunk), reader.plain[:n], chunkData(last))
+	reader.chunk++
+	reader.done = last
+	return nil
+}
+
+// decryptingReader decrypts the chunks of a file as they are read.
+// Seeking only moves the position, so a range of a file only reads and decrypts the chunks it needs.
+type decryptingReader struct {
+	file       io.ReadSeeker
+	aead       cipher.AEAD
+	header     encryptedHeader
+	chunks     int64
+	cipherSize int64
+	size       int64
+	position   int64
+	filePos    int64
+	loaded     int64
+	plain      []byte
+}
+
+// newDecryptingReader reads the header of an encrypted file and unwraps its data key.
+func newDecryptingReader(keys EncryptionKeys, file io.ReadSeeker) (*decryptingReader, error) {
+	cipherSize, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	header, err := readEncryptedHeader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := keys.unwrap(header.KeyId, header.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	body := cipherSize - header.size()
+	stride := header.ChunkSize + gcmTagSize
+	chunks := (body + stride - 1) / stride
+	if body < gcmTagSize || body-(chunks-1)*stride < gcmTagSize {
+		return nil, errors.New("encrypted file is incomplete")
+	}
+
+	return &decryptingReader{
+		file:       file,
+		aead:       aead,
+		header:     header,
+		chunks:     chunks,
+		cipherSize: cipherSize,
+		size:       body - chunks*gcmTagSize,
+		filePos:    header.size(),
+		loaded:     -1,
+	}, nil
+}
+
+func (reader *decryptingReader) Read(p []byte) (int, error) {
+	if reader.position >= reader.size {
+		return 0, io.EOF
+	}
+
+	chunk := reader.position / reader.header.ChunkSize
+	if chunk != reader.loaded {
+		if err := reader.loadChunk(chunk); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, reader.plain[reader.position-chunk*reader.header.ChunkSize:])
+	reader.position += int64(n)
+	return n, nil
+}
+
+func (reader *decryptingReader) loadChunk(chunk int64) error {
+	stride := reader.header.ChunkSize + gcmTagSize
+	offset := reader.header.size() + chunk*stride
+	if offset != reader.filePos {
+		if _, err := reader.file.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	sealed := make([]byte, min(stride, reader.cipherSize-offset))
+	if _, err := io.ReadFull(reader.file, sealed); err != nil {
+		return err
+	}
+
+	reader.filePos = offset + int64(len(sealed))
+	plain, err := reader.aead.Open(reader.plain[:0], reader.header.chunkNonce(chunk), sealed, chunkData(chunk == reader.chunks-1))
+	if err != nil {
+		return fmt.Errorf("unable to decrypt chunk %v %v", chunk, err)
+	}
+
+	reader.plain = plain
+	reader.loaded = chunk
+	return nil
+}
+
+func (reader *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	position := offset
+	switch whence {
+	case io.SeekCurrent:
+		position += reader.position
+	case io.SeekEnd:
+		position += reader.size
+	}
+
+	if position < 0 {
+		return reader.position, errors.New("decryptingReader.Seek: negative position")
+	}
+
+	reader.position = position
+	return position, nil
+}
+
+// decryptedFileInfo reports the size of a file before it was encrypted.
+type decryptedFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (info decryptedFileInfo) Size() int64 {
+	return info.size
+}
+
+// RewrappableFileManager defines a file manager whose files can be rewrapped with the active encryption key.
+// RewrapFile should report if the file needed to be rewritten.
+type RewrappableFileManager interface {
+	RewrapFile(incident string, fileName string) (bool, error)
+}
+
+// EncryptedFileManager encrypts files before they are stored by another file manager and decrypts them as they are loaded.
+// Each file is encrypted with AES-256-GCM using its own data key, which is stored with the file wrapped by a master key.
+// Files saved before encryption was turned on are loaded as they are until they are rewrapped.
+type EncryptedFileManager struct {
+	Store FileManager // The file manager the encrypted files are stored in.
+	Keys  EncryptionKeys
+}
+
+// SaveFile encrypts a file as it is saved.
+func (manager EncryptedFileManager) SaveFile(incident string, fileName string, file io.Reader) (string, bool) {
+	encrypted, err := newEncryptingReader(manager.Keys, file)
+	if err != nil {
+		logManager.LogPrintf("Unable to encrypt %v/%v %v\n", incident, fileName, err)
+		return "", false
+	}
+
+	return manager.Store.SaveFile(incident, fileName, encrypted)
+}
+
+// LoadFile decrypts a file as it is read.
+func (manager EncryptedFileManager) LoadFile(incident string, fileName string) (io.ReadSeeker, os.FileInfo, bool, func()) {
+	return manager.decrypt(manager.Store.LoadFile(incident, fileName))
+}
+
+// DeleteFile removes a file.
+func (manager EncryptedFileManager) DeleteFile(incident string, fileName string) bool {
+	return manager.Store.DeleteFile(incident, fileName)
+}
+
+// SupportsVersions reports if the underlying file manager is keeping versions.
+func (manager EncryptedFileManager) SupportsVersions() bool {
+	versioned, ok := manager.Store.(VersionedFileManager)
+	return ok && versioned.SupportsVersions()
+}
+
+// SaveFileVersion encrypts a new version of a file as it is saved.
+func (manager EncryptedFileManager) SaveFileVersion(incident string, fileName string, file io.Reader) (string, bool) {
+	versioned, ok := manager.Store.(VersionedFileManager)
+	if !ok {
+		return "", false
+	}
+
+	encrypted, err := newEncryptingReader(manager.Keys, file)
+	if err != nil {
+		logManager.LogPrintf("Unable to encrypt %v/%v %v\n", incident, fileName, err)
+		return "", false
+	}
+
+	return versioned.SaveFileVersion(incident, fileName, encrypted)
+}
+
+// GetFileVersion finds the version of a file kept by the underlying file manager.
+func (manager EncryptedFileManager) GetFileVersion(incident string, fileName string) (string, bool) {
+	if versioned, ok := manager.Store.(VersionedFileManager); ok {
+		return versioned.GetFileVersion(incident, fileName)
+	}
+
+	return "", false
+}
+
+// LoadFileVersion decrypts a version of a file as it is read.
+func (manager EncryptedFileManager) LoadFileVersion(incident string, fileName string, version string) (io.ReadSeeker, os.FileInfo, bool, func()) {
+	versioned, ok := manager.Store.(VersionedFileManager)
+	if !ok {
+		return nil, nil, false, nil
+	}
+
+	return manager.decrypt(versioned.LoadFileVersion(incident, fileName, version))
+}
+
+// DeleteFileVersion removes a version of a file.
+func (manager EncryptedFileManager) DeleteFileVersion(incident string, fileName string, version string) bool {
+	if versioned, ok := manager.Store.(VersionedFileManager); ok {
+		return versioned.DeleteFileVersion(incident, fileName, version)
+	}
+
+	return false
+}
+
+// ListFiles lists the files of the underlying file manager.
+func (manager EncryptedFileManager) ListFiles() ([]StoredFile, bool) {
+	if listable, ok := manager.Store.(ListableFileManager); ok {
+		return listable.ListFiles()
+	}
+
+	return nil, false
+}
+
+func (manager EncryptedFileManager) decrypt(file io.ReadSeeker, info os.FileInfo, found bool, closer func()) (io.ReadSeeker, os.FileInfo, bool, func()) {
+	if !found || file == nil {
+		return file, info, found, closer
+	}
+
+	decrypted, err := newDecryptingReader(manager.Keys, file)
+	if err == errNotEncrypted {
+		if _, err := file.Seek(0, io.SeekStart); err == nil {
+			return file, info, true, closer
+		}
+	}
+
+	if err != nil {
+		logManager.LogPrintf("Unable to decrypt file %v\n", err)
+		if closer != nil {
+			closer()
+		}
+
+		return nil, nil, false, nil
+	}
+
+	if info != nil {
+		info = decryptedFileInfo{info, decrypted.size}
+	}
+
+	return decrypted, info, true, closer
+}
+
+// RewrapFile wraps the data key of a file with the active master key.
+// Only the header of the file changes, but since files cannot be partly rewritten the whole file is staged and saved again.
+// Files that were saved before encryption was turned on are encrypted.
+func (manager EncryptedFileManager) RewrapFile(incident string, fileName string) (bool, error) {
+	file, _, found, closer := manager.Store.LoadFile(incident, fileName)
+	if closer != nil {
+		defer closer()
+	}
+
+	if !found || file == nil {
+		return false, os.ErrNotExist
+	}
+
+	header, err := readEncryptedHeader(file)
+	encrypted := err == nil
+	if encrypted && header.KeyId == manager.Keys.Active {
+		return false, nil
+	}
+
+	if err != nil && err != errNotEncrypted {
+		return false, err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	staged, err := os.CreateTemp("", "sona-rewrap-*")
+	if err != nil {
+		return false, err
+	}
+
+	defer os.Remove(staged.Name())
+	defer staged.Close()
+
+	if _, err := io.Copy(staged, file); err != nil {
+		return false, err
+	}
+
+	if _, err := staged.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	var content io.Reader
+	if !encrypted {
+		if content, err = newEncryptingReader(manager.Keys, staged); err != nil {
+			return false, err
+		}
+	} else {
+		dataKey, err := manager.Keys.unwrap(header.KeyId, header.WrappedKey)
+		if err != nil {
+			return false, err
+		}
+
+		rewrapped := header
+		rewrapped.KeyId = manager.Keys.Active
+		if rewrapped.WrappedKey, err = manager.Keys.wrap(dataKey); err != nil {
+			return false, err
+		}
+
+		if _, err := staged.Seek(header.size(), io.SeekStart); err != nil {
+			return false, err
+		}
+
+		content = io.MultiReader(bytes.NewReader(rewrapped.marshal()), staged)
+	}
+
+	if _, saved := manager.Store.SaveFile(incident, fileName, content); !saved {
+		return false, fmt.Errorf("unable to save %v/%v", incident, fileName)
+	}
+
+	return true, nil
+}
+
+// RewrapResult counts the files visited when rewrapping every attachment.
+type RewrapResult struct {
+	Rewrapped int `json:"rewrapped"` // Files rewrapped with the active key, or encrypted for the first time.
+	Skipped   int `json:"skipped"`   // Files already using the active key or that do not exist, like previews not created yet.
+	Failed    int `json:"failed"`    // Files that could not be rewrapped.
+}
+
+// rewrapAttachments rewraps every version and preview of every attachment with the active key.
+// Versions kept by the file manager itself, like S3 object versions, cannot be rewritten so they keep the key they were saved with.
+func rewrapAttachments(manager RewrappableFileManager) (RewrapResult, bool) {
+	var result RewrapResult
+	incidents, passed := incidentManager.GetIncidents(nil)
+	if !passed {
+		logManager.LogPrintln("Unable to get incidents to rewrap")
+		return result, false
+	}
+
+	for _, incident := range incidents {
+		attachments, _ := incidentManager.GetAttachments(int(incident.Id))
+		for _, attachment := range attachments {
+			for _, fileName := range getAttachmentFileNames(attachment) {
+				rewrapped, err := manager.RewrapFile(strconv.FormatInt(incident.Id, 10), fileName)
+				switch {
+				case errors.Is(err, os.ErrNotExist):
+					result.Skipped++
+				case err != nil:
+					logManager.LogPrintf("Unable to rewrap %v/%v %v\n", incident.Id, fileName, err)
+					result.Failed++
+				case rewrapped:
+					result.Rewrapped++
+				default:
+					result.Skipped++
+				}
+			}
+		}
+	}
+
+	return result, true
+}
+
+// getAttachmentFileNames returns the names of every file stored for an attachment.
+func getAttachmentFileNames(attachment Attachment) []string {
+	fileNames := make([]string, 0)
+	for _, version := range attachment.getVersions() {
+		if len(version.StorageVersion) == 0 {
+			fileNames = append(fileNames, attachment.getVersionKey(version))
+		}
+
+		fileNames = append(fileNames, previewGenerator.getPreviewNames(attachment, version)...)
+	}
+
+	return fileNames
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func createTestKeys(t *testing.T, active string, ids ...string) EncryptionKeys {
+	keys := make(map[string][]byte)
+	for _, id := range ids {
+		key := sha256.Sum256([]byte(id))
+		keys[id] = key[:]
+	}
+
+	encryptionKeys, err := NewEncryptionKeys(active, keys)
+	if err != nil {
+		t.Fatalf("Unable to create keys %v", err)
+	}
+
+	return encryptionKeys
+}
+
+func TestEncryptionKeysValidated(t *testing.T) {
+	if _, err := NewEncryptionKeys("missing", map[string][]byte{"a": make([]byte, 32)}); err == nil {
+		t.Errorf("Expected missing active key to fail")
+	}
+
+	if _, err := NewEncryptionKeys("a", map[string][]byte{"a": make([]byte, 16)}); err == nil {
+		t.Errorf("Expected short key to fail")
+	}
+}
+
+func TestEncryptedSaveAndLoad(t *testing.T) {
+	root := t.TempDir()
+	manager := EncryptedFileManager{LocalFileManager{root}, createTestKeys(t, "a", "a")}
+	content := strings.Repeat("a line of the log\n", 10000)
+
+	manager.SaveFile("0", "app.log", strings.NewReader(content))
+
+	stored, _ := os.ReadFile(filepath.Join(root, "incidents", "0", "app.log"))
+	if bytes.Contains(stored, []byte("a line of the log")) || !bytes.HasPrefix(stored, []byte(encryptedMagic)) {
+		t.Errorf("Expected file to be encrypted")
+	}
+
+	file, info, found, closer := manager.LoadFile("0", "app.log")
+	if !found {
+		t.Fatalf("Expected file to be found")
+	}
+
+	defer closer()
+	if info.Size() != int64(len(content)) {
+		t.Errorf("Expected size %v got %v", len(content), info.Size())
+	}
+
+	if data, _ := io.ReadAll(file); string(data) != content {
+		t.Errorf("Unexpected content of length %v", len(data))
+	}
+}
+
+func TestEncryptedEmptyFile(t *testing.T) {
+	manager := EncryptedFileManager{LocalFileManager{t.TempDir()}, createTestKeys(t, "a", "a")}
+	manager.SaveFile("0", "empty", strings.NewReader(""))
+
+	if content := readFile(t, manager, "0", "empty"); content != "" {
+		t.Errorf("Unexpected content %v", content)
+	}
+}
+
+func TestEncryptedSeek(t *testing.T) {
+	manager := EncryptedFileManager{LocalFileManager{t.TempDir()}, createTestKeys(t, "a", "a")}
+	content := strings.Repeat("0123456789", encryptedChunkSize/5)
+	manager.SaveFile("0", "a", strings.NewReader(content))
+
+	file, _, _, closer := manager.LoadFile("0", "a")
+	defer closer()
+
+	offset := int64(encryptedChunkSize - 3)
+	file.Seek(offset, io.SeekStart)
+	data := make([]byte, 10)
+	io.ReadFull(file, data)
+
+	if string(data) != content[offset:offset+10] {
+		t.Errorf("Expected %v got %v", content[offset:offset+10], string(data))
+	}
+
+	if end, _ := file.Seek(-4, io.SeekEnd); end != int64(len(content)-4) {
+		t.Errorf("Unexpected end %v", end)
+	}
+
+	if rest, _ := io.ReadAll(file); string(rest) != "6789" {
+		t.Errorf("Unexpected end of file %v", string(rest))
+	}
+}
+
+func TestEncryptedDetectsTampering(t *testing.T) {
+	root := t.TempDir()
+	manager := EncryptedFileManager{LocalFileManager{root}, createTestKeys(t, "a", "a")}
+	manager.SaveFile("0", "a", strings.NewReader(strings.Repeat("x", encryptedChunkSize*2)))
+	path := filepath.Join(root, "incidents", "0", "a")
+	stored, _ := os.ReadFile(path)
+
+	tampered := bytes.Clone(stored)
+	tampered[len(tampered)-20] ^= 1
+	os.WriteFile(path, tampered, 0600)
+
+	file, _, found, closer := manager.LoadFile("0", "a")
+	if !found {
+		t.Fatalf("Expected file to be found")
+	}
+
+	defer closer()
+	if _, err := io.ReadAll(file); err == nil {
+		t.Errorf("Expected tampered file to fail")
+	}
+
+	os.WriteFile(path, stored[:len(stored)-encryptedChunkSize-gcmTagSize], 0600)
+
+	if file, _, found, closer := manager.LoadFile("0", "a"); found {
+		defer closer()
+		if _, err := io.ReadAll(file); err == nil {
+			t.Errorf("Expected truncated file to fail")
+		}
+	}
+}
+
+func TestEncryptedLoadsFilesSavedBefore(t *testing.T) {
+	root := t.TempDir()
+	LocalFileManager{root}.SaveFile("0", "a", strings.NewReader("saved before encryption"))
+	manager := EncryptedFileManager{LocalFileManager{root}, createTestKeys(t, "a", "a")}
+
+	if content := readFile(t, manager, "0", "a"); content != "saved before encryption" {
+		t.Errorf("Unexpected content %v", content)
+	}
+}
+
+func TestEncryptedRewrap(t *testing.T) {
+	root := t.TempDir()
+	EncryptedFileManager{LocalFileManager{root}, createTestKeys(t, "old", "old")}.SaveFile("0", "a", strings.NewReader("rotate me"))
+	LocalFileManager{root}.SaveFile("0", "b", strings.NewReader("plaintext"))
+	manager := EncryptedFileManager{LocalFileManager{root}, createTestKeys(t, "new", "old", "new")}
+
+	for _, fileName := range []string{"a", "b"} {
+		if rewrapped, err := manager.RewrapFile("0", fileName); !rewrapped || err != nil {
+			t.Errorf("Expected %v to be rewrapped got %v", fileName, err)
+		}
+	}
+
+	if rewrapped, _ := manager.RewrapFile("0", "a"); rewrapped {
+		t.Errorf("Expected file to already use the active key")
+	}
+
+	retired := EncryptedFileManager{LocalFileManager{root}, createTestKeys(t, "new", "new")}
+	if content := readFile(t, retired, "0", "a"); content != "rotate me" {
+		t.Errorf("Unexpected content %v", content)
+	}
+
+	if content := readFile(t, retired, "0", "b"); content != "plaintext" {
+		t.Errorf("Unexpected content %v", content)
+	}
+
+	if stored, _ := os.ReadFile(filepath.Join(root, "incidents", "0", "b")); !bytes.HasPrefix(stored, []byte(encryptedMagic)) {
+		t.Errorf("Expected plaintext file to be encrypted")
+	}
+}
+
+func TestEncryptedDeduplicated(t *testing.T) {
+	root := t.TempDir()
+	encrypted := EncryptedFileManager{LocalFileManager{root}, createTestKeys(t, "old", "old")}
+	NewContentAddressedFileManager(encrypted).SaveFile("0", "a", strings.NewReader("same"))
+	manager := NewContentAddressedFileManager(EncryptedFileManager{LocalFileManager{root}, createTestKeys(t, "new", "old", "new")})
+	manager.SaveFile("1", "b", strings.NewReader("same"))
+
+	if rewrapped, err := manager.RewrapFile("0", "a"); !rewrapped || err != nil {
+		t.Errorf("Expected file to be rewrapped got %v", err)
+	}
+
+	retired := NewContentAddressedFileManager(EncryptedFileManager{LocalFileManager{root}, createTestKeys(t, "new", "new")})
+	if content := readFile(t, retired, "1", "b"); content != "same" {
+		t.Errorf("Unexpected content %v", content)
+	}
+}
+
+func TestDownloadEncryptedAttachmentRange(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	fileManager = EncryptedFileManager{LocalFileManager{t.TempDir()}, createTestKeys(t, "a", "a")}
+	attachment := readUploadedAttachment(t, uploadAttachment(token, "app.log", "0123456789"))
+
+	w := downloadAttachment(token, attachment.Id, map[string]string{"Range": "bytes=2-5"})
+
+	if w.Result().StatusCode != 206 || w.Body.String() != "2345" {
+		t.Errorf("Expected partial content got %v %v", w.Result(), w.Body)
+	}
+
+	if length := w.Header().Get("Content-Length"); length != "4" {
+		t.Errorf("Unexpected Content-Length %v", length)
+	}
+}
+
+func TestRewrapAttachmentsHandler(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.master)
+	root := t.TempDir()
+	fileManager = EncryptedFileManager{LocalFileManager{root}, createTestKeys(t, "old", "old")}
+	readUploadedAttachment(t, uploadAttachment(token, "app.log", "started"))
+	waitForBackgroundWork()
+	fileManager = EncryptedFileManager{LocalFileManager{root}, createTestKeys(t, "new", "old", "new")}
+
+	r, _ := http.NewRequest("POST", "/sona/v1/encryption/rewrap", nil)
+	r.Header.Set("X-Sona-Token", token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	var result RewrapResult
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil || w.Result().StatusCode != 200 {
+		t.Fatalf("Expected result got %v %v", w.Result(), err)
+	}
+
+	if result.Rewrapped != 2 || result.Failed != 0 {
+		t.Errorf("Expected attachment and preview to be rewrapped got %v", result)
+	}
+}
+
+func TestRewrapAttachmentsNotEncrypted(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.master)
+
+	r, _ := http.NewRequest("POST", "/sona/v1/encryption/rewrap", nil)
+	r.Header.Set("X-Sona-Token", token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 409 {
+		t.Errorf("Expected 409 status code got %v", w.Result())
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// HandleRewrapAttachments handles the rewrap attachments web request.
+// Every stored attachment is rewrapped with the active encryption key so older keys can be retired.
+func HandleRewrapAttachments(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got Rewrap Attachments request")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if !validateRequest(w, r, availablePermissions.master) {
+		return
+	}
+
+	manager, ok := fileManager.(RewrappableFileManager)
+	if deduplicated, isDeduplicated := fileManager.(ContentAddressedFileManager); isDeduplicated {
+		_, ok = deduplicated.Store.(RewrappableFileManager)
+	}
+
+	if !ok {
+		logManager.LogPrintln("Unable to rewrap attachments, encryption is not configured")
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	result, passed := rewrapAttachments(manager)
+	if !passed {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		panic(err)
+	}
+}
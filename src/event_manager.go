@@ -0,0 +1,92 @@
+package main
+
+import "sync"
+
+// IncidentEvent describes a change that has happened to an incident.
+// The Type is the kind of change (created, updated or attached).
+// The IncidentId is the incident that was changed.
+// The Incident is the incident that was created, if any.
+// The Update is the update that was applied, if any.
+// The Attachment is the attachment that was added, if any.
+type IncidentEvent struct {
+	Type       string          `json:"type"`
+	IncidentId int64           `json:"incidentId"`
+	Incident   *Incident       `json:"incident,omitempty"`
+	Update     *IncidentUpdate `json:"update,omitempty"`
+	Attachment *Attachment     `json:"attachment,omitempty"`
+}
+
+const (
+	incidentCreatedEvent  = "created"
+	incidentUpdatedEvent  = "updated"
+	incidentAttachedEvent = "attached"
+)
+
+// EventManager fans incident events out to in process subscribers.
+// Subscribers that are not keeping up will miss events instead of blocking publishers.
+// Listeners are called for every event and should return quickly.
+type EventManager struct {
+	lock        sync.Mutex
+	nextId      int
+	subscribers map[int]chan IncidentEvent
+	listeners   []func(IncidentEvent)
+}
+
+var eventManager = NewEventManager()
+
+// NewEventManager creates an EventManager with no subscribers.
+func NewEventManager() *EventManager {
+	return &EventManager{subscribers: make(map[int]chan IncidentEvent)}
+}
+
+// Subscribe registers a new subscriber.
+// The returned id should be passed to Unsubscribe once the subscriber is done.
+func (manager *EventManager) Subscribe() (int, <-chan IncidentEvent) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	id := manager.nextId
+	manager.nextId++
+
+	events := make(chan IncidentEvent, 16)
+	manager.subscribers[id] = events
+	return id, events
+}
+
+// Unsubscribe removes a subscriber and closes its channel.
+func (manager *EventManager) Unsubscribe(id int) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	if events, ok := manager.subscribers[id]; ok {
+		delete(manager.subscribers, id)
+		close(events)
+	}
+}
+
+// Listen registers a function to be called with every event.
+// Unlike subscribers listeners never miss an event.
+func (manager *EventManager) Listen(listener func(IncidentEvent)) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	manager.listeners = append(manager.listeners, listener)
+}
+
+// Publish sends an event to every listener and subscriber.
+func (manager *EventManager) Publish(event IncidentEvent) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	for _, listener := range manager.listeners {
+		listener(event)
+	}
+
+	for id, events := range manager.subscribers {
+		select {
+		case events <- event:
+		default:
+			logManager.LogPrintf("Dropping %v event for slow subscriber %v\n", event.Type, id)
+		}
+	}
+}
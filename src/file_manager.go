@@ -2,16 +2,133 @@ package main
 
 import (
 	"io"
-	"mime/multipart"
 	"os"
+	"strconv"
 )
 
 // FileManager defines a minimal implementation required for managing attachments.
 // SaveFile should attempt to save a file associated with an incident.
 // LoadFile should attempt to load a file given a filename and incident.
+// The file does not need to be read into memory or onto disk first, it can be streamed as it is read.
+// Seeking should be cheap since downloads seek to serve range requests.
 // DeleteFile should attempt to remove the file assoicated with an incident.
 type FileManager interface {
-	SaveFile(incident string, fileName string, file multipart.File) (string, bool)
+	SaveFile(incident string, fileName string, file io.Reader) (string, bool)
 	LoadFile(incident string, fileName string) (io.ReadSeeker, os.FileInfo, bool, func())
 	DeleteFile(incident string, fileName string) bool
 }
+
+// VersionedFileManager defines a file manager that can keep every version of a file saved under the same name.
+// SupportsVersions should report if versions are currently being kept.
+// SaveFileVersion should save a new version of a file and return the id of the version.
+// GetFileVersion should return the id of the current version of a file.
+// LoadFileVersion should attempt to load a version of a file given its id.
+// DeleteFileVersion should attempt to remove a version of a file.
+type VersionedFileManager interface {
+	FileManager
+	SupportsVersions() bool
+	SaveFileVersion(incident string, fileName string, file io.Reader) (string, bool)
+	GetFileVersion(incident string, fileName string) (string, bool)
+	LoadFileVersion(incident string, fileName string, version string) (io.ReadSeeker, os.FileInfo, bool, func())
+	DeleteFileVersion(incident string, fileName string, version string) bool
+}
+
+// PresignedFileManager defines a file manager that can let clients download files directly from where they are stored.
+// PresignFile should return a url that downloads a version of a file with the given Content-Disposition and Content-Type.
+// A false should be returned if downloads should go through sona server instead.
+type PresignedFileManager interface {
+	PresignFile(incident string, fileName string, version string, disposition string, contentType string) (string, bool)
+}
+
+// StoredFile names a file stored by a file manager.
+type StoredFile struct {
+	Incident string `json:"incident"`
+	FileName string `json:"filename"`
+}
+
+// ListableFileManager defines a file manager that can list every file it stores.
+// ListFiles should return the current name of every file, versions kept by the file manager are not listed.
+type ListableFileManager interface {
+	ListFiles() ([]StoredFile, bool)
+}
+
+// getVersionedFileManager returns the file manager if it is currently keeping versions.
+func getVersionedFileManager() (VersionedFileManager, bool) {
+	versioned, ok := fileManager.(VersionedFileManager)
+	if !ok || !versioned.SupportsVersions() {
+		return nil, false
+	}
+
+	return versioned, true
+}
+
+// loadAttachmentVersion loads the content of a version of an attachment.
+func loadAttachmentVersion(incidentId int64, attachment Attachment, version AttachmentVersion) (io.ReadSeeker, os.FileInfo, bool, func()) {
+	incident := strconv.FormatInt(incidentId, 10)
+	if versioned, ok := fileManager.(VersionedFileManager); ok && len(version.StorageVersion) > 0 {
+		return versioned.LoadFileVersion(incident, attachment.getId(), version.StorageVersion)
+	}
+
+	return fileManager.LoadFile(incident, attachment.getVersionKey(version))
+}
+
+// presignAttachmentVersion creates a url that downloads a version of an attachment directly from the file manager.
+func presignAttachmentVersion(incidentId int64, attachment Attachment, version AttachmentVersion) (string, bool) {
+	presigned, ok := fileManager.(PresignedFileManager)
+	if !ok {
+		return "", false
+	}
+
+	incident := strconv.FormatInt(incidentId, 10)
+	if _, isVersioned := fileManager.(VersionedFileManager); isVersioned && len(version.StorageVersion) > 0 {
+		return presigned.PresignFile(incident, attachment.getId(), version.StorageVersion, version.getContentDisposition(), version.ContentType)
+	}
+
+	return presigned.PresignFile(incident, attachment.getVersionKey(version), "", version.getContentDisposition(), version.ContentType)
+}
+
+// saveAttachmentVersion stores the content of a new version of an attachment.
+// When the file manager keeps versions the new version is saved under the attachment id.
+// Any version saved there before versions were kept is given its version id first, so it can still be found afterwards.
+func saveAttachmentVersion(incidentId int64, attachment *Attachment, version *AttachmentVersion, file io.Reader) bool {
+	incident := strconv.FormatInt(incidentId, 10)
+	versioned, ok := getVersionedFileManager()
+	if !ok {
+		_, saved := fileManager.SaveFile(incident, attachment.getVersionKey(*version), file)
+		return saved
+	}
+
+	unversioned := func(v AttachmentVersion) bool {
+		return len(v.StorageVersion) == 0 && attachment.getVersionKey(v) == attachment.getId()
+	}
+
+	if id, found := versioned.GetFileVersion(incident, attachment.getId()); found {
+		for i := range attachment.Versions {
+			if unversioned(attachment.Versions[i]) {
+				attachment.Versions[i].StorageVersion = id
+			}
+		}
+
+		if unversioned(attachment.getCurrentVersion()) {
+			attachment.StorageVersion = id
+		}
+	}
+
+	id, saved := versioned.SaveFileVersion(incident, attachment.getId(), file)
+	version.StorageVersion = id
+	return saved
+}
+
+// deleteAttachmentFiles removes the content of every version of an attachment.
+func deleteAttachmentFiles(incidentId int64, attachment Attachment) {
+	incident := strconv.FormatInt(incidentId, 10)
+	versioned, isVersioned := fileManager.(VersionedFileManager)
+	for _, version := range attachment.getVersions() {
+		if isVersioned && len(version.StorageVersion) > 0 {
+			versioned.DeleteFileVersion(incident, attachment.getId(), version.StorageVersion)
+			continue
+		}
+
+		fileManager.DeleteFile(incident, attachment.getVersionKey(version))
+	}
+}
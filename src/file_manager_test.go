@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// FakeVersionedFileManager keeps every version of a file in memory in the same way a versioned s3 bucket does.
+// The versions are read by the search indexer in the background so they are locked.
+type FakeVersionedFileManager struct {
+	lock     *sync.Mutex
+	versions map[string][]string
+}
+
+func (manager FakeVersionedFileManager) SaveFile(incident string, fileName string, file io.Reader) (string, bool) {
+	manager.SaveFileVersion(incident, fileName, file)
+	return fileName, true
+}
+
+func (manager FakeVersionedFileManager) LoadFile(incident string, fileName string) (io.ReadSeeker, os.FileInfo, bool, func()) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	versions := manager.versions[incident+"/"+fileName]
+	if len(versions) == 0 {
+		return nil, nil, false, nil
+	}
+
+	return strings.NewReader(versions[len(versions)-1]), nil, true, func() {}
+}
+
+func (manager FakeVersionedFileManager) DeleteFile(incident string, fileName string) bool {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	delete(manager.versions, incident+"/"+fileName)
+	return true
+}
+
+func (manager FakeVersionedFileManager) SupportsVersions() bool {
+	return true
+}
+
+func (manager FakeVersionedFileManager) SaveFileVersion(incident string, fileName string, file io.Reader) (string, bool) {
+	var content bytes.Buffer
+	io.Copy(&content, file)
+
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	key := incident + "/" + fileName
+	manager.versions[key] = append(manager.versions[key], content.String())
+	return strconv.Itoa(len(manager.versions[key]) - 1), true
+}
+
+func (manager FakeVersionedFileManager) GetFileVersion(incident string, fileName string) (string, bool) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	versions := manager.versions[incident+"/"+fileName]
+	if len(versions) == 0 {
+		return "", false
+	}
+
+	return strconv.Itoa(len(versions) - 1), true
+}
+
+func (manager FakeVersionedFileManager) LoadFileVersion(incident string, fileName string, version string) (io.ReadSeeker, os.FileInfo, bool, func()) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	index, err := strconv.Atoi(version)
+	versions := manager.versions[incident+"/"+fileName]
+	if err != nil || index >= len(versions) {
+		return nil, nil, false, nil
+	}
+
+	return strings.NewReader(versions[index]), nil, true, func() {}
+}
+
+func (manager FakeVersionedFileManager) DeleteFileVersion(incident string, fileName string, version string) bool {
+	return true
+}
+
+func readAttachmentVersion(t *testing.T, attachment Attachment, version AttachmentVersion) string {
+	file, _, found, closer := loadAttachmentVersion(0, attachment, version)
+	if !found {
+		t.Fatalf("Expected version %v to be found", version.Version)
+	}
+	defer closer()
+
+	content, _ := io.ReadAll(file)
+	return string(content)
+}
+
+func TestSaveAttachmentVersionWithVersionedFileManager(t *testing.T) {
+	setup()
+	fileManager = FakeVersionedFileManager{&sync.Mutex{}, make(map[string][]string)}
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
+	attachment, _ := attachFile(0, "app.log", strings.NewReader("first"), "", 0)
+	attachment, _ = attachFileVersion(0, attachment, "app.log", strings.NewReader("second"), "", 0)
+	attachment, _ = attachFileVersion(0, attachment, "app.log", strings.NewReader("third"), "", 0)
+
+	expected := []string{"first", "second", "third"}
+	for i, version := range attachment.getVersions() {
+		if len(version.StorageVersion) == 0 {
+			t.Errorf("Expected version %v to have a storage version", version.Version)
+		}
+
+		if attachment.getVersionKey(version) != attachment.Id {
+			t.Errorf("Expected version %v to be stored under the attachment id", version.Version)
+		}
+
+		if content := readAttachmentVersion(t, attachment, version); content != expected[i] {
+			t.Errorf("Expected %v for version %v got %v", expected[i], version.Version, content)
+		}
+	}
+}
+
+func TestSaveAttachmentVersionWithoutVersionedFileManager(t *testing.T) {
+	setup()
+	fileManager = LocalFileManager{t.TempDir()}
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
+	attachment, _ := attachFile(0, "app.log", strings.NewReader("first"), "", 0)
+	attachment, _ = attachFileVersion(0, attachment, "app.log", strings.NewReader("second"), "", 0)
+
+	versions := attachment.getVersions()
+	if attachment.getVersionKey(versions[0]) != attachment.Id || attachment.getVersionKey(versions[1]) != attachment.Id+".v2" {
+		t.Errorf("Unexpected version paths %v", versions)
+	}
+
+	if content := readAttachmentVersion(t, attachment, versions[0]); content != "first" {
+		t.Errorf("Expected first version got %v", content)
+	}
+}
+
+// testFileManager saves, reads, replaces and deletes a file in a file manager.
+func testFileManager(t *testing.T, manager FileManager) {
+	incident := strconv.FormatInt(time.Now().UnixNano(), 10)
+	if _, saved := manager.SaveFile(incident, "app.log", strings.NewReader("hello world")); !saved {
+		t.Fatalf("Expected file to be saved")
+	}
+
+	file, info, found, closer := manager.LoadFile(incident, "app.log")
+	if !found {
+		t.Fatalf("Expected file to be found")
+	}
+
+	if info.Size() != 11 {
+		t.Errorf("Expected size 11 got %v", info.Size())
+	}
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("Range", "bytes=6-")
+	w := httptest.NewRecorder()
+	http.ServeContent(w, r, "app.log", info.ModTime(), file)
+	closer()
+
+	if w.Result().StatusCode != 206 || w.Body.String() != "world" {
+		t.Errorf("Expected partial content got %v %v", w.Result().StatusCode, w.Body.String())
+	}
+
+	manager.SaveFile(incident, "app.log", strings.NewReader("replaced"))
+	if content := readFile(t, manager, incident, "app.log"); content != "replaced" {
+		t.Errorf("Expected replaced content got %v", content)
+	}
+
+	if !manager.DeleteFile(incident, "app.log") {
+		t.Errorf("Expected file to be deleted")
+	}
+
+	if _, _, found, _ := manager.LoadFile(incident, "app.log"); found {
+		t.Errorf("Expected deleted file to not be found")
+	}
+}
+
+func TestLocalFileManager(t *testing.T) {
+	testFileManager(t, LocalFileManager{t.TempDir()})
+}
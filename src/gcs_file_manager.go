@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// GCSFileManager provides the ability to store attachments in Google Cloud Storage.
+// When STORAGE_EMULATOR_HOST is set the emulator it names, like fake-gcs-server, is used instead.
+type GCSFileManager struct {
+	ProjectName string // The project to create the bucket in if it does not exist.
+	Bucket      string // The bucket to store objects in.
+	AuthFile    string // The service account json file to authenticate with, if empty the default credentials are used.
+	client      *storage.Client
+}
+
+// Initialize will setup Google Cloud Storage. This will make sure the bucket can be connected to.
+// This will also create the configured bucket if it does not already exist.
+func (manager *GCSFileManager) Initialize() {
+	options := make([]option.ClientOption, 0)
+	if len(manager.AuthFile) > 0 {
+		options = append(options, option.WithCredentialsFile(manager.AuthFile))
+	}
+
+	client, err := storage.NewClient(context.Background(), options...)
+	if err != nil {
+		logManager.LogPrintf("Unable to create google cloud storage client %v\n", err)
+		panic(err)
+	}
+
+	manager.client = client
+	bucket := client.Bucket(manager.Bucket)
+	if _, err := bucket.Attrs(context.Background()); err == nil {
+		logManager.LogPrintf("Bucket %v exists starting google cloud storage file manager\n", manager.Bucket)
+		return
+	} else if !errors.Is(err, storage.ErrBucketNotExist) {
+		logManager.LogPrintf("Unable to find bucket %v. Error %v\n", manager.Bucket, err)
+		panic(err)
+	}
+
+	if err := bucket.Create(context.Background(), manager.ProjectName, nil); err != nil {
+		logManager.LogPrintf("Unable to create bucket %v. Error %v\n", manager.Bucket, err)
+		panic(err)
+	}
+
+	logManager.LogPrintf("Created bucket %v\n", manager.Bucket)
+}
+
+func (manager *GCSFileManager) object(incident string, fileName string) *storage.ObjectHandle {
+	return manager.client.Bucket(manager.Bucket).Object(incident + "/" + fileName)
+}
+
+// SaveFile will attempt to save an attachment to the configured bucket.
+// If the attempt fails a false will be returned.
+func (manager *GCSFileManager) SaveFile(incident string, fileName string, file io.Reader) (string, bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Cancelling the context before closing the writer stops a failed upload from replacing the object.
+	writer := manager.object(incident, fileName).NewWriter(ctx)
+	if _, err := io.Copy(writer, file); err != nil {
+		logManager.LogPrintf("Unable to save object in google cloud storage %v\n", err)
+		cancel()
+		writer.Close()
+		return "", false
+	}
+
+	if err := writer.Close(); err != nil {
+		logManager.LogPrintf("Unable to save object in google cloud storage %v\n", err)
+		return "", false
+	}
+
+	return "gs://" + manager.Bucket + "/" + incident + "/" + fileName, true
+}
+
+// LoadFile will attempt to load an attachment out of the configured bucket.
+// The object is streamed as it is read. If the file cannot be returned a false will be returned.
+func (manager *GCSFileManager) LoadFile(incident string, fileName string) (io.ReadSeeker, os.FileInfo, bool, func()) {
+	attrs, err := manager.object(incident, fileName).Attrs(context.Background())
+	if err != nil {
+		logManager.LogPrintf("Unable to find object in google cloud storage %v\n", err)
+		return nil, nil, false, nil
+	}
+
+	// Reading the generation that was found means a replaced object fails the read rather than mixing content.
+	handle := manager.object(incident, fileName).Generation(attrs.Generation)
+	object := &rangedObject{
+		open: func(offset int64) (io.ReadCloser, error) {
+			return handle.NewRangeReader(context.Background(), offset, -1)
+		},
+		size: attrs.Size,
+	}
+
+	info := objectFileInfo{fileName, attrs.Size, attrs.Updated}
+	return object, info, true, object.close
+}
+
+// DeleteFile should attempt to remove the file assoicated with an incident.
+func (manager *GCSFileManager) DeleteFile(incident string, fileName string) bool {
+	if err := manager.object(incident, fileName).Delete(context.Background()); err != nil {
+		logManager.LogPrintf("Error deleting object in google cloud storage %v\n", err)
+		return false
+	}
+
+	logManager.LogPrintln("Deleted object in google cloud storage")
+	return true
+}
+
+// ListFiles will list every object in the configured bucket.
+func (manager *GCSFileManager) ListFiles() ([]StoredFile, bool) {
+	files := make([]StoredFile, 0)
+	objects := manager.client.Bucket(manager.Bucket).Objects(context.Background(), nil)
+	for {
+		attrs, err := objects.Next()
+		if err == iterator.Done {
+			return files, true
+		}
+
+		if err != nil {
+			logManager.LogPrintf("Unable to list objects in google cloud storage %v\n", err)
+			return nil, false
+		}
+
+		if file, ok := parseStoredFileKey(attrs.Name); ok {
+			files = append(files, file)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestGCSFileManager runs against a google cloud storage emulator like fake-gcs-server.
+// Start one with fake-gcs-server -scheme http -port 4443 -public-host localhost:4443 and set STORAGE_EMULATOR_HOST=localhost:4443.
+func TestGCSFileManager(t *testing.T) {
+	if len(os.Getenv("STORAGE_EMULATOR_HOST")) == 0 {
+		t.Skip("STORAGE_EMULATOR_HOST is not set")
+	}
+
+	manager := &GCSFileManager{ProjectName: "sona", Bucket: "sona-test"}
+	manager.Initialize()
+	testFileManager(t, manager)
+}
@@ -0,0 +1,804 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	b64 "encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+type graphQLContextKey string
+
+const graphQLPrincipalKey graphQLContextKey = "principal"
+
+// GraphQLRequest defines a graphql operation sent to the graphql endpoint.
+type GraphQLRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+var attributeType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Attribute",
+	Fields: graphql.Fields{
+		"key":   &graphql.Field{Type: graphql.String},
+		"value": &graphql.Field{Type: graphql.String},
+	},
+})
+
+var attachmentType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Attachment",
+	Fields: graphql.Fields{
+		"id": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(Attachment).getId(), nil
+			},
+		},
+		"filename": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(Attachment).FileName, nil
+			},
+		},
+		"time": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(Attachment).Time, nil
+			},
+		},
+		"size": &graphql.Field{
+			Type: graphql.Float,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(Attachment).Size, nil
+			},
+		},
+		"contentType": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(Attachment).ContentType, nil
+			},
+		},
+		"sha256": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(Attachment).Checksum, nil
+			},
+		},
+		"uploaderId": &graphql.Field{
+			Type: graphql.Int,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(Attachment).UploaderId, nil
+			},
+		},
+		"serviceAccountId": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(Attachment).ServiceAccountId, nil
+			},
+		},
+		"version": &graphql.Field{
+			Type: graphql.Int,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(Attachment).getVersion(), nil
+			},
+		},
+		"scanStatus": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(Attachment).ScanStatus, nil
+			},
+		},
+		"scanSignature": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(Attachment).ScanSignature, nil
+			},
+		},
+	},
+})
+
+var incidentUsageType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "IncidentUsage",
+	Fields: graphql.Fields{
+		"files": &graphql.Field{
+			Type: graphql.Int,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(IncidentUsage).Files, nil
+			},
+		},
+		"bytes": &graphql.Field{
+			Type: graphql.Float,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(IncidentUsage).Bytes, nil
+			},
+		},
+		"maxBytes": &graphql.Field{
+			Type: graphql.Float,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(IncidentUsage).MaxBytes, nil
+			},
+		},
+	},
+})
+
+var userType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "User",
+	Fields: graphql.Fields{
+		"id": &graphql.Field{
+			Type: graphql.Int,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(User).Id, nil
+			},
+		},
+		"userName": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(User).UserName, nil
+			},
+		},
+		"firstName": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(User).FirstName, nil
+			},
+		},
+		"lastName": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(User).LastName, nil
+			},
+		},
+		"gender": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(User).Gender, nil
+			},
+		},
+		"emailAddress": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				user := p.Source.(User)
+				if !canViewUser(p, user.Id) {
+					return nil, nil
+				}
+
+				return user.EmailAddress, nil
+			},
+		},
+		"permissions": &graphql.Field{
+			Type: graphql.NewList(graphql.String),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				user := p.Source.(User)
+				if !canViewUser(p, user.Id) {
+					return nil, nil
+				}
+
+				return user.Permissions, nil
+			},
+		},
+	},
+})
+
+var incidentType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Incident",
+	Fields: graphql.Fields{
+		"id": &graphql.Field{
+			Type: graphql.Int,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(Incident).Id, nil
+			},
+		},
+		"type": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(Incident).Type, nil
+			},
+		},
+		"description": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(Incident).Description, nil
+			},
+		},
+		"reporter": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(Incident).Reporter, nil
+			},
+		},
+		"state": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(Incident).State, nil
+			},
+		},
+		"attributes": &graphql.Field{
+			Type: graphql.NewList(attributeType),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return convertToGraphQLAttributes(p.Source.(Incident).Attributes), nil
+			},
+		},
+		"attribute": &graphql.Field{
+			Type: graphql.String,
+			Args: graphql.FieldConfigArgument{
+				"name": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				if val, ok := p.Source.(Incident).Attributes[p.Args["name"].(string)]; ok {
+					return val, nil
+				}
+
+				return nil, nil
+			},
+		},
+		"attachments": &graphql.Field{
+			Type: graphql.NewList(attachmentType),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				attachments, ok := incidentManager.GetAttachments(int(p.Source.(Incident).Id))
+				if !ok {
+					return nil, fmt.Errorf("unable to get attachments")
+				}
+
+				return attachments, nil
+			},
+		},
+		"attachmentUsage": &graphql.Field{
+			Type: incidentUsageType,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return getIncidentUsage(int(p.Source.(Incident).Id)), nil
+			},
+		},
+		"assignee": &graphql.Field{
+			Type:    userType,
+			Resolve: resolveAssignee,
+		},
+	},
+})
+
+var incidentEventType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "IncidentEvent",
+	Fields: graphql.Fields{
+		"type": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(IncidentEvent).Type, nil
+			},
+		},
+		"incidentId": &graphql.Field{
+			Type: graphql.Int,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(IncidentEvent).IncidentId, nil
+			},
+		},
+		"incident": &graphql.Field{
+			Type: incidentType,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				if inc, ok := incidentManager.GetIncident(int(p.Source.(IncidentEvent).IncidentId)); ok {
+					return inc, nil
+				}
+
+				return nil, nil
+			},
+		},
+		"attachment": &graphql.Field{
+			Type: attachmentType,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				if attachment := p.Source.(IncidentEvent).Attachment; attachment != nil {
+					return *attachment, nil
+				}
+
+				return nil, nil
+			},
+		},
+	},
+})
+
+var attributeInputType = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name: "AttributeInput",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"key":   &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		"value": &graphql.InputObjectFieldConfig{Type: graphql.String},
+	},
+})
+
+var filterInputType = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name: "FilterInput",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"property":   &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		"comparison": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		"value":      &graphql.InputObjectFieldConfig{Type: graphql.String},
+	},
+})
+
+var graphQLSchema graphql.Schema
+
+func init() {
+	var complexFilterInputType *graphql.InputObject
+	complexFilterInputType = graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "ComplexFilterInput",
+		Fields: graphql.InputObjectConfigFieldMapThunk(func() graphql.InputObjectConfigFieldMap {
+			return graphql.InputObjectConfigFieldMap{
+				"children": &graphql.InputObjectFieldConfig{Type: graphql.NewList(complexFilterInputType)},
+				"filters":  &graphql.InputObjectFieldConfig{Type: graphql.NewList(filterInputType)},
+				"junction": &graphql.InputObjectFieldConfig{Type: graphql.String},
+			}
+		}),
+	})
+
+	filterRequestInputType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "FilterRequestInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"complexfilters": &graphql.InputObjectFieldConfig{Type: graphql.NewList(complexFilterInputType)},
+			"union":          &graphql.InputObjectFieldConfig{Type: graphql.String},
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"incident": &graphql.Field{
+				Type: incidentType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+				},
+				Resolve: resolveIncident,
+			},
+			"incidents": &graphql.Field{
+				Type: graphql.NewList(incidentType),
+				Args: graphql.FieldConfigArgument{
+					"filter": &graphql.ArgumentConfig{Type: filterRequestInputType},
+				},
+				Resolve: resolveIncidents,
+			},
+			"user": &graphql.Field{
+				Type: userType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+				},
+				Resolve: resolveUser,
+			},
+		},
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createIncident": &graphql.Field{
+				Type: incidentType,
+				Args: graphql.FieldConfigArgument{
+					"description": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"reporter":    &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"attributes":  &graphql.ArgumentConfig{Type: graphql.NewList(attributeInputType)},
+				},
+				Resolve: resolveCreateIncident,
+			},
+			"updateIncident": &graphql.Field{
+				Type: incidentType,
+				Args: graphql.FieldConfigArgument{
+					"id":          &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+					"state":       &graphql.ArgumentConfig{Type: graphql.String},
+					"description": &graphql.ArgumentConfig{Type: graphql.String},
+					"reporter":    &graphql.ArgumentConfig{Type: graphql.String},
+					"attributes":  &graphql.ArgumentConfig{Type: graphql.NewList(attributeInputType)},
+				},
+				Resolve: resolveUpdateIncident,
+			},
+			"attach": &graphql.Field{
+				Type: attachmentType,
+				Args: graphql.FieldConfigArgument{
+					"incidentId":  &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+					"filename":    &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"content":     &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"contentType": &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Resolve: resolveAttach,
+			},
+		},
+	})
+
+	subscription := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Subscription",
+		Fields: graphql.Fields{
+			"incidentEvents": &graphql.Field{
+				Type: incidentEventType,
+				Args: graphql.FieldConfigArgument{
+					"incidentId": &graphql.ArgumentConfig{Type: graphql.Int},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source, nil
+				},
+				Subscribe: subscribeIncidentEvents,
+			},
+		},
+	})
+
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query:        query,
+		Mutation:     mutation,
+		Subscription: subscription,
+	})
+
+	if err != nil {
+		panic(err)
+	}
+
+	graphQLSchema = schema
+}
+
+func getGraphQLPrincipal(p graphql.ResolveParams) Principal {
+	if principal, ok := p.Context.Value(graphQLPrincipalKey).(Principal); ok {
+		return principal
+	}
+
+	return Principal{UserId: -1}
+}
+
+func requireGraphQLPermission(p graphql.ResolveParams, permission string) error {
+	if !getGraphQLPrincipal(p).hasPermission(permission) {
+		return fmt.Errorf("%v permission is required", permission)
+	}
+
+	return nil
+}
+
+func canViewUser(p graphql.ResolveParams, userId int64) bool {
+	principal := getGraphQLPrincipal(p)
+	return principal.hasPermission(availablePermissions.viewUser) || principal.isUser(userId)
+}
+
+func resolveIncident(p graphql.ResolveParams) (interface{}, error) {
+	if err := requireGraphQLPermission(p, availablePermissions.viewIncident); err != nil {
+		return nil, err
+	}
+
+	if inc, ok := incidentManager.GetIncident(p.Args["id"].(int)); ok {
+		return inc, nil
+	}
+
+	return nil, nil
+}
+
+func resolveIncidents(p graphql.ResolveParams) (interface{}, error) {
+	if err := requireGraphQLPermission(p, availablePermissions.viewIncident); err != nil {
+		return nil, err
+	}
+
+	var filter *FilterRequest
+	if arg, ok := p.Args["filter"]; ok && arg != nil {
+		data, err := json.Marshal(arg)
+		if err != nil {
+			return nil, err
+		}
+
+		filter = new(FilterRequest)
+		if err := json.Unmarshal(data, filter); err != nil {
+			return nil, err
+		}
+	}
+
+	incidents, ok := incidentManager.GetIncidents(filter)
+	if !ok {
+		return nil, fmt.Errorf("unable to get incidents")
+	}
+
+	return incidents, nil
+}
+
+func resolveUser(p graphql.ResolveParams) (interface{}, error) {
+	userId := int64(p.Args["id"].(int))
+	if !canViewUser(p, userId) {
+		return nil, fmt.Errorf("%v permission is required", availablePermissions.viewUser)
+	}
+
+	if user, ok := userManager.GetUser(userId); ok {
+		return user, nil
+	}
+
+	return nil, nil
+}
+
+// resolveAssignee looks up the user referenced by the incidents assignee attribute.
+// The attribute can either be a user id or an email address.
+func resolveAssignee(p graphql.ResolveParams) (interface{}, error) {
+	assignee, ok := p.Source.(Incident).Attributes["assignee"]
+	if !ok || len(assignee) == 0 {
+		return nil, nil
+	}
+
+	var (
+		user  User
+		found bool
+	)
+
+	if userId, err := strconv.ParseInt(assignee, 10, 64); err == nil {
+		user, found = userManager.GetUser(userId)
+	} else {
+		user, found = userManager.GetUserByEmail(assignee)
+	}
+
+	if !found {
+		return nil, nil
+	}
+
+	return user, nil
+}
+
+func resolveCreateIncident(p graphql.ResolveParams) (interface{}, error) {
+	if err := requireGraphQLPermission(p, availablePermissions.createIncident); err != nil {
+		return nil, err
+	}
+
+	incident := Incident{
+		Description: p.Args["description"].(string),
+		Reporter:    p.Args["reporter"].(string),
+		Attributes:  convertFromGraphQLAttributes(p.Args["attributes"]),
+	}
+
+	if !createIncident(&incident) {
+		return nil, fmt.Errorf("unable to create incident")
+	}
+
+	return incident, nil
+}
+
+func resolveUpdateIncident(p graphql.ResolveParams) (interface{}, error) {
+	if err := requireGraphQLPermission(p, availablePermissions.modifyIncident); err != nil {
+		return nil, err
+	}
+
+	incidentId := p.Args["id"].(int)
+	update := IncidentUpdate{}
+
+	if state, ok := p.Args["state"].(string); ok {
+		update.State = state
+	}
+	if description, ok := p.Args["description"].(string); ok {
+		update.Description = description
+	}
+	if reporter, ok := p.Args["reporter"].(string); ok {
+		update.Reporter = reporter
+	}
+	if attributes, ok := p.Args["attributes"]; ok {
+		update.Attributes = convertFromGraphQLAttributes(attributes)
+	}
+
+	if checkIncidentUpdate(incidentId, update) == http.StatusConflict {
+		return nil, fmt.Errorf("incident %v cannot move to state %v", incidentId, update.State)
+	}
+
+	if !applyIncidentUpdate(incidentId, update) {
+		return nil, fmt.Errorf("incident %v not found", incidentId)
+	}
+
+	inc, _ := incidentManager.GetIncident(incidentId)
+	return inc, nil
+}
+
+func resolveAttach(p graphql.ResolveParams) (interface{}, error) {
+	if err := requireGraphQLPermission(p, availablePermissions.modifyIncident); err != nil {
+		return nil, err
+	}
+
+	incidentId := p.Args["incidentId"].(int)
+	if _, ok := incidentManager.GetIncident(incidentId); !ok {
+		return nil, fmt.Errorf("incident %v not found", incidentId)
+	}
+
+	content, err := b64.StdEncoding.DecodeString(p.Args["content"].(string))
+	if err != nil {
+		return nil, fmt.Errorf("content must be base64 encoded")
+	}
+
+	contentType, _ := p.Args["contentType"].(string)
+	attach, problem, ok := attachUpload(incidentId, p.Args["filename"].(string), bytes.NewReader(content), contentType, getGraphQLPrincipal(p))
+	if problem != nil {
+		return nil, fmt.Errorf("%v", problem.Detail)
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("unable to attach file")
+	}
+
+	return attach, nil
+}
+
+func subscribeIncidentEvents(p graphql.ResolveParams) (interface{}, error) {
+	if err := requireGraphQLPermission(p, availablePermissions.viewIncident); err != nil {
+		return nil, err
+	}
+
+	incidentId, filtered := p.Args["incidentId"].(int)
+	id, events := eventManager.Subscribe()
+	results := make(chan interface{})
+
+	go func() {
+		defer close(results)
+		defer eventManager.Unsubscribe(id)
+
+		for {
+			select {
+			case <-p.Context.Done():
+				return
+			case event := <-events:
+				if filtered && event.IncidentId != int64(incidentId) {
+					continue
+				}
+
+				select {
+				case results <- event:
+				case <-p.Context.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return results, nil
+}
+
+func convertToGraphQLAttributes(attributes map[string]string) []map[string]string {
+	retVal := make([]map[string]string, 0, len(attributes))
+	for k, v := range attributes {
+		retVal = append(retVal, map[string]string{"key": k, "value": v})
+	}
+
+	return retVal
+}
+
+func convertFromGraphQLAttributes(arg interface{}) map[string]string {
+	attributes, ok := arg.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	retVal := make(map[string]string, len(attributes))
+	for _, v := range attributes {
+		attribute := v.(map[string]interface{})
+		value, _ := attribute["value"].(string)
+		retVal[attribute["key"].(string)] = value
+	}
+
+	return retVal
+}
+
+// HandleGraphQL handles graphql queries, mutations and subscriptions.
+// Subscriptions are streamed as server sent events when the client accepts text/event-stream.
+func HandleGraphQL(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got GraphQL request")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	principal, valid := authenticateRequest(w, r)
+	if !valid {
+		return
+	}
+
+	req, passed := convertGraphQLRequest(r)
+	if !passed || len(req.Query) == 0 {
+		logManager.LogPrintln("Invalid GraphQL request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodGet && getGraphQLOperation(req) != ast.OperationTypeQuery {
+		logManager.LogPrintln("Only queries can be run using GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := graphql.Params{
+		Schema:         graphQLSchema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        context.WithValue(r.Context(), graphQLPrincipalKey, principal),
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		streamGraphQLSubscription(w, params)
+		return
+	}
+
+	result := graphql.Do(params)
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		panic(err)
+	}
+}
+
+func streamGraphQLSubscription(w http.ResponseWriter, params graphql.Params) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		logManager.LogPrintln("Streaming is not supported by the response writer")
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for result := range graphql.Subscribe(params) {
+		data, err := json.Marshal(result)
+		if err != nil {
+			logManager.LogPrintf("Unable to encode subscription result %v\n", err)
+			continue
+		}
+
+		fmt.Fprintf(w, "event: next\ndata: %s\n\n", data)
+		flusher.Flush()
+	}
+
+	fmt.Fprint(w, "event: complete\ndata:\n\n")
+	flusher.Flush()
+}
+
+func convertGraphQLRequest(r *http.Request) (GraphQLRequest, bool) {
+	var req GraphQLRequest
+
+	if r.Method == http.MethodGet {
+		query := r.URL.Query()
+		req.Query = query.Get("query")
+		req.OperationName = query.Get("operationName")
+
+		if variables := query.Get("variables"); len(variables) > 0 {
+			if err := json.Unmarshal([]byte(variables), &req.Variables); err != nil {
+				logManager.LogPrintf("Unable to unmarshal variables: %v\n", err)
+				return req, false
+			}
+		}
+
+		return req, true
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logManager.LogPrintf("Got error when attempting to decode body %v", err)
+		return req, false
+	}
+
+	return req, true
+}
+
+// getGraphQLOperation finds the type of the operation a request will run.
+// An empty string is returned if the query cannot be parsed or the operation cannot be found.
+func getGraphQLOperation(req GraphQLRequest) string {
+	doc, err := parser.Parse(parser.ParseParams{Source: req.Query})
+	if err != nil {
+		return ""
+	}
+
+	operation := ""
+	for _, definition := range doc.Definitions {
+		op, ok := definition.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+
+		if len(req.OperationName) == 0 {
+			if len(operation) > 0 {
+				return ""
+			}
+
+			operation = op.Operation
+			continue
+		}
+
+		if op.Name != nil && op.Name.Value == req.OperationName {
+			return op.Operation
+		}
+	}
+
+	return operation
+}
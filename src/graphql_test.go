@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+type graphQLTestResult struct {
+	Data   map[string]interface{}   `json:"data"`
+	Errors []map[string]interface{} `json:"errors"`
+}
+
+func runGraphQL(t *testing.T, token string, query string) graphQLTestResult {
+	body, _ := json.Marshal(GraphQLRequest{Query: query})
+
+	r, _ := http.NewRequest("POST", "/sona/v1/graphql", bytes.NewBuffer(body))
+	r.Header.Set("X-Sona-Token", token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 200 {
+		t.Fatalf("Expected 200 status code got %v", w.Result())
+	}
+
+	var retVal graphQLTestResult
+	if err := json.Unmarshal(w.Body.Bytes(), &retVal); err != nil {
+		t.Fatalf("Failed to convert response %v error %v", w.Body, err)
+	}
+
+	return retVal
+}
+
+func TestGraphQLWithInvalidToken(t *testing.T) {
+	setup()
+	body, _ := json.Marshal(GraphQLRequest{Query: "{ incidents { id } }"})
+
+	r, _ := http.NewRequest("POST", "/sona/v1/graphql", bytes.NewBuffer(body))
+	r.Header.Set("X-Sona-Token", "badToken")
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 403 {
+		t.Errorf("Expected 403 status code got %v", w.Result())
+	}
+}
+
+func TestGraphQLGetOnlyRunsQueries(t *testing.T) {
+	setup()
+	user1.Permissions = append(user1.Permissions, availablePermissions.viewIncident, availablePermissions.createIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	_, token := user1.Authenticate("1234")
+
+	requests := map[string]int{
+		"{ incidents { id } }": 200,
+		`mutation { createIncident(description: "Test", reporter: "Tester") { id } }`:                                        405,
+		`query Find { incidents { id } } mutation Create { createIncident(description: "Test", reporter: "Tester") { id } }`: 405,
+	}
+
+	for query, status := range requests {
+		r, _ := http.NewRequest("GET", "/sona/v1/graphql?query="+url.QueryEscape(query), nil)
+		r.Header.Set("X-Sona-Token", token.Token)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, r)
+
+		if w.Result().StatusCode != status {
+			t.Errorf("Expected %v status code for %v got %v", status, query, w.Result())
+		}
+	}
+
+	incidents, _ := incidentManager.GetIncidents(&FilterRequest{})
+	if len(incidents) != 0 {
+		t.Errorf("Expected no incidents to be created got %v", incidents)
+	}
+}
+
+func TestGraphQLIncidentsWithFilter(t *testing.T) {
+	setup()
+	user1.Permissions = append(user1.Permissions, availablePermissions.viewIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
+	incidentManager.AddIncident(&Incident{"Incident", 1, "Other", "Tester", "closed", make(map[string]string, 0)})
+	incidentManager.AddAttachment(0, Attachment{FileName: "testfile.png", Time: "2009-11-10T23:00:00Z"})
+	_, token := user1.Authenticate("1234")
+
+	result := runGraphQL(t, token.Token, `{
+		incidents(filter: {complexfilters: [{filters: [{property: "state", comparison: "equals", value: "open"}]}]}) {
+			id
+			state
+			attachments { filename }
+		}
+	}`)
+
+	if len(result.Errors) != 0 {
+		t.Fatalf("Expected no errors got %v", result.Errors)
+	}
+
+	incidents := result.Data["incidents"].([]interface{})
+	if len(incidents) != 1 {
+		t.Fatalf("Expected 1 incident got %v", len(incidents))
+	}
+
+	attachments := incidents[0].(map[string]interface{})["attachments"].([]interface{})
+	if len(attachments) != 1 {
+		t.Errorf("Expected 1 attachment got %v", len(attachments))
+	}
+}
+
+func TestGraphQLIncidentsWithInvalidPermissions(t *testing.T) {
+	setup()
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
+	_, token := user1.Authenticate("1234")
+
+	result := runGraphQL(t, token.Token, "{ incidents { id } }")
+
+	if len(result.Errors) != 1 {
+		t.Errorf("Expected 1 error got %v", result.Errors)
+	}
+}
+
+func TestGraphQLHidesAssigneeEmailWithoutUserView(t *testing.T) {
+	setup()
+	user1.Permissions = append(user1.Permissions, availablePermissions.viewIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	_, other := userManager.AddUser(&AddUser{EmailAddress: "d@e.f", UserName: "Other", Password: "5678"})
+
+	attributes := make(map[string]string, 0)
+	attributes["assignee"] = "d@e.f"
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", attributes})
+	_, token := user1.Authenticate("1234")
+
+	result := runGraphQL(t, token.Token, "{ incident(id: 0) { assignee { id userName emailAddress } } }")
+
+	if len(result.Errors) != 0 {
+		t.Fatalf("Expected no errors got %v", result.Errors)
+	}
+
+	assignee := result.Data["incident"].(map[string]interface{})["assignee"].(map[string]interface{})
+	if assignee["userName"] != "Other" || int64(assignee["id"].(float64)) != other.Id {
+		t.Errorf("Expected assignee Other got %v", assignee)
+	}
+
+	if assignee["emailAddress"] != nil {
+		t.Errorf("Expected email address to be hidden got %v", assignee["emailAddress"])
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 
 	"encoding/json"
@@ -21,7 +22,7 @@ var user1 User
 type FakeFileManager struct {
 }
 
-func (manager FakeFileManager) SaveFile(incident string, fileName string, file multipart.File) (string, bool) {
+func (manager FakeFileManager) SaveFile(incident string, fileName string, file io.Reader) (string, bool) {
 	return fileName, true
 }
 
@@ -33,7 +34,14 @@ func (manager FakeFileManager) DeleteFile(incident string, fileName string) bool
 	return true
 }
 
+// waitForBackgroundWork lets the indexing and previews of earlier requests finish before the globals they use are changed.
+func waitForBackgroundWork() {
+	searchIndex.Wait()
+	previewGenerator.Wait()
+}
+
 func setup() {
+	waitForBackgroundWork()
 	if router == nil {
 		router = NewRouter()
 		http.Handle("/", router)
@@ -41,8 +49,18 @@ func setup() {
 
 	incidentManager = RuntimeIncidentManager{make(map[int64]*Incident), make(map[int][]Attachment)}
 	userManager = RuntimeUserManager{make(map[int64]*User), make(map[int64]string), make(map[int64][]string), make([]string, 0)}
-	hookManager = HookManager{make([]WebHook, 0), make([]WebHook, 0), make([]WebHook, 0), make([]WebHook, 0), make([]WebHook, 0)}
+	serviceAccountManager = NewRuntimeServiceAccountManager()
+	hookManager = HookManager{make([]WebHook, 0), make([]WebHook, 0), make([]WebHook, 0), make([]WebHook, 0), make([]WebHook, 0), make([]WebHook, 0), make([]WebHook, 0)}
 	fileManager = FakeFileManager{}
+	incidentTransitions = nil
+	searchIndex = NewSearchIndex("")
+	startSearchIndexing()
+	resumableUploads = NewResumableUploadManager(0, defaultUploadExpiration)
+	uploadPolicy = UploadPolicy{}
+	userUploadUsage.Reset()
+	attachmentScanner = nil
+	previewGenerator = NewPreviewGenerator(nil, 0, 0)
+	startPreviewGeneration()
 
 	addUser1 := AddUser{
 		EmailAddress: "a@b.c",
@@ -55,6 +73,26 @@ func setup() {
 	_, user1 = userManager.AddUser(&addUser1)
 }
 
+// setupAttachmentTest stores attachments in a temporary folder and adds incidents 0 and 1.
+// The user1 is given the permissions and a token for them is returned.
+// The file manager, upload policy and resumable uploads can be changed by the test, they are put back once it finishes.
+func setupAttachmentTest(t *testing.T, permissions ...string) string {
+	setup()
+	files, policy, uploads := fileManager, uploadPolicy, resumableUploads
+	t.Cleanup(func() {
+		waitForBackgroundWork()
+		fileManager, uploadPolicy, resumableUploads = files, policy, uploads
+	})
+
+	fileManager = LocalFileManager{t.TempDir()}
+	user1.Permissions = append(user1.Permissions, permissions...)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
+	incidentManager.AddIncident(&Incident{"Incident", 1, "Other", "Tester", "open", make(map[string]string, 0)})
+	_, token := user1.Authenticate("1234")
+	return token.Token
+}
+
 func TestCreateIncident(t *testing.T) {
 	setup()
 	inc := Incident{}
@@ -112,6 +150,7 @@ func TestCreateIncidentWithInvalidRequest(t *testing.T) {
 func TestIncidentUpdateWithValidToken(t *testing.T) {
 	setup()
 	user1.Permissions = append(user1.Permissions, availablePermissions.modifyIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
 	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
 
 	m := make(map[string]string, 1)
@@ -178,6 +217,7 @@ func TestIncidentUpdateWithInvalidPermissionsToken(t *testing.T) {
 func TestIncidentUpdateWithInvalidId(t *testing.T) {
 	setup()
 	user1.Permissions = append(user1.Permissions, availablePermissions.modifyIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
 	body, _ := json.Marshal(IncidentUpdate{})
 	_, token := user1.Authenticate("1234")
 
@@ -195,6 +235,7 @@ func TestIncidentUpdateWithInvalidId(t *testing.T) {
 func TestIncidentUpdateWithNonExistantId(t *testing.T) {
 	setup()
 	user1.Permissions = append(user1.Permissions, availablePermissions.modifyIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
 	body, _ := json.Marshal(IncidentUpdate{})
 	_, token := user1.Authenticate("1234")
 
@@ -209,9 +250,31 @@ func TestIncidentUpdateWithNonExistantId(t *testing.T) {
 	}
 }
 
+func TestIncidentUpdateWithInvalidTransition(t *testing.T) {
+	setup()
+	incidentTransitions = map[string][]string{"open": {"closed"}}
+	user1.Permissions = append(user1.Permissions, availablePermissions.modifyIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
+
+	body, _ := json.Marshal(IncidentUpdate{"reopened", "", "", nil})
+	_, token := user1.Authenticate("1234")
+
+	r, _ := http.NewRequest("PUT", "/sona/v1/incidents/0", bytes.NewBuffer(body))
+	r.Header.Set("X-Sona-Token", token.Token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 409 {
+		t.Errorf("Expected 409 status code got %v", w.Result())
+	}
+}
+
 func TestGetIncidentHandler(t *testing.T) {
 	setup()
 	user1.Permissions = append(user1.Permissions, availablePermissions.viewIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
 	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
 	_, token := user1.Authenticate("1234")
 
@@ -282,6 +345,7 @@ func TestGetIncidentHandlerWithInvalidPermissions(t *testing.T) {
 func TestGetIncidentHandlerWithInvalidId(t *testing.T) {
 	setup()
 	user1.Permissions = append(user1.Permissions, availablePermissions.viewIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
 	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
 	_, token := user1.Authenticate("1234")
 
@@ -299,6 +363,7 @@ func TestGetIncidentHandlerWithInvalidId(t *testing.T) {
 func TestGetIncidentHandlerWithNonExistantId(t *testing.T) {
 	setup()
 	user1.Permissions = append(user1.Permissions, availablePermissions.viewIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
 	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
 	_, token := user1.Authenticate("1234")
 
@@ -316,6 +381,7 @@ func TestGetIncidentHandlerWithNonExistantId(t *testing.T) {
 func TestGetIncidentsHandler(t *testing.T) {
 	setup()
 	user1.Permissions = append(user1.Permissions, availablePermissions.viewIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
 	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
 	incidentManager.AddIncident(&Incident{"Incident", 1, "Something", "Someone", "Closed", make(map[string]string, 0)})
 	_, token := user1.Authenticate("1234")
@@ -406,9 +472,157 @@ func TestGetIncidentsHandlerWithInvalidPermissions(t *testing.T) {
 	}
 }
 
+func TestGetIncidentsHandlerWithFields(t *testing.T) {
+	setup()
+	user1.Permissions = append(user1.Permissions, availablePermissions.viewIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	attributes := make(map[string]string, 0)
+	attributes["severity"] = "high"
+	attributes["team"] = "core"
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", attributes})
+	_, token := user1.Authenticate("1234")
+
+	r, _ := http.NewRequest("GET", "/sona/v1/incidents?fields=state,id,severity", nil)
+	r.Header.Set("X-Sona-Token", token.Token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 200 {
+		t.Errorf("Expected 200 status code got %v", w.Result())
+	}
+
+	expected := `[{"attributes":{"severity":"high"},"id":0,"state":"open"}]` + "\n"
+	if w.Body.String() != expected {
+		t.Errorf("Expected %v got %v", expected, w.Body.String())
+	}
+}
+
+func TestGetIncidentsHandlerAsCSV(t *testing.T) {
+	setup()
+	user1.Permissions = append(user1.Permissions, availablePermissions.viewIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	attributes := make(map[string]string, 0)
+	attributes["team"] = "core"
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", attributes})
+	attributes2 := make(map[string]string, 0)
+	attributes2["severity"] = "high"
+	incidentManager.AddIncident(&Incident{"Incident", 1, "Something, else", "Someone", "Closed", attributes2})
+	_, token := user1.Authenticate("1234")
+
+	r, _ := http.NewRequest("GET", "/sona/v1/incidents", nil)
+	r.Header.Set("X-Sona-Token", token.Token)
+	r.Header.Set("Accept", "text/csv")
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 200 {
+		t.Errorf("Expected 200 status code got %v", w.Result())
+	}
+
+	if w.Result().Header.Get("Content-Type") != "text/csv;charset=UTF-8" {
+		t.Errorf("Expected csv content type got %v", w.Result().Header.Get("Content-Type"))
+	}
+
+	expected := "type,id,description,reporter,state,attributes.severity,attributes.team\n" +
+		"Incident,0,Test,Tester,open,,core\n" +
+		"Incident,1,\"Something, else\",Someone,Closed,high,\n"
+	if w.Body.String() != expected {
+		t.Errorf("Expected %v got %v", expected, w.Body.String())
+	}
+}
+
+func TestGetIncidentsHandlerAsCSVEscapesFormulas(t *testing.T) {
+	setup()
+	user1.Permissions = append(user1.Permissions, availablePermissions.viewIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	attributes := make(map[string]string, 0)
+	attributes["=team"] = "\tcore"
+	incidentManager.AddIncident(&Incident{"Incident", 0, "=HYPERLINK(\"http://example.com\")", "@Tester", "+open", attributes})
+	incidentManager.AddIncident(&Incident{"Incident", 1, "-1", "Some=one", "\rClosed", make(map[string]string, 0)})
+	_, token := user1.Authenticate("1234")
+
+	r, _ := http.NewRequest("GET", "/sona/v1/incidents", nil)
+	r.Header.Set("X-Sona-Token", token.Token)
+	r.Header.Set("Accept", "text/csv")
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	expected := "type,id,description,reporter,state,attributes.=team\n" +
+		"Incident,0,\"'=HYPERLINK(\"\"http://example.com\"\")\",'@Tester,'+open,'\tcore\n" +
+		"Incident,1,'-1,Some=one,\"'\rClosed\",\n"
+	if w.Body.String() != expected {
+		t.Errorf("Expected %q got %q", expected, w.Body.String())
+	}
+}
+
+func TestGetIncidentsHandlerAsNDJSON(t *testing.T) {
+	setup()
+	user1.Permissions = append(user1.Permissions, availablePermissions.viewIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
+	incidentManager.AddIncident(&Incident{"Incident", 1, "Something", "Someone", "Closed", make(map[string]string, 0)})
+	_, token := user1.Authenticate("1234")
+
+	r, _ := http.NewRequest("GET", "/sona/v1/incidents?fields=id", nil)
+	r.Header.Set("X-Sona-Token", token.Token)
+	r.Header.Set("Accept", "application/x-ndjson")
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	expected := "{\"id\":0}\n{\"id\":1}\n"
+	if w.Body.String() != expected {
+		t.Errorf("Expected %v got %v", expected, w.Body.String())
+	}
+}
+
+func TestGetIncidentsHandlerAsYAML(t *testing.T) {
+	setup()
+	user1.Permissions = append(user1.Permissions, availablePermissions.viewIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	attributes := make(map[string]string, 0)
+	attributes["team"] = "core"
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", attributes})
+	_, token := user1.Authenticate("1234")
+
+	r, _ := http.NewRequest("GET", "/sona/v1/incidents?fields=id,state,attributes", nil)
+	r.Header.Set("X-Sona-Token", token.Token)
+	r.Header.Set("Accept", "application/yaml")
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	expected := "- id: 0\n  state: open\n  attributes:\n    team: core\n"
+	if w.Body.String() != expected {
+		t.Errorf("Expected %v got %v", expected, w.Body.String())
+	}
+}
+
+func TestGetIncidentsHandlerWithUnsupportedFormat(t *testing.T) {
+	setup()
+	user1.Permissions = append(user1.Permissions, availablePermissions.viewIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	_, token := user1.Authenticate("1234")
+
+	r, _ := http.NewRequest("GET", "/sona/v1/incidents", nil)
+	r.Header.Set("X-Sona-Token", token.Token)
+	r.Header.Set("Accept", "image/png")
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 406 {
+		t.Errorf("Expected 406 status code got %v", w.Result())
+	}
+}
+
 func TestGetAttachmentWithInvalidId(t *testing.T) {
 	setup()
 	user1.Permissions = append(user1.Permissions, availablePermissions.viewIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
 	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
 	_, token := user1.Authenticate("1234")
 
@@ -426,6 +640,7 @@ func TestGetAttachmentWithInvalidId(t *testing.T) {
 func TestGetAttachmentsWithNoAttached(t *testing.T) {
 	setup()
 	user1.Permissions = append(user1.Permissions, availablePermissions.viewIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
 	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
 	_, token := user1.Authenticate("1234")
 
@@ -453,9 +668,10 @@ func TestGetAttachmentsWithNoAttached(t *testing.T) {
 func TestGetAttachmentsWithAttached(t *testing.T) {
 	setup()
 	user1.Permissions = append(user1.Permissions, availablePermissions.viewIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
 	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
-	incidentManager.AddAttachment(0, Attachment{"testfile.png", "2009-11-10T23:00:00Z"})
-	incidentManager.AddAttachment(0, Attachment{"testfile2.jpg", "2009-10-10T23:00:00Z"})
+	incidentManager.AddAttachment(0, Attachment{FileName: "testfile.png", Time: "2009-11-10T23:00:00Z"})
+	incidentManager.AddAttachment(0, Attachment{FileName: "testfile2.jpg", Time: "2009-10-10T23:00:00Z"})
 	_, token := user1.Authenticate("1234")
 
 	r, _ := http.NewRequest("GET", "/sona/v1/incidents/0/attachments", nil)
@@ -490,8 +706,8 @@ func TestGetAttachmentsWithAttached(t *testing.T) {
 func TestGetAttachmentsWithAttachedAndInvalidToken(t *testing.T) {
 	setup()
 	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
-	incidentManager.AddAttachment(0, Attachment{"testfile.png", "2009-11-10T23:00:00Z"})
-	incidentManager.AddAttachment(0, Attachment{"testfile2.jpg", "2009-10-10T23:00:00Z"})
+	incidentManager.AddAttachment(0, Attachment{FileName: "testfile.png", Time: "2009-11-10T23:00:00Z"})
+	incidentManager.AddAttachment(0, Attachment{FileName: "testfile2.jpg", Time: "2009-10-10T23:00:00Z"})
 
 	r, _ := http.NewRequest("GET", "/sona/v1/incidents/0/attachments", nil)
 	w := httptest.NewRecorder()
@@ -507,8 +723,8 @@ func TestGetAttachmentsWithAttachedAndInvalidToken(t *testing.T) {
 func TestGetAttachmentsWithAttachedAndInvalidPermissions(t *testing.T) {
 	setup()
 	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
-	incidentManager.AddAttachment(0, Attachment{"testfile.png", "2009-11-10T23:00:00Z"})
-	incidentManager.AddAttachment(0, Attachment{"testfile2.jpg", "2009-10-10T23:00:00Z"})
+	incidentManager.AddAttachment(0, Attachment{FileName: "testfile.png", Time: "2009-11-10T23:00:00Z"})
+	incidentManager.AddAttachment(0, Attachment{FileName: "testfile2.jpg", Time: "2009-10-10T23:00:00Z"})
 	_, token := user1.Authenticate("1234")
 
 	r, _ := http.NewRequest("GET", "/sona/v1/incidents/0/attachments", nil)
@@ -525,6 +741,7 @@ func TestGetAttachmentsWithAttachedAndInvalidPermissions(t *testing.T) {
 func TestUploadAttachmentWithInvalidId(t *testing.T) {
 	setup()
 	user1.Permissions = append(user1.Permissions, availablePermissions.modifyIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
 	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
 	_, token := user1.Authenticate("1234")
 
@@ -573,6 +790,7 @@ func TestUploadAttachmentWithInvalidPermissions(t *testing.T) {
 func TestUploadAttachmentWithNonExistantId(t *testing.T) {
 	setup()
 	user1.Permissions = append(user1.Permissions, availablePermissions.modifyIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
 	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
 	_, token := user1.Authenticate("1234")
 
@@ -587,9 +805,254 @@ func TestUploadAttachmentWithNonExistantId(t *testing.T) {
 	}
 }
 
+func TestUploadAttachmentRecordsMetadata(t *testing.T) {
+	setup()
+	fileManager = LocalFileManager{t.TempDir()}
+	user1.Permissions = append(user1.Permissions, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
+	_, token := user1.Authenticate("1234")
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("uploadfile", "notes.txt")
+	part.Write([]byte("hello"))
+	form.Close()
+
+	r, _ := http.NewRequest("POST", "/sona/v1/incidents/0/attachment", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.Header.Set("X-Sona-Token", token.Token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 200 {
+		t.Fatalf("Expected 200 status code got %v", w.Result())
+	}
+
+	attachments, _ := incidentManager.GetAttachments(0)
+	if len(attachments) != 1 {
+		t.Fatalf("Expected 1 attachment got %v", attachments)
+	}
+
+	attachment := attachments[0]
+	if attachment.Size != 5 {
+		t.Errorf("Expected size 5 got %v", attachment.Size)
+	}
+
+	if attachment.ContentType != "text/plain; charset=utf-8" {
+		t.Errorf("Expected text content type got %v", attachment.ContentType)
+	}
+
+	if attachment.Checksum != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Errorf("Unexpected checksum %v", attachment.Checksum)
+	}
+
+	if attachment.UploaderId != user1.Id {
+		t.Errorf("Expected uploader %v got %v", user1.Id, attachment.UploaderId)
+	}
+
+	r, _ = http.NewRequest("GET", "/sona/v1/incidents/0/attachment/"+attachment.Id, nil)
+	r.Header.Set("X-Sona-Token", token.Token)
+	w = httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 200 {
+		t.Fatalf("Expected 200 status code got %v", w.Result())
+	}
+
+	if w.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Errorf("Expected stored content type got %v", w.Header().Get("Content-Type"))
+	}
+
+	if w.Header().Get("Digest") != "sha-256=LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=" {
+		t.Errorf("Unexpected digest %v", w.Header().Get("Digest"))
+	}
+
+	if w.Header().Get("Content-Disposition") != "attachment; filename=notes.txt" {
+		t.Errorf("Unexpected content disposition %v", w.Header().Get("Content-Disposition"))
+	}
+}
+
+func TestUploadAttachmentsWithSameName(t *testing.T) {
+	setup()
+	fileManager = LocalFileManager{t.TempDir()}
+	user1.Permissions = append(user1.Permissions, availablePermissions.viewIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
+	first, _ := attachFile(0, "screenshot.txt", strings.NewReader("a much longer first file"), "", 0)
+	second, _ := attachFile(0, "screenshot.txt", strings.NewReader("second"), "", 0)
+	_, token := user1.Authenticate("1234")
+
+	if first.Id == second.Id {
+		t.Fatalf("Expected attachments to have different ids got %v", first.Id)
+	}
+
+	for _, attachment := range []Attachment{first, second} {
+		r, _ := http.NewRequest("GET", "/sona/v1/incidents/0/attachment/"+attachment.Id, nil)
+		r.Header.Set("X-Sona-Token", token.Token)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, r)
+
+		if w.Body.Len() != int(attachment.Size) {
+			t.Errorf("Expected %v bytes got %v", attachment.Size, w.Body.String())
+		}
+	}
+}
+
+func uploadAttachmentVersion(token string, attachmentId string, fileName string, content string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("uploadfile", fileName)
+	part.Write([]byte(content))
+	form.Close()
+
+	r, _ := http.NewRequest("POST", "/sona/v1/incidents/0/attachment/"+attachmentId, &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.Header.Set("X-Sona-Token", token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestUploadAttachmentVersion(t *testing.T) {
+	setup()
+	fileManager = LocalFileManager{t.TempDir()}
+	user1.Permissions = append(user1.Permissions, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
+	original, _ := attachFile(0, "app.log", strings.NewReader("first run"), "", 0)
+	_, token := user1.Authenticate("1234")
+
+	w := uploadAttachmentVersion(token.Token, original.Id, "app.log", "second run")
+	if w.Result().StatusCode != 200 {
+		t.Fatalf("Expected 200 status code got %v", w.Result())
+	}
+
+	var updated Attachment
+	json.Unmarshal(w.Body.Bytes(), &updated)
+	if updated.Id != original.Id || updated.Version != 2 || updated.Size != 10 || updated.UploaderId != user1.Id {
+		t.Errorf("Unexpected attachment %v", updated)
+	}
+
+	expected := map[string]string{"": "second run", "?version=2": "second run", "?version=1": "first run"}
+	for query, content := range expected {
+		r, _ := http.NewRequest("GET", "/sona/v1/incidents/0/attachment/"+original.Id+query, nil)
+		r.Header.Set("X-Sona-Token", token.Token)
+		w = httptest.NewRecorder()
+
+		router.ServeHTTP(w, r)
+
+		if w.Result().StatusCode != 200 || w.Body.String() != content {
+			t.Errorf("Expected %v for %v got %v %v", content, query, w.Result().StatusCode, w.Body.String())
+		}
+	}
+
+	r, _ := http.NewRequest("GET", "/sona/v1/incidents/0/attachment/"+original.Id+"/versions", nil)
+	r.Header.Set("X-Sona-Token", token.Token)
+	w = httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	var versions []AttachmentVersion
+	json.Unmarshal(w.Body.Bytes(), &versions)
+	if len(versions) != 2 || versions[0].Version != 1 || versions[0].Size != 9 || versions[1].Version != 2 {
+		t.Errorf("Unexpected versions %v", versions)
+	}
+}
+
+func TestDownloadMissingAttachmentVersion(t *testing.T) {
+	setup()
+	fileManager = LocalFileManager{t.TempDir()}
+	user1.Permissions = append(user1.Permissions, availablePermissions.viewIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
+	attachment, _ := attachFile(0, "app.log", strings.NewReader("first run"), "", 0)
+	_, token := user1.Authenticate("1234")
+
+	expected := map[string]int{"?version=3": 404, "?version=latest": 400}
+	for query, status := range expected {
+		r, _ := http.NewRequest("GET", "/sona/v1/incidents/0/attachment/"+attachment.Id+query, nil)
+		r.Header.Set("X-Sona-Token", token.Token)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, r)
+
+		if w.Result().StatusCode != status {
+			t.Errorf("Expected %v status code for %v got %v", status, query, w.Result())
+		}
+	}
+}
+
+func TestUploadVersionOfMissingAttachment(t *testing.T) {
+	setup()
+	user1.Permissions = append(user1.Permissions, availablePermissions.modifyIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
+	_, token := user1.Authenticate("1234")
+
+	w := uploadAttachmentVersion(token.Token, "missing", "app.log", "content")
+
+	if w.Result().StatusCode != 404 {
+		t.Errorf("Expected 404 status code got %v", w.Result())
+	}
+}
+
+func TestDeleteVersionedAttachment(t *testing.T) {
+	setup()
+	fileManager = LocalFileManager{t.TempDir()}
+	user1.Permissions = append(user1.Permissions, availablePermissions.modifyIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
+	attachment, _ := attachFile(0, "app.log", strings.NewReader("first run"), "", 0)
+	attachment, _ = attachFileVersion(0, attachment, "app.log", strings.NewReader("second run"), "", 0)
+	_, token := user1.Authenticate("1234")
+
+	r, _ := http.NewRequest("DELETE", "/sona/v1/incidents/0/attachment/"+attachment.Id, nil)
+	r.Header.Set("X-Sona-Token", token.Token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 200 {
+		t.Fatalf("Expected 200 status code got %v", w.Result())
+	}
+
+	for _, version := range attachment.getVersions() {
+		if _, _, found, _ := fileManager.LoadFile("0", attachment.getVersionKey(version)); found {
+			t.Errorf("Expected version %v to be deleted", version.Version)
+		}
+	}
+}
+
+func TestDownloadLegacyAttachment(t *testing.T) {
+	setup()
+	fileManager = LocalFileManager{t.TempDir()}
+	user1.Permissions = append(user1.Permissions, availablePermissions.viewIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
+	fileManager.SaveFile("0", "old.txt", strings.NewReader("legacy"))
+	incidentManager.AddAttachment(0, Attachment{FileName: "old.txt", Time: "2009-11-10T23:00:00Z"})
+	_, token := user1.Authenticate("1234")
+
+	r, _ := http.NewRequest("GET", "/sona/v1/incidents/0/attachment/old.txt", nil)
+	r.Header.Set("X-Sona-Token", token.Token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 200 || w.Body.String() != "legacy" {
+		t.Errorf("Expected legacy attachment got %v %v", w.Result().StatusCode, w.Body.String())
+	}
+}
+
 func TestDeleteAttachmentWithInvalidId(t *testing.T) {
 	setup()
 	user1.Permissions = append(user1.Permissions, availablePermissions.modifyIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
 	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
 	_, token := user1.Authenticate("1234")
 
@@ -607,6 +1070,7 @@ func TestDeleteAttachmentWithInvalidId(t *testing.T) {
 func TestDeleteAttachmentWithNonExistantIncidentId(t *testing.T) {
 	setup()
 	user1.Permissions = append(user1.Permissions, availablePermissions.modifyIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
 	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
 	_, token := user1.Authenticate("1234")
 
@@ -624,8 +1088,9 @@ func TestDeleteAttachmentWithNonExistantIncidentId(t *testing.T) {
 func TestDeleteAttachmentWithNonExistantAttachmentId(t *testing.T) {
 	setup()
 	user1.Permissions = append(user1.Permissions, availablePermissions.modifyIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
 	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
-	incidentManager.AddAttachment(0, Attachment{"somefile.png", "2009-11-10T23:00:00Z"})
+	incidentManager.AddAttachment(0, Attachment{FileName: "somefile.png", Time: "2009-11-10T23:00:00Z"})
 	_, token := user1.Authenticate("1234")
 
 	r, _ := http.NewRequest("DELETE", "/sona/v1/incidents/0/attachment/test.jpg", nil)
@@ -642,8 +1107,9 @@ func TestDeleteAttachmentWithNonExistantAttachmentId(t *testing.T) {
 func TestDeleteAttachment(t *testing.T) {
 	setup()
 	user1.Permissions = append(user1.Permissions, availablePermissions.modifyIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
 	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
-	incidentManager.AddAttachment(0, Attachment{"test.jpg", "2009-11-10T23:00:00Z"})
+	incidentManager.AddAttachment(0, Attachment{FileName: "test.jpg", Time: "2009-11-10T23:00:00Z"})
 	_, token := user1.Authenticate("1234")
 
 	r, _ := http.NewRequest("DELETE", "/sona/v1/incidents/0/attachment/test.jpg", nil)
@@ -660,7 +1126,7 @@ func TestDeleteAttachment(t *testing.T) {
 func TestDeleteAttachmentWithInvalidToken(t *testing.T) {
 	setup()
 	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
-	incidentManager.AddAttachment(0, Attachment{"test.jpg", "2009-11-10T23:00:00Z"})
+	incidentManager.AddAttachment(0, Attachment{FileName: "test.jpg", Time: "2009-11-10T23:00:00Z"})
 
 	r, _ := http.NewRequest("DELETE", "/sona/v1/incidents/0/attachment/test.jpg", nil)
 	w := httptest.NewRecorder()
@@ -676,7 +1142,7 @@ func TestDeleteAttachmentWithInvalidToken(t *testing.T) {
 func TestDeleteAttachmentWithInvalidPermissions(t *testing.T) {
 	setup()
 	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
-	incidentManager.AddAttachment(0, Attachment{"test.jpg", "2009-11-10T23:00:00Z"})
+	incidentManager.AddAttachment(0, Attachment{FileName: "test.jpg", Time: "2009-11-10T23:00:00Z"})
 	_, token := user1.Authenticate("1234")
 
 	r, _ := http.NewRequest("DELETE", "/sona/v1/incidents/0/attachment/test.jpg", nil)
@@ -689,3 +1155,79 @@ func TestDeleteAttachmentWithInvalidPermissions(t *testing.T) {
 		t.Errorf("Expected 401 status code got %v", w.Result())
 	}
 }
+
+// FakePresignedFileManager stores files locally and presigns urls for them.
+type FakePresignedFileManager struct {
+	LocalFileManager
+}
+
+func (manager FakePresignedFileManager) PresignFile(incident string, fileName string, version string, disposition string, contentType string) (string, bool) {
+	return "https://files.example.com/" + incident + "/" + fileName + "?type=" + contentType, true
+}
+
+func downloadAttachment(token string, attachmentId string, headers map[string]string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("GET", "/sona/v1/incidents/0/attachment/"+attachmentId, nil)
+	r.Header.Set("X-Sona-Token", token)
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestDownloadAttachmentRange(t *testing.T) {
+	setup()
+	fileManager = LocalFileManager{t.TempDir()}
+	user1.Permissions = append(user1.Permissions, availablePermissions.viewIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
+	attachment, _ := attachFile(0, "app.log", strings.NewReader("hello world"), "", 0)
+	_, token := user1.Authenticate("1234")
+
+	w := downloadAttachment(token.Token, attachment.Id, map[string]string{"Range": "bytes=6-"})
+
+	if w.Result().StatusCode != 206 || w.Body.String() != "world" {
+		t.Errorf("Expected partial content got %v %v", w.Result().StatusCode, w.Body.String())
+	}
+}
+
+func TestDownloadUnmodifiedAttachment(t *testing.T) {
+	setup()
+	fileManager = LocalFileManager{t.TempDir()}
+	user1.Permissions = append(user1.Permissions, availablePermissions.viewIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
+	attachment, _ := attachFile(0, "app.log", strings.NewReader("hello world"), "", 0)
+	_, token := user1.Authenticate("1234")
+
+	w := downloadAttachment(token.Token, attachment.Id, nil)
+	etag := w.Header().Get("ETag")
+	if etag != "\""+attachment.Checksum+"\"" {
+		t.Fatalf("Expected checksum as ETag got %v", etag)
+	}
+
+	w = downloadAttachment(token.Token, attachment.Id, map[string]string{"If-None-Match": etag})
+
+	if w.Result().StatusCode != 304 || w.Body.Len() != 0 {
+		t.Errorf("Expected 304 status code got %v", w.Result())
+	}
+}
+
+func TestDownloadPresignedAttachment(t *testing.T) {
+	setup()
+	fileManager = FakePresignedFileManager{LocalFileManager{t.TempDir()}}
+	user1.Permissions = append(user1.Permissions, availablePermissions.viewIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
+	attachment, _ := attachFile(0, "app.log", strings.NewReader("hello world"), "", 0)
+	_, token := user1.Authenticate("1234")
+
+	w := downloadAttachment(token.Token, attachment.Id, nil)
+
+	expected := "https://files.example.com/0/" + attachment.Id + "?type=text/plain; charset=utf-8"
+	if w.Result().StatusCode != 307 || w.Header().Get("Location") != expected {
+		t.Errorf("Expected redirect to %v got %v", expected, w.Result())
+	}
+}
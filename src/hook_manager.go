@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -13,12 +14,16 @@ import (
 // The AddedWebHooks are the endpoints to call in CallAddedHooks.
 // The UpdatedWebHooks are the endpoints to call in CallUpdatedHooks.
 // The AttachedWebHooks are the endpoints to call in CallAttachedWebHooks.
+// The BulkUpdatedWebHooks are the endpoints to call in CallBulkUpdatedHooks.
+// The InfectedWebHooks are the endpoints to call in CallInfectedHooks.
 type HookManager struct {
 	AddedWebHooks       []WebHook
 	UpdatedWebHooks     []WebHook
 	AttachedWebHooks    []WebHook
 	UserAddedWebHooks   []WebHook
 	UserUpdatedWebHooks []WebHook
+	BulkUpdatedWebHooks []WebHook
+	InfectedWebHooks    []WebHook
 }
 
 // CallAddedHooks will call all defined added endpoints.
@@ -48,6 +53,15 @@ func (manager HookManager) CallUpdatedHooks(incidentID int, incident IncidentUpd
 	}
 }
 
+// CallBulkUpdatedHooks will call all defined bulk updated endpoints once for a set of incidents.
+// During this process it will subsitute any nessicary data.
+func (manager HookManager) CallBulkUpdatedHooks(incidentIDs []int, incident IncidentUpdate) {
+	logManager.LogPrintln("Calling bulk updated hooks")
+	for _, hook := range manager.BulkUpdatedWebHooks {
+		go fireHook(hook, preformBulkUpdateSubsitutions(hook, incidentIDs, incident))
+	}
+}
+
 // CallAddedUserHooks will call all defined updated endpoints.
 // During this process it will subsitute any nessicary data.
 func (manager HookManager) CallUpdatedUserHooks(user User) {
@@ -188,6 +202,66 @@ func getUpdateSubstitutionValue(key string, incidentID int, incident IncidentUpd
 	return ""
 }
 
+func preformBulkUpdateSubsitutions(hook WebHook, incidentIDs []int, incident IncidentUpdate) *bytes.Buffer {
+	var bod = make(map[string]string, 0)
+
+	for _, item := range hook.Body.Items {
+		if item.Substitute {
+			bod[item.Key] = preformBulkUpdateSubstitutionImpl(item.Value, incidentIDs, incident)
+		} else {
+			bod[item.Key] = item.Value
+		}
+	}
+
+	b := new(bytes.Buffer)
+	json.NewEncoder(b).Encode(bod)
+	return b
+}
+
+func preformBulkUpdateSubstitutionImpl(key string, incidentIDs []int, incident IncidentUpdate) string {
+	var cRegEx = regexp.MustCompile("\\{\\{([^\\}\\}]*)\\}\\}")
+	match := cRegEx.FindAllStringSubmatch(key, -1)
+
+	if len(match) <= 0 {
+		return getBulkUpdateSubstitutionValue(key, incidentIDs, incident)
+	}
+
+	var retVal = key
+	for i := 0; i < len(match); i++ {
+		var replaceRegEx = regexp.MustCompile(match[i][0])
+		retVal = replaceRegEx.ReplaceAllString(retVal, getBulkUpdateSubstitutionValue(match[i][1], incidentIDs, incident))
+	}
+
+	return retVal
+}
+
+func getBulkUpdateSubstitutionValue(key string, incidentIDs []int, incident IncidentUpdate) string {
+	if key == "ids" {
+		ids := make([]string, len(incidentIDs))
+		for i, id := range incidentIDs {
+			ids[i] = strconv.Itoa(id)
+		}
+		return strings.Join(ids, ",")
+	}
+	if key == "count" {
+		return strconv.Itoa(len(incidentIDs))
+	}
+	if key == "id" {
+		return ""
+	}
+
+	return getUpdateSubstitutionValue(key, 0, incident)
+}
+
+// CallInfectedHooks will call all defined infected endpoints.
+// During this process it will subsitute any nessicary data.
+func (manager HookManager) CallInfectedHooks(incidentID int, attachment Attachment) {
+	logManager.LogPrintln("Calling infected hooks")
+	for _, hook := range manager.InfectedWebHooks {
+		go fireHook(hook, preformAttachSubsitutions(hook, incidentID, attachment))
+	}
+}
+
 func preformAttachSubsitutions(hook WebHook, incidentID int, attachment Attachment) *bytes.Buffer {
 	var bod = make(map[string]string, 0)
 
@@ -236,6 +310,33 @@ func getAttachSubstitutionValue(key string, incidentID int, attachment Attachmen
 	if key == "filename" {
 		return attachment.FileName
 	}
+	if key == "attachmentId" {
+		return attachment.getId()
+	}
+	if key == "version" {
+		return strconv.Itoa(attachment.getVersion())
+	}
+	if key == "size" {
+		return strconv.FormatInt(attachment.Size, 10)
+	}
+	if key == "contentType" {
+		return attachment.ContentType
+	}
+	if key == "sha256" {
+		return attachment.Checksum
+	}
+	if key == "uploaderId" {
+		return strconv.FormatInt(attachment.UploaderId, 10)
+	}
+	if key == "serviceAccountId" {
+		return attachment.ServiceAccountId
+	}
+	if key == "scanStatus" {
+		return attachment.ScanStatus
+	}
+	if key == "signature" {
+		return attachment.ScanSignature
+	}
 
 	return ""
 }
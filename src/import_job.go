@@ -0,0 +1,356 @@
+package main
+
+import (
+	b64 "encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	guuid "github.com/google/uuid"
+)
+
+const (
+	importPending   = "pending"
+	importRunning   = "running"
+	importCompleted = "completed"
+	importFailed    = "failed"
+)
+
+// Conflict policies control what happens when an imported user has the same email address as an existing user.
+// Skip keeps the existing user, overwrite replaces the existing users details and fail stops the import.
+const (
+	conflictSkip      = "skip"
+	conflictOverwrite = "overwrite"
+	conflictFail      = "fail"
+)
+
+// ImportCounts tracks what happened to each record of a given type during an import.
+type ImportCounts struct {
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+	Skipped int `json:"skipped"`
+	Failed  int `json:"failed"`
+}
+
+// ImportJob tracks the progress of an import.
+// The UserIds and IncidentIds map the ids in the archive to the ids they were imported as.
+type ImportJob struct {
+	lock        sync.Mutex
+	Id          string           `json:"id"`
+	State       string           `json:"state"`
+	Conflict    string           `json:"conflict"`
+	Total       int              `json:"total"`
+	Processed   int              `json:"processed"`
+	Users       ImportCounts     `json:"users"`
+	Incidents   ImportCounts     `json:"incidents"`
+	Attachments ImportCounts     `json:"attachments"`
+	UserIds     map[string]int64 `json:"userIds"`
+	IncidentIds map[string]int64 `json:"incidentIds"`
+	Errors      []string         `json:"errors"`
+	Started     string           `json:"started"`
+	Finished    string           `json:"finished,omitempty"`
+}
+
+// ImportJobManager keeps track of the imports that have been started.
+// Jobs are only kept in memory and will be lost when the server restarts.
+type ImportJobManager struct {
+	lock sync.Mutex
+	jobs map[string]*ImportJob
+}
+
+var importJobs = &ImportJobManager{jobs: make(map[string]*ImportJob)}
+
+// NewImportJob creates and tracks a new pending import.
+func (manager *ImportJobManager) NewImportJob(conflict string) *ImportJob {
+	job := &ImportJob{
+		Id:          guuid.New().String(),
+		State:       importPending,
+		Conflict:    conflict,
+		UserIds:     make(map[string]int64, 0),
+		IncidentIds: make(map[string]int64, 0),
+		Errors:      make([]string, 0),
+		Started:     time.Now().Format(time.RFC3339),
+	}
+
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	manager.jobs[job.Id] = job
+	return job
+}
+
+// GetImportJob finds an import by its id.
+func (manager *ImportJobManager) GetImportJob(id string) (*ImportJob, bool) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	job, ok := manager.jobs[id]
+	return job, ok
+}
+
+// Status converts the current state of the job to json.
+func (job *ImportJob) Status() ([]byte, error) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	return json.Marshal(job)
+}
+
+func (job *ImportJob) update(change func()) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	change()
+}
+
+func (job *ImportJob) fail(err error) {
+	logManager.LogPrintf("Import %v failed %v\n", job.Id, err)
+	job.update(func() {
+		job.Errors = append(job.Errors, err.Error())
+		job.State = importFailed
+		job.Finished = time.Now().Format(time.RFC3339)
+	})
+}
+
+func (job *ImportJob) recordError(counts *ImportCounts, message string) {
+	logManager.LogPrintf("Import %v: %v\n", job.Id, message)
+	job.update(func() {
+		counts.Failed++
+		job.Processed++
+		job.Errors = append(job.Errors, message)
+	})
+}
+
+// Run imports the archive and closes it once done.
+// Users are imported first so that incidents assigned to a user can be remapped.
+func (job *ImportJob) Run(archive importArchive) {
+	defer archive.Close()
+	defer userUploadUsage.Reset()
+	job.update(func() {
+		job.State = importRunning
+	})
+
+	var manifest TransferManifest
+	if err := readImportEntry(archive, manifestEntry, func(decoder *json.Decoder) error {
+		return decoder.Decode(&manifest)
+	}); err != nil {
+		job.fail(err)
+		return
+	}
+
+	if manifest.Version > transferVersion {
+		job.fail(fmt.Errorf("unsupported archive version %v", manifest.Version))
+		return
+	}
+
+	job.update(func() {
+		job.Total = manifest.Users + manifest.Incidents + manifest.Attachments
+	})
+
+	steps := []struct {
+		name   string
+		handle func(decoder *json.Decoder) error
+	}{
+		{usersEntry, job.importUser},
+		{incidentsEntry, job.importIncident},
+		{attachmentsEntry, func(decoder *json.Decoder) error {
+			return job.importAttachment(archive, decoder)
+		}},
+	}
+
+	for _, step := range steps {
+		if err := readImportEntry(archive, step.name, step.handle); err != nil {
+			job.fail(err)
+			return
+		}
+	}
+
+	job.update(func() {
+		job.State = importCompleted
+		job.Finished = time.Now().Format(time.RFC3339)
+	})
+	logManager.LogPrintf("Import %v completed\n", job.Id)
+}
+
+func (job *ImportJob) importUser(decoder *json.Decoder) error {
+	var user TransferUser
+	if err := decoder.Decode(&user); err != nil {
+		return err
+	}
+
+	oldId := strconv.FormatInt(user.Id, 10)
+	existing, found := userManager.GetUserByEmail(user.EmailAddress)
+
+	if found && job.Conflict == conflictFail {
+		return fmt.Errorf("user %v already exists", user.EmailAddress)
+	}
+
+	if found && job.Conflict == conflictSkip {
+		job.update(func() {
+			job.UserIds[oldId] = existing.Id
+			job.Users.Skipped++
+			job.Processed++
+		})
+		return nil
+	}
+
+	if found {
+		updated := user.User
+		updated.Id = existing.Id
+		if !userManager.UpdateUser(existing.Id, &updated) || !userManager.SetPermissions(existing.Id, user.Permissions) {
+			job.recordError(&job.Users, fmt.Sprintf("unable to update user %v", user.EmailAddress))
+			return nil
+		}
+
+		job.importPasswordHash(existing, user.PasswordHash)
+		job.update(func() {
+			job.UserIds[oldId] = existing.Id
+			job.Users.Updated++
+			job.Processed++
+		})
+		return nil
+	}
+
+	// Users without a password hash get a random password and will need to have it reset.
+	passed, created := userManager.AddUser(&AddUser{
+		EmailAddress: user.EmailAddress,
+		UserName:     user.UserName,
+		FirstName:    user.FirstName,
+		LastName:     user.LastName,
+		Gender:       user.Gender,
+		Password:     guuid.New().String(),
+	})
+
+	if !passed {
+		job.recordError(&job.Users, fmt.Sprintf("unable to create user %v", user.EmailAddress))
+		return nil
+	}
+
+	userManager.SetPermissions(created.Id, user.Permissions)
+	job.importPasswordHash(created, user.PasswordHash)
+	job.update(func() {
+		job.UserIds[oldId] = created.Id
+		job.Users.Created++
+		job.Processed++
+	})
+	return nil
+}
+
+func (job *ImportJob) importPasswordHash(user User, hash string) {
+	if len(hash) == 0 {
+		return
+	}
+
+	decoded, err := b64.StdEncoding.DecodeString(hash)
+	if err != nil || !userManager.SetPasswordHash(user, string(decoded)) {
+		job.update(func() {
+			job.Errors = append(job.Errors, fmt.Sprintf("unable to set password for user %v", user.EmailAddress))
+		})
+	}
+}
+
+func (job *ImportJob) importIncident(decoder *json.Decoder) error {
+	var incident Incident
+	if err := decoder.Decode(&incident); err != nil {
+		return err
+	}
+
+	oldId := strconv.FormatInt(incident.Id, 10)
+	job.remapAssignee(&incident)
+
+	if !incidentManager.AddIncident(&incident) {
+		job.recordError(&job.Incidents, fmt.Sprintf("unable to create incident %v", oldId))
+		return nil
+	}
+
+	eventManager.Publish(IncidentEvent{Type: incidentCreatedEvent, IncidentId: incident.Id, Incident: &incident})
+	job.update(func() {
+		job.IncidentIds[oldId] = incident.Id
+		job.Incidents.Created++
+		job.Processed++
+	})
+	return nil
+}
+
+// remapAssignee points an assignee attribute holding a user id at the imported user.
+func (job *ImportJob) remapAssignee(incident *Incident) {
+	assignee, ok := incident.Attributes["assignee"]
+	if !ok {
+		return
+	}
+
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	if id, found := job.UserIds[assignee]; found {
+		incident.Attributes["assignee"] = strconv.FormatInt(id, 10)
+	}
+}
+
+// remapUserId returns the id a user in the archive was imported as.
+func (job *ImportJob) remapUserId(id int64) int64 {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	if imported, found := job.UserIds[strconv.FormatInt(id, 10)]; found {
+		return imported
+	}
+
+	return id
+}
+
+func (job *ImportJob) importAttachment(archive importArchive, decoder *json.Decoder) error {
+	var attachment TransferAttachment
+	if err := decoder.Decode(&attachment); err != nil {
+		return err
+	}
+
+	job.lock.Lock()
+	incidentId, found := job.IncidentIds[strconv.FormatInt(attachment.IncidentId, 10)]
+	job.lock.Unlock()
+
+	if !found {
+		job.recordError(&job.Attachments, fmt.Sprintf("attachment %v references unknown incident %v", attachment.FileName, attachment.IncidentId))
+		return nil
+	}
+
+	// Attachments are given new ids in the same way incidents are.
+	imported := attachment.Attachment
+	imported.Id = guuid.New().String()
+	imported.StorageVersion = ""
+	imported.Versions = nil
+
+	for i, version := range attachment.getVersions() {
+		version.StorageVersion = ""
+		version.UploaderId = job.remapUserId(version.UploaderId)
+		path := attachment.getVersionPath(version)
+		content, err := archive.Open(path)
+		if err != nil {
+			job.recordError(&job.Attachments, fmt.Sprintf("unable to read attachment %v: %v", path, err))
+			return nil
+		}
+
+		saved := false
+		if i == 0 {
+			_, saved = fileManager.SaveFile(strconv.FormatInt(incidentId, 10), imported.getVersionKey(version), content)
+			imported.setCurrentVersion(version)
+		} else {
+			saved = saveAttachmentVersion(incidentId, &imported, &version, content)
+			imported.addVersion(version)
+		}
+		content.Close()
+
+		if !saved {
+			job.recordError(&job.Attachments, fmt.Sprintf("unable to save attachment %v", path))
+			return nil
+		}
+	}
+
+	if !incidentManager.AddAttachment(int(incidentId), imported) {
+		job.recordError(&job.Attachments, fmt.Sprintf("unable to add attachment %v", attachment.Path))
+		return nil
+	}
+
+	eventManager.Publish(IncidentEvent{Type: incidentAttachedEvent, IncidentId: incidentId, Attachment: &imported})
+	job.update(func() {
+		job.Attachments.Created++
+		job.Processed++
+	})
+	return nil
+}
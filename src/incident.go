@@ -21,6 +21,31 @@ type IncidentUpdate struct {
 	Attributes  map[string]string `json:"attributes"`  // The new attributes to associate with the incident.
 }
 
+// incidentTransitions are the allowed state changes for an incident.
+// When no transitions are configured any state change is allowed.
+var incidentTransitions map[string][]string
+
+// canTransitionIncident checks if an incident is allowed to move from one state to another.
+func canTransitionIncident(from string, to string) bool {
+	if len(incidentTransitions) == 0 || len(to) == 0 || strings.EqualFold(from, to) {
+		return true
+	}
+
+	for state, allowed := range incidentTransitions {
+		if !strings.EqualFold(state, from) {
+			continue
+		}
+
+		for _, next := range allowed {
+			if strings.EqualFold(next, to) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 func updateIncident(original *Incident, updated IncidentUpdate) bool {
 	changed := false
 	if len(updated.State) > 0 {
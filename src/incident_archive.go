@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	incidentArchiveManifest = "incident.json"
+	incidentArchiveDir      = "attachments"
+)
+
+// IncidentArchiveManifest describes the content of an archive of the attachments of an incident.
+type IncidentArchiveManifest struct {
+	Created     string                 `json:"created"`     // The time the archive was created.
+	Incident    Incident               `json:"incident"`    // The incident the attachments belong to.
+	Attachments []IncidentArchiveEntry `json:"attachments"` // Every attachment of the incident.
+}
+
+// IncidentArchiveEntry is the metadata of an attachment in an incident archive.
+// The Path is where the current version of the attachment is in the archive.
+// If the attachment was left out the Path is empty and Skipped says why.
+type IncidentArchiveEntry struct {
+	Attachment
+	Path    string `json:"path,omitempty"`
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// negotiateArchiveFormat picks the archive format out of the requests Accept header, zip is used by default.
+func negotiateArchiveFormat(r *http.Request) string {
+	return negotiateFormat(r, zipArchive, func(mediaType string) string {
+		switch mediaType {
+		case "application/zip", "application/x-zip-compressed", "application/*", "*/*":
+			return zipArchive
+		case "application/gzip", "application/x-gzip", "application/x-tar+gzip":
+			return tarGzArchive
+		}
+
+		return ""
+	})
+}
+
+// getUniqueArchivePath returns a path for a file that is not already used.
+// Attachments can share a name, so later ones have a number added like report (2).txt.
+func getUniqueArchivePath(used map[string]bool, fileName string) string {
+	fileName = sanitizeFileName(fileName)
+	extension := path.Ext(fileName)
+	base := strings.TrimSuffix(fileName, extension)
+
+	candidate := path.Join(incidentArchiveDir, fileName)
+	for i := 2; used[strings.ToLower(candidate)]; i++ {
+		candidate = path.Join(incidentArchiveDir, fmt.Sprintf("%v (%v)%v", base, i, extension))
+	}
+
+	used[strings.ToLower(candidate)] = true
+	return candidate
+}
+
+// writeIncidentArchive streams the current version of every attachment of an incident into an archive.
+// The manifest is written last so it can record any attachments that were left out.
+func writeIncidentArchive(archive archiveWriter, incident Incident, attachments []Attachment) error {
+	manifest := IncidentArchiveManifest{
+		Created:     time.Now().Format(time.RFC3339),
+		Incident:    incident,
+		Attachments: make([]IncidentArchiveEntry, 0, len(attachments)),
+	}
+
+	used := make(map[string]bool)
+	for _, attachment := range attachments {
+		entry := IncidentArchiveEntry{Attachment: attachment}
+		version := attachment.getCurrentVersion()
+
+		if version.isQuarantined() {
+			entry.Skipped = version.getQuarantineProblem().Detail
+			manifest.Attachments = append(manifest.Attachments, entry)
+			continue
+		}
+
+		entryPath := getUniqueArchivePath(used, version.FileName)
+		written, err := writeAttachmentVersionEntry(archive, incident.Id, attachment, version, entryPath)
+		if err != nil {
+			return err
+		}
+
+		if written {
+			entry.Path = entryPath
+		} else {
+			entry.Skipped = "The file could not be loaded."
+		}
+
+		manifest.Attachments = append(manifest.Attachments, entry)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := archive.WriteEntry(incidentArchiveManifest, int64(len(data)), bytes.NewReader(data)); err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func getAttachmentArchive(token string, incidentId string, accept string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("GET", "/sona/v1/incidents/"+incidentId+"/attachments/archive", nil)
+	r.Header.Set("X-Sona-Token", token)
+	if len(accept) > 0 {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func readZipEntries(t *testing.T, data []byte) map[string]string {
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("Unable to read zip %v", err)
+	}
+
+	entries := make(map[string]string)
+	for _, file := range reader.File {
+		content, _ := file.Open()
+		data, _ := io.ReadAll(content)
+		content.Close()
+		entries[file.Name] = string(data)
+	}
+
+	return entries
+}
+
+func readArchiveManifest(t *testing.T, entries map[string]string) IncidentArchiveManifest {
+	var manifest IncidentArchiveManifest
+	if err := json.Unmarshal([]byte(entries[incidentArchiveManifest]), &manifest); err != nil {
+		t.Fatalf("Unable to read manifest %v error %v", entries[incidentArchiveManifest], err)
+	}
+
+	return manifest
+}
+
+func TestAttachmentArchiveZip(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	readUploadedAttachment(t, uploadAttachment(token, "notes.txt", "first"))
+	readUploadedAttachment(t, uploadAttachment(token, "NOTES.txt", "second"))
+	readUploadedAttachment(t, uploadAttachment(token, "app.log", "started"))
+
+	w := getAttachmentArchive(token, "0", "")
+
+	if w.Result().StatusCode != 200 || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("Expected zip got %v", w.Result())
+	}
+
+	if disposition := w.Header().Get("Content-Disposition"); disposition != `attachment; filename="incident-0-attachments.zip"` {
+		t.Errorf("Unexpected Content-Disposition %v", disposition)
+	}
+
+	entries := readZipEntries(t, w.Body.Bytes())
+	if entries["attachments/notes.txt"] != "first" || entries["attachments/NOTES (2).txt"] != "second" || entries["attachments/app.log"] != "started" {
+		t.Errorf("Unexpected entries %v", entries)
+	}
+
+	manifest := readArchiveManifest(t, entries)
+	if manifest.Incident.Id != 0 || len(manifest.Attachments) != 3 || manifest.Attachments[1].Path != "attachments/NOTES (2).txt" {
+		t.Errorf("Unexpected manifest %v", manifest)
+	}
+}
+
+func TestAttachmentArchiveTarGz(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	readUploadedAttachment(t, uploadAttachment(token, "notes.txt", "first"))
+
+	w := getAttachmentArchive(token, "0", "application/gzip")
+
+	if w.Result().StatusCode != 200 || w.Header().Get("Content-Type") != "application/gzip" {
+		t.Fatalf("Expected tar.gz got %v", w.Result())
+	}
+
+	compressed, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("Unable to read gzip %v", err)
+	}
+
+	entries := make(map[string]string)
+	reader := tar.NewReader(compressed)
+	for {
+		header, err := reader.Next()
+		if err != nil {
+			break
+		}
+
+		data, _ := io.ReadAll(reader)
+		entries[header.Name] = string(data)
+	}
+
+	if entries["attachments/notes.txt"] != "first" || len(entries[incidentArchiveManifest]) == 0 {
+		t.Errorf("Unexpected entries %v", entries)
+	}
+}
+
+func TestAttachmentArchiveSkipsQuarantined(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	readUploadedAttachment(t, uploadAttachment(token, "notes.txt", "clean"))
+	attachmentScanner = FakeScanner{errors.New("scanner unavailable")}
+	readUploadedAttachment(t, uploadAttachment(token, "other.txt", "unknown"))
+
+	entries := readZipEntries(t, getAttachmentArchive(token, "0", "").Body.Bytes())
+
+	if _, found := entries["attachments/other.txt"]; found || entries["attachments/notes.txt"] != "clean" {
+		t.Errorf("Unexpected entries %v", entries)
+	}
+
+	manifest := readArchiveManifest(t, entries)
+	if len(manifest.Attachments) != 2 || len(manifest.Attachments[1].Path) != 0 || len(manifest.Attachments[1].Skipped) == 0 {
+		t.Errorf("Expected quarantined attachment to be skipped got %v", manifest)
+	}
+}
+
+func TestAttachmentArchiveNotAcceptable(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+
+	if w := getAttachmentArchive(token, "0", "text/csv"); w.Result().StatusCode != 406 {
+		t.Errorf("Expected 406 status code got %v", w.Result())
+	}
+}
+
+func TestAttachmentArchiveMissingIncident(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+
+	if w := getAttachmentArchive(token, "42", ""); w.Result().StatusCode != 404 {
+		t.Errorf("Expected 404 status code got %v", w.Result())
+	}
+}
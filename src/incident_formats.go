@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	jsonFormat   = "application/json"
+	csvFormat    = "text/csv"
+	ndjsonFormat = "application/x-ndjson"
+	yamlFormat   = "application/yaml"
+)
+
+const attributeColumnPrefix = "attributes."
+
+// incidentFields are the non attribute incident fields in the order they are written.
+var incidentFields = []string{"type", "id", "description", "reporter", "state"}
+
+// IncidentProjection controls which parts of an incident are returned.
+// The Fields are the incident fields to return in the order of incidentFields.
+// AllAttributes indicates that every attribute should be returned.
+// The Attributes are the specific attributes to return.
+type IncidentProjection struct {
+	Fields        []string
+	AllAttributes bool
+	Attributes    []string
+}
+
+// convertFields reads the fields query parameter into a projection.
+// Names that are not incident fields are treated as attributes, the same way filters treat them.
+// A nil projection means the whole incident should be returned.
+func convertFields(r *http.Request) *IncidentProjection {
+	param := r.URL.Query().Get("fields")
+	if len(param) == 0 {
+		return nil
+	}
+
+	projection := new(IncidentProjection)
+	requested := make(map[string]bool, 0)
+	attributes := make(map[string]bool, 0)
+
+	for _, field := range strings.Split(param, ",") {
+		field = strings.TrimSpace(field)
+		if len(field) == 0 {
+			continue
+		}
+
+		if strings.EqualFold(field, "attributes") {
+			projection.AllAttributes = true
+			continue
+		}
+
+		if isIncidentField(field) {
+			requested[strings.ToLower(field)] = true
+			continue
+		}
+
+		name := strings.TrimPrefix(field, attributeColumnPrefix)
+		if !attributes[name] {
+			attributes[name] = true
+			projection.Attributes = append(projection.Attributes, name)
+		}
+	}
+
+	for _, field := range incidentFields {
+		if requested[field] {
+			projection.Fields = append(projection.Fields, field)
+		}
+	}
+
+	sort.Strings(projection.Attributes)
+	return projection
+}
+
+func isIncidentField(field string) bool {
+	for _, f := range incidentFields {
+		if strings.EqualFold(f, field) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// negotiateIncidentFormat picks the best supported format out of the requests Accept header.
+// If none of the accepted formats are supported an empty string is returned.
+func negotiateIncidentFormat(r *http.Request) string {
+	return negotiateFormat(r, jsonFormat, convertToIncidentFormat)
+}
+
+// negotiateFormat picks the best format out of the requests Accept header using convert to find the format of each media type.
+// The fallback is used if there is no Accept header.
+func negotiateFormat(r *http.Request, fallback string, convert func(mediaType string) string) string {
+	accept := r.Header.Get("Accept")
+	if len(accept) == 0 {
+		return fallback
+	}
+
+	best := ""
+	bestQuality := 0.0
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(q, 64); err == nil {
+				quality = parsed
+			}
+		}
+
+		format := convert(mediaType)
+		if len(format) > 0 && quality > bestQuality {
+			best = format
+			bestQuality = quality
+		}
+	}
+
+	return best
+}
+
+func convertToIncidentFormat(mediaType string) string {
+	switch mediaType {
+	case jsonFormat, "application/*", "*/*":
+		return jsonFormat
+	case csvFormat, "text/*":
+		return csvFormat
+	case ndjsonFormat, "application/jsonl":
+		return ndjsonFormat
+	case yamlFormat, "application/x-yaml", "text/yaml":
+		return yamlFormat
+	}
+
+	return ""
+}
+
+// incidentColumns returns the columns to write for a set of incidents.
+// Incident fields come first followed by attributes sorted by name.
+func incidentColumns(projection *IncidentProjection, incidents []Incident) []string {
+	columns := make([]string, 0)
+
+	if projection == nil {
+		columns = append(columns, incidentFields...)
+	} else {
+		columns = append(columns, projection.Fields...)
+	}
+
+	var attributes []string
+	if projection == nil || projection.AllAttributes {
+		found := make(map[string]bool, 0)
+		for _, incident := range incidents {
+			for k := range incident.Attributes {
+				found[k] = true
+			}
+		}
+
+		if projection != nil {
+			for _, k := range projection.Attributes {
+				found[k] = true
+			}
+		}
+
+		for k := range found {
+			attributes = append(attributes, k)
+		}
+
+		sort.Strings(attributes)
+	} else {
+		attributes = projection.Attributes
+	}
+
+	for _, attribute := range attributes {
+		columns = append(columns, attributeColumnPrefix+attribute)
+	}
+
+	return columns
+}
+
+func getIncidentColumnValue(column string, incident Incident) string {
+	if strings.HasPrefix(column, attributeColumnPrefix) {
+		return incident.Attributes[strings.TrimPrefix(column, attributeColumnPrefix)]
+	}
+
+	if column == "type" {
+		return incident.Type
+	}
+
+	return getIncidentPropertyValue(column, incident)
+}
+
+// projectIncident converts an incident into a map only containing the requested columns.
+func projectIncident(columns []string, incident Incident) map[string]interface{} {
+	retVal := make(map[string]interface{}, len(columns))
+	attributes := make(map[string]string, 0)
+	hasAttributes := false
+
+	for _, column := range columns {
+		if strings.HasPrefix(column, attributeColumnPrefix) {
+			hasAttributes = true
+			name := strings.TrimPrefix(column, attributeColumnPrefix)
+			if val, ok := incident.Attributes[name]; ok {
+				attributes[name] = val
+			}
+			continue
+		}
+
+		if column == "id" {
+			retVal[column] = incident.Id
+			continue
+		}
+
+		retVal[column] = getIncidentColumnValue(column, incident)
+	}
+
+	if hasAttributes {
+		retVal["attributes"] = attributes
+	}
+
+	return retVal
+}
+
+// writeIncidents writes a set of incidents in the requested format.
+func writeIncidents(w io.Writer, format string, projection *IncidentProjection, incidents []Incident) error {
+	switch format {
+	case csvFormat:
+		return writeIncidentsCSV(w, projection, incidents)
+	case ndjsonFormat:
+		return writeIncidentsNDJSON(w, projection, incidents)
+	case yamlFormat:
+		return writeIncidentsYAML(w, projection, incidents)
+	}
+
+	if projection == nil {
+		return json.NewEncoder(w).Encode(incidents)
+	}
+
+	columns := incidentColumns(projection, incidents)
+	projected := make([]map[string]interface{}, 0, len(incidents))
+	for _, incident := range incidents {
+		projected = append(projected, projectIncident(columns, incident))
+	}
+
+	return json.NewEncoder(w).Encode(projected)
+}
+
+func writeIncidentsCSV(w io.Writer, projection *IncidentProjection, incidents []Incident) error {
+	columns := incidentColumns(projection, incidents)
+	writer := csv.NewWriter(w)
+
+	record := make([]string, len(columns))
+	for i, column := range columns {
+		record[i] = escapeCSVCell(column)
+	}
+
+	if err := writer.Write(record); err != nil {
+		return err
+	}
+
+	for _, incident := range incidents {
+		for i, column := range columns {
+			record[i] = escapeCSVCell(getIncidentColumnValue(column, incident))
+		}
+
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// escapeCSVCell keeps spreadsheets from running a cell as a formula.
+// Incidents can be created without a token so any value starting like a formula is prefixed with a quote.
+func escapeCSVCell(value string) string {
+	if len(value) > 0 && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+
+	return value
+}
+
+func writeIncidentsNDJSON(w io.Writer, projection *IncidentProjection, incidents []Incident) error {
+	buffer := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffer)
+
+	var columns []string
+	if projection != nil {
+		columns = incidentColumns(projection, incidents)
+	}
+
+	for _, incident := range incidents {
+		var err error
+		if projection == nil {
+			err = encoder.Encode(incident)
+		} else {
+			err = encoder.Encode(projectIncident(columns, incident))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return buffer.Flush()
+}
+
+func writeIncidentsYAML(w io.Writer, projection *IncidentProjection, incidents []Incident) error {
+	columns := incidentColumns(projection, incidents)
+	buffer := bufio.NewWriter(w)
+
+	if len(incidents) == 0 {
+		buffer.WriteString("[]\n")
+		return buffer.Flush()
+	}
+
+	for _, incident := range incidents {
+		data, err := yaml.Marshal([]*yaml.Node{convertToYAMLNode(columns, incident)})
+		if err != nil {
+			return err
+		}
+
+		if _, err := buffer.Write(data); err != nil {
+			return err
+		}
+	}
+
+	return buffer.Flush()
+}
+
+// convertToYAMLNode builds a mapping node so that keys keep the column order.
+func convertToYAMLNode(columns []string, incident Incident) *yaml.Node {
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	var attributes *yaml.Node
+
+	for _, column := range columns {
+		if strings.HasPrefix(column, attributeColumnPrefix) {
+			name := strings.TrimPrefix(column, attributeColumnPrefix)
+			val, ok := incident.Attributes[name]
+			if !ok {
+				continue
+			}
+
+			if attributes == nil {
+				attributes = &yaml.Node{Kind: yaml.MappingNode}
+			}
+
+			attributes.Content = append(attributes.Content, yamlString(name), yamlString(val))
+			continue
+		}
+
+		value := yamlString(getIncidentColumnValue(column, incident))
+		if column == "id" {
+			value = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.FormatInt(incident.Id, 10)}
+		}
+
+		node.Content = append(node.Content, yamlString(column), value)
+	}
+
+	if attributes != nil {
+		node.Content = append(node.Content, yamlString("attributes"), attributes)
+	}
+
+	return node
+}
+
+func yamlString(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
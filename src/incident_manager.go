@@ -5,17 +5,32 @@ package main
 // GetIncident should return the requested incident and return a false if the incident does not exist
 // GetIncidents should return all managed incidents.
 // Update incident should update the underlying incident with new data.
+// UpdateIncidents should apply the same update to each incident and report which incidents were updated.
 // AddAttachments should update the association between an incident and an attachment.
 // GetAttachments should get all attachments associated with an incident.
-// RemoveAttachment will find and remove an attachment associated with an incident.
+// UpdateAttachment should replace the stored attachment with the same id.
+// RemoveAttachment will find and remove an attachment associated with an incident by its id.
 // CleanUp will do any required cleanup actions on the incident manager.
 type IncidentManager interface {
 	AddIncident(incident *Incident) bool
 	GetIncident(incidentId int) (Incident, bool)
 	GetIncidents(filter *FilterRequest) ([]Incident, bool)
 	UpdateIncident(id int, incident IncidentUpdate) bool
+	UpdateIncidents(ids []int, update IncidentUpdate) map[int]bool
 	AddAttachment(incidentId int, attachment Attachment) bool
 	GetAttachments(incidentId int) ([]Attachment, bool)
-	RemoveAttachment(incidentId int, fileName string) bool
+	UpdateAttachment(incidentId int, attachment Attachment) bool
+	RemoveAttachment(incidentId int, attachmentId string) bool
 	CleanUp()
 }
+
+// updateIncidents applies an update to each incident one at a time.
+// This is used by managers that do not support transactions.
+func updateIncidents(manager IncidentManager, ids []int, update IncidentUpdate) map[int]bool {
+	results := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		results[id] = manager.UpdateIncident(id, update)
+	}
+
+	return results
+}
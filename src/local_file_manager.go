@@ -4,8 +4,8 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"mime/multipart"
 	"os"
+	"strings"
 )
 
 // LocalFileManager is a manager to use to store attachments locally on the running machine.
@@ -13,26 +13,38 @@ type LocalFileManager struct {
 	Root string // The root folder to store attachments under.
 }
 
+// isSafePathPart makes sure a part of a path names a single entry, so it cannot escape the Root.
+func isSafePathPart(part string) bool {
+	return len(part) > 0 && part != "." && part != ".." && !strings.ContainsAny(part, "/\\\x00")
+}
+
 // SaveFile will attempt to save a file to the local file system.
 // The the request fails a false will be returned.
-func (m LocalFileManager) SaveFile(incident string, fileName string, file multipart.File) (string, bool) {
+func (m LocalFileManager) SaveFile(incident string, fileName string, file io.Reader) (string, bool) {
+	if !isSafePathPart(incident) || !isSafePathPart(fileName) {
+		log.Printf("Refusing to save unsafe path %v/%v\n", incident, fileName)
+		return "", false
+	}
+
 	filePath := m.Root + "/incidents/" + incident + "/"
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
 		fmt.Println("Path does not exist creating path")
-		os.MkdirAll(filePath, 0777)
+		os.MkdirAll(filePath, 0700)
 	}
 
 	filePath += fileName
 	fmt.Printf("Attempting to create file at path %v\n", filePath)
 
-	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0666)
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 
 	if err != nil {
 		return filePath, false
 	}
 
 	defer f.Close()
-	io.Copy(f, file)
+	if _, err := io.Copy(f, file); err != nil {
+		return filePath, false
+	}
 
 	return filePath, true
 }
@@ -40,6 +52,11 @@ func (m LocalFileManager) SaveFile(incident string, fileName string, file multip
 // LoadFile will attempt to load a file from the local file system.
 // If the attempt fails a false will be returned.
 func (m LocalFileManager) LoadFile(incident string, fileName string) (io.ReadSeeker, os.FileInfo, bool, func()) {
+	if !isSafePathPart(incident) || !isSafePathPart(fileName) {
+		log.Printf("Refusing to load unsafe path %v/%v\n", incident, fileName)
+		return nil, nil, false, nil
+	}
+
 	fileDir := m.Root + "/incidents/" + incident + "/"
 	if _, err := os.Stat(fileDir); os.IsNotExist(err) {
 		log.Println("Path does not exist failing request")
@@ -69,6 +86,11 @@ func (m LocalFileManager) LoadFile(incident string, fileName string) (io.ReadSee
 
 // DeleteFile should attempt to remove the file assoicated with an incident.
 func (m LocalFileManager) DeleteFile(incident string, fileName string) bool {
+	if !isSafePathPart(incident) || !isSafePathPart(fileName) {
+		log.Printf("Refusing to delete unsafe path %v/%v\n", incident, fileName)
+		return false
+	}
+
 	filePath := m.Root + "/incidents/" + incident + "/" + fileName
 
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
@@ -83,3 +105,37 @@ func (m LocalFileManager) DeleteFile(incident string, fileName string) bool {
 
 	return true
 }
+
+// ListFiles will list every file stored under the Root.
+func (m LocalFileManager) ListFiles() ([]StoredFile, bool) {
+	files := make([]StoredFile, 0)
+	incidents, err := os.ReadDir(m.Root + "/incidents")
+	if os.IsNotExist(err) {
+		return files, true
+	}
+
+	if err != nil {
+		log.Printf("Unable to list incidents %v\n", err)
+		return nil, false
+	}
+
+	for _, incident := range incidents {
+		if !incident.IsDir() {
+			continue
+		}
+
+		entries, err := os.ReadDir(m.Root + "/incidents/" + incident.Name())
+		if err != nil {
+			log.Printf("Unable to list files of incident %v %v\n", incident.Name(), err)
+			return nil, false
+		}
+
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				files = append(files, StoredFile{incident.Name(), entry.Name()})
+			}
+		}
+	}
+
+	return files, true
+}
@@ -2,15 +2,18 @@ package main
 
 import (
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/user"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/handlers"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var logManager LogManager
@@ -34,14 +37,57 @@ func main() {
 	config := processConfig(path)
 	initialize(config)
 
+	if len(os.Args) > 2 && os.Args[2] == "rebuild-index" {
+		count, _ := searchIndex.Rebuild()
+		log.Printf("Indexed %v incidents\n", count)
+		return
+	}
+
+	if len(os.Args) > 2 && os.Args[2] == "migrate-files" {
+		migrateFiles()
+		return
+	}
+
+	if len(os.Args) > 2 && os.Args[2] == "gc-files" {
+		collectFiles(len(os.Args) > 3 && os.Args[3] == "repair")
+		return
+	}
+
 	defer incidentManager.CleanUp()
 	startListening(config)
 }
 
+// migrateFiles copies every attachment to the migration target and waits for it to finish.
+func migrateFiles() {
+	if migrationTarget == nil {
+		log.Fatal("No migrationtarget is configured")
+	}
+
+	job := storageMigrations.NewStorageMigrationJob()
+	job.Run(fileManager, migrationTarget)
+
+	data, _ := job.Status()
+	log.Printf("Migration finished %v\n", string(data))
+	if job.State != migrationCompleted || job.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// collectFiles reports the attachment files that are orphaned or missing, and repairs them if asked to.
+func collectFiles(repair bool) {
+	report, passed := collectStorageGarbage(repair)
+	if !passed {
+		log.Fatal("Unable to check attachment files")
+	}
+
+	data, _ := json.MarshalIndent(report, "", "  ")
+	log.Printf("Checked attachment files %v\n", string(data))
+}
+
 func startListening(config Config) {
 	router := NewRouter()
 
-	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type"})
+	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization"})
 	originsOk := handlers.AllowedOrigins([]string{"*"})
 	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "OPTIONS"})
 
@@ -71,7 +117,7 @@ func processConfig(file string) Config {
 	parser := json.NewDecoder(configFile)
 	parser.Decode(&config)
 
-	log.Printf("Loaded config %v\n", config)
+	log.Printf("Loaded config %v\n", config.redacted())
 	return config
 }
 
@@ -102,8 +148,11 @@ func createDefaultConfig() Config {
 func initialize(config Config) {
 	setupAdmin(config)
 	setupLogManager(config)
+	setupPasswords(config)
+	setupTokens(config)
 	setupFileManager(config)
 	setupManagers(config)
+	go reclaimTokensPeriodically(time.Minute * 10)
 
 	hookManager = HookManager{
 		config.Hooks.AddedHooks,
@@ -111,6 +160,59 @@ func initialize(config Config) {
 		config.Hooks.AttachedHooks,
 		config.Hooks.AddedUserHooks,
 		config.Hooks.UpdatedUserHooks,
+		config.Hooks.BulkUpdatedHooks,
+		config.Hooks.InfectedHooks,
+	}
+
+	incidentTransitions = config.Incidents.Transitions
+	setupSearchIndex(config)
+	setupUploads(config)
+	setupDownloadLinks(config)
+	setupScanner(config)
+	setupPreviews(config)
+}
+
+func setupPreviews(config Config) {
+	previewGenerator = NewPreviewGenerator(config.Previews.ThumbnailSizes, config.Previews.Lines, config.Previews.MaxPixels)
+	startPreviewGeneration()
+}
+
+func setupDownloadLinks(config Config) {
+	if len(config.Links.Secret) == 0 {
+		log.Println("No download link secret configured, download links will stop working on restart")
+	}
+
+	downloadLinks = NewDownloadLinkSigner(config.Links.Secret, time.Minute*time.Duration(config.Links.ExpirationMinutes), time.Minute*time.Duration(config.Links.MaxExpirationMinutes))
+}
+
+func setupScanner(config Config) {
+	timeout := time.Second * time.Duration(config.Scanner.TimeoutSeconds)
+	switch config.Scanner.Type {
+	case "":
+		attachmentScanner = nil
+	case "clamd":
+		log.Printf("Scanning attachments with clamd at %v\n", config.Scanner.Address)
+		attachmentScanner = NewClamdScanner(config.Scanner.Address, timeout)
+	case "exec":
+		log.Printf("Scanning attachments with %v\n", config.Scanner.Command)
+		attachmentScanner = ExecScanner{config.Scanner.Command, config.Scanner.Args, timeout}
+	default:
+		log.Fatalf("Unknown scanner type %v\n", config.Scanner.Type)
+	}
+}
+
+func setupUploads(config Config) {
+	uploadPolicy = NewUploadPolicy(config.Uploads)
+	resumableUploads = NewResumableUploadManager(config.Uploads.MaxSize, time.Hour*time.Duration(config.Uploads.ExpirationHours))
+	go expireUploadsPeriodically(time.Minute * 10)
+}
+
+func setupSearchIndex(config Config) {
+	searchIndex = NewSearchIndex(config.Search.Path)
+	startSearchIndexing()
+
+	if len(config.Search.Path) > 0 {
+		go saveSearchIndexPeriodically(time.Second * 30)
 	}
 }
 
@@ -124,24 +226,188 @@ func setupAdmin(config Config) {
 	}
 }
 
+func setupPasswords(config Config) {
+	if config.Passwords.Algorithm != "" && config.Passwords.Algorithm != argon2idAlgorithm && config.Passwords.Algorithm != bcryptAlgorithm {
+		log.Fatalf("Unknown password algorithm %v\n", config.Passwords.Algorithm)
+	}
+
+	if config.Passwords.Algorithm == bcryptAlgorithm && config.Passwords.Cost != 0 && (config.Passwords.Cost < bcrypt.MinCost || config.Passwords.Cost > bcrypt.MaxCost) {
+		log.Fatalf("The bcrypt cost must be between %v and %v\n", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+
+	passwordHasher = NewPasswordHasher(config.Passwords)
+	log.Printf("Hashing passwords with %v\n", passwordHasher.Algorithm)
+}
+
+func setupTokens(config Config) {
+	signer := NewRandomTokenSigner()
+	if len(config.Tokens.ActiveKey) == 0 && len(config.Tokens.KeyFile) == 0 {
+		log.Println("No token keys configured, tokens will stop working on restart")
+	} else {
+		loaded, err := loadTokenSigner(config.Tokens)
+		if err != nil {
+			log.Fatalf("Unable to load token keys %v\n", err)
+		}
+
+		log.Printf("Signing tokens with key %v\n", loaded.Active)
+		signer = loaded
+	}
+
+	if config.Tokens.ExpirationMinutes < 0 || config.Tokens.RefreshExpirationHours < 0 {
+		log.Fatalln("Token expirations cannot be negative")
+	}
+
+	if config.Tokens.ExpirationMinutes > 0 {
+		signer.Expiration = time.Minute * time.Duration(config.Tokens.ExpirationMinutes)
+	}
+
+	if config.Tokens.RefreshExpirationHours > 0 {
+		signer.RefreshExpiration = time.Hour * time.Duration(config.Tokens.RefreshExpirationHours)
+	}
+
+	tokenSigner = signer
+}
+
+func loadTokenSigner(config TokenConfig) (*TokenSigner, error) {
+	if len(config.KeyFile) > 0 {
+		data, err := os.ReadFile(config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Keys = nil
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, err
+		}
+	}
+
+	keys := make(map[string]TokenKey)
+	for id, keyConfig := range config.Keys {
+		decoded, err := base64.StdEncoding.DecodeString(keyConfig.Key)
+		if err != nil {
+			return nil, fmt.Errorf("token key %v is not base64 %v", id, err)
+		}
+
+		key, err := NewTokenKey(keyConfig.Algorithm, decoded)
+		if err != nil {
+			return nil, fmt.Errorf("token key %v %v", id, err)
+		}
+
+		keys[id] = key
+	}
+
+	return NewTokenSigner(config.ActiveKey, keys)
+}
+
 func setupLogManager(config Config) {
 	logManager = LogManager{config.Logging.Path, config.Logging.Enabled}
 	logManager.Initialize()
 }
 
 func setupFileManager(config Config) {
-	if config.FileManagerType > 0 {
+	fileManager = buildFileManager(config)
+
+	if config.MigrationTarget != nil {
+		log.Println("Setting up file manager to migrate attachments to")
+		migrationTarget = buildFileManager(*config.MigrationTarget)
+	}
+}
+
+// buildFileManager creates the configured file manager with encryption and deduplication added on top.
+func buildFileManager(config Config) FileManager {
+	manager := createFileManager(config)
+
+	if len(config.Encryption.ActiveKey) > 0 || len(config.Encryption.KeyFile) > 0 {
+		keys, err := loadEncryptionKeys(config.Encryption)
+		if err != nil {
+			log.Fatalf("Unable to load encryption keys %v\n", err)
+		}
+
+		log.Printf("Encrypting attachments with key %v\n", keys.Active)
+		manager = EncryptedFileManager{manager, keys}
+	}
+
+	// Deduplication has to happen before encryption, every encrypted file is different even when the content is the same.
+	if config.Deduplicate {
+		log.Println("Deduplicating attachments")
+		manager = NewContentAddressedFileManager(manager)
+	}
+
+	return manager
+}
+
+func loadEncryptionKeys(config EncryptionConfig) (EncryptionKeys, error) {
+	if len(config.KeyFile) > 0 {
+		data, err := os.ReadFile(config.KeyFile)
+		if err != nil {
+			return EncryptionKeys{}, err
+		}
+
+		config.Keys = nil
+		if err := json.Unmarshal(data, &config); err != nil {
+			return EncryptionKeys{}, err
+		}
+	}
+
+	keys := make(map[string][]byte)
+	for id, encoded := range config.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return EncryptionKeys{}, fmt.Errorf("encryption key %v is not base64 %v", id, err)
+		}
+
+		keys[id] = key
+	}
+
+	return NewEncryptionKeys(config.ActiveKey, keys)
+}
+
+func createFileManager(config Config) FileManager {
+	switch config.FileManagerType {
+	case 1:
 		log.Printf("Setting file manager to s3 with region %v and bucket %v\n", config.S3Config.Region, config.S3Config.Bucket)
-		s3Manager := S3FileManager{config.S3Config.Region, config.S3Config.Bucket}
+		s3Manager := S3FileManager{config.S3Config.Region, config.S3Config.Bucket, time.Duration(config.S3Config.PresignMinutes) * time.Minute}
 		s3Manager.Initialize()
-		fileManager = &s3Manager
-		return
+		return &s3Manager
+	case 2:
+		log.Printf("Setting file manager to google cloud storage with bucket %v\n", config.GCSConfig.Bucket)
+		gcsManager := &GCSFileManager{ProjectName: config.GCSConfig.ProjectName, Bucket: config.GCSConfig.Bucket, AuthFile: config.GCSConfig.AuthFile}
+		gcsManager.Initialize()
+		return gcsManager
+	case 3:
+		log.Printf("Setting file manager to azure blob storage with account %v and container %v\n", config.AzureConfig.AccountName, config.AzureConfig.Container)
+		azureManager := &AzureBlobFileManager{
+			AccountName: config.AzureConfig.AccountName,
+			AccountKey:  config.AzureConfig.AccountKey,
+			Container:   config.AzureConfig.Container,
+			Endpoint:    config.AzureConfig.Endpoint,
+		}
+		azureManager.Initialize()
+		return azureManager
+	case 4:
+		log.Printf("Setting file manager to mysql database %v\n", config.MYSQL.DBName)
+		mysqlManager := MySQLFileManager{openMySQL(config.MYSQL)}
+		mysqlManager.Initialize()
+		return mysqlManager
+	case 5:
+		table := "IncidentFiles"
+		if len(config.DynamoConfig.FileTableOverride) > 0 {
+			table = config.DynamoConfig.FileTableOverride
+		}
+
+		log.Printf("Setting file manager to dynamodb with region %v and table %v\n", config.DynamoConfig.Region, table)
+		dynamoManager := NewDynamoDBFileManager(config.DynamoConfig.Region, config.DynamoConfig.Endpoint, table)
+		dynamoManager.Initialize()
+		return dynamoManager
+	}
+
+	if config.FileManagerType != 0 {
+		log.Fatalf("Unknown file manager type %v\n", config.FileManagerType)
 	}
 
 	if len(config.LocalFileConfig.Path) > 0 {
 		log.Printf("Setting local file manager path to %v\n", config.LocalFileConfig.Path)
-		fileManager = LocalFileManager{config.LocalFileConfig.Path}
-		return
+		return LocalFileManager{config.LocalFileConfig.Path}
 	}
 
 	currentUser, err := user.Current()
@@ -150,7 +416,7 @@ func setupFileManager(config Config) {
 		panic(err)
 	}
 
-	fileManager = LocalFileManager{currentUser.HomeDir}
+	return LocalFileManager{currentUser.HomeDir}
 }
 
 func setupManagers(config Config) {
@@ -167,13 +433,7 @@ func setupManagers(config Config) {
 	}
 
 	if config.ManagerType == 2 {
-		conn := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v", config.MYSQL.UserName, config.MYSQL.Password, config.MYSQL.Host, config.MYSQL.Port, config.MYSQL.DBName)
-		db, err := sql.Open("mysql", conn)
-
-		if err != nil {
-			panic(err)
-		}
-
+		db := openMySQL(config.MYSQL)
 		setupMySQLIncidentManager(config, db)
 		setupSQLUsermanager(config, db)
 		return
@@ -245,9 +505,30 @@ func setupDynamoDBManagers(config Config) {
 	udbManager.Initialize()
 	userManager = &udbManager
 
+	accounts := "ServiceAccounts"
+	if len(config.DynamoConfig.ServiceAccountTableOverride) > 0 {
+		accounts = config.DynamoConfig.ServiceAccountTableOverride
+		log.Printf("Found service account table override %v\n", accounts)
+	}
+
+	accountManager := NewDynamoDBServiceAccountManager(config.DynamoConfig.Region, config.DynamoConfig.Endpoint, accounts)
+	accountManager.Initialize()
+	serviceAccountManager = accountManager
+
 	ensureAdminAccount(0)
 }
 
+func openMySQL(config MySQLConfig) *sql.DB {
+	conn := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v", config.UserName, config.Password, config.Host, config.Port, config.DBName)
+	db, err := sql.Open("mysql", conn)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return db
+}
+
 func setupMySQLIncidentManager(config Config, db *sql.DB) {
 	mysqlManager := MySQLManager{db}
 	mysqlManager.Initialize()
@@ -268,6 +549,7 @@ func setupRuntimeUsermanager(config Config) {
 	userManager = RuntimeUserManager{make(map[int64]*User), make(map[int64]string), make(map[int64][]string), config.User.DefaultPermissions}
 	_, res := userManager.AddUser(&admin)
 	userManager.SetPermissions(res.Id, adminPermissions)
+	serviceAccountManager = NewRuntimeServiceAccountManager()
 }
 
 func setupSQLUsermanager(config Config, db *sql.DB) {
@@ -276,4 +558,8 @@ func setupSQLUsermanager(config Config, db *sql.DB) {
 
 	userManager = usrMySQLManager
 	ensureAdminAccount(1)
+
+	accountManager := MySQLServiceAccountManager{db}
+	accountManager.Initialize()
+	serviceAccountManager = accountManager
 }
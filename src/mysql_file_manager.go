@@ -0,0 +1,206 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"os"
+	"time"
+
+	guuid "github.com/google/uuid"
+)
+
+// MySQLFileManager stores attachments in the same mysql database as incidents, so a single backup captures everything.
+// Each file is split into chunks stored as rows of the IncidentFileChunks table.
+// Every save writes a new generation of chunks and only then points the file at it, so readers never see a partly saved file.
+type MySQLFileManager struct {
+	Connection *sql.DB
+}
+
+// Initialize creates the file tables if they do not already exist.
+func (manager MySQLFileManager) Initialize() {
+	tables := MySQLManager{manager.Connection}
+	if !tables.hasTable("IncidentFiles") {
+		logManager.LogPrintln("Unable to find file table creating now")
+		manager.createTable("CREATE TABLE IncidentFiles (" +
+			"Incident VARCHAR(255) NOT NULL, " +
+			"FileName VARCHAR(255) NOT NULL, " +
+			"Generation VARCHAR(36) NOT NULL, " +
+			"Size BIGINT NOT NULL, " +
+			"ChunkSize INT NOT NULL, " +
+			"Modified BIGINT NOT NULL, " +
+			"PRIMARY KEY(Incident, FileName))")
+	}
+
+	if !tables.hasTable("IncidentFileChunks") {
+		logManager.LogPrintln("Unable to find file chunk table creating now")
+		manager.createTable("CREATE TABLE IncidentFileChunks (" +
+			"Generation VARCHAR(36) NOT NULL, " +
+			"ChunkIndex INT NOT NULL, " +
+			"Data MEDIUMBLOB NOT NULL, " +
+			"PRIMARY KEY(Generation, ChunkIndex))")
+	}
+}
+
+func (manager MySQLFileManager) createTable(statement string) {
+	res, err := manager.Connection.Exec(statement)
+	if err != nil {
+		panic(err)
+	}
+
+	logManager.LogPrintf("Created file table: %v\n", res)
+}
+
+// SaveFile stores a file one chunk at a time and then points the file at the new chunks.
+// If the attempt fails a false will be returned.
+func (manager MySQLFileManager) SaveFile(incident string, fileName string, file io.Reader) (string, bool) {
+	generation := guuid.New().String()
+	stmt, err := manager.Connection.Prepare("INSERT INTO IncidentFileChunks (Generation, ChunkIndex, Data) VALUES (?, ?, ?)")
+	if err != nil {
+		logManager.LogPrintf("Error occurred when preparing file chunk insert %v\n", err)
+		return "", false
+	}
+
+	defer stmt.Close()
+	size, err := saveChunks(file, fileChunkSize, func(index int, data []byte) error {
+		_, err := stmt.Exec(generation, index, data)
+		return err
+	})
+
+	if err != nil {
+		logManager.LogPrintf("Unable to save file %v/%v %v\n", incident, fileName, err)
+		manager.deleteChunks(generation)
+		return "", false
+	}
+
+	tx, err := manager.Connection.Begin()
+	if err != nil {
+		manager.deleteChunks(generation)
+		return "", false
+	}
+
+	var previous string
+	err = tx.QueryRow("SELECT Generation FROM IncidentFiles WHERE Incident = ? AND FileName = ? FOR UPDATE", incident, fileName).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		manager.deleteChunks(generation)
+		return "", false
+	}
+
+	_, err = tx.Exec("INSERT INTO IncidentFiles (Incident, FileName, Generation, Size, ChunkSize, Modified) VALUES (?, ?, ?, ?, ?, ?) "+
+		"ON DUPLICATE KEY UPDATE Generation = VALUES(Generation), Size = VALUES(Size), ChunkSize = VALUES(ChunkSize), Modified = VALUES(Modified)",
+		incident, fileName, generation, size, fileChunkSize, time.Now().Unix())
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	if err != nil {
+		logManager.LogPrintf("Unable to save file %v/%v %v\n", incident, fileName, err)
+		manager.deleteChunks(generation)
+		return "", false
+	}
+
+	if len(previous) > 0 {
+		manager.deleteChunks(previous)
+	}
+
+	return "mysql:" + incident + "/" + fileName, true
+}
+
+// LoadFile streams a file out of the database as it is read.
+// Reading from an offset only queries the chunks from that offset on.
+func (manager MySQLFileManager) LoadFile(incident string, fileName string) (io.ReadSeeker, os.FileInfo, bool, func()) {
+	var generation string
+	var size, modified int64
+	var chunkSize int
+	err := manager.Connection.QueryRow("SELECT Generation, Size, ChunkSize, Modified FROM IncidentFiles WHERE Incident = ? AND FileName = ?", incident, fileName).
+		Scan(&generation, &size, &chunkSize, &modified)
+
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logManager.LogPrintf("Unable to find file %v/%v %v\n", incident, fileName, err)
+		}
+
+		return nil, nil, false, nil
+	}
+
+	object := &rangedObject{
+		open: func(offset int64) (io.ReadCloser, error) {
+			rows, err := manager.Connection.Query("SELECT Data FROM IncidentFileChunks WHERE Generation = ? AND ChunkIndex >= ? ORDER BY ChunkIndex",
+				generation, offset/int64(chunkSize))
+
+			if err != nil {
+				return nil, err
+			}
+
+			next := func() ([]byte, error) {
+				if !rows.Next() {
+					if err := rows.Err(); err != nil {
+						return nil, err
+					}
+
+					return nil, io.EOF
+				}
+
+				var data []byte
+				err := rows.Scan(&data)
+				return data, err
+			}
+
+			return newChunkReader(int(offset%int64(chunkSize)), next, rows.Close), nil
+		},
+		size: size,
+	}
+
+	info := objectFileInfo{fileName, size, time.Unix(modified, 0)}
+	return object, info, true, object.close
+}
+
+// DeleteFile removes a file and its chunks.
+func (manager MySQLFileManager) DeleteFile(incident string, fileName string) bool {
+	var generation string
+	err := manager.Connection.QueryRow("SELECT Generation FROM IncidentFiles WHERE Incident = ? AND FileName = ?", incident, fileName).Scan(&generation)
+	if err != nil {
+		logManager.LogPrintf("Unable to find file %v/%v %v\n", incident, fileName, err)
+		return false
+	}
+
+	if _, err := manager.Connection.Exec("DELETE FROM IncidentFiles WHERE Incident = ? AND FileName = ? AND Generation = ?", incident, fileName, generation); err != nil {
+		logManager.LogPrintf("Unable to delete file %v/%v %v\n", incident, fileName, err)
+		return false
+	}
+
+	manager.deleteChunks(generation)
+	return true
+}
+
+// ListFiles will list every file stored in the database.
+func (manager MySQLFileManager) ListFiles() ([]StoredFile, bool) {
+	rows, err := manager.Connection.Query("SELECT Incident, FileName FROM IncidentFiles")
+	if err != nil {
+		logManager.LogPrintf("Unable to list files %v\n", err)
+		return nil, false
+	}
+
+	defer rows.Close()
+	files := make([]StoredFile, 0)
+	for rows.Next() {
+		var file StoredFile
+		if err := rows.Scan(&file.Incident, &file.FileName); err != nil {
+			logManager.LogPrintf("Unable to list files %v\n", err)
+			return nil, false
+		}
+
+		files = append(files, file)
+	}
+
+	return files, rows.Err() == nil
+}
+
+func (manager MySQLFileManager) deleteChunks(generation string) {
+	if _, err := manager.Connection.Exec("DELETE FROM IncidentFileChunks WHERE Generation = ?", generation); err != nil {
+		logManager.LogPrintf("Unable to delete file chunks %v %v\n", generation, err)
+	}
+}
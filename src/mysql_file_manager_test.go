@@ -0,0 +1,25 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+)
+
+// TestMySQLFileManager runs against a mysql database, set SONA_MYSQL_DSN to a data source name like user:password@tcp(127.0.0.1:3306)/sona.
+func TestMySQLFileManager(t *testing.T) {
+	dsn := os.Getenv("SONA_MYSQL_DSN")
+	if len(dsn) == 0 {
+		t.Skip("SONA_MYSQL_DSN is not set")
+	}
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatalf("Unable to open database %v", err)
+	}
+
+	defer db.Close()
+	manager := MySQLFileManager{db}
+	manager.Initialize()
+	testFileManager(t, manager)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	b64 "encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	argon2idAlgorithm = "argon2id"
+	bcryptAlgorithm   = "bcrypt"
+	argon2SaltSize    = 16
+	argon2KeySize     = 32
+)
+
+var errUnknownPasswordHash = errors.New("unknown password hash")
+
+// PasswordHasher hashes passwords with argon2id or bcrypt.
+// Each hash is stored in a self describing format that records its algorithm, cost and salt, so hashes made with different settings can be checked.
+// Argon2id hashes use the format $argon2id$v=19$m={memory},t={iterations},p={parallelism}${salt}${hash} and bcrypt hashes use the standard $2a$ format.
+// Hashes made before either was used are an unsalted SHA-256 of the password and email address, these are still checked so they can be replaced.
+type PasswordHasher struct {
+	Algorithm   string
+	Memory      uint32 // The memory argon2id uses in KiB.
+	Iterations  uint32 // The passes argon2id makes over the memory.
+	Parallelism uint8  // The threads argon2id uses.
+	Cost        int    // The bcrypt cost.
+}
+
+var passwordHasher = NewPasswordHasher(PasswordConfig{})
+
+// NewPasswordHasher creates a hasher from the config, filling in the recommended defaults.
+func NewPasswordHasher(config PasswordConfig) PasswordHasher {
+	hasher := PasswordHasher{config.Algorithm, config.Memory, config.Iterations, config.Parallelism, config.Cost}
+	if len(hasher.Algorithm) == 0 {
+		hasher.Algorithm = argon2idAlgorithm
+	}
+
+	if hasher.Memory == 0 {
+		hasher.Memory = 19 * 1024
+	}
+
+	if hasher.Iterations == 0 {
+		hasher.Iterations = 2
+	}
+
+	if hasher.Parallelism == 0 {
+		hasher.Parallelism = 1
+	}
+
+	if hasher.Cost == 0 {
+		hasher.Cost = bcrypt.DefaultCost
+	}
+
+	return hasher
+}
+
+// Hash creates a new salted hash of a password.
+func (hasher PasswordHasher) Hash(password string) (string, error) {
+	if hasher.Algorithm == bcryptAlgorithm {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), hasher.Cost)
+		return string(hash), err
+	}
+
+	salt := make([]byte, argon2SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, hasher.Iterations, hasher.Memory, hasher.Parallelism, argon2KeySize)
+	return fmt.Sprintf("$argon2id$v=%v$m=%v,t=%v,p=%v$%v$%v", argon2.Version, hasher.Memory, hasher.Iterations, hasher.Parallelism,
+		b64.RawStdEncoding.EncodeToString(salt), b64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify checks a password against a stored hash.
+// The rehash result is true when the password matches a hash that was not made with the current algorithm and cost.
+// A hash is only treated as argon2id or bcrypt when it parses as one, since a legacy hash is raw bytes that can start with the same characters.
+func (hasher PasswordHasher) Verify(user User, password string, stored string) (match bool, rehash bool) {
+	if params, salt, key, err := parseArgon2Hash(stored); err == nil {
+		computed := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+		if subtle.ConstantTimeCompare(computed, key) != 1 {
+			return false, false
+		}
+
+		return true, hasher.Algorithm != argon2idAlgorithm || params.Memory != hasher.Memory || params.Iterations != hasher.Iterations || params.Parallelism != hasher.Parallelism
+	}
+
+	if cost, err := bcrypt.Cost([]byte(stored)); err == nil {
+		if bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) != nil {
+			return false, false
+		}
+
+		return true, hasher.Algorithm != bcryptAlgorithm || cost != hasher.Cost
+	}
+
+	if len(stored) != sha256.Size {
+		if len(stored) > 0 {
+			logManager.LogPrintf("Unable to check password of user %v %v\n", user.Id, errUnknownPasswordHash)
+		}
+		return false, false
+	}
+
+	legacy := sha256.Sum256([]byte(password + user.EmailAddress))
+	return subtle.ConstantTimeCompare(legacy[:], []byte(stored)) == 1, true
+}
+
+func parseArgon2Hash(stored string) (PasswordHasher, []byte, []byte, error) {
+	var params PasswordHasher
+	var version int
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 || len(parts[0]) != 0 || parts[1] != argon2idAlgorithm {
+		return params, nil, nil, errUnknownPasswordHash
+	}
+
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errUnknownPasswordHash
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, err
+	}
+
+	salt, err := b64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+
+	key, err := b64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, errUnknownPasswordHash
+	}
+
+	return params, salt, key, nil
+}
+
+// createPasswordHash hashes a password with the configured algorithm.
+// An empty hash is returned if the password cannot be hashed, no password matches it.
+func createPasswordHash(password string) string {
+	hash, err := passwordHasher.Hash(password)
+	if err != nil {
+		logManager.LogPrintf("Unable to hash password %v\n", err)
+		return ""
+	}
+
+	return hash
+}
+
+// checkPassword checks a password against the stored hash of a user.
+// If the hash needs to be upgraded to the configured algorithm the password is hashed again and passed to store.
+func checkPassword(user User, password string, stored string, store func(hash string) bool) bool {
+	match, rehash := passwordHasher.Verify(user, password, stored)
+	if match && rehash {
+		if hash := createPasswordHash(password); len(hash) > 0 && !store(hash) {
+			logManager.LogPrintf("Unable to rehash password of user %v\n", user.Id)
+		}
+	}
+
+	return match
+}
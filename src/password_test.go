@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha256"
+	"strings"
+	"testing"
+)
+
+func TestPasswordHashesAreSalted(t *testing.T) {
+	hasher := NewPasswordHasher(PasswordConfig{})
+	first, _ := hasher.Hash("secret")
+	second, _ := hasher.Hash("secret")
+
+	if !strings.HasPrefix(first, "$argon2id$v=19$m=19456,t=2,p=1$") || first == second {
+		t.Errorf("Expected different argon2id hashes got %v and %v", first, second)
+	}
+
+	if match, rehash := hasher.Verify(User{}, "secret", first); !match || rehash {
+		t.Errorf("Expected password to match without rehash got %v %v", match, rehash)
+	}
+
+	if match, _ := hasher.Verify(User{}, "wrong", first); match {
+		t.Errorf("Expected wrong password not to match")
+	}
+}
+
+func TestBcryptPasswordHash(t *testing.T) {
+	hasher := NewPasswordHasher(PasswordConfig{Algorithm: bcryptAlgorithm, Cost: 4})
+	hash, err := hasher.Hash("secret")
+
+	if err != nil || !strings.HasPrefix(hash, "$2a$04$") {
+		t.Fatalf("Expected bcrypt hash got %v %v", hash, err)
+	}
+
+	if match, rehash := hasher.Verify(User{}, "secret", hash); !match || rehash {
+		t.Errorf("Expected password to match without rehash got %v %v", match, rehash)
+	}
+
+	if _, rehash := NewPasswordHasher(PasswordConfig{Algorithm: bcryptAlgorithm, Cost: 5}).Verify(User{}, "secret", hash); !rehash {
+		t.Errorf("Expected a changed cost to rehash")
+	}
+
+	if match, rehash := NewPasswordHasher(PasswordConfig{}).Verify(User{}, "secret", hash); !match || !rehash {
+		t.Errorf("Expected bcrypt hash to match and move to argon2id got %v %v", match, rehash)
+	}
+}
+
+func TestLegacyPasswordRehashedOnAuthentication(t *testing.T) {
+	setup()
+	legacy := sha256.Sum256([]byte("1234" + user1.EmailAddress))
+	userManager.SetPasswordHash(user1, string(legacy[:]))
+
+	if auth, _ := userManager.AuthenticateUser(user1, "wrong"); auth {
+		t.Fatalf("Expected wrong password to fail")
+	}
+
+	if hash, _ := userManager.GetPasswordHash(user1); hash != string(legacy[:]) {
+		t.Errorf("Expected failed authentication not to rehash")
+	}
+
+	if auth, _ := userManager.AuthenticateUser(user1, "1234"); !auth {
+		t.Fatalf("Expected legacy password to authenticate")
+	}
+
+	if hash, _ := userManager.GetPasswordHash(user1); !strings.HasPrefix(hash, "$argon2id$") {
+		t.Errorf("Expected password to be rehashed got %v", hash)
+	}
+
+	user1.EmailAddress = "changed@b.c"
+	userManager.UpdateUser(user1.Id, &user1)
+	if auth, _ := userManager.AuthenticateUser(user1, "1234"); !auth {
+		t.Errorf("Expected changing email address not to break authentication")
+	}
+}
+
+func TestLegacyPasswordThatLooksLikeBcrypt(t *testing.T) {
+	user := User{EmailAddress: "a@b.c"}
+	legacy := sha256.Sum256([]byte("password154464" + user.EmailAddress))
+	if !strings.HasPrefix(string(legacy[:]), "$2") {
+		t.Fatalf("Expected legacy hash to start like a bcrypt hash got %q", legacy[:2])
+	}
+
+	hasher := NewPasswordHasher(PasswordConfig{})
+	if match, rehash := hasher.Verify(user, "password154464", string(legacy[:])); !match || !rehash {
+		t.Errorf("Expected legacy hash to match and be rehashed got %v %v", match, rehash)
+	}
+
+	if match, _ := hasher.Verify(user, "password154464", string(legacy[:31])); match {
+		t.Errorf("Expected a truncated legacy hash not to match")
+	}
+}
+
+func TestChangePasswordStoresHash(t *testing.T) {
+	setup()
+	user1.SetPassword("new password")
+
+	if hash, _ := userManager.GetPasswordHash(user1); strings.Contains(hash, "new password") || !strings.HasPrefix(hash, "$argon2id$") {
+		t.Errorf("Expected password to be hashed got %v", hash)
+	}
+
+	if auth, _ := user1.Authenticate("new password"); !auth {
+		t.Errorf("Expected new password to authenticate")
+	}
+}
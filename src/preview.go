@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	previewImage = "image"
+	previewText  = "text"
+)
+
+const (
+	defaultPreviewLines = 20
+
+	// defaultMaxPreviewPixels is the largest image that will be decoded, so a small file cannot expand to fill memory.
+	defaultMaxPreviewPixels = 40000000
+
+	// maxPreviewLineLength is the most characters of a line that are kept in a text preview.
+	maxPreviewLineLength = 1024
+
+	// previewTailWindow is how far from the end of a file the last lines are looked for.
+	previewTailWindow = 256 * 1024
+)
+
+var defaultThumbnailSizes = []int{128, 512}
+
+// TextPreview is the first and last lines of a text attachment.
+// Lines are valid UTF-8 without control characters and long lines are cut short.
+// Truncated is set when lines between the Head and Tail were left out.
+type TextPreview struct {
+	Head      []string `json:"head"`
+	Tail      []string `json:"tail"`
+	Truncated bool     `json:"truncated"`
+}
+
+// PreviewGenerator creates thumbnails of image attachments and previews of text attachments.
+// Previews are created in the background and stored alongside the attachment using the file manager.
+type PreviewGenerator struct {
+	lock       sync.Mutex
+	pending    sync.WaitGroup
+	generating map[string]bool
+	Sizes      []int // The widths and heights thumbnails are fit within, smallest first.
+	Lines      int   // The number of lines at the start and end of a text preview.
+	MaxPixels  int   // The largest image in pixels that a thumbnail will be created for.
+}
+
+var previewGenerator = NewPreviewGenerator(nil, 0, 0)
+var previewGeneration sync.Once
+
+// NewPreviewGenerator creates a preview generator, any value that is not set uses its default.
+func NewPreviewGenerator(sizes []int, lines int, maxPixels int) *PreviewGenerator {
+	valid := make([]int, 0, len(sizes))
+	for _, size := range sizes {
+		if size > 0 && !slices.Contains(valid, size) {
+			valid = append(valid, size)
+		}
+	}
+
+	if len(valid) == 0 {
+		valid = slices.Clone(defaultThumbnailSizes)
+	}
+
+	slices.Sort(valid)
+
+	if lines <= 0 {
+		lines = defaultPreviewLines
+	}
+
+	if maxPixels <= 0 {
+		maxPixels = defaultMaxPreviewPixels
+	}
+
+	return &PreviewGenerator{
+		generating: make(map[string]bool),
+		Sizes:      valid,
+		Lines:      lines,
+		MaxPixels:  maxPixels,
+	}
+}
+
+// startPreviewGeneration creates previews for attachments as they are attached.
+// Quarantined attachments are not announced so no previews are created for them until they are found to be clean.
+func startPreviewGeneration() {
+	previewGeneration.Do(func() {
+		eventManager.Listen(func(event IncidentEvent) {
+			if event.Type != incidentAttachedEvent || event.Attachment == nil {
+				return
+			}
+
+			attachment := *event.Attachment
+			previewGenerator.Queue(event.IncidentId, attachment, attachment.getCurrentVersion())
+		})
+	})
+}
+
+// getPreviewKind reports what kind of preview can be created for a version, if any.
+func getPreviewKind(version AttachmentVersion) string {
+	mediaType, _, err := mime.ParseMediaType(version.ContentType)
+	if err != nil {
+		return ""
+	}
+
+	switch {
+	case mediaType == "image/png" || mediaType == "image/jpeg" || mediaType == "image/gif":
+		return previewImage
+	case strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" || mediaType == "application/xml":
+		return previewText
+	}
+
+	return ""
+}
+
+// getThumbnailName returns the name a thumbnail of a version is stored under.
+func getThumbnailName(attachment Attachment, version AttachmentVersion, size int) string {
+	return fmt.Sprintf("%v.v%v.thumb%v.png", attachment.getId(), version.Version, size)
+}
+
+// getTextPreviewName returns the name a text preview of a version is stored under.
+func getTextPreviewName(attachment Attachment, version AttachmentVersion) string {
+	return fmt.Sprintf("%v.v%v.preview.json", attachment.getId(), version.Version)
+}
+
+// getThumbnailSize picks the smallest configured size that is at least as large as the requested size.
+// If no size is requested the smallest size is used.
+func (generator *PreviewGenerator) getThumbnailSize(requested int) int {
+	for _, size := range generator.Sizes {
+		if size >= requested {
+			return size
+		}
+	}
+
+	return generator.Sizes[len(generator.Sizes)-1]
+}
+
+// Queue starts creating the previews of a version in the background.
+// A false is returned if there is nothing to preview or the previews are already being created.
+func (generator *PreviewGenerator) Queue(incidentId int64, attachment Attachment, version AttachmentVersion) bool {
+	if len(getPreviewKind(version)) == 0 || version.isQuarantined() {
+		return false
+	}
+
+	key := fmt.Sprintf("%v/%v", incidentId, getTextPreviewName(attachment, version))
+
+	generator.lock.Lock()
+	defer generator.lock.Unlock()
+
+	if generator.generating[key] {
+		return false
+	}
+
+	generator.generating[key] = true
+	generator.pending.Add(1)
+	go func() {
+		defer generator.pending.Done()
+		generator.generate(incidentId, attachment, version)
+
+		generator.lock.Lock()
+		defer generator.lock.Unlock()
+		delete(generator.generating, key)
+	}()
+
+	return true
+}
+
+// Wait blocks until all queued previews have been created.
+func (generator *PreviewGenerator) Wait() {
+	generator.pending.Wait()
+}
+
+func (generator *PreviewGenerator) generate(incidentId int64, attachment Attachment, version AttachmentVersion) {
+	file, _, found, closer := loadAttachmentVersion(incidentId, attachment, version)
+	if closer != nil {
+		defer closer()
+	}
+
+	if !found || file == nil {
+		logManager.LogPrintf("Unable to load attachment %v version %v to preview\n", attachment.getId(), version.Version)
+		return
+	}
+
+	var err error
+	if getPreviewKind(version) == previewImage {
+		err = generator.saveThumbnails(incidentId, attachment, version, file)
+	} else {
+		err = generator.saveTextPreview(incidentId, attachment, version, file)
+	}
+
+	if err != nil {
+		logManager.LogPrintf("Unable to preview attachment %v version %v %v\n", attachment.getId(), version.Version, err)
+		return
+	}
+
+	logManager.LogPrintf("Created previews of attachment %v version %v\n", attachment.getId(), version.Version)
+}
+
+func (generator *PreviewGenerator) saveThumbnails(incidentId int64, attachment Attachment, version AttachmentVersion, file io.ReadSeeker) error {
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return err
+	}
+
+	if config.Width*config.Height > generator.MaxPixels {
+		return fmt.Errorf("image is %vx%v which is larger than %v pixels", config.Width, config.Height, generator.MaxPixels)
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	source, _, err := image.Decode(file)
+	if err != nil {
+		return err
+	}
+
+	// Each thumbnail is scaled from the next largest one, which is much quicker than scaling the original every time.
+	incident := strconv.FormatInt(incidentId, 10)
+	for i := len(generator.Sizes) - 1; i >= 0; i-- {
+		size := generator.Sizes[i]
+		source = fitImage(source, size)
+
+		var encoded bytes.Buffer
+		if err := png.Encode(&encoded, source); err != nil {
+			return err
+		}
+
+		if _, saved := fileManager.SaveFile(incident, getThumbnailName(attachment, version, size), &encoded); !saved {
+			return fmt.Errorf("unable to save %v thumbnail", size)
+		}
+	}
+
+	return nil
+}
+
+func (generator *PreviewGenerator) saveTextPreview(incidentId int64, attachment Attachment, version AttachmentVersion, file io.ReadSeeker) error {
+	preview, err := createTextPreview(file, generator.Lines)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(preview)
+	if err != nil {
+		return err
+	}
+
+	if _, saved := fileManager.SaveFile(strconv.FormatInt(incidentId, 10), getTextPreviewName(attachment, version), bytes.NewReader(data)); !saved {
+		return fmt.Errorf("unable to save text preview")
+	}
+
+	return nil
+}
+
+// getPreviewNames returns the names the previews of a version are stored under.
+func (generator *PreviewGenerator) getPreviewNames(attachment Attachment, version AttachmentVersion) []string {
+	names := make([]string, 0)
+	switch getPreviewKind(version) {
+	case previewImage:
+		for _, size := range generator.Sizes {
+			names = append(names, getThumbnailName(attachment, version, size))
+		}
+	case previewText:
+		names = append(names, getTextPreviewName(attachment, version))
+	}
+
+	return names
+}
+
+// deletePreviews removes any previews of the versions of an attachment.
+func (generator *PreviewGenerator) deletePreviews(incidentId int64, attachment Attachment) {
+	incident := strconv.FormatInt(incidentId, 10)
+	for _, version := range attachment.getVersions() {
+		for _, name := range generator.getPreviewNames(attachment, version) {
+			fileManager.DeleteFile(incident, name)
+		}
+	}
+}
+
+// fitImage scales an image down to fit within a square of the given size, keeping its aspect ratio.
+// Each pixel of the result is the average of the pixels it covers. Images that already fit are not changed.
+func fitImage(source image.Image, size int) image.Image {
+	bounds := source.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= size && height <= size {
+		return source
+	}
+
+	scaledWidth, scaledHeight := size, size
+	if width > height {
+		scaledHeight = max(1, height*size/width)
+	} else {
+		scaledWidth = max(1, width*size/height)
+	}
+
+	scaled := image.NewNRGBA(image.Rect(0, 0, scaledWidth, scaledHeight))
+	for y := 0; y < scaledHeight; y++ {
+		top, bottom := bounds.Min.Y+y*height/scaledHeight, bounds.Min.Y+(y+1)*height/scaledHeight
+		for x := 0; x < scaledWidth; x++ {
+			left, right := bounds.Min.X+x*width/scaledWidth, bounds.Min.X+(x+1)*width/scaledWidth
+
+			var r, g, b, a, count uint64
+			for sy := top; sy < bottom; sy++ {
+				for sx := left; sx < right; sx++ {
+					pr, pg, pb, pa := source.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					count++
+				}
+			}
+
+			// The colors are premultiplied by alpha, so transparent pixels do not darken the average.
+			pixel := color.RGBA64{uint16(r / count), uint16(g / count), uint16(b / count), uint16(a / count)}
+			scaled.Set(x, y, pixel)
+		}
+	}
+
+	return scaled
+}
+
+// createTextPreview reads the first and last lines of a file.
+// Only the start of the file and a window at its end are read, so large logs can be previewed quickly.
+func createTextPreview(file io.ReadSeeker, lines int) (TextPreview, error) {
+	preview := TextPreview{Head: make([]string, 0, lines), Tail: make([]string, 0)}
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return preview, err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return preview, err
+	}
+
+	reader := bufio.NewReader(file)
+	var consumed int64
+	for len(preview.Head) < lines {
+		line, err := reader.ReadString('\n')
+		consumed += int64(len(line))
+		if len(line) > 0 {
+			preview.Head = append(preview.Head, sanitizePreviewLine(line))
+		}
+
+		if err == io.EOF {
+			return preview, nil
+		}
+
+		if err != nil {
+			return preview, err
+		}
+	}
+
+	if consumed >= size {
+		return preview, nil
+	}
+
+	start := max(consumed, size-previewTailWindow)
+	if _, err := file.Seek(start, io.SeekStart); err != nil {
+		return preview, err
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return preview, err
+	}
+
+	tail := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if start > consumed {
+		// The window starts part way through a line.
+		tail = tail[1:]
+		preview.Truncated = true
+	}
+
+	if len(tail) > lines {
+		tail = tail[len(tail)-lines:]
+		preview.Truncated = true
+	}
+
+	for _, line := range tail {
+		preview.Tail = append(preview.Tail, sanitizePreviewLine(line))
+	}
+
+	return preview, nil
+}
+
+// sanitizePreviewLine makes a line safe to show, replacing invalid UTF-8 and removing control characters other than tabs.
+func sanitizePreviewLine(line string) string {
+	line = strings.ToValidUTF8(strings.TrimRight(line, "\r\n"), "�")
+	line = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\t' {
+			return -1
+		}
+
+		return r
+	}, line)
+
+	if runes := []rune(line); len(runes) > maxPreviewLineLength {
+		line = string(runes[:maxPreviewLineLength]) + "…"
+	}
+
+	return line
+}
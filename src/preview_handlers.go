@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// HandleGetAttachmentPreview handles the attachment preview web request.
+// Images are previewed with a thumbnail and text with its first and last lines.
+// If the preview has not been created yet it is queued and a 202 is returned so the client can try again.
+func HandleGetAttachmentPreview(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got attachment preview request.")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if !validateRequest(w, r, availablePermissions.viewIncident) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["incidentId"])
+	if err != nil {
+		logManager.LogPrintf("Error converting incidentId %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	size := 0
+	if requested := r.URL.Query().Get("size"); len(requested) > 0 {
+		if size, err = strconv.Atoi(requested); err != nil || size <= 0 {
+			logManager.LogPrintf("Got invalid preview size %v\n", requested)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	attachment, found := findAttachment(id, vars["attachmentId"])
+	if !found {
+		logManager.LogPrintf("Got invalid preview request for attachment id %v.\n", vars["attachmentId"])
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	version, found := findRequestedVersion(w, r, attachment)
+	if !found {
+		return
+	}
+
+	if version.isQuarantined() {
+		writeProblem(w, version.getQuarantineProblem())
+		return
+	}
+
+	kind := getPreviewKind(version)
+	if len(kind) == 0 {
+		logManager.LogPrintf("Attachment %v of type %v cannot be previewed\n", attachment.getId(), version.ContentType)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	name, contentType := getTextPreviewName(attachment, version), "application/json;charset=UTF-8"
+	if kind == previewImage {
+		name, contentType = getThumbnailName(attachment, version, previewGenerator.getThumbnailSize(size)), "image/png"
+	}
+
+	f, d, passed, callback := fileManager.LoadFile(strconv.Itoa(id), name)
+	if !passed {
+		previewGenerator.Queue(int64(id), attachment, version)
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	defer callback()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private")
+
+	http.ServeContent(w, r, "", d.ModTime(), f)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func createTestImage(width int, height int) string {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.NRGBA{uint8(x), uint8(y), 200, 255})
+		}
+	}
+
+	var encoded bytes.Buffer
+	png.Encode(&encoded, img)
+	return encoded.String()
+}
+
+func getPreview(token string, attachmentId string, query string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("GET", "/sona/v1/incidents/0/attachment/"+attachmentId+"/preview"+query, nil)
+	r.Header.Set("X-Sona-Token", token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestFitImage(t *testing.T) {
+	source := image.NewNRGBA(image.Rect(0, 0, 400, 200))
+
+	if bounds := fitImage(source, 128).Bounds(); bounds.Dx() != 128 || bounds.Dy() != 64 {
+		t.Errorf("Expected 128x64 got %v", bounds)
+	}
+
+	if fitted := fitImage(source, 512); fitted != image.Image(source) {
+		t.Errorf("Expected small image to be unchanged got %v", fitted.Bounds())
+	}
+}
+
+func TestFitImageAveragesPixels(t *testing.T) {
+	source := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	source.Set(0, 0, color.NRGBA{255, 255, 255, 255})
+	source.Set(1, 1, color.NRGBA{255, 255, 255, 255})
+	source.Set(0, 1, color.NRGBA{0, 0, 0, 255})
+	source.Set(1, 0, color.NRGBA{0, 0, 0, 255})
+
+	r, _, _, a := fitImage(source, 1).At(0, 0).RGBA()
+	if r>>8 != 127 || a>>8 != 255 {
+		t.Errorf("Expected grey pixel got %v %v", r>>8, a>>8)
+	}
+}
+
+func TestCreateTextPreviewShortFile(t *testing.T) {
+	preview, err := createTextPreview(strings.NewReader("one\ntwo\nthree"), 5)
+
+	if err != nil || len(preview.Head) != 3 || preview.Head[2] != "three" || len(preview.Tail) != 0 || preview.Truncated {
+		t.Errorf("Unexpected preview %v %v", preview, err)
+	}
+}
+
+func TestCreateTextPreviewLongFile(t *testing.T) {
+	var content strings.Builder
+	for i := 1; i <= 100; i++ {
+		fmt.Fprintf(&content, "line %v\n", i)
+	}
+
+	preview, err := createTextPreview(strings.NewReader(content.String()), 3)
+
+	if err != nil || !preview.Truncated {
+		t.Fatalf("Unexpected preview %v %v", preview, err)
+	}
+
+	if strings.Join(preview.Head, ",") != "line 1,line 2,line 3" || strings.Join(preview.Tail, ",") != "line 98,line 99,line 100" {
+		t.Errorf("Unexpected preview %v", preview)
+	}
+}
+
+func TestCreateTextPreviewLargeFile(t *testing.T) {
+	content := "first\n" + strings.Repeat("x", previewTailWindow) + "\nlast\n"
+
+	preview, err := createTextPreview(strings.NewReader(content), 1)
+
+	if err != nil || !preview.Truncated || strings.Join(preview.Head, ",") != "first" || strings.Join(preview.Tail, ",") != "last" {
+		t.Errorf("Unexpected preview %v %v", preview, err)
+	}
+}
+
+func TestSanitizePreviewLine(t *testing.T) {
+	if line := sanitizePreviewLine("a\x1b[31mb\tc\xffd\r\n"); line != "a[31mb\tc�d" {
+		t.Errorf("Unexpected line %q", line)
+	}
+
+	if line := sanitizePreviewLine(strings.Repeat("é", maxPreviewLineLength+10)); len([]rune(line)) != maxPreviewLineLength+1 {
+		t.Errorf("Expected long line to be cut short got %v characters", len([]rune(line)))
+	}
+}
+
+func TestImagePreview(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	attachment := readUploadedAttachment(t, uploadAttachment(token, "screenshot.png", createTestImage(600, 300)))
+	previewGenerator.Wait()
+
+	w := getPreview(token, attachment.Id, "?size=100")
+
+	if w.Result().StatusCode != 200 || w.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("Expected thumbnail got %v", w.Result())
+	}
+
+	thumbnail, err := png.DecodeConfig(w.Body)
+	if err != nil || thumbnail.Width != 128 || thumbnail.Height != 64 {
+		t.Errorf("Expected 128x64 thumbnail got %v %v", thumbnail, err)
+	}
+
+	w = getPreview(token, attachment.Id, "?size=1000")
+	if thumbnail, err := png.DecodeConfig(w.Body); err != nil || thumbnail.Width != 512 {
+		t.Errorf("Expected largest thumbnail got %v %v", thumbnail, err)
+	}
+}
+
+func TestTextPreview(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	attachment := readUploadedAttachment(t, uploadAttachment(token, "app.log", "started\n<script>alert(1)</script>\nstopped\n"))
+	previewGenerator.Wait()
+
+	w := getPreview(token, attachment.Id, "")
+
+	if w.Result().StatusCode != 200 || w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Fatalf("Expected preview got %v", w.Result())
+	}
+
+	if strings.Contains(w.Body.String(), "<script>") {
+		t.Errorf("Expected html to be escaped got %v", w.Body)
+	}
+
+	var preview TextPreview
+	if err := json.Unmarshal(w.Body.Bytes(), &preview); err != nil || len(preview.Head) != 3 || preview.Head[1] != "<script>alert(1)</script>" {
+		t.Errorf("Unexpected preview %v %v", w.Body, err)
+	}
+}
+
+func TestPreviewNotCreatedYet(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	attachment := readUploadedAttachment(t, uploadAttachment(token, "app.log", "started\n"))
+	previewGenerator.Wait()
+	fileManager.DeleteFile("0", getTextPreviewName(attachment, attachment.getCurrentVersion()))
+
+	w := getPreview(token, attachment.Id, "")
+
+	if w.Result().StatusCode != 202 || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("Expected 202 status code got %v", w.Result())
+	}
+
+	previewGenerator.Wait()
+	if w := getPreview(token, attachment.Id, ""); w.Result().StatusCode != 200 {
+		t.Errorf("Expected preview to be created got %v", w.Result())
+	}
+}
+
+func TestPreviewUnsupportedType(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	attachment := readUploadedAttachment(t, uploadAttachment(token, "data.bin", "\x00\x01\x02\x03"))
+
+	if w := getPreview(token, attachment.Id, ""); w.Result().StatusCode != 404 {
+		t.Errorf("Expected 404 status code got %v", w.Result())
+	}
+}
+
+func TestPreviewQuarantined(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	attachmentScanner = FakeScanner{errors.New("scanner unavailable")}
+	attachment := readUploadedAttachment(t, uploadAttachment(token, "app.log", "started\n"))
+	previewGenerator.Wait()
+
+	w := getPreview(token, attachment.Id, "")
+
+	if w.Result().StatusCode != 403 {
+		t.Fatalf("Expected 403 status code got %v", w.Result())
+	}
+
+	if files, _ := filepath.Glob(filepath.Join(fileManager.(LocalFileManager).Root, "incidents", "0", "*.preview.json")); len(files) != 0 {
+		t.Errorf("Expected no preview of quarantined attachment got %v", files)
+	}
+}
+
+func TestRemoveAttachmentRemovesPreviews(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	attachment := readUploadedAttachment(t, uploadAttachment(token, "screenshot.png", createTestImage(16, 16)))
+	previewGenerator.Wait()
+
+	r, _ := http.NewRequest("DELETE", "/sona/v1/incidents/0/attachment/"+attachment.Id, nil)
+	r.Header.Set("X-Sona-Token", token)
+	router.ServeHTTP(httptest.NewRecorder(), r)
+
+	if files, _ := filepath.Glob(filepath.Join(fileManager.(LocalFileManager).Root, "incidents", "0", "*")); len(files) != 0 {
+		t.Errorf("Expected previews to be removed got %v", files)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// parseStoredFileKey splits an object key of the form incident/fileName.
+func parseStoredFileKey(key string) (StoredFile, bool) {
+	incident, fileName, found := strings.Cut(key, "/")
+	if !found || len(incident) == 0 || len(fileName) == 0 || strings.Contains(fileName, "/") {
+		return StoredFile{}, false
+	}
+
+	return StoredFile{incident, fileName}, true
+}
+
+// rangedObject streams an object out of a cloud storage service.
+// Nothing is requested until the object is read, and the first read after a seek opens the object from the new offset,
+// so only the ranges a client asks for are sent by the service.
+type rangedObject struct {
+	open   func(offset int64) (io.ReadCloser, error) // Opens the object from an offset to its end.
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (object *rangedObject) Read(p []byte) (int, error) {
+	if object.offset >= object.size {
+		return 0, io.EOF
+	}
+
+	if object.body == nil {
+		body, err := object.open(object.offset)
+		if err != nil {
+			return 0, err
+		}
+
+		object.body = body
+	}
+
+	n, err := object.body.Read(p)
+	object.offset += int64(n)
+	if err == io.EOF && object.offset < object.size {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+func (object *rangedObject) Seek(offset int64, whence int) (int64, error) {
+	position := offset
+	switch whence {
+	case io.SeekCurrent:
+		position += object.offset
+	case io.SeekEnd:
+		position += object.size
+	}
+
+	if position < 0 {
+		return object.offset, errors.New("rangedObject.Seek: negative position")
+	}
+
+	if position != object.offset {
+		object.close()
+		object.offset = position
+	}
+
+	return position, nil
+}
+
+// close stops reading the current range of the object.
+func (object *rangedObject) close() {
+	if object.body != nil {
+		object.body.Close()
+		object.body = nil
+	}
+}
+
+// objectFileInfo describes an object in a cloud storage service.
+type objectFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (info objectFileInfo) Name() string       { return info.name }
+func (info objectFileInfo) Size() int64        { return info.size }
+func (info objectFileInfo) Mode() os.FileMode  { return 0444 }
+func (info objectFileInfo) ModTime() time.Time { return info.modTime }
+func (info objectFileInfo) IsDir() bool        { return false }
+func (info objectFileInfo) Sys() interface{}   { return nil }
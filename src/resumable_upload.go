@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	guuid "github.com/google/uuid"
+)
+
+// tusVersion is the version of the tus resumable upload protocol supported.
+const tusVersion = "1.0.0"
+
+// defaultUploadExpiration is how long an upload can go without receiving data if no expiration is configured.
+const defaultUploadExpiration = time.Hour * 24
+
+// ResumableUpload tracks an attachment being uploaded in chunks.
+// Each chunk and the upload itself are staged in the file manager next to the incidents attachments,
+// so an upload can be resumed after the server restarts.
+type ResumableUpload struct {
+	lock             sync.Mutex
+	Id               string    `json:"id"`
+	IncidentId       int       `json:"incidentId"`
+	Length           int64     `json:"length"`
+	Offset           int64     `json:"offset"`
+	Chunks           int       `json:"chunks"`
+	FileName         string    `json:"filename"`
+	ContentType      string    `json:"contentType"`
+	UploaderId       int64     `json:"uploaderId"`
+	ServiceAccountId string    `json:"serviceAccountId,omitempty"`
+	Metadata         string    `json:"metadata"`
+	Expires          time.Time `json:"expires"`
+	AttachmentId     string    `json:"attachmentId,omitempty"`
+}
+
+// ResumableUploadManager keeps track of the uploads that are in progress.
+// The MaxSize is the largest upload that can be created, 0 allows any size.
+// The Expiration is how long an upload can go without receiving data before it is removed.
+type ResumableUploadManager struct {
+	lock       sync.Mutex
+	uploads    map[string]*ResumableUpload
+	MaxSize    int64
+	Expiration time.Duration
+}
+
+var resumableUploads = NewResumableUploadManager(0, defaultUploadExpiration)
+
+// NewResumableUploadManager creates a manager with no uploads in progress.
+func NewResumableUploadManager(maxSize int64, expiration time.Duration) *ResumableUploadManager {
+	if expiration <= 0 {
+		expiration = defaultUploadExpiration
+	}
+
+	return &ResumableUploadManager{
+		uploads:    make(map[string]*ResumableUpload),
+		MaxSize:    maxSize,
+		Expiration: expiration,
+	}
+}
+
+func getUploadInfoName(uploadId string) string {
+	return uploadId + ".upload"
+}
+
+func getUploadChunkName(uploadId string, chunk int) string {
+	return fmt.Sprintf("%v.chunk%v", uploadId, chunk)
+}
+
+// CreateUpload starts a new upload for an incident.
+func (manager *ResumableUploadManager) CreateUpload(incidentId int, length int64, fileName string, contentType string, metadata string, uploader Principal) (*ResumableUpload, bool) {
+	upload := &ResumableUpload{
+		Id:               guuid.New().String(),
+		IncidentId:       incidentId,
+		Length:           length,
+		FileName:         fileName,
+		ContentType:      contentType,
+		Metadata:         metadata,
+		UploaderId:       uploader.UserId,
+		ServiceAccountId: uploader.ServiceAccountId,
+		Expires:          time.Now().Add(manager.Expiration),
+	}
+
+	if !upload.save() {
+		return nil, false
+	}
+
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	manager.uploads[upload.Id] = upload
+	return upload, true
+}
+
+// GetUpload finds an upload for an incident.
+// Uploads started before the server restarted are loaded from the file manager.
+// Expired uploads are removed and not found.
+func (manager *ResumableUploadManager) GetUpload(incidentId int, uploadId string) (*ResumableUpload, bool) {
+	if _, err := guuid.Parse(uploadId); err != nil {
+		return nil, false
+	}
+
+	manager.lock.Lock()
+	upload, found := manager.uploads[uploadId]
+	manager.lock.Unlock()
+
+	if !found {
+		upload, found = loadResumableUpload(incidentId, uploadId)
+		if !found {
+			return nil, false
+		}
+
+		manager.lock.Lock()
+		if existing, ok := manager.uploads[uploadId]; ok {
+			upload = existing
+		} else {
+			manager.uploads[uploadId] = upload
+		}
+		manager.lock.Unlock()
+	}
+
+	if upload.IncidentId != incidentId {
+		return nil, false
+	}
+
+	upload.lock.Lock()
+	expired := time.Now().After(upload.Expires)
+	upload.lock.Unlock()
+
+	if expired {
+		manager.RemoveUpload(upload)
+		return nil, false
+	}
+
+	return upload, true
+}
+
+// RemoveUpload stops tracking an upload and removes anything it staged.
+func (manager *ResumableUploadManager) RemoveUpload(upload *ResumableUpload) {
+	upload.lock.Lock()
+	defer upload.lock.Unlock()
+	upload.remove(manager)
+}
+
+// ExpireUploads removes every upload that has not received data before it expired.
+// Uploads staged before the server restarted are found first, so they expire even if no client asks for them again.
+func (manager *ResumableUploadManager) ExpireUploads() int {
+	manager.loadStagedUploads()
+
+	now := time.Now()
+	expired := make([]*ResumableUpload, 0)
+
+	// Uploads are locked before the manager when they complete, so they are copied rather than locked while the manager is.
+	manager.lock.Lock()
+	uploads := make([]*ResumableUpload, 0, len(manager.uploads))
+	for _, upload := range manager.uploads {
+		uploads = append(uploads, upload)
+	}
+	manager.lock.Unlock()
+
+	for _, upload := range uploads {
+		upload.lock.Lock()
+		if now.After(upload.Expires) {
+			expired = append(expired, upload)
+		}
+		upload.lock.Unlock()
+	}
+
+	for _, upload := range expired {
+		logManager.LogPrintf("Removing expired upload %v\n", upload.Id)
+		manager.RemoveUpload(upload)
+	}
+
+	return len(expired)
+}
+
+// loadStagedUploads starts tracking the uploads staged in the file manager that are not tracked yet.
+// Uploads can only be found this way when the file manager can list its files.
+func (manager *ResumableUploadManager) loadStagedUploads() {
+	listable, ok := fileManager.(ListableFileManager)
+	if !ok {
+		return
+	}
+
+	files, listed := listable.ListFiles()
+	if !listed {
+		logManager.LogPrintln("Unable to list staged uploads")
+		return
+	}
+
+	for _, file := range files {
+		uploadId, isUpload := strings.CutSuffix(file.FileName, ".upload")
+		incidentId, err := strconv.Atoi(file.Incident)
+		if !isUpload || err != nil {
+			continue
+		}
+
+		manager.lock.Lock()
+		_, tracked := manager.uploads[uploadId]
+		manager.lock.Unlock()
+		if tracked {
+			continue
+		}
+
+		upload, found := loadResumableUpload(incidentId, uploadId)
+		if !found {
+			continue
+		}
+
+		manager.lock.Lock()
+		if _, tracked := manager.uploads[uploadId]; !tracked {
+			manager.uploads[uploadId] = upload
+		}
+		manager.lock.Unlock()
+	}
+}
+
+// expireUploadsPeriodically removes expired uploads on an interval.
+func expireUploadsPeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		resumableUploads.ExpireUploads()
+	}
+}
+
+func loadResumableUpload(incidentId int, uploadId string) (*ResumableUpload, bool) {
+	file, _, passed, closer := fileManager.LoadFile(strconv.Itoa(incidentId), getUploadInfoName(uploadId))
+	if closer != nil {
+		defer closer()
+	}
+
+	if !passed || file == nil {
+		return nil, false
+	}
+
+	var upload ResumableUpload
+	if err := json.NewDecoder(file).Decode(&upload); err != nil {
+		logManager.LogPrintf("Unable to read upload %v %v\n", uploadId, err)
+		return nil, false
+	}
+
+	return &upload, upload.Id == uploadId
+}
+
+// save stages the state of the upload in the file manager.
+// The upload lock should be held unless the upload is not shared yet.
+func (upload *ResumableUpload) save() bool {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		logManager.LogPrintf("Unable to convert upload %v %v\n", upload.Id, err)
+		return false
+	}
+
+	_, saved := fileManager.SaveFile(strconv.Itoa(upload.IncidentId), getUploadInfoName(upload.Id), bytes.NewReader(data))
+	return saved
+}
+
+// removeStaged removes the chunks and state of the upload from the file manager.
+func (upload *ResumableUpload) removeStaged() {
+	incident := strconv.Itoa(upload.IncidentId)
+	for chunk := 0; chunk < upload.Chunks; chunk++ {
+		fileManager.DeleteFile(incident, getUploadChunkName(upload.Id, chunk))
+	}
+
+	fileManager.DeleteFile(incident, getUploadInfoName(upload.Id))
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+// WriteChunk stages the next chunk of the upload, which must start at the current offset.
+// Once the last chunk is written the upload is attached to its incident and removed.
+// The returned status is the http status to respond with.
+// If the completed upload breaks the upload policy it is removed and the problem is returned.
+func (upload *ResumableUpload) WriteChunk(manager *ResumableUploadManager, offset int64, chunk io.Reader) (int, *ProblemDetails) {
+	upload.lock.Lock()
+	defer upload.lock.Unlock()
+
+	if offset != upload.Offset {
+		logManager.LogPrintf("Upload %v is at offset %v not %v\n", upload.Id, upload.Offset, offset)
+		return http.StatusConflict, nil
+	}
+
+	incident := strconv.Itoa(upload.IncidentId)
+	name := getUploadChunkName(upload.Id, upload.Chunks)
+	counted := &countingReader{reader: io.LimitReader(chunk, upload.Length-upload.Offset)}
+
+	if _, saved := fileManager.SaveFile(incident, name, counted); !saved {
+		logManager.LogPrintf("Unable to stage chunk %v of upload %v\n", upload.Chunks, upload.Id)
+		fileManager.DeleteFile(incident, name)
+		return http.StatusInternalServerError, nil
+	}
+
+	if counted.count > 0 {
+		upload.Chunks++
+		upload.Offset += counted.count
+	} else {
+		fileManager.DeleteFile(incident, name)
+	}
+
+	upload.Expires = time.Now().Add(manager.Expiration)
+	if upload.Offset < upload.Length {
+		if !upload.save() {
+			return http.StatusInternalServerError, nil
+		}
+
+		return http.StatusNoContent, nil
+	}
+
+	return upload.complete(manager)
+}
+
+// complete attaches the staged chunks to the incident in the same way as a normal upload.
+func (upload *ResumableUpload) complete(manager *ResumableUploadManager) (int, *ProblemDetails) {
+	incident := strconv.Itoa(upload.IncidentId)
+	readers := make([]io.Reader, 0, upload.Chunks)
+	closers := make([]func(), 0, upload.Chunks)
+	defer func() {
+		for _, closer := range closers {
+			closer()
+		}
+	}()
+
+	for chunk := 0; chunk < upload.Chunks; chunk++ {
+		file, _, passed, closer := fileManager.LoadFile(incident, getUploadChunkName(upload.Id, chunk))
+		if closer != nil {
+			closers = append(closers, closer)
+		}
+
+		if !passed || file == nil {
+			logManager.LogPrintf("Unable to load chunk %v of upload %v\n", chunk, upload.Id)
+			return http.StatusInternalServerError, nil
+		}
+
+		readers = append(readers, file)
+	}
+
+	attach, problem, ok := attachUpload(upload.IncidentId, upload.FileName, io.MultiReader(readers...), upload.ContentType, Principal{upload.UploaderId, upload.ServiceAccountId})
+	if problem != nil {
+		upload.remove(manager)
+		return problem.Status, problem
+	}
+
+	if !ok {
+		return http.StatusInternalServerError, nil
+	}
+
+	upload.AttachmentId = attach.Id
+	upload.remove(manager)
+
+	logManager.LogPrintf("Upload %v completed as attachment %v\n", upload.Id, attach.Id)
+	return http.StatusNoContent, nil
+}
+
+// remove stops tracking the upload and removes anything it staged.
+// The upload lock should be held.
+func (upload *ResumableUpload) remove(manager *ResumableUploadManager) {
+	manager.lock.Lock()
+	delete(manager.uploads, upload.Id)
+	manager.lock.Unlock()
+	upload.removeStaged()
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	b64 "encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const tusExtensions = "creation,termination,expiration"
+
+// setTusHeaders sets the headers every tus response needs.
+// Browsers can only read the tus headers if they are exposed.
+func setTusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Offset, Upload-Length, Upload-Metadata, Upload-Expires, X-Sona-Attachment-Id")
+	w.Header().Set("Tus-Resumable", tusVersion)
+}
+
+// checkTusVersion makes sure the client is using the supported version of the tus protocol.
+func checkTusVersion(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Tus-Resumable") == tusVersion {
+		return true
+	}
+
+	logManager.LogPrintf("Unsupported tus version %v\n", r.Header.Get("Tus-Resumable"))
+	w.Header().Set("Tus-Version", tusVersion)
+	w.WriteHeader(http.StatusPreconditionFailed)
+	return false
+}
+
+// parseUploadMetadata converts the Upload-Metadata header to a map.
+// The header is a comma separated list of keys, each followed by a space and a base64 encoded value.
+func parseUploadMetadata(header string) (map[string]string, bool) {
+	metadata := make(map[string]string, 0)
+	if len(strings.TrimSpace(header)) == 0 {
+		return metadata, true
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		if len(parts) == 0 || len(parts) > 2 {
+			return metadata, false
+		}
+
+		value := ""
+		if len(parts) == 2 {
+			decoded, err := b64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return metadata, false
+			}
+			value = string(decoded)
+		}
+
+		metadata[parts[0]] = value
+	}
+
+	return metadata, true
+}
+
+// getMetadataValue returns the first of the keys found in the metadata.
+// Clients do not agree on names, for example tus-js-client uses filename and Uppy uses name.
+func getMetadataValue(metadata map[string]string, keys ...string) string {
+	for _, key := range keys {
+		if value, ok := metadata[key]; ok && len(value) > 0 {
+			return value
+		}
+	}
+
+	return ""
+}
+
+// getRequestedUpload finds the upload a tus request is for.
+func getRequestedUpload(w http.ResponseWriter, r *http.Request) (*ResumableUpload, bool) {
+	vars := mux.Vars(r)
+	incidentId, err := strconv.Atoi(vars["incidentId"])
+	if err != nil {
+		logManager.LogPrintf("Error converting incidentId %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+
+	upload, found := resumableUploads.GetUpload(incidentId, vars["uploadId"])
+	if !found {
+		logManager.LogPrintf("Upload %v not found\n", vars["uploadId"])
+		w.WriteHeader(http.StatusNotFound)
+		return nil, false
+	}
+
+	return upload, true
+}
+
+// setUploadProgress sets the headers describing how much of an upload has been received.
+func setUploadProgress(w http.ResponseWriter, upload *ResumableUpload) {
+	upload.lock.Lock()
+	defer upload.lock.Unlock()
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	if len(upload.AttachmentId) > 0 {
+		w.Header().Set("X-Sona-Attachment-Id", upload.AttachmentId)
+	}
+}
+
+// HandleUploadOptions handles the tus discovery web request.
+func HandleUploadOptions(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got upload options request")
+	setTusHeaders(w)
+
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	if resumableUploads.MaxSize > 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(resumableUploads.MaxSize, 10))
+	}
+
+	w.Header().Set("Access-Control-Allow-Methods", "POST, HEAD, PATCH, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "X-Sona-Token, Authorization, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset, Content-Type")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleCreateUpload handles the tus create upload web request.
+func HandleCreateUpload(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got create upload request")
+	setTusHeaders(w)
+
+	uploader, valid := validatePrincipal(w, r, availablePermissions.modifyIncident)
+	if !valid {
+		return
+	}
+
+	vars := mux.Vars(r)
+	incidentId, err := strconv.Atoi(vars["incidentId"])
+
+	if err != nil {
+		logManager.LogPrintf("Error converting incidentId %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	if _, found := incidentManager.GetIncident(incidentId); !found {
+		logManager.LogPrintf("Got Invalid upload request for %v.\n", incidentId)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		logManager.LogPrintf("Invalid upload length %v\n", r.Header.Get("Upload-Length"))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if resumableUploads.MaxSize > 0 && length > resumableUploads.MaxSize {
+		logManager.LogPrintf("Upload of %v bytes is larger than %v\n", length, resumableUploads.MaxSize)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	metadata, ok := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	fileName := sanitizeFileName(getMetadataValue(metadata, "filename", "name"))
+	if !ok || len(getMetadataValue(metadata, "filename", "name")) == 0 {
+		logManager.LogPrintf("Invalid upload metadata %v\n", r.Header.Get("Upload-Metadata"))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if problem := uploadPolicy.checkUpload(incidentId, uploader, fileName, length); problem != nil {
+		writeProblem(w, problem)
+		return
+	}
+
+	contentType := getMetadataValue(metadata, "filetype", "type")
+	upload, ok := resumableUploads.CreateUpload(incidentId, length, fileName, contentType, r.Header.Get("Upload-Metadata"), uploader)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// An empty file has nothing to wait for.
+	if length == 0 {
+		if _, problem := upload.WriteChunk(resumableUploads, 0, strings.NewReader("")); problem != nil {
+			writeProblem(w, problem)
+			return
+		}
+	}
+
+	setUploadProgress(w, upload)
+	w.Header().Set("Location", fmt.Sprintf("/sona/v1/incidents/%v/uploads/%v", incidentId, upload.Id))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// HandleGetUpload handles the tus upload offset web request.
+func HandleGetUpload(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got upload offset request")
+	setTusHeaders(w)
+	w.Header().Set("Cache-Control", "no-store")
+
+	if !validateRequest(w, r, availablePermissions.modifyIncident) {
+		return
+	}
+
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	upload, ok := getRequestedUpload(w, r)
+	if !ok {
+		return
+	}
+
+	upload.lock.Lock()
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if len(upload.Metadata) > 0 {
+		w.Header().Set("Upload-Metadata", upload.Metadata)
+	}
+	upload.lock.Unlock()
+
+	setUploadProgress(w, upload)
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandlePatchUpload handles the tus upload chunk web request.
+// When the last chunk is received the attachment is added to the incident.
+func HandlePatchUpload(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got upload chunk request")
+	setTusHeaders(w)
+
+	if !validateRequest(w, r, availablePermissions.modifyIncident) {
+		return
+	}
+
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		logManager.LogPrintf("Invalid upload content type %v\n", r.Header.Get("Content-Type"))
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		logManager.LogPrintf("Invalid upload offset %v\n", r.Header.Get("Upload-Offset"))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	upload, ok := getRequestedUpload(w, r)
+	if !ok {
+		return
+	}
+
+	status, problem := upload.WriteChunk(resumableUploads, offset, r.Body)
+	if problem != nil {
+		writeProblem(w, problem)
+		return
+	}
+
+	setUploadProgress(w, upload)
+	w.WriteHeader(status)
+}
+
+// HandleDeleteUpload handles the tus terminate upload web request.
+func HandleDeleteUpload(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got delete upload request")
+	setTusHeaders(w)
+
+	if !validateRequest(w, r, availablePermissions.modifyIncident) {
+		return
+	}
+
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	upload, ok := getRequestedUpload(w, r)
+	if !ok {
+		return
+	}
+
+	resumableUploads.RemoveUpload(upload)
+	w.WriteHeader(http.StatusNoContent)
+}
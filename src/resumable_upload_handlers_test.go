@@ -0,0 +1,256 @@
+package main
+
+import (
+	b64 "encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tusRequest(method string, url string, token string, body io.Reader) *http.Request {
+	r, _ := http.NewRequest(method, url, body)
+	r.Header.Set("X-Sona-Token", token)
+	r.Header.Set("Tus-Resumable", tusVersion)
+	return r
+}
+
+func createUpload(t *testing.T, token string, length int, fileName string) string {
+	r := tusRequest("POST", "/sona/v1/incidents/0/uploads", token, nil)
+	r.Header.Set("Upload-Length", strconv.Itoa(length))
+	r.Header.Set("Upload-Metadata", "filename "+b64.StdEncoding.EncodeToString([]byte(fileName))+",filetype "+b64.StdEncoding.EncodeToString([]byte("text/plain")))
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 201 {
+		t.Fatalf("Expected 201 status code got %v", w.Result())
+	}
+
+	return w.Header().Get("Location")
+}
+
+func patchUpload(token string, location string, offset int, chunk string) *httptest.ResponseRecorder {
+	r := tusRequest("PATCH", location, token, strings.NewReader(chunk))
+	r.Header.Set("Content-Type", "application/offset+octet-stream")
+	r.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestUploadOptions(t *testing.T) {
+	setup()
+
+	r, _ := http.NewRequest("OPTIONS", "/sona/v1/incidents/0/uploads", nil)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 204 || w.Header().Get("Tus-Version") != tusVersion || w.Header().Get("Tus-Extension") != tusExtensions {
+		t.Errorf("Unexpected options response %v", w.Result())
+	}
+}
+
+func TestResumableUpload(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident)
+	location := createUpload(t, token, 11, "crash.dmp")
+
+	w := patchUpload(token, location, 0, "hello ")
+	if w.Result().StatusCode != 204 || w.Header().Get("Upload-Offset") != "6" {
+		t.Fatalf("Unexpected first chunk response %v", w.Result())
+	}
+
+	r := tusRequest("HEAD", location, token, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 200 || w.Header().Get("Upload-Offset") != "6" || w.Header().Get("Upload-Length") != "11" {
+		t.Fatalf("Unexpected head response %v", w.Result())
+	}
+
+	w = patchUpload(token, location, 6, "world")
+	if w.Result().StatusCode != 204 || w.Header().Get("Upload-Offset") != "11" {
+		t.Fatalf("Unexpected last chunk response %v", w.Result())
+	}
+
+	attachments, _ := incidentManager.GetAttachments(0)
+	if len(attachments) != 1 {
+		t.Fatalf("Expected upload to be attached got %v", attachments)
+	}
+
+	attachment := attachments[0]
+	if attachment.Id != w.Header().Get("X-Sona-Attachment-Id") || attachment.FileName != "crash.dmp" || attachment.Size != 11 || attachment.UploaderId != user1.Id {
+		t.Errorf("Unexpected attachment %v", attachment)
+	}
+
+	file, _, _, closer := fileManager.LoadFile("0", attachment.Id)
+	content, _ := io.ReadAll(file)
+	closer()
+	if string(content) != "hello world" {
+		t.Errorf("Expected uploaded content got %v", string(content))
+	}
+
+	if _, _, found, _ := fileManager.LoadFile("0", getUploadChunkName(strings.TrimPrefix(location, "/sona/v1/incidents/0/uploads/"), 0)); found {
+		t.Errorf("Expected staged chunks to be removed")
+	}
+}
+
+func TestResumableUploadWithWrongOffset(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident)
+	location := createUpload(t, token, 11, "crash.dmp")
+
+	w := patchUpload(token, location, 3, "lo world")
+
+	if w.Result().StatusCode != 409 || w.Header().Get("Upload-Offset") != "0" {
+		t.Errorf("Expected 409 status code got %v", w.Result())
+	}
+}
+
+func TestResumableUploadWithoutTusVersion(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident)
+
+	r, _ := http.NewRequest("POST", "/sona/v1/incidents/0/uploads", nil)
+	r.Header.Set("X-Sona-Token", token)
+	r.Header.Set("Upload-Length", "11")
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 412 {
+		t.Errorf("Expected 412 status code got %v", w.Result())
+	}
+}
+
+func TestResumableUploadWithoutFileName(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident)
+
+	r := tusRequest("POST", "/sona/v1/incidents/0/uploads", token, nil)
+	r.Header.Set("Upload-Length", "11")
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 400 {
+		t.Errorf("Expected 400 status code got %v", w.Result())
+	}
+}
+
+func TestResumableUploadTooLarge(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident)
+	resumableUploads.MaxSize = 10
+
+	r := tusRequest("POST", "/sona/v1/incidents/0/uploads", token, nil)
+	r.Header.Set("Upload-Length", "11")
+	r.Header.Set("Upload-Metadata", "filename "+b64.StdEncoding.EncodeToString([]byte("crash.dmp")))
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 413 {
+		t.Errorf("Expected 413 status code got %v", w.Result())
+	}
+}
+
+func TestResumableUploadWithInvalidPermissions(t *testing.T) {
+	setup()
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
+	_, token := user1.Authenticate("1234")
+
+	r := tusRequest("POST", "/sona/v1/incidents/0/uploads", token.Token, nil)
+	r.Header.Set("Upload-Length", "11")
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 401 {
+		t.Errorf("Expected 401 status code got %v", w.Result())
+	}
+}
+
+func TestDeleteResumableUpload(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident)
+	location := createUpload(t, token, 11, "crash.dmp")
+	patchUpload(token, location, 0, "hello ")
+
+	r := tusRequest("DELETE", location, token, nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 204 {
+		t.Fatalf("Expected 204 status code got %v", w.Result())
+	}
+
+	w = patchUpload(token, location, 6, "world")
+	if w.Result().StatusCode != 404 {
+		t.Errorf("Expected 404 status code got %v", w.Result())
+	}
+}
+
+func TestResumableUploadAfterRestart(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident)
+	location := createUpload(t, token, 11, "crash.dmp")
+	patchUpload(token, location, 0, "hello ")
+
+	resumableUploads = NewResumableUploadManager(0, defaultUploadExpiration)
+	w := patchUpload(token, location, 6, "world")
+
+	if w.Result().StatusCode != 204 || len(w.Header().Get("X-Sona-Attachment-Id")) == 0 {
+		t.Errorf("Expected upload to complete got %v", w.Result())
+	}
+}
+
+func TestExpireResumableUploads(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident)
+	location := createUpload(t, token, 11, "crash.dmp")
+	patchUpload(token, location, 0, "hello ")
+
+	resumableUploads.Expiration = -time.Minute
+	patchUpload(token, location, 6, "wor")
+
+	if expired := resumableUploads.ExpireUploads(); expired != 1 {
+		t.Fatalf("Expected 1 upload to expire got %v", expired)
+	}
+
+	w := patchUpload(token, location, 9, "ld")
+	if w.Result().StatusCode != 404 {
+		t.Errorf("Expected 404 status code got %v", w.Result())
+	}
+}
+
+func TestExpireResumableUploadsAfterRestart(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident)
+	location := createUpload(t, token, 11, "crash.dmp")
+	patchUpload(token, location, 0, "hello ")
+	resumableUploads.Expiration = -time.Minute
+	patchUpload(token, location, 6, "wor")
+
+	resumableUploads = NewResumableUploadManager(0, defaultUploadExpiration)
+	if expired := resumableUploads.ExpireUploads(); expired != 1 {
+		t.Fatalf("Expected upload staged before the restart to expire got %v", expired)
+	}
+
+	if files, _ := fileManager.(ListableFileManager).ListFiles(); len(files) != 0 {
+		t.Errorf("Expected staged files to be removed got %v", files)
+	}
+}
+
+func TestResumableUploadBreakingPolicy(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident)
+	uploadPolicy = UploadPolicy{MaxFileSize: 10}
+
+	r := tusRequest("POST", "/sona/v1/incidents/0/uploads", token, nil)
+	r.Header.Set("Upload-Length", "11")
+	r.Header.Set("Upload-Metadata", "filename "+b64.StdEncoding.EncodeToString([]byte("crash.dmp")))
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 413 || w.Header().Get("Content-Type") != "application/problem+json" {
+		t.Errorf("Expected 413 status code got %v", w.Result())
+	}
+}
@@ -50,6 +50,18 @@ var routes = Routes{
 		"/sona/v1/incidents/{incidentId}/attachments",
 		HandleGetAttachments,
 	},
+	Route{
+		"GetIncidentUsage",
+		"GET",
+		"/sona/v1/incidents/{incidentId}/usage",
+		HandleGetIncidentUsage,
+	},
+	Route{
+		"GetAttachmentArchive",
+		"GET",
+		"/sona/v1/incidents/{incidentId}/attachments/archive",
+		HandleGetAttachmentArchive,
+	},
 	Route{
 		"UploadAttachment",
 		"POST",
@@ -62,6 +74,78 @@ var routes = Routes{
 		"/sona/v1/incidents/{incidentId}/attachment/{attachmentId}",
 		HandleDownloadAttachment,
 	},
+	Route{
+		"UploadAttachmentVersion",
+		"POST",
+		"/sona/v1/incidents/{incidentId}/attachment/{attachmentId}",
+		HandleUploadAttachmentVersion,
+	},
+	Route{
+		"GetAttachmentVersions",
+		"GET",
+		"/sona/v1/incidents/{incidentId}/attachment/{attachmentId}/versions",
+		HandleGetAttachmentVersions,
+	},
+	Route{
+		"GetAttachmentPreview",
+		"GET",
+		"/sona/v1/incidents/{incidentId}/attachment/{attachmentId}/preview",
+		HandleGetAttachmentPreview,
+	},
+	Route{
+		"ScanAttachment",
+		"POST",
+		"/sona/v1/incidents/{incidentId}/attachment/{attachmentId}/scan",
+		HandleScanAttachment,
+	},
+	Route{
+		"CreateDownloadLink",
+		"POST",
+		"/sona/v1/incidents/{incidentId}/attachment/{attachmentId}/link",
+		HandleCreateDownloadLink,
+	},
+	Route{
+		"LinkDownload",
+		"GET",
+		"/sona/v1/links/{incidentId}/{attachmentId}",
+		HandleLinkDownload,
+	},
+	Route{
+		"UploadOptions",
+		"OPTIONS",
+		"/sona/v1/incidents/{incidentId}/uploads",
+		HandleUploadOptions,
+	},
+	Route{
+		"CreateUpload",
+		"POST",
+		"/sona/v1/incidents/{incidentId}/uploads",
+		HandleCreateUpload,
+	},
+	Route{
+		"UploadChunkOptions",
+		"OPTIONS",
+		"/sona/v1/incidents/{incidentId}/uploads/{uploadId}",
+		HandleUploadOptions,
+	},
+	Route{
+		"GetUpload",
+		"HEAD",
+		"/sona/v1/incidents/{incidentId}/uploads/{uploadId}",
+		HandleGetUpload,
+	},
+	Route{
+		"PatchUpload",
+		"PATCH",
+		"/sona/v1/incidents/{incidentId}/uploads/{uploadId}",
+		HandlePatchUpload,
+	},
+	Route{
+		"DeleteUpload",
+		"DELETE",
+		"/sona/v1/incidents/{incidentId}/uploads/{uploadId}",
+		HandleDeleteUpload,
+	},
 	Route{
 		"RemoveAttachment",
 		"DELETE",
@@ -86,6 +170,12 @@ var routes = Routes{
 		"/sona/v1/users",
 		HandleCreateUser,
 	},
+	Route{
+		"GetUsers",
+		"GET",
+		"/sona/v1/users",
+		HandleGetUsers,
+	},
 	Route{
 		"GetUser",
 		"GET",
@@ -116,10 +206,148 @@ var routes = Routes{
 		"/sona/v1/users/{userId}/permissions",
 		HandleSetPermissions,
 	},
+	Route{
+		"RevokeSessions",
+		"DELETE",
+		"/sona/v1/users/{userId}/sessions",
+		HandleRevokeSessions,
+	},
 	Route{
 		"Authenticate",
 		"POST",
 		"/sona/v1/authenticate",
 		HandleAuthentication,
 	},
+	Route{
+		"RefreshToken",
+		"POST",
+		"/sona/v1/authenticate/refresh",
+		HandleRefreshToken,
+	},
+	Route{
+		"Logout",
+		"POST",
+		"/sona/v1/logout",
+		HandleLogout,
+	},
+	Route{
+		"GraphQL",
+		"POST",
+		"/sona/v1/graphql",
+		HandleGraphQL,
+	},
+	Route{
+		"GraphQLQuery",
+		"GET",
+		"/sona/v1/graphql",
+		HandleGraphQL,
+	},
+	Route{
+		"BulkUpdate",
+		"POST",
+		"/sona/v1/incidents/bulk",
+		HandleBulkIncidentUpdate,
+	},
+	Route{
+		"Export",
+		"GET",
+		"/sona/v1/export",
+		HandleExport,
+	},
+	Route{
+		"Import",
+		"POST",
+		"/sona/v1/import",
+		HandleImport,
+	},
+	Route{
+		"ImportStatus",
+		"GET",
+		"/sona/v1/import/{jobId}",
+		HandleGetImport,
+	},
+	Route{
+		"Search",
+		"GET",
+		"/sona/v1/search",
+		HandleSearch,
+	},
+	Route{
+		"RebuildSearch",
+		"POST",
+		"/sona/v1/search/rebuild",
+		HandleRebuildSearch,
+	},
+	Route{
+		"RewrapAttachments",
+		"POST",
+		"/sona/v1/encryption/rewrap",
+		HandleRewrapAttachments,
+	},
+	Route{
+		"MigrateStorage",
+		"POST",
+		"/sona/v1/storage/migrations",
+		HandleMigrateStorage,
+	},
+	Route{
+		"StorageMigrationStatus",
+		"GET",
+		"/sona/v1/storage/migrations/{jobId}",
+		HandleGetStorageMigration,
+	},
+	Route{
+		"CollectStorageGarbage",
+		"POST",
+		"/sona/v1/storage/gc",
+		HandleCollectStorageGarbage,
+	},
+	Route{
+		"CreateServiceAccount",
+		"POST",
+		"/sona/v1/serviceaccounts",
+		HandleCreateServiceAccount,
+	},
+	Route{
+		"GetServiceAccounts",
+		"GET",
+		"/sona/v1/serviceaccounts",
+		HandleGetServiceAccounts,
+	},
+	Route{
+		"GetServiceAccount",
+		"GET",
+		"/sona/v1/serviceaccounts/{accountId}",
+		HandleGetServiceAccount,
+	},
+	Route{
+		"UpdateServiceAccount",
+		"PUT",
+		"/sona/v1/serviceaccounts/{accountId}",
+		HandleUpdateServiceAccount,
+	},
+	Route{
+		"DeleteServiceAccount",
+		"DELETE",
+		"/sona/v1/serviceaccounts/{accountId}",
+		HandleDeleteServiceAccount,
+	},
+	Route{
+		"CreateAPIKey",
+		"POST",
+		"/sona/v1/serviceaccounts/{accountId}/keys",
+		HandleCreateAPIKey,
+	},
+	Route{
+		"RotateAPIKey",
+		"POST",
+		"/sona/v1/serviceaccounts/{accountId}/keys/{keyId}/rotate",
+		HandleRotateAPIKey,
+	},
+	Route{
+		"DeleteAPIKey",
+		"DELETE",
+		"/sona/v1/serviceaccounts/{accountId}/keys/{keyId}",
+		HandleDeleteAPIKey,
+	},
 }
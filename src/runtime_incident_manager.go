@@ -3,8 +3,13 @@ package main
 import (
 	"sort"
 	"strings"
+	"sync"
 )
 
+// runtimeIncidentLock guards the incidents and attachments of the runtime incident manager.
+// They are used by every request as well as imports and indexing in the background.
+var runtimeIncidentLock sync.RWMutex
+
 // RuntimeIncidentManager manages incidents in the applications runtime.
 // These incidents will no longer be available after the application shuts down.
 type RuntimeIncidentManager struct {
@@ -14,6 +19,9 @@ type RuntimeIncidentManager struct {
 
 // AddIncident adds an incident to the runtimes incident collection.
 func (manager RuntimeIncidentManager) AddIncident(incident *Incident) bool {
+	runtimeIncidentLock.Lock()
+	defer runtimeIncidentLock.Unlock()
+
 	var id = int64(len(manager.Incidents))
 	incident.Id = id
 	if incident.Attributes == nil {
@@ -27,6 +35,9 @@ func (manager RuntimeIncidentManager) AddIncident(incident *Incident) bool {
 // GetIncident attempts to get an incident out of the runtimes incident collection.
 // If an incident is not found a false will be returned.
 func (manager RuntimeIncidentManager) GetIncident(incidentId int) (Incident, bool) {
+	runtimeIncidentLock.RLock()
+	defer runtimeIncidentLock.RUnlock()
+
 	if val, ok := manager.Incidents[int64(incidentId)]; ok {
 		return *val, true
 	}
@@ -38,11 +49,13 @@ func (manager RuntimeIncidentManager) GetIncident(incidentId int) (Incident, boo
 func (manager RuntimeIncidentManager) GetIncidents(filter *FilterRequest) ([]Incident, bool) {
 	retVal := make([]Incident, 0)
 
+	runtimeIncidentLock.RLock()
 	for _, v := range manager.Incidents {
 		if incidentInFilterRequest(*v, filter) {
 			retVal = append(retVal, *v)
 		}
 	}
+	runtimeIncidentLock.RUnlock()
 
 	sort.Slice(retVal, func(i, j int) bool {
 		return retVal[i].Id < retVal[j].Id
@@ -138,6 +151,9 @@ func incidentInFilter(incident Incident, filter Filter) bool {
 
 // UpdateIncident will update a given incident in the runtime.
 func (manager RuntimeIncidentManager) UpdateIncident(id int, update IncidentUpdate) bool {
+	runtimeIncidentLock.Lock()
+	defer runtimeIncidentLock.Unlock()
+
 	if val, ok := manager.Incidents[int64(id)]; ok {
 		updateIncident(val, update)
 		return true
@@ -146,8 +162,16 @@ func (manager RuntimeIncidentManager) UpdateIncident(id int, update IncidentUpda
 	return false
 }
 
+// UpdateIncidents will update a set of incidents in the runtime.
+func (manager RuntimeIncidentManager) UpdateIncidents(ids []int, update IncidentUpdate) map[int]bool {
+	return updateIncidents(manager, ids, update)
+}
+
 // AddAttachment will create an association between an attachment and an incident in the runtime.
 func (manager RuntimeIncidentManager) AddAttachment(incidentId int, attachment Attachment) bool {
+	runtimeIncidentLock.Lock()
+	defer runtimeIncidentLock.Unlock()
+
 	if _, ok := manager.Incidents[int64(incidentId)]; ok {
 		manager.Attachments[incidentId] = append(manager.Attachments[incidentId], attachment)
 		return true
@@ -157,18 +181,36 @@ func (manager RuntimeIncidentManager) AddAttachment(incidentId int, attachment A
 }
 
 // GetAttachments will find all attachments associated with an incident in the runtime.
+// A copy is returned so the attachments can be used while they are changed.
 func (manager RuntimeIncidentManager) GetAttachments(incidentId int) ([]Attachment, bool) {
-	if val, ok := manager.Attachments[incidentId]; ok {
-		return val, true
-	}
+	runtimeIncidentLock.RLock()
+	defer runtimeIncidentLock.RUnlock()
 
-	attachments := make([]Attachment, 0)
-	manager.Attachments[incidentId] = attachments
+	attachments := make([]Attachment, len(manager.Attachments[incidentId]))
+	copy(attachments, manager.Attachments[incidentId])
 	return attachments, true
 }
 
+// UpdateAttachment will replace an attachment associated with an incident in the runtime.
+func (manager RuntimeIncidentManager) UpdateAttachment(incidentId int, attachment Attachment) bool {
+	runtimeIncidentLock.Lock()
+	defer runtimeIncidentLock.Unlock()
+
+	for i, v := range manager.Attachments[incidentId] {
+		if v.getId() == attachment.getId() {
+			manager.Attachments[incidentId][i] = attachment
+			return true
+		}
+	}
+
+	return false
+}
+
 // RemoveAttachment will find and remove an attachment associated with an incident.
-func (manager RuntimeIncidentManager) RemoveAttachment(incidentId int, fileName string) bool {
+func (manager RuntimeIncidentManager) RemoveAttachment(incidentId int, attachmentId string) bool {
+	runtimeIncidentLock.Lock()
+	defer runtimeIncidentLock.Unlock()
+
 	val, ok := manager.Attachments[incidentId]
 
 	if !ok {
@@ -176,8 +218,8 @@ func (manager RuntimeIncidentManager) RemoveAttachment(incidentId int, fileName
 	}
 
 	for i, v := range val {
-		if v.FileName == fileName {
-			manager.Attachments[incidentId] = append(val[:i], val[i+1:]...)
+		if v.getId() == attachmentId {
+			manager.Attachments[incidentId] = append(val[:i:i], val[i+1:]...)
 			return true
 		}
 	}
@@ -568,7 +568,7 @@ func TestAddAttachment(t *testing.T) {
 	var incident = Incident{"Incident", 0, "Some Description", "Someone", "Open", make(map[string]string, 0)}
 	manager.AddIncident(&incident)
 
-	var attach = Attachment{"testfile.jpg", "2009-11-10T23:00:00Z"}
+	var attach = Attachment{FileName: "testfile.jpg", Time: "2009-11-10T23:00:00Z"}
 	pass := manager.AddAttachment(0, attach)
 
 	if !pass {
@@ -586,12 +586,39 @@ func TestAddAttachment(t *testing.T) {
 	}
 }
 
+func TestUpdateAttachment(t *testing.T) {
+	var manager = RuntimeIncidentManager{make(map[int64]*Incident, 0), make(map[int][]Attachment, 0)}
+	var incident = Incident{"Incident", 0, "Some Description", "Someone", "Open", make(map[string]string, 0)}
+	manager.AddIncident(&incident)
+	manager.AddAttachment(0, Attachment{Id: "abc", FileName: "testfile.jpg", Time: "2009-11-10T23:00:00Z"})
+
+	pass := manager.UpdateAttachment(0, Attachment{Id: "abc", FileName: "testfile.jpg", Version: 2})
+
+	if !pass {
+		t.Error(
+			"For", pass,
+			"expected", true,
+			"got", pass)
+	}
+
+	if manager.Attachments[0][0].Version != 2 {
+		t.Error(
+			"For", manager.Attachments[0],
+			"expected", 2,
+			"got", manager.Attachments[0][0].Version)
+	}
+
+	if manager.UpdateAttachment(0, Attachment{Id: "def", FileName: "other.jpg"}) {
+		t.Error("Expected update of a missing attachment to fail")
+	}
+}
+
 func TestAddAttachmentToInvalidIncident(t *testing.T) {
 	var manager = RuntimeIncidentManager{make(map[int64]*Incident, 0), make(map[int][]Attachment, 0)}
 	var incident = Incident{"Incident", 0, "Some Description", "Someone", "Open", make(map[string]string, 0)}
 	manager.AddIncident(&incident)
 
-	var attach = Attachment{"testfile.jpg", "2009-11-10T23:00:00Z"}
+	var attach = Attachment{FileName: "testfile.jpg", Time: "2009-11-10T23:00:00Z"}
 	pass := manager.AddAttachment(1, attach)
 
 	if pass {
@@ -614,8 +641,8 @@ func TestGetAttachments(t *testing.T) {
 	var incident = Incident{"Incident", 0, "Some Description", "Someone", "Open", make(map[string]string, 0)}
 	manager.AddIncident(&incident)
 
-	var attach1 = Attachment{"testfile.jpg", "2009-11-10T23:00:00Z"}
-	var attach2 = Attachment{"testfile2.jpg", "2009-10-10T23:00:00Z"}
+	var attach1 = Attachment{FileName: "testfile.jpg", Time: "2009-11-10T23:00:00Z"}
+	var attach2 = Attachment{FileName: "testfile2.jpg", Time: "2009-10-10T23:00:00Z"}
 	pass1 := manager.AddAttachment(0, attach1)
 	pass2 := manager.AddAttachment(0, attach2)
 
@@ -715,9 +742,9 @@ func TestRemoveAttachment(t *testing.T) {
 	var incident = Incident{"Incident", 0, "Some Description", "Someone", "Open", make(map[string]string, 0)}
 	manager.AddIncident(&incident)
 
-	var attach1 = Attachment{"testfile.jpg", "2009-11-10T23:00:00Z"}
-	var attach2 = Attachment{"testfile2.jpg", "2009-10-10T23:00:00Z"}
-	var attach3 = Attachment{"testfile3.jpg", "2009-12-10T23:00:00Z"}
+	var attach1 = Attachment{FileName: "testfile.jpg", Time: "2009-11-10T23:00:00Z"}
+	var attach2 = Attachment{FileName: "testfile2.jpg", Time: "2009-10-10T23:00:00Z"}
+	var attach3 = Attachment{FileName: "testfile3.jpg", Time: "2009-12-10T23:00:00Z"}
 	pass1 := manager.AddAttachment(0, attach1)
 	pass2 := manager.AddAttachment(0, attach2)
 	pass3 := manager.AddAttachment(0, attach3)
@@ -782,3 +809,29 @@ func TestRemoveAttachment(t *testing.T) {
 			"got", retVal[1].FileName)
 	}
 }
+
+func TestUseIncidentsWhileImporting(t *testing.T) {
+	var manager = RuntimeIncidentManager{make(map[int64]*Incident, 0), make(map[int][]Attachment, 0)}
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			manager.AddIncident(new(Incident))
+			manager.AddAttachment(i, Attachment{Id: "a"})
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		manager.GetIncidents(nil)
+		manager.GetIncident(i)
+		manager.GetAttachments(i)
+	}
+
+	<-done
+	if attachments, _ := manager.GetAttachments(19); len(attachments) != 1 {
+		t.Error(
+			"For", attachments,
+			"expected", 1,
+			"got", len(attachments))
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// RuntimeServiceAccountManager keeps service accounts in memory, they will be lost when the server restarts.
+type RuntimeServiceAccountManager struct {
+	lock     *sync.RWMutex
+	accounts map[string]ServiceAccount
+}
+
+// NewRuntimeServiceAccountManager creates a service account manager without any accounts.
+func NewRuntimeServiceAccountManager() RuntimeServiceAccountManager {
+	return RuntimeServiceAccountManager{&sync.RWMutex{}, make(map[string]ServiceAccount)}
+}
+
+func (manager RuntimeServiceAccountManager) AddServiceAccount(account ServiceAccount) bool {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	if _, found := manager.accounts[account.Id]; found {
+		return false
+	}
+
+	manager.accounts[account.Id] = account.clone()
+	return true
+}
+
+func (manager RuntimeServiceAccountManager) GetServiceAccount(id string) (ServiceAccount, bool) {
+	manager.lock.RLock()
+	defer manager.lock.RUnlock()
+
+	account, found := manager.accounts[id]
+	if !found {
+		return ServiceAccount{}, false
+	}
+
+	return account.clone(), true
+}
+
+func (manager RuntimeServiceAccountManager) GetServiceAccounts() ([]ServiceAccount, bool) {
+	manager.lock.RLock()
+	defer manager.lock.RUnlock()
+
+	retVal := make([]ServiceAccount, 0, len(manager.accounts))
+	for _, account := range manager.accounts {
+		retVal = append(retVal, account.clone())
+	}
+
+	sortServiceAccounts(retVal)
+	return retVal, true
+}
+
+func (manager RuntimeServiceAccountManager) UpdateServiceAccount(account ServiceAccount) bool {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	if _, found := manager.accounts[account.Id]; !found {
+		return false
+	}
+
+	manager.accounts[account.Id] = account.clone()
+	return true
+}
+
+func (manager RuntimeServiceAccountManager) RemoveServiceAccount(id string) bool {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	if _, found := manager.accounts[id]; !found {
+		return false
+	}
+
+	delete(manager.accounts, id)
+	return true
+}
+
+// sortServiceAccounts orders accounts by name, accounts with the same name are ordered by id.
+func sortServiceAccounts(accounts []ServiceAccount) {
+	sort.Slice(accounts, func(i, j int) bool {
+		if accounts[i].Name != accounts[j].Name {
+			return accounts[i].Name < accounts[j].Name
+		}
+
+		return accounts[i].Id < accounts[j].Id
+	})
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
-	"crypto/sha256"
-	"io"
-	"strings"
+	"sort"
+	"sync"
 )
 
+// runtimeUserLock guards the users, passwords and tokens of the runtime user manager.
+// They are used by every request as well as imports and token reclamation in the background.
+var runtimeUserLock sync.RWMutex
+
 type RuntimeUserManager struct {
 	Users              map[int64]*User
 	Passwords          map[int64]string
@@ -14,10 +17,14 @@ type RuntimeUserManager struct {
 }
 
 func (manager RuntimeUserManager) AddUser(user *AddUser) (bool, User) {
+	hash := createPasswordHash(user.Password)
+
+	runtimeUserLock.Lock()
+	defer runtimeUserLock.Unlock()
+
 	var cuser, id = manager.convertAddUser(user)
 	manager.Users[id] = cuser
-
-	manager.SetUserPassword(*cuser, user.Password)
+	manager.Passwords[id] = hash
 	return true, *cuser
 }
 
@@ -44,6 +51,9 @@ func (manager RuntimeUserManager) convertAddUser(user *AddUser) (*User, int64) {
 }
 
 func (manager RuntimeUserManager) GetUser(userId int64) (User, bool) {
+	runtimeUserLock.RLock()
+	defer runtimeUserLock.RUnlock()
+
 	if val, ok := manager.Users[userId]; ok {
 		return *val, true
 	}
@@ -52,6 +62,9 @@ func (manager RuntimeUserManager) GetUser(userId int64) (User, bool) {
 }
 
 func (manager RuntimeUserManager) GetUserByEmail(emailAddress string) (User, bool) {
+	runtimeUserLock.RLock()
+	defer runtimeUserLock.RUnlock()
+
 	for _, u := range manager.Users {
 		if u.EmailAddress == emailAddress {
 			return *u, true
@@ -61,7 +74,31 @@ func (manager RuntimeUserManager) GetUserByEmail(emailAddress string) (User, boo
 	return User{}, false
 }
 
+func (manager RuntimeUserManager) GetUsers() ([]User, bool) {
+	runtimeUserLock.RLock()
+	retVal := make([]User, 0, len(manager.Users))
+	for _, u := range manager.Users {
+		retVal = append(retVal, *u)
+	}
+	runtimeUserLock.RUnlock()
+
+	sort.Slice(retVal, func(i, j int) bool {
+		return retVal[i].Id < retVal[j].Id
+	})
+
+	return retVal, true
+}
+
+// ListUsers finds a page of the users matching the query.
+func (manager RuntimeUserManager) ListUsers(query UserQuery) (UserPage, bool) {
+	users, _ := manager.GetUsers()
+	return queryUsers(users, query), true
+}
+
 func (manager RuntimeUserManager) UpdateUser(userId int64, user *User) bool {
+	runtimeUserLock.Lock()
+	defer runtimeUserLock.Unlock()
+
 	originalUser := manager.Users[userId]
 	updateUser(originalUser, *user)
 	manager.Users[userId] = originalUser
@@ -69,72 +106,88 @@ func (manager RuntimeUserManager) UpdateUser(userId int64, user *User) bool {
 }
 
 func (manager RuntimeUserManager) RemoveUser(userId int64) bool {
+	runtimeUserLock.Lock()
+	defer runtimeUserLock.Unlock()
+
 	delete(manager.Users, userId)
+	delete(manager.Tokens, userId)
 	return true
 }
 
 func (manager RuntimeUserManager) SetUserPassword(user User, password string) {
-	manager.Passwords[user.Id] = createPasswordHash(user, password)
+	hash := createPasswordHash(password)
+
+	runtimeUserLock.Lock()
+	defer runtimeUserLock.Unlock()
+	manager.Passwords[user.Id] = hash
 }
 
-func (manager RuntimeUserManager) AuthenticateUser(user User, password string) (bool, TokenResponse) {
-	auth := createPasswordHash(user, password) == manager.Passwords[user.Id]
+func (manager RuntimeUserManager) GetPasswordHash(user User) (string, bool) {
+	runtimeUserLock.RLock()
+	defer runtimeUserLock.RUnlock()
 
-	if !auth {
-		return auth, TokenResponse{"", -1}
+	hash, ok := manager.Passwords[user.Id]
+	return hash, ok
+}
+
+func (manager RuntimeUserManager) SetPasswordHash(user User, hash string) bool {
+	runtimeUserLock.Lock()
+	defer runtimeUserLock.Unlock()
+
+	if _, ok := manager.Users[user.Id]; !ok {
+		return false
 	}
 
-	token := GenerateToken(user)
+	manager.Passwords[user.Id] = hash
+	return true
+}
+
+func (manager RuntimeUserManager) AuthenticateUser(user User, password string) (bool, TokenResponse) {
+	stored, _ := manager.GetPasswordHash(user)
+	auth := checkPassword(user, password, stored, func(hash string) bool {
+		return manager.SetPasswordHash(user, hash)
+	})
 
-	if manager.Tokens[user.Id] == nil {
-		manager.Tokens[user.Id] = make([]string, 0, 0)
+	if !auth {
+		return auth, TokenResponse{UserId: -1}
 	}
 
-	manager.Tokens[user.Id] = append(manager.Tokens[user.Id], token.Token)
-	return auth, token
+	token, issued := issueTokens(manager, user)
+	return issued, token
 }
 
 func (manager RuntimeUserManager) ValidateUser(token string) bool {
-	userId := GetTokenUser(token)
+	return validateToken(manager, token)
+}
 
-	found := -1
+func (manager RuntimeUserManager) GetTokens(userId int64) ([]string, bool) {
+	runtimeUserLock.RLock()
+	defer runtimeUserLock.RUnlock()
 
-	for i, v := range manager.Tokens[userId] {
-		if v == token {
-			found = i
-		}
-	}
-
-	if found == -1 {
-		logManager.LogPrintf("Token not found for user %v", userId)
-		return false
-	}
+	tokens := make([]string, len(manager.Tokens[userId]))
+	copy(tokens, manager.Tokens[userId])
+	return tokens, true
+}
 
-	expired := TokenExpired(token)
-	logManager.LogPrintf("Token expired %v", expired)
+func (manager RuntimeUserManager) SetTokens(userId int64, tokens []string) bool {
+	runtimeUserLock.Lock()
+	defer runtimeUserLock.Unlock()
 
-	if expired {
-		manager.Tokens[userId] = append(manager.Tokens[userId][:found], manager.Tokens[userId][found+1:]...)
+	if len(tokens) == 0 {
+		delete(manager.Tokens, userId)
+		return true
 	}
 
-	return !expired
+	manager.Tokens[userId] = tokens
+	return true
 }
 
 func (manager RuntimeUserManager) SetPermissions(userId int64, permissions []string) bool {
+	runtimeUserLock.Lock()
+	defer runtimeUserLock.Unlock()
+
 	user := manager.Users[userId]
 	user.Permissions = permissions
 	manager.Users[userId] = user
 	return true
 }
-
-func createPasswordHash(user User, password string) string {
-	hash := sha256.New()
-
-	pw := strings.NewReader(password + user.EmailAddress)
-
-	if _, err := io.Copy(hash, pw); err != nil {
-		return ""
-	}
-
-	return string(hash.Sum(nil))
-}
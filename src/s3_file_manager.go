@@ -1,22 +1,24 @@
 package main
 
 import (
+	"fmt"
 	"io"
-	"io/ioutil"
-	"mime/multipart"
 	"os"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
 // S3FileManager provides the ability to store attachments in AWS S3
 type S3FileManager struct {
-	Region string // The region to store objects in.
-	Bucket string // The bucket to store objects in.
+	Region            string        // The region to store objects in.
+	Bucket            string        // The bucket to store objects in.
+	PresignExpiration time.Duration // How long presigned download urls last, 0 proxies downloads instead.
 }
 
 // Initialize will setup S3. This will make sure S3 can be connected to.
@@ -61,7 +63,7 @@ func (manager S3FileManager) Initialize() {
 
 // SaveFile will attempt to save an attachment to the configured s3 bucket.
 // If the attempt fails a false will be returned.
-func (manager S3FileManager) SaveFile(incident string, fileName string, file multipart.File) (string, bool) {
+func (manager S3FileManager) SaveFile(incident string, fileName string, file io.Reader) (string, bool) {
 	uploader := s3manager.NewUploader(CreateSession(manager.Region))
 
 	result, err := uploader.Upload(&s3manager.UploadInput{
@@ -77,52 +79,166 @@ func (manager S3FileManager) SaveFile(incident string, fileName string, file mul
 	return result.Location, true
 }
 
-// LoadFile will attempt to load an attachment out of an s3 bucket.
-// If the file cannot be returned a false will be returned.
-func (manager S3FileManager) LoadFile(incident string, fileName string) (io.ReadSeeker, os.FileInfo, bool, func()) {
-	downloader := s3manager.NewDownloader(CreateSession(manager.Region))
+// SupportsVersions reports if object versioning is enabled on the configured bucket.
+// Versioning is never enabled by sona server, it has to be turned on for the bucket.
+func (manager S3FileManager) SupportsVersions() bool {
+	svc := s3.New(CreateSession(manager.Region))
 
-	f, err := ioutil.TempFile("", fileName)
+	result, err := svc.GetBucketVersioning(&s3.GetBucketVersioningInput{
+		Bucket: aws.String(manager.Bucket),
+	})
 
 	if err != nil {
-		return nil, nil, false, nil
+		logManager.LogPrintf("Unable to get bucket versioning %v\n", err)
+		return false
 	}
 
-	_, err2 := downloader.Download(f, &s3.GetObjectInput{
+	return aws.StringValue(result.Status) == s3.BucketVersioningStatusEnabled
+}
+
+// SaveFileVersion will attempt to save a new version of an attachment to the configured s3 bucket.
+// The version id s3 gave the object is returned.
+func (manager S3FileManager) SaveFileVersion(incident string, fileName string, file io.Reader) (string, bool) {
+	uploader := s3manager.NewUploader(CreateSession(manager.Region))
+
+	result, err := uploader.Upload(&s3manager.UploadInput{
 		Bucket: aws.String(manager.Bucket),
 		Key:    aws.String(incident + "/" + fileName),
+		Body:   file,
 	})
 
-	if err2 != nil {
-		f.Close()
-		defer os.Remove(f.Name())
-		return nil, nil, false, nil
+	if err != nil {
+		logManager.LogPrintf("Unable to save file version %v\n", err)
+		return "", false
 	}
 
-	d, err3 := f.Stat()
-	if err3 != nil {
-		f.Close()
-		defer os.Remove(f.Name())
+	return aws.StringValue(result.VersionID), true
+}
+
+// GetFileVersion will find the version id of the current object for an attachment.
+func (manager S3FileManager) GetFileVersion(incident string, fileName string) (string, bool) {
+	svc := s3.New(CreateSession(manager.Region))
+
+	result, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(manager.Bucket),
+		Key:    aws.String(incident + "/" + fileName),
+	})
+
+	if err != nil || result.VersionId == nil {
+		return "", false
+	}
+
+	return *result.VersionId, true
+}
+
+// LoadFile will attempt to load an attachment out of an s3 bucket.
+// If the file cannot be returned a false will be returned.
+func (manager S3FileManager) LoadFile(incident string, fileName string) (io.ReadSeeker, os.FileInfo, bool, func()) {
+	return manager.loadFile(incident, fileName, nil)
+}
+
+// LoadFileVersion will attempt to load a version of an attachment out of an s3 bucket.
+// If the file cannot be returned a false will be returned.
+func (manager S3FileManager) LoadFileVersion(incident string, fileName string, version string) (io.ReadSeeker, os.FileInfo, bool, func()) {
+	return manager.loadFile(incident, fileName, aws.String(version))
+}
+
+// loadFile finds an object without downloading it.
+// The object is streamed from s3 as it is read.
+func (manager S3FileManager) loadFile(incident string, fileName string, version *string) (io.ReadSeeker, os.FileInfo, bool, func()) {
+	svc := s3.New(CreateSession(manager.Region))
+
+	result, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket:    aws.String(manager.Bucket),
+		Key:       aws.String(incident + "/" + fileName),
+		VersionId: version,
+	})
+
+	if err != nil {
+		logManager.LogPrintf("Unable to find object in s3 %v\n", err)
 		return nil, nil, false, nil
 	}
 
-	callback := func() {
-		if f != nil {
-			f.Close()
-			os.Remove(f.Name())
-		}
+	// If the object is replaced while it is being read s3 will fail the request rather than mixing content.
+	object := newS3Object(svc, s3.GetObjectInput{
+		Bucket:    aws.String(manager.Bucket),
+		Key:       aws.String(incident + "/" + fileName),
+		VersionId: version,
+		IfMatch:   result.ETag,
+	}, aws.Int64Value(result.ContentLength))
+
+	info := objectFileInfo{fileName, object.size, aws.TimeValue(result.LastModified)}
+	return object, info, true, object.close
+}
+
+// PresignFile creates a url that downloads an attachment directly from the s3 bucket.
+// If presigned urls are not configured a false will be returned.
+func (manager S3FileManager) PresignFile(incident string, fileName string, version string, disposition string, contentType string) (string, bool) {
+	if manager.PresignExpiration <= 0 {
+		return "", false
 	}
 
-	return f, d, true, callback
+	svc := s3.New(CreateSession(manager.Region))
+
+	input := &s3.GetObjectInput{
+		Bucket:                     aws.String(manager.Bucket),
+		Key:                        aws.String(incident + "/" + fileName),
+		ResponseContentDisposition: aws.String(disposition),
+	}
+
+	if len(version) > 0 {
+		input.VersionId = aws.String(version)
+	}
+
+	if len(contentType) > 0 {
+		input.ResponseContentType = aws.String(contentType)
+	}
+
+	req, _ := svc.GetObjectRequest(input)
+	url, err := req.Presign(manager.PresignExpiration)
+	if err != nil {
+		logManager.LogPrintf("Unable to presign object in s3 %v\n", err)
+		return "", false
+	}
+
+	return url, true
+}
+
+// newS3Object streams an object out of s3, each range is requested with a ranged GetObject.
+func newS3Object(svc s3iface.S3API, input s3.GetObjectInput, size int64) *rangedObject {
+	return &rangedObject{
+		open: func(offset int64) (io.ReadCloser, error) {
+			ranged := input
+			ranged.Range = aws.String(fmt.Sprintf("bytes=%v-", offset))
+
+			result, err := svc.GetObject(&ranged)
+			if err != nil {
+				return nil, err
+			}
+
+			return result.Body, nil
+		},
+		size: size,
+	}
 }
 
 // DeleteFile should attempt to remove the file assoicated with an incident.
 func (manager S3FileManager) DeleteFile(incident string, fileName string) bool {
+	return manager.deleteFile(incident, fileName, nil)
+}
+
+// DeleteFileVersion should attempt to remove a version of the file assoicated with an incident.
+func (manager S3FileManager) DeleteFileVersion(incident string, fileName string, version string) bool {
+	return manager.deleteFile(incident, fileName, aws.String(version))
+}
+
+func (manager S3FileManager) deleteFile(incident string, fileName string, version *string) bool {
 	svc := s3.New(CreateSession(manager.Region))
 
 	input := &s3.DeleteObjectInput{
-		Bucket: aws.String(manager.Bucket),
-		Key:    aws.String(incident + "/" + fileName),
+		Bucket:    aws.String(manager.Bucket),
+		Key:       aws.String(incident + "/" + fileName),
+		VersionId: version,
 	}
 
 	_, err := svc.DeleteObject(input)
@@ -141,6 +257,29 @@ func (manager S3FileManager) DeleteFile(incident string, fileName string) bool {
 	return true
 }
 
+// ListFiles will list every object in the configured bucket.
+func (manager S3FileManager) ListFiles() ([]StoredFile, bool) {
+	svc := s3.New(CreateSession(manager.Region))
+	files := make([]StoredFile, 0)
+
+	err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{Bucket: aws.String(manager.Bucket)}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, object := range page.Contents {
+			if file, ok := parseStoredFileKey(aws.StringValue(object.Key)); ok {
+				files = append(files, file)
+			}
+		}
+
+		return true
+	})
+
+	if err != nil {
+		logManager.LogPrintf("Unable to list objects in s3 %v\n", err)
+		return nil, false
+	}
+
+	return files, true
+}
+
 // CreateSession will create a session.Session for an AWS region.
 func CreateSession(region string) *session.Session {
 	return session.Must(session.NewSession(&aws.Config{
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// FakeS3 serves the ranges of a single object in the same way as s3.
+type FakeS3 struct {
+	s3iface.S3API
+	content string
+	ranges  []string
+}
+
+func (svc *FakeS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	var start int
+	fmt.Sscanf(aws.StringValue(input.Range), "bytes=%d-", &start)
+	svc.ranges = append(svc.ranges, aws.StringValue(input.Range))
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(svc.content[start:]))}, nil
+}
+
+func TestS3ObjectServesRanges(t *testing.T) {
+	svc := &FakeS3{content: "hello world"}
+	object := newS3Object(svc, s3.GetObjectInput{}, int64(len(svc.content)))
+	defer object.close()
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("Range", "bytes=6-")
+	w := httptest.NewRecorder()
+
+	http.ServeContent(w, r, "app.log", time.Now(), object)
+
+	if w.Result().StatusCode != 206 || w.Body.String() != "world" {
+		t.Errorf("Expected partial content got %v %v", w.Result().StatusCode, w.Body.String())
+	}
+
+	if len(svc.ranges) != 1 || svc.ranges[0] != "bytes=6-" {
+		t.Errorf("Expected a single ranged request got %v", svc.ranges)
+	}
+}
+
+func TestS3ObjectNotRequestedUntilRead(t *testing.T) {
+	svc := &FakeS3{content: "hello world"}
+	object := newS3Object(svc, s3.GetObjectInput{}, int64(len(svc.content)))
+	defer object.close()
+
+	object.Seek(0, io.SeekEnd)
+	object.Seek(0, io.SeekStart)
+	if len(svc.ranges) != 0 {
+		t.Fatalf("Expected no requests got %v", svc.ranges)
+	}
+
+	content, _ := io.ReadAll(object)
+	if string(content) != "hello world" {
+		t.Errorf("Expected object content got %v", string(content))
+	}
+}
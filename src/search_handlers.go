@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+const defaultSearchLimit = 20
+
+// SearchResponse is the result of a search.
+// The Total is the number of matching incidents before the limit and offset are applied.
+type SearchResponse struct {
+	Total   int            `json:"total"`
+	Results []SearchResult `json:"results"`
+}
+
+// HandleSearch handles the full text search web request.
+func HandleSearch(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got Search request")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	if !validateRequest(w, r, availablePermissions.viewIncident) {
+		return
+	}
+
+	query := r.URL.Query().Get("q")
+	limit, validLimit := getQueryInt(r, "limit", defaultSearchLimit)
+	offset, validOffset := getQueryInt(r, "offset", 0)
+
+	if len(query) == 0 || !validLimit || !validOffset {
+		logManager.LogPrintf("Invalid search %v\n", r.URL.RawQuery)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	matches := searchIndex.Search(query)
+	response := SearchResponse{len(matches), make([]SearchResult, 0)}
+
+	for i := offset; i < len(matches) && len(response.Results) < limit; i++ {
+		incident, found := incidentManager.GetIncident(int(matches[i].Id))
+		if !found {
+			continue
+		}
+
+		matches[i].Incident = incident
+		response.Results = append(response.Results, matches[i])
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		panic(err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// HandleRebuildSearch handles the rebuild search index web request.
+func HandleRebuildSearch(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got Rebuild Search request")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	if !validateRequest(w, r, availablePermissions.master) {
+		return
+	}
+
+	count, passed := searchIndex.Rebuild()
+	if !passed {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	data, err := json.Marshal(map[string]int{"indexed": count})
+	if err != nil {
+		panic(err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// getQueryInt reads a non negative integer query parameter.
+func getQueryInt(r *http.Request, name string, defaultValue int) (int, bool) {
+	param := r.URL.Query().Get(name)
+	if len(param) == 0 {
+		return defaultValue, true
+	}
+
+	val, err := strconv.Atoi(param)
+	if err != nil || val < 0 {
+		return 0, false
+	}
+
+	return val, true
+}
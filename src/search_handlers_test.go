@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSearchHandler(t *testing.T) {
+	setup()
+	fileManager = LocalFileManager{t.TempDir()}
+	user1.Permissions = append(user1.Permissions, availablePermissions.viewIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	createIncident(&Incident{Description: "Printer on fire", Reporter: "Tester"})
+	createIncident(&Incident{Description: "Network down", Reporter: "Tester"})
+	attach, _ := attachFile(1, "trace.txt", strings.NewReader("router reported a printer error"), "", 0)
+	searchIndex.Wait()
+	_, token := user1.Authenticate("1234")
+
+	r, _ := http.NewRequest("GET", "/sona/v1/search?q=printer", nil)
+	r.Header.Set("X-Sona-Token", token.Token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 200 {
+		t.Fatalf("Expected 200 status code got %v", w.Result())
+	}
+
+	var response SearchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to convert response %v error %v", w.Body, err)
+	}
+
+	if response.Total != 2 || response.Results[0].Incident.Description != "Printer on fire" {
+		t.Fatalf("Unexpected search response %v", response)
+	}
+
+	if response.Results[1].Highlights["attachments."+attach.Id][0] != "router reported a <em>printer</em> error" {
+		t.Errorf("Unexpected highlights %v", response.Results[1].Highlights)
+	}
+}
+
+func TestSearchHandlerWithoutQuery(t *testing.T) {
+	setup()
+	user1.Permissions = append(user1.Permissions, availablePermissions.viewIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	_, token := user1.Authenticate("1234")
+
+	r, _ := http.NewRequest("GET", "/sona/v1/search", nil)
+	r.Header.Set("X-Sona-Token", token.Token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 400 {
+		t.Errorf("Expected 400 status code got %v", w.Result())
+	}
+}
+
+func TestSearchHandlerWithInvalidPermissions(t *testing.T) {
+	setup()
+	_, token := user1.Authenticate("1234")
+
+	r, _ := http.NewRequest("GET", "/sona/v1/search?q=printer", nil)
+	r.Header.Set("X-Sona-Token", token.Token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 401 {
+		t.Errorf("Expected 401 status code got %v", w.Result())
+	}
+}
+
+func TestRebuildSearchHandler(t *testing.T) {
+	setup()
+	user1.Permissions = append(user1.Permissions, availablePermissions.master)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Printer on fire", "Tester", "open", make(map[string]string, 0)})
+	_, token := user1.Authenticate("1234")
+
+	if results := searchIndex.Search("printer"); len(results) != 0 {
+		t.Fatalf("Expected incident to not be indexed yet got %v", results)
+	}
+
+	r, _ := http.NewRequest("POST", "/sona/v1/search/rebuild", nil)
+	r.Header.Set("X-Sona-Token", token.Token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 200 {
+		t.Fatalf("Expected 200 status code got %v", w.Result())
+	}
+
+	if results := searchIndex.Search("printer"); len(results) != 1 {
+		t.Errorf("Expected rebuilt index to find the incident got %v", results)
+	}
+}
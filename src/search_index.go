@@ -0,0 +1,568 @@
+package main
+
+import (
+	"encoding/gob"
+	"html"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	attachmentFieldPrefix = "attachments."
+
+	// maxIndexedAttachmentSize is the most of an attachment that will be read for indexing.
+	maxIndexedAttachmentSize = 1 << 20
+
+	// snippetContext is the number of tokens shown either side of a highlighted match.
+	snippetContext = 8
+)
+
+// searchToken is a single term found in a field along with where it was found.
+type searchToken struct {
+	Term  string
+	Start int
+	End   int
+}
+
+type searchField struct {
+	Text   string
+	Tokens []searchToken
+}
+
+type searchDocument struct {
+	Fields map[string]*searchField
+}
+
+// SearchIndex is an in memory inverted index of incidents and the text of their attachments.
+// If a path is provided the indexed text is saved there so it can be loaded on startup.
+type SearchIndex struct {
+	lock      sync.RWMutex
+	update    sync.Mutex
+	pending   sync.WaitGroup
+	path      string
+	dirty     bool
+	documents map[int64]*searchDocument
+	postings  map[string]map[int64]int
+}
+
+// SearchResult is a single incident matching a search.
+// The Highlights map a field to snippets of its text with the matches wrapped in em tags.
+type SearchResult struct {
+	Id         int64               `json:"id"`
+	Score      float64             `json:"score"`
+	Incident   Incident            `json:"incident"`
+	Highlights map[string][]string `json:"highlights"`
+}
+
+// searchClause is a single term or a phrase of terms that must appear in order.
+type searchClause []string
+
+var searchIndex = NewSearchIndex("")
+var searchIndexing sync.Once
+
+// NewSearchIndex creates an index, loading any previously saved index from the path.
+func NewSearchIndex(path string) *SearchIndex {
+	index := &SearchIndex{
+		path:      path,
+		documents: make(map[int64]*searchDocument),
+		postings:  make(map[string]map[int64]int),
+	}
+
+	if len(path) > 0 {
+		index.load()
+	}
+
+	return index
+}
+
+// startSearchIndexing keeps the current search index up to date with incident events.
+func startSearchIndexing() {
+	searchIndexing.Do(func() {
+		eventManager.Listen(func(event IncidentEvent) {
+			index := searchIndex
+			index.pending.Add(1)
+			go func() {
+				defer index.pending.Done()
+				index.apply(event)
+			}()
+		})
+	})
+}
+
+// apply updates the index for a single event.
+// The incident is always read back from the incident manager so the index reflects its latest state.
+func (index *SearchIndex) apply(event IncidentEvent) {
+	index.update.Lock()
+	defer index.update.Unlock()
+
+	if event.Type == incidentAttachedEvent && event.Attachment != nil {
+		text, _ := extractAttachmentText(event.IncidentId, *event.Attachment)
+		index.IndexAttachment(event.IncidentId, event.Attachment.getId(), text)
+		return
+	}
+
+	incident, found := incidentManager.GetIncident(int(event.IncidentId))
+	if !found {
+		index.Remove(event.IncidentId)
+		return
+	}
+
+	index.IndexIncident(incident)
+}
+
+// Wait blocks until all queued index updates have been applied.
+func (index *SearchIndex) Wait() {
+	index.pending.Wait()
+}
+
+// extractAttachmentText reads the current version of an attachment if it looks like text.
+func extractAttachmentText(incidentId int64, attachment Attachment) (string, bool) {
+	file, _, passed, closer := loadAttachmentVersion(incidentId, attachment, attachment.getCurrentVersion())
+	if closer != nil {
+		defer closer()
+	}
+
+	if !passed || file == nil {
+		return "", false
+	}
+
+	data, err := io.ReadAll(io.LimitReader(file, maxIndexedAttachmentSize))
+	if err != nil {
+		logManager.LogPrintf("Unable to read attachment %v for indexing %v\n", attachment.getId(), err)
+		return "", false
+	}
+
+	if !strings.HasPrefix(http.DetectContentType(data), "text/") || !utf8.Valid(data) {
+		return "", false
+	}
+
+	return string(data), true
+}
+
+// Rebuild replaces the index with the incidents and attachments currently in the incident manager.
+func (index *SearchIndex) Rebuild() (int, bool) {
+	index.update.Lock()
+	defer index.update.Unlock()
+
+	incidents, passed := incidentManager.GetIncidents(nil)
+	if !passed {
+		logManager.LogPrintln("Unable to get incidents to index")
+		return 0, false
+	}
+
+	rebuilt := NewSearchIndex("")
+	for _, incident := range incidents {
+		rebuilt.IndexIncident(incident)
+
+		attachments, _ := incidentManager.GetAttachments(int(incident.Id))
+		for _, attachment := range attachments {
+			text, _ := extractAttachmentText(incident.Id, attachment)
+			rebuilt.IndexAttachment(incident.Id, attachment.getId(), text)
+		}
+	}
+
+	index.lock.Lock()
+	index.documents = rebuilt.documents
+	index.postings = rebuilt.postings
+	index.dirty = true
+	index.lock.Unlock()
+
+	logManager.LogPrintf("Rebuilt search index with %v incidents\n", len(incidents))
+	return len(incidents), index.Save()
+}
+
+// IndexIncident indexes the fields of an incident, keeping any indexed attachments.
+func (index *SearchIndex) IndexIncident(incident Incident) {
+	fields := map[string]string{
+		"type":        incident.Type,
+		"description": incident.Description,
+		"reporter":    incident.Reporter,
+		"state":       incident.State,
+	}
+
+	for name, value := range incident.Attributes {
+		fields[attributeColumnPrefix+name] = value
+	}
+
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	if doc, ok := index.documents[incident.Id]; ok {
+		for name := range doc.Fields {
+			if _, keep := fields[name]; !keep && !strings.HasPrefix(name, attachmentFieldPrefix) {
+				index.setField(incident.Id, name, "")
+			}
+		}
+	}
+
+	for name, value := range fields {
+		index.setField(incident.Id, name, value)
+	}
+}
+
+// IndexAttachment indexes the text of an attachment under its id.
+func (index *SearchIndex) IndexAttachment(incidentId int64, attachmentId string, text string) {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	index.setField(incidentId, attachmentFieldPrefix+attachmentId, text)
+}
+
+// Remove drops an incident from the index.
+func (index *SearchIndex) Remove(incidentId int64) {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	if doc, ok := index.documents[incidentId]; ok {
+		for name := range doc.Fields {
+			index.setField(incidentId, name, "")
+		}
+	}
+
+	delete(index.documents, incidentId)
+}
+
+// setField replaces the text of a field, the caller must hold the write lock.
+func (index *SearchIndex) setField(docId int64, name string, text string) {
+	doc, ok := index.documents[docId]
+	if !ok {
+		doc = &searchDocument{make(map[string]*searchField)}
+		index.documents[docId] = doc
+	}
+
+	if old, ok := doc.Fields[name]; ok {
+		for _, token := range old.Tokens {
+			index.postings[token.Term][docId]--
+			if index.postings[token.Term][docId] <= 0 {
+				delete(index.postings[token.Term], docId)
+			}
+			if len(index.postings[token.Term]) == 0 {
+				delete(index.postings, token.Term)
+			}
+		}
+		delete(doc.Fields, name)
+	}
+
+	index.dirty = true
+	if len(text) == 0 {
+		return
+	}
+
+	field := &searchField{text, tokenize(text)}
+	doc.Fields[name] = field
+	for _, token := range field.Tokens {
+		if index.postings[token.Term] == nil {
+			index.postings[token.Term] = make(map[int64]int)
+		}
+		index.postings[token.Term][docId]++
+	}
+}
+
+// tokenize splits text into lower cased words made of letters and digits.
+func tokenize(text string) []searchToken {
+	tokens := make([]searchToken, 0)
+	start := -1
+
+	for i, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+
+		if start >= 0 {
+			tokens = append(tokens, searchToken{strings.ToLower(text[start:i]), start, i})
+			start = -1
+		}
+	}
+
+	if start >= 0 {
+		tokens = append(tokens, searchToken{strings.ToLower(text[start:]), start, len(text)})
+	}
+
+	return tokens
+}
+
+// parseSearchQuery splits a query into terms and quoted phrases.
+func parseSearchQuery(query string) []searchClause {
+	clauses := make([]searchClause, 0)
+	for i, part := range strings.Split(query, "\"") {
+		if i%2 == 1 {
+			if clause := toSearchClause(part); len(clause) > 0 {
+				clauses = append(clauses, clause)
+			}
+			continue
+		}
+
+		for _, word := range strings.Fields(part) {
+			if clause := toSearchClause(word); len(clause) > 0 {
+				clauses = append(clauses, clause)
+			}
+		}
+	}
+
+	return clauses
+}
+
+func toSearchClause(text string) searchClause {
+	tokens := tokenize(text)
+	clause := make(searchClause, len(tokens))
+	for i, token := range tokens {
+		clause[i] = token.Term
+	}
+
+	return clause
+}
+
+func getFieldBoost(name string) float64 {
+	if name == "description" {
+		return 2
+	}
+
+	if strings.HasPrefix(name, attachmentFieldPrefix) {
+		return 0.5
+	}
+
+	return 1
+}
+
+// findClause returns the token positions in a field where the clause starts.
+func findClause(field *searchField, clause searchClause) []int {
+	matches := make([]int, 0)
+	for i := 0; i+len(clause) <= len(field.Tokens); i++ {
+		found := true
+		for j, term := range clause {
+			if field.Tokens[i+j].Term != term {
+				found = false
+				break
+			}
+		}
+
+		if found {
+			matches = append(matches, i)
+		}
+	}
+
+	return matches
+}
+
+// Search finds the incidents matching every term and phrase in the query.
+// Results are ranked with a tf-idf score where matches in the description count the most.
+func (index *SearchIndex) Search(query string) []SearchResult {
+	clauses := parseSearchQuery(query)
+	if len(clauses) == 0 {
+		return make([]SearchResult, 0)
+	}
+
+	index.lock.RLock()
+	defer index.lock.RUnlock()
+
+	candidates := index.findCandidates(clauses)
+	results := make([]SearchResult, 0, len(candidates))
+	total := float64(len(index.documents))
+
+	for _, docId := range candidates {
+		doc := index.documents[docId]
+		score := 0.0
+		matched := true
+		matches := make(map[string][][2]int)
+
+		for _, clause := range clauses {
+			idf := 0.0
+			for _, term := range clause {
+				idf += math.Log(1 + total/float64(len(index.postings[term])))
+			}
+			idf /= float64(len(clause))
+
+			clauseScore := 0.0
+			for name, field := range doc.Fields {
+				found := findClause(field, clause)
+				if len(found) == 0 {
+					continue
+				}
+
+				clauseScore += (1 + math.Log(float64(len(found)))) * idf * getFieldBoost(name)
+				for _, start := range found {
+					matches[name] = append(matches[name], [2]int{start, start + len(clause)})
+				}
+			}
+
+			if clauseScore == 0 {
+				matched = false
+				break
+			}
+			score += clauseScore
+		}
+
+		if !matched {
+			continue
+		}
+
+		highlights := make(map[string][]string, len(matches))
+		for name, found := range matches {
+			highlights[name] = []string{createSnippet(doc.Fields[name], found)}
+		}
+
+		results = append(results, SearchResult{Id: docId, Score: score, Highlights: highlights})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Id < results[j].Id
+	})
+
+	return results
+}
+
+// findCandidates finds the documents that contain every term in the query.
+func (index *SearchIndex) findCandidates(clauses []searchClause) []int64 {
+	var candidates map[int64]bool
+	for _, clause := range clauses {
+		for _, term := range clause {
+			next := make(map[int64]bool)
+			for docId := range index.postings[term] {
+				if candidates == nil || candidates[docId] {
+					next[docId] = true
+				}
+			}
+			candidates = next
+		}
+	}
+
+	retVal := make([]int64, 0, len(candidates))
+	for docId := range candidates {
+		retVal = append(retVal, docId)
+	}
+
+	return retVal
+}
+
+// createSnippet shows the text around the first match with every match in that text highlighted.
+func createSnippet(field *searchField, matches [][2]int) string {
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i][0] < matches[j][0]
+	})
+
+	first := matches[0][0]
+	lo := first - snippetContext
+	if lo < 0 {
+		lo = 0
+	}
+
+	hi := matches[0][1] + snippetContext
+	if hi > len(field.Tokens) {
+		hi = len(field.Tokens)
+	}
+
+	var snippet strings.Builder
+	if lo > 0 {
+		snippet.WriteString("…")
+	}
+
+	position := field.Tokens[lo].Start
+	for _, match := range matches {
+		if match[0] < lo || match[1] > hi || field.Tokens[match[0]].Start < position {
+			continue
+		}
+
+		start := field.Tokens[match[0]].Start
+		end := field.Tokens[match[1]-1].End
+		snippet.WriteString(html.EscapeString(field.Text[position:start]))
+		snippet.WriteString("<em>")
+		snippet.WriteString(html.EscapeString(field.Text[start:end]))
+		snippet.WriteString("</em>")
+		position = end
+	}
+
+	snippet.WriteString(html.EscapeString(field.Text[position:field.Tokens[hi-1].End]))
+	if hi < len(field.Tokens) {
+		snippet.WriteString("…")
+	}
+
+	return snippet.String()
+}
+
+// Save writes the indexed text to the index path if it has changed.
+func (index *SearchIndex) Save() bool {
+	if len(index.path) == 0 {
+		return true
+	}
+
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	if !index.dirty {
+		return true
+	}
+
+	saved := make(map[int64]map[string]string, len(index.documents))
+	for docId, doc := range index.documents {
+		fields := make(map[string]string, len(doc.Fields))
+		for name, field := range doc.Fields {
+			fields[name] = field.Text
+		}
+		saved[docId] = fields
+	}
+
+	tmp := index.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		logManager.LogPrintf("Unable to save search index %v\n", err)
+		return false
+	}
+
+	err = gob.NewEncoder(f).Encode(saved)
+	f.Close()
+	if err != nil {
+		logManager.LogPrintf("Unable to save search index %v\n", err)
+		return false
+	}
+
+	if err := os.Rename(tmp, index.path); err != nil {
+		logManager.LogPrintf("Unable to save search index %v\n", err)
+		return false
+	}
+
+	index.dirty = false
+	return true
+}
+
+func (index *SearchIndex) load() {
+	f, err := os.Open(index.path)
+	if err != nil {
+		logManager.LogPrintf("No search index found at %v\n", index.path)
+		return
+	}
+	defer f.Close()
+
+	var saved map[int64]map[string]string
+	if err := gob.NewDecoder(f).Decode(&saved); err != nil {
+		logManager.LogPrintf("Unable to load search index %v\n", err)
+		return
+	}
+
+	for docId, fields := range saved {
+		for name, text := range fields {
+			index.setField(docId, name, text)
+		}
+	}
+
+	index.dirty = false
+}
+
+// saveSearchIndexPeriodically saves the index whenever it has changed.
+func saveSearchIndexPeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		searchIndex.Save()
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSearchIndexRanksDescriptionMatchesFirst(t *testing.T) {
+	index := NewSearchIndex("")
+	index.IndexIncident(Incident{"Incident", 0, "Printer on fire", "Tester", "open", map[string]string{"location": "printer room"}})
+	index.IndexIncident(Incident{"Incident", 1, "Coffee machine broken", "Tester", "open", map[string]string{"location": "printer room"}})
+	index.IndexIncident(Incident{"Incident", 2, "Network down", "Tester", "open", nil})
+
+	results := index.Search("printer")
+
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results got %v", results)
+	}
+
+	if results[0].Id != 0 || results[1].Id != 1 {
+		t.Errorf("Expected incident 0 to rank above incident 1 got %v", results)
+	}
+}
+
+func TestSearchIndexWithPhrase(t *testing.T) {
+	index := NewSearchIndex("")
+	index.IndexIncident(Incident{"Incident", 0, "The server room is hot", "Tester", "open", nil})
+	index.IndexIncident(Incident{"Incident", 1, "The room next to the server is hot", "Tester", "open", nil})
+
+	results := index.Search("\"server room\"")
+
+	if len(results) != 1 || results[0].Id != 0 {
+		t.Fatalf("Expected only incident 0 got %v", results)
+	}
+
+	if results[0].Highlights["description"][0] != "The <em>server room</em> is hot" {
+		t.Errorf("Unexpected highlight %v", results[0].Highlights)
+	}
+}
+
+func TestSearchIndexRequiresEveryTerm(t *testing.T) {
+	index := NewSearchIndex("")
+	index.IndexIncident(Incident{"Incident", 0, "Printer on fire", "Tester", "open", nil})
+	index.IndexIncident(Incident{"Incident", 1, "Printer out of paper", "Tester", "open", nil})
+
+	results := index.Search("printer fire")
+
+	if len(results) != 1 || results[0].Id != 0 {
+		t.Errorf("Expected only incident 0 got %v", results)
+	}
+}
+
+func TestSearchIndexUpdateReplacesText(t *testing.T) {
+	index := NewSearchIndex("")
+	index.IndexIncident(Incident{"Incident", 0, "Printer on fire", "Tester", "open", map[string]string{"severity": "critical"}})
+	index.IndexAttachment(0, "log.txt", "toner error")
+	index.IndexIncident(Incident{"Incident", 0, "Printer fixed", "Tester", "closed", nil})
+
+	if results := index.Search("fire"); len(results) != 0 {
+		t.Errorf("Expected old description to be removed got %v", results)
+	}
+
+	if results := index.Search("critical"); len(results) != 0 {
+		t.Errorf("Expected removed attribute to be removed got %v", results)
+	}
+
+	if results := index.Search("toner"); len(results) != 1 {
+		t.Errorf("Expected attachment text to be kept got %v", results)
+	}
+}
+
+func TestSearchIndexSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "search.index")
+	index := NewSearchIndex(path)
+	index.IndexIncident(Incident{"Incident", 3, "Printer on fire", "Tester", "open", nil})
+
+	if !index.Save() {
+		t.Fatalf("Expected index to save")
+	}
+
+	loaded := NewSearchIndex(path)
+	if results := loaded.Search("printer"); len(results) != 1 || results[0].Id != 3 {
+		t.Errorf("Expected loaded index to find incident 3 got %v", results)
+	}
+}
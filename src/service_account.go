@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	guuid "github.com/google/uuid"
+)
+
+// apiKeyPrefix starts every API key so they can be told apart from access tokens.
+const apiKeyPrefix = "sona_"
+
+// ServiceAccount is a non-interactive principal used by integrations like CI jobs and monitoring scripts.
+// Service accounts cannot log in, they authenticate with their API keys and only have the Permissions given to them.
+type ServiceAccount struct {
+	Id          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+	Keys        []APIKey `json:"keys"`
+}
+
+// APIKey is a long lived key of a service account.
+// Only the SHA-256 Hash of the secret is stored, the key itself is only returned when it is created.
+// The Created and Expires are formatted as RFC3339, if Expires is empty the key does not expire.
+// The AllowedIPs are the addresses or CIDR ranges the key can be used from, if empty it can be used from anywhere.
+type APIKey struct {
+	Id         string   `json:"id"`
+	Name       string   `json:"name"`
+	Hash       string   `json:"hash,omitempty"`
+	Created    string   `json:"created"`
+	Expires    string   `json:"expires,omitempty"`
+	AllowedIPs []string `json:"allowedIps,omitempty"`
+}
+
+// ServiceAccountManager stores service accounts and their keys.
+type ServiceAccountManager interface {
+	AddServiceAccount(account ServiceAccount) bool
+	GetServiceAccount(id string) (ServiceAccount, bool)
+	GetServiceAccounts() ([]ServiceAccount, bool)
+	UpdateServiceAccount(account ServiceAccount) bool
+	RemoveServiceAccount(id string) bool
+}
+
+var serviceAccountManager ServiceAccountManager = NewRuntimeServiceAccountManager()
+
+// serviceAccountLock keeps changes to the keys of a service account from overwriting each other.
+var serviceAccountLock sync.Mutex
+
+// NewServiceAccount creates a service account without any keys.
+func NewServiceAccount(name string, description string, permissions []string) ServiceAccount {
+	return ServiceAccount{guuid.New().String(), name, description, permissions, make([]APIKey, 0)}
+}
+
+// clone copies an account so changes to it are not seen by other copies.
+func (account ServiceAccount) clone() ServiceAccount {
+	retVal := account
+	retVal.Permissions = append(make([]string, 0, len(account.Permissions)), account.Permissions...)
+	retVal.Keys = make([]APIKey, 0, len(account.Keys))
+	for _, key := range account.Keys {
+		key.AllowedIPs = append([]string(nil), key.AllowedIPs...)
+		retVal.Keys = append(retVal.Keys, key)
+	}
+
+	return retVal
+}
+
+// public copies an account without the hashes of its keys so it can be returned to clients.
+func (account ServiceAccount) public() ServiceAccount {
+	retVal := account.clone()
+	for i := range retVal.Keys {
+		retVal.Keys[i].Hash = ""
+	}
+
+	return retVal
+}
+
+func (account ServiceAccount) hasPermission(permission string) bool {
+	for _, p := range account.Permissions {
+		if p == permission || p == availablePermissions.master {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (account ServiceAccount) findKey(keyId string) int {
+	for i, key := range account.Keys {
+		if key.Id == keyId {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// NewAPIKey creates a key for a service account and returns it along with the secret key to give to the client.
+// A zero expires creates a key that does not expire.
+func NewAPIKey(accountId string, name string, expires time.Time, allowedIPs []string) (APIKey, string, error) {
+	for _, allowed := range allowedIPs {
+		if !isValidAllowedIP(allowed) {
+			return APIKey{}, "", fmt.Errorf("%v is not an address or CIDR range", allowed)
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return APIKey{}, "", err
+	}
+
+	key := APIKey{
+		Id:         strings.ReplaceAll(guuid.New().String(), "-", ""),
+		Name:       name,
+		Created:    time.Now().Format(time.RFC3339),
+		AllowedIPs: allowedIPs,
+	}
+
+	if !expires.IsZero() {
+		key.Expires = expires.Format(time.RFC3339)
+	}
+
+	encoded := hex.EncodeToString(secret)
+	key.Hash = hashAPIKeySecret(encoded)
+	return key, apiKeyPrefix + accountId + "_" + key.Id + "_" + encoded, nil
+}
+
+// hashAPIKeySecret hashes the secret of a key to store it.
+// Secrets are 32 random bytes rather than passwords chosen by people, so a fast hash is enough and keeps checking keys cheap.
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func isValidAllowedIP(allowed string) bool {
+	if _, _, err := net.ParseCIDR(allowed); err == nil {
+		return true
+	}
+
+	return net.ParseIP(allowed) != nil
+}
+
+// isAPIKey checks if a token looks like an API key rather than an access token.
+func isAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+// parseAPIKey splits an API key into the id of its account, the id of the key and its secret.
+func parseAPIKey(token string) (string, string, string, bool) {
+	parts := strings.Split(strings.TrimPrefix(token, apiKeyPrefix), "_")
+	if !isAPIKey(token) || len(parts) != 3 {
+		return "", "", "", false
+	}
+
+	return parts[0], parts[1], parts[2], true
+}
+
+// authenticateAPIKey finds the service account of an API key used from an address.
+// The key must match the stored hash, must not have expired and must be allowed from the address.
+func authenticateAPIKey(token string, address string) (ServiceAccount, bool) {
+	accountId, keyId, secret, valid := parseAPIKey(token)
+	if !valid {
+		return ServiceAccount{}, false
+	}
+
+	account, found := serviceAccountManager.GetServiceAccount(accountId)
+	if !found {
+		logManager.LogPrintf("Service account %v not found\n", accountId)
+		return ServiceAccount{}, false
+	}
+
+	index := account.findKey(keyId)
+	if index < 0 {
+		logManager.LogPrintf("Key %v of service account %v not found\n", keyId, accountId)
+		return ServiceAccount{}, false
+	}
+
+	key := account.Keys[index]
+	if subtle.ConstantTimeCompare([]byte(hashAPIKeySecret(secret)), []byte(key.Hash)) != 1 {
+		logManager.LogPrintf("Invalid secret used for key %v of service account %v\n", keyId, accountId)
+		return ServiceAccount{}, false
+	}
+
+	if isAPIKeyExpired(key) {
+		logManager.LogPrintf("Key %v of service account %v has expired\n", keyId, accountId)
+		return ServiceAccount{}, false
+	}
+
+	if !isAddressAllowed(key, address) {
+		logManager.LogPrintf("Key %v of service account %v is not allowed from %v\n", keyId, accountId, address)
+		return ServiceAccount{}, false
+	}
+
+	return account, true
+}
+
+func isAPIKeyExpired(key APIKey) bool {
+	if len(key.Expires) == 0 {
+		return false
+	}
+
+	expires, err := time.Parse(time.RFC3339, key.Expires)
+	return err != nil || !expires.After(time.Now())
+}
+
+func isAddressAllowed(key APIKey, address string) bool {
+	if len(key.AllowedIPs) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+
+	for _, allowed := range key.AllowedIPs {
+		if _, network, err := net.ParseCIDR(allowed); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		if allowedIP := net.ParseIP(allowed); allowedIP != nil && allowedIP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// updateServiceAccount changes a stored service account.
+// A false is returned if the account cannot be found, the change fails or it cannot be stored.
+func updateServiceAccount(accountId string, change func(account *ServiceAccount) bool) bool {
+	serviceAccountLock.Lock()
+	defer serviceAccountLock.Unlock()
+
+	account, found := serviceAccountManager.GetServiceAccount(accountId)
+	if !found || !change(&account) {
+		return false
+	}
+
+	return serviceAccountManager.UpdateServiceAccount(account)
+}
+
+// addAPIKey creates a new key for a service account and returns it along with the secret key.
+func addAPIKey(accountId string, name string, expires time.Time, allowedIPs []string) (APIKey, string, bool) {
+	key, secret, err := NewAPIKey(accountId, name, expires, allowedIPs)
+	if err != nil {
+		logManager.LogPrintf("Unable to create key %v\n", err)
+		return APIKey{}, "", false
+	}
+
+	passed := updateServiceAccount(accountId, func(account *ServiceAccount) bool {
+		account.Keys = append(account.Keys, key)
+		return true
+	})
+
+	return key, secret, passed
+}
+
+// rotateAPIKey replaces a key with a new key that has the same name, allowed addresses and lifetime.
+// The old key keeps working for the grace period so clients can switch to the new key, with no grace period it stops working straight away.
+func rotateAPIKey(accountId string, keyId string, grace time.Duration) (APIKey, string, bool) {
+	var key APIKey
+	var secret string
+	passed := updateServiceAccount(accountId, func(account *ServiceAccount) bool {
+		index := account.findKey(keyId)
+		if index < 0 {
+			return false
+		}
+
+		old := account.Keys[index]
+		var expires time.Time
+		if len(old.Expires) > 0 {
+			created, _ := time.Parse(time.RFC3339, old.Created)
+			previous, _ := time.Parse(time.RFC3339, old.Expires)
+			expires = time.Now().Add(previous.Sub(created))
+		}
+
+		var err error
+		key, secret, err = NewAPIKey(accountId, old.Name, expires, old.AllowedIPs)
+		if err != nil {
+			logManager.LogPrintf("Unable to create key %v\n", err)
+			return false
+		}
+
+		if grace <= 0 {
+			account.Keys = append(account.Keys[:index], account.Keys[index+1:]...)
+		} else if graceEnd := time.Now().Add(grace); len(old.Expires) == 0 || isBefore(graceEnd, old.Expires) {
+			account.Keys[index].Expires = graceEnd.Format(time.RFC3339)
+		}
+
+		account.Keys = append(account.Keys, key)
+		return true
+	})
+
+	return key, secret, passed
+}
+
+func isBefore(t time.Time, formatted string) bool {
+	other, err := time.Parse(time.RFC3339, formatted)
+	return err != nil || t.Before(other)
+}
+
+// removeAPIKey revokes a key of a service account.
+func removeAPIKey(accountId string, keyId string) bool {
+	return updateServiceAccount(accountId, func(account *ServiceAccount) bool {
+		index := account.findKey(keyId)
+		if index < 0 {
+			return false
+		}
+
+		account.Keys = append(account.Keys[:index], account.Keys[index+1:]...)
+		return true
+	})
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ServiceAccountRequest is the name, description and permissions of a service account to create or update.
+type ServiceAccountRequest struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+// APIKeyRequest describes a key to create.
+// The Expires is formatted as RFC3339, if empty the key does not expire.
+type APIKeyRequest struct {
+	Name       string   `json:"name"`
+	Expires    string   `json:"expires"`
+	AllowedIPs []string `json:"allowedIps"`
+}
+
+// RotateAPIKeyRequest is how long the old key keeps working after it has been rotated.
+type RotateAPIKeyRequest struct {
+	GraceMinutes int `json:"graceMinutes"`
+}
+
+// APIKeyResponse is a created key along with the secret Key, which cannot be retrieved again.
+type APIKeyResponse struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+func convertServiceAccountRequest(r *http.Request) (ServiceAccountRequest, bool) {
+	var req ServiceAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logManager.LogPrintf("Invalid service account request %v\n", err)
+		return req, false
+	}
+
+	if len(req.Name) == 0 {
+		logManager.LogPrintln("Service accounts must have a name")
+		return req, false
+	}
+
+	if req.Permissions == nil {
+		req.Permissions = make([]string, 0)
+	}
+
+	for _, permission := range req.Permissions {
+		if !isKnownPermission(permission) {
+			logManager.LogPrintf("Unknown permission %v\n", permission)
+			return req, false
+		}
+	}
+
+	return req, true
+}
+
+func writeServiceAccountJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		panic(err)
+	}
+}
+
+// HandleCreateServiceAccount handles the create service account web request.
+func HandleCreateServiceAccount(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got create service account request")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if !validateRequest(w, r, availablePermissions.master) {
+		return
+	}
+
+	req, passed := convertServiceAccountRequest(r)
+	if !passed {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	account := NewServiceAccount(req.Name, req.Description, req.Permissions)
+	if !serviceAccountManager.AddServiceAccount(account) {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/sona/v1/serviceaccounts/"+account.Id)
+	writeServiceAccountJSON(w, http.StatusCreated, account.public())
+}
+
+// HandleGetServiceAccounts handles the get service accounts web request.
+func HandleGetServiceAccounts(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got service accounts request")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if !validateRequest(w, r, availablePermissions.master) {
+		return
+	}
+
+	accounts, passed := serviceAccountManager.GetServiceAccounts()
+	if !passed {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	for i, account := range accounts {
+		accounts[i] = account.public()
+	}
+
+	writeServiceAccountJSON(w, http.StatusOK, accounts)
+}
+
+// HandleGetServiceAccount handles the get service account web request.
+func HandleGetServiceAccount(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got service account request")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if !validateRequest(w, r, availablePermissions.master) {
+		return
+	}
+
+	account, found := serviceAccountManager.GetServiceAccount(mux.Vars(r)["accountId"])
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	writeServiceAccountJSON(w, http.StatusOK, account.public())
+}
+
+// HandleUpdateServiceAccount handles the update service account web request.
+// The keys of the account are not changed.
+func HandleUpdateServiceAccount(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got update service account request")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if !validateRequest(w, r, availablePermissions.master) {
+		return
+	}
+
+	accountId := mux.Vars(r)["accountId"]
+	req, passed := convertServiceAccountRequest(r)
+	if !passed {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if _, found := serviceAccountManager.GetServiceAccount(accountId); !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var updated ServiceAccount
+	passed = updateServiceAccount(accountId, func(account *ServiceAccount) bool {
+		account.Name = req.Name
+		account.Description = req.Description
+		account.Permissions = req.Permissions
+		updated = *account
+		return true
+	})
+
+	if !passed {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeServiceAccountJSON(w, http.StatusOK, updated.public())
+}
+
+// HandleDeleteServiceAccount handles the delete service account web request.
+// Every key of the account stops working.
+func HandleDeleteServiceAccount(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got delete service account request")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if !validateRequest(w, r, availablePermissions.master) {
+		return
+	}
+
+	accountId := mux.Vars(r)["accountId"]
+	if _, found := serviceAccountManager.GetServiceAccount(accountId); !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !serviceAccountManager.RemoveServiceAccount(accountId) {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandleCreateAPIKey handles the create API key web request.
+// The key is only returned in the response, only its hash is stored.
+func HandleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got create API key request")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if !validateRequest(w, r, availablePermissions.master) {
+		return
+	}
+
+	accountId := mux.Vars(r)["accountId"]
+
+	var req APIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logManager.LogPrintf("Invalid API key request %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var expires time.Time
+	if len(req.Expires) > 0 {
+		parsed, err := time.Parse(time.RFC3339, req.Expires)
+		if err != nil || !parsed.After(time.Now()) {
+			logManager.LogPrintf("Invalid API key expiration %v\n", req.Expires)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		expires = parsed
+	}
+
+	for _, allowed := range req.AllowedIPs {
+		if !isValidAllowedIP(allowed) {
+			logManager.LogPrintf("Invalid allowed address %v\n", allowed)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	if _, found := serviceAccountManager.GetServiceAccount(accountId); !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	key, secret, passed := addAPIKey(accountId, req.Name, expires, req.AllowedIPs)
+	if !passed {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	key.Hash = ""
+	writeServiceAccountJSON(w, http.StatusCreated, APIKeyResponse{key, secret})
+}
+
+// HandleRotateAPIKey handles the rotate API key web request.
+// A new key is returned and the old key stops working once the grace period is over.
+func HandleRotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got rotate API key request")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if !validateRequest(w, r, availablePermissions.master) {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	var req RotateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		logManager.LogPrintf("Invalid rotate API key request %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if req.GraceMinutes < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	account, found := serviceAccountManager.GetServiceAccount(vars["accountId"])
+	if !found || account.findKey(vars["keyId"]) < 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	key, secret, passed := rotateAPIKey(account.Id, vars["keyId"], time.Minute*time.Duration(req.GraceMinutes))
+	if !passed {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	key.Hash = ""
+	writeServiceAccountJSON(w, http.StatusCreated, APIKeyResponse{key, secret})
+}
+
+// HandleDeleteAPIKey handles the delete API key web request.
+func HandleDeleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got delete API key request")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if !validateRequest(w, r, availablePermissions.master) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	account, found := serviceAccountManager.GetServiceAccount(vars["accountId"])
+	if !found || account.findKey(vars["keyId"]) < 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !removeAPIKey(account.Id, vars["keyId"]) {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func serviceAccountRequest(token string, method string, url string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	r.Header.Set("X-Sona-Token", token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func createServiceAccount(t *testing.T, token string, body string) ServiceAccount {
+	w := serviceAccountRequest(token, "POST", "/sona/v1/serviceaccounts", body)
+	if w.Result().StatusCode != 201 {
+		t.Fatalf("Expected 201 status code got %v", w.Result())
+	}
+
+	var account ServiceAccount
+	if err := json.Unmarshal(w.Body.Bytes(), &account); err != nil {
+		t.Fatalf("Failed to convert response %v error %v", w.Body, err)
+	}
+
+	return account
+}
+
+func createAPIKey(t *testing.T, token string, accountId string, body string) APIKeyResponse {
+	w := serviceAccountRequest(token, "POST", "/sona/v1/serviceaccounts/"+accountId+"/keys", body)
+	if w.Result().StatusCode != 201 {
+		t.Fatalf("Expected 201 status code got %v", w.Result())
+	}
+
+	var key APIKeyResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &key); err != nil {
+		t.Fatalf("Failed to convert response %v error %v", w.Body, err)
+	}
+
+	return key
+}
+
+func getIncidentsWithKey(key string, address string) int {
+	r := httptest.NewRequest("GET", "/sona/v1/incidents", nil)
+	r.Header.Set("Authorization", "Bearer "+key)
+	if len(address) > 0 {
+		r.RemoteAddr = address
+	}
+
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+	return w.Result().StatusCode
+}
+
+func TestServiceAccountAPIKey(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.master)
+	account := createServiceAccount(t, token, `{"name": "ci", "description": "Builds", "permissions": ["incident-view"]}`)
+	key := createAPIKey(t, token, account.Id, `{"name": "build"}`)
+
+	if len(key.Key) == 0 || len(key.Hash) != 0 || key.Name != "build" {
+		t.Fatalf("Expected key without its hash got %v", key)
+	}
+
+	if status := getIncidentsWithKey(key.Key, ""); status != 200 {
+		t.Errorf("Expected key to be accepted got %v", status)
+	}
+
+	r := httptest.NewRequest("GET", "/sona/v1/incidents", nil)
+	r.Header.Set("X-Sona-Token", key.Key)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Result().StatusCode != 200 {
+		t.Errorf("Expected key to be accepted in X-Sona-Token got %v", w.Result())
+	}
+
+	w = serviceAccountRequest(key.Key, "PUT", "/sona/v1/incidents/0", `{}`)
+	if w.Result().StatusCode != 401 {
+		t.Errorf("Expected key to only have its permissions got %v", w.Result())
+	}
+
+	w = serviceAccountRequest(token, "GET", "/sona/v1/serviceaccounts/"+account.Id, "")
+	if w.Result().StatusCode != 200 || strings.Contains(w.Body.String(), "hash") {
+		t.Errorf("Expected service account without key hashes got %v %v", w.Result(), w.Body)
+	}
+}
+
+func TestBearerAccessToken(t *testing.T) {
+	setup()
+	user1.Permissions = append(user1.Permissions, availablePermissions.viewIncident)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	_, token := user1.Authenticate("1234")
+
+	if status := getIncidentsWithKey(token.Token, ""); status != 200 {
+		t.Errorf("Expected bearer access token to be accepted got %v", status)
+	}
+}
+
+func TestServiceAccountAPIKeyRejected(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.master)
+	account := createServiceAccount(t, token, `{"name": "ci", "permissions": ["incident-view"]}`)
+	key := createAPIKey(t, token, account.Id, `{"name": "build", "allowedIps": ["10.0.0.0/8"]}`)
+
+	if status := getIncidentsWithKey(key.Key, "10.1.2.3:4000"); status != 200 {
+		t.Errorf("Expected key to be accepted from an allowed address got %v", status)
+	}
+
+	if status := getIncidentsWithKey(key.Key, "192.0.2.1:4000"); status != 403 {
+		t.Errorf("Expected key to be rejected from other addresses got %v", status)
+	}
+
+	w := serviceAccountRequest(token, "DELETE", "/sona/v1/serviceaccounts/"+account.Id+"/keys/"+key.Id, "")
+	if w.Result().StatusCode != 200 {
+		t.Fatalf("Expected 200 status code got %v", w.Result())
+	}
+
+	if status := getIncidentsWithKey(key.Key, "10.1.2.3:4000"); status != 403 {
+		t.Errorf("Expected deleted key to be rejected got %v", status)
+	}
+
+	other := createAPIKey(t, token, account.Id, `{"name": "build"}`)
+	if w := serviceAccountRequest("", "GET", "/sona/v1/incidents?token="+other.Key, ""); w.Result().StatusCode != 403 {
+		t.Errorf("Expected key to be rejected as a query parameter got %v", w.Result())
+	}
+
+	serviceAccountRequest(token, "DELETE", "/sona/v1/serviceaccounts/"+account.Id, "")
+	if status := getIncidentsWithKey(other.Key, ""); status != 403 {
+		t.Errorf("Expected keys of deleted account to be rejected got %v", status)
+	}
+}
+
+func TestRotateAPIKeyHandler(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.master)
+	account := createServiceAccount(t, token, `{"name": "ci", "permissions": ["incident-view"]}`)
+	key := createAPIKey(t, token, account.Id, `{"name": "build"}`)
+
+	w := serviceAccountRequest(token, "POST", "/sona/v1/serviceaccounts/"+account.Id+"/keys/"+key.Id+"/rotate", `{"graceMinutes": 5}`)
+	if w.Result().StatusCode != 201 {
+		t.Fatalf("Expected 201 status code got %v", w.Result())
+	}
+
+	var rotated APIKeyResponse
+	json.Unmarshal(w.Body.Bytes(), &rotated)
+
+	if getIncidentsWithKey(rotated.Key, "") != 200 || getIncidentsWithKey(key.Key, "") != 200 {
+		t.Errorf("Expected both keys to work during the grace period")
+	}
+
+	w = serviceAccountRequest(token, "POST", "/sona/v1/serviceaccounts/"+account.Id+"/keys/"+rotated.Id+"/rotate", "")
+	if w.Result().StatusCode != 201 || getIncidentsWithKey(rotated.Key, "") != 403 {
+		t.Errorf("Expected key without a grace period to stop working got %v", w.Result())
+	}
+
+	w = serviceAccountRequest(token, "POST", "/sona/v1/serviceaccounts/"+account.Id+"/keys/missing/rotate", "")
+	if w.Result().StatusCode != 404 {
+		t.Errorf("Expected 404 status code got %v", w.Result())
+	}
+}
+
+func TestUpdateServiceAccount(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.master)
+	account := createServiceAccount(t, token, `{"name": "ci", "permissions": ["incident-view"]}`)
+	key := createAPIKey(t, token, account.Id, `{"name": "build"}`)
+
+	w := serviceAccountRequest(token, "PUT", "/sona/v1/serviceaccounts/"+account.Id, `{"name": "monitor", "permissions": ["user-view"]}`)
+	if w.Result().StatusCode != 200 {
+		t.Fatalf("Expected 200 status code got %v", w.Result())
+	}
+
+	if status := getIncidentsWithKey(key.Key, ""); status != 401 {
+		t.Errorf("Expected permissions to be read from the current account got %v", status)
+	}
+
+	w = serviceAccountRequest(token, "GET", "/sona/v1/serviceaccounts", "")
+	var accounts []ServiceAccount
+	json.Unmarshal(w.Body.Bytes(), &accounts)
+
+	if len(accounts) != 1 || accounts[0].Name != "monitor" || len(accounts[0].Keys) != 1 {
+		t.Errorf("Expected updated account with its keys got %v", accounts)
+	}
+}
+
+func TestServiceAccountInvalidRequests(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.master)
+	account := createServiceAccount(t, token, `{"name": "ci"}`)
+
+	requests := []struct {
+		method string
+		url    string
+		body   string
+		status int
+	}{
+		{"POST", "/sona/v1/serviceaccounts", `{"permissions": ["incident-view"]}`, 400},
+		{"POST", "/sona/v1/serviceaccounts", `{"name": "ci", "permissions": ["incident-everything"]}`, 400},
+		{"POST", "/sona/v1/serviceaccounts/" + account.Id + "/keys", `{"expires": "2000-01-01T00:00:00Z"}`, 400},
+		{"POST", "/sona/v1/serviceaccounts/" + account.Id + "/keys", `{"expires": "tomorrow"}`, 400},
+		{"POST", "/sona/v1/serviceaccounts/" + account.Id + "/keys", `{"allowedIps": ["somewhere"]}`, 400},
+		{"POST", "/sona/v1/serviceaccounts/missing/keys", `{}`, 404},
+		{"PUT", "/sona/v1/serviceaccounts/missing", `{"name": "ci"}`, 404},
+		{"DELETE", "/sona/v1/serviceaccounts/missing", "", 404},
+		{"DELETE", "/sona/v1/serviceaccounts/" + account.Id + "/keys/missing", "", 404},
+	}
+
+	for _, req := range requests {
+		w := serviceAccountRequest(token, req.method, req.url, req.body)
+		if w.Result().StatusCode != req.status {
+			t.Errorf("Expected %v %v with %v to return %v got %v", req.method, req.url, req.body, req.status, w.Result().StatusCode)
+		}
+	}
+}
+
+func TestServiceAccountsRequireMaster(t *testing.T) {
+	setup()
+	user1.Permissions = append(user1.Permissions, availablePermissions.modifyUser)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	_, token := user1.Authenticate("1234")
+
+	w := serviceAccountRequest(token.Token, "POST", "/sona/v1/serviceaccounts", `{"name": "ci"}`)
+	if w.Result().StatusCode != 401 {
+		t.Errorf("Expected 401 status code got %v", w.Result())
+	}
+
+	account := NewServiceAccount("ci", "", []string{availablePermissions.modifyUser})
+	serviceAccountManager.AddServiceAccount(account)
+	_, secret, _ := addAPIKey(account.Id, "build", time.Time{}, nil)
+
+	w = serviceAccountRequest(secret, "GET", fmt.Sprintf("/sona/v1/serviceaccounts/%v", account.Id), "")
+	if w.Result().StatusCode != 401 {
+		t.Errorf("Expected 401 status code got %v", w.Result())
+	}
+}
+
+func TestServiceAccountAPIKeyOnUserAndGraphQL(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.master)
+	account := createServiceAccount(t, token, `{"name": "directory", "permissions": ["user-view"]}`)
+	key := createAPIKey(t, token, account.Id, `{"name": "sync"}`)
+	userUrl := fmt.Sprintf("/sona/v1/users/%v", user1.Id)
+
+	if w := serviceAccountRequest(key.Key, "GET", userUrl, ""); w.Result().StatusCode != 200 {
+		t.Errorf("Expected key to view users got %v", w.Result())
+	}
+
+	if w := serviceAccountRequest(key.Key, "PUT", userUrl, `{"firstName": "Other"}`); w.Result().StatusCode != 401 {
+		t.Errorf("Expected key to only have its permissions got %v", w.Result())
+	}
+
+	query := fmt.Sprintf(`{"query": "{ user(id: %v) { emailAddress } }"}`, user1.Id)
+	w := serviceAccountRequest(key.Key, "POST", "/sona/v1/graphql", query)
+	if w.Result().StatusCode != 200 || !strings.Contains(w.Body.String(), user1.EmailAddress) {
+		t.Errorf("Expected key to query users got %v %v", w.Result(), w.Body)
+	}
+
+	w = serviceAccountRequest(key.Key, "POST", "/sona/v1/graphql", `{"query": "{ incidents { id } }"}`)
+	if !strings.Contains(w.Body.String(), "permission is required") {
+		t.Errorf("Expected key to only query with its permissions got %v", w.Body)
+	}
+}
+
+func TestServiceAccountUploadRecordsAccount(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.master)
+	uploadPolicy = UploadPolicy{MaxUserSize: 8}
+	account := createServiceAccount(t, token, `{"name": "ci", "permissions": ["incident-modify"]}`)
+	key := createAPIKey(t, token, account.Id, `{"name": "build"}`)
+
+	if w := uploadAttachment(token, "user.txt", "hello"); w.Result().StatusCode != 200 {
+		t.Fatalf("Expected 200 status code got %v", w.Result())
+	}
+
+	w := uploadAttachment(key.Key, "build.log", "hello")
+	if w.Result().StatusCode != 200 {
+		t.Fatalf("Expected service account to have its own quota got %v", w.Result())
+	}
+
+	var attachment Attachment
+	if err := json.Unmarshal(w.Body.Bytes(), &attachment); err != nil {
+		t.Fatalf("Failed to convert response %v error %v", w.Body, err)
+	}
+
+	if attachment.UploaderId != -1 || attachment.ServiceAccountId != account.Id {
+		t.Errorf("Expected upload to be recorded against the service account got %v", attachment)
+	}
+
+	w = uploadAttachment(key.Key, "more.log", "hello")
+	if problem := readProblem(t, w); problem.Type != problemUserQuotaExceeded || problem.Usage != 5 {
+		t.Errorf("Unexpected problem %v", problem)
+	}
+}
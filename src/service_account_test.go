@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testServiceAccountManager(t *testing.T, manager ServiceAccountManager) {
+	account := NewServiceAccount("ci", "Builds", []string{availablePermissions.viewIncident})
+	key, _, _ := NewAPIKey(account.Id, "build", time.Now().Add(time.Hour), []string{"10.0.0.0/8"})
+	account.Keys = append(account.Keys, key)
+
+	if !manager.AddServiceAccount(account) {
+		t.Fatalf("Expected service account to be added")
+	}
+
+	if manager.AddServiceAccount(account) {
+		t.Errorf("Expected service account with the same id to not be added")
+	}
+
+	stored, found := manager.GetServiceAccount(account.Id)
+	if !found || stored.Name != "ci" || stored.Description != "Builds" || len(stored.Permissions) != 1 || len(stored.Keys) != 1 {
+		t.Fatalf("Expected stored service account got %v", stored)
+	}
+
+	if stored.Keys[0].Hash != key.Hash || stored.Keys[0].Expires != key.Expires || stored.Keys[0].AllowedIPs[0] != "10.0.0.0/8" {
+		t.Errorf("Expected stored key got %v", stored.Keys[0])
+	}
+
+	other := NewServiceAccount("alerts", "", nil)
+	manager.AddServiceAccount(other)
+
+	stored.Name = "builds"
+	stored.Keys = make([]APIKey, 0)
+	if !manager.UpdateServiceAccount(stored) {
+		t.Fatalf("Expected service account to be updated")
+	}
+
+	accounts, passed := manager.GetServiceAccounts()
+	if !passed || len(accounts) != 2 || accounts[0].Name != "alerts" || accounts[1].Name != "builds" || len(accounts[1].Keys) != 0 {
+		t.Errorf("Expected updated service accounts by name got %v", accounts)
+	}
+
+	if !manager.RemoveServiceAccount(account.Id) || manager.RemoveServiceAccount(account.Id) {
+		t.Errorf("Expected service account to be removed once")
+	}
+
+	if _, found := manager.GetServiceAccount(account.Id); found {
+		t.Errorf("Expected removed service account to not be found")
+	}
+
+	manager.RemoveServiceAccount(other.Id)
+}
+
+func TestRuntimeServiceAccountManager(t *testing.T) {
+	testServiceAccountManager(t, NewRuntimeServiceAccountManager())
+}
+
+// TestMySQLServiceAccountManager runs against a mysql database, set SONA_MYSQL_DSN to a data source name like user:password@tcp(127.0.0.1:3306)/sona.
+func TestMySQLServiceAccountManager(t *testing.T) {
+	dsn := os.Getenv("SONA_MYSQL_DSN")
+	if len(dsn) == 0 {
+		t.Skip("SONA_MYSQL_DSN is not set")
+	}
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatalf("Unable to open database %v", err)
+	}
+
+	defer db.Close()
+	manager := MySQLServiceAccountManager{db}
+	manager.Initialize()
+	testServiceAccountManager(t, manager)
+}
+
+func TestAPIKeyHashedAtRest(t *testing.T) {
+	setup()
+	account := NewServiceAccount("ci", "", []string{availablePermissions.viewIncident})
+	serviceAccountManager.AddServiceAccount(account)
+
+	key, secret, passed := addAPIKey(account.Id, "build", time.Time{}, nil)
+	if !passed || !strings.HasPrefix(secret, apiKeyPrefix+account.Id+"_"+key.Id+"_") {
+		t.Fatalf("Expected key for account got %v", secret)
+	}
+
+	stored, _ := serviceAccountManager.GetServiceAccount(account.Id)
+	if strings.Contains(stored.Keys[0].Hash, secret[strings.LastIndex(secret, "_")+1:]) || len(stored.Keys[0].Hash) != 64 {
+		t.Errorf("Expected only the hash of the key to be stored got %v", stored.Keys[0].Hash)
+	}
+
+	if _, valid := authenticateAPIKey(secret, "192.0.2.1"); !valid {
+		t.Errorf("Expected key to be valid")
+	}
+
+	for _, invalid := range []string{secret + "0", secret[:len(secret)-1], strings.Replace(secret, key.Id, "other", 1), "sona_bad"} {
+		if _, valid := authenticateAPIKey(invalid, "192.0.2.1"); valid {
+			t.Errorf("Expected key %v to be invalid", invalid)
+		}
+	}
+}
+
+func TestAPIKeyExpired(t *testing.T) {
+	setup()
+	account := NewServiceAccount("ci", "", nil)
+	key, secret, _ := NewAPIKey(account.Id, "build", time.Now().Add(time.Hour), nil)
+	key.Expires = time.Now().Add(-time.Minute).Format(time.RFC3339)
+	account.Keys = append(account.Keys, key)
+	serviceAccountManager.AddServiceAccount(account)
+
+	if _, valid := authenticateAPIKey(secret, "192.0.2.1"); valid {
+		t.Errorf("Expected expired key to be invalid")
+	}
+}
+
+func TestAPIKeyAllowedIPs(t *testing.T) {
+	setup()
+	account := NewServiceAccount("ci", "", nil)
+	serviceAccountManager.AddServiceAccount(account)
+	_, secret, _ := addAPIKey(account.Id, "build", time.Time{}, []string{"10.1.0.0/16", "192.0.2.7", "2001:db8::/32"})
+
+	for address, allowed := range map[string]bool{"10.1.2.3": true, "192.0.2.7": true, "2001:db8::1": true, "10.2.0.1": false, "192.0.2.8": false, "": false} {
+		if _, valid := authenticateAPIKey(secret, address); valid != allowed {
+			t.Errorf("Expected key from %v to be allowed %v", address, allowed)
+		}
+	}
+
+	if _, _, err := NewAPIKey(account.Id, "build", time.Time{}, []string{"10.1.0.0/33"}); err == nil {
+		t.Errorf("Expected invalid range to be rejected")
+	}
+}
+
+func TestRotateAPIKey(t *testing.T) {
+	setup()
+	account := NewServiceAccount("ci", "", nil)
+	serviceAccountManager.AddServiceAccount(account)
+	old, oldSecret, _ := addAPIKey(account.Id, "build", time.Now().Add(time.Hour*24), []string{"192.0.2.0/24"})
+
+	key, secret, passed := rotateAPIKey(account.Id, old.Id, 0)
+	if !passed || key.Id == old.Id || key.Name != "build" || key.AllowedIPs[0] != "192.0.2.0/24" {
+		t.Fatalf("Expected new key like the old key got %v", key)
+	}
+
+	expires, _ := time.Parse(time.RFC3339, key.Expires)
+	if expires.Before(time.Now().Add(time.Hour * 23)) {
+		t.Errorf("Expected new key to last as long as the old key got %v", key.Expires)
+	}
+
+	if _, valid := authenticateAPIKey(oldSecret, "192.0.2.1"); valid {
+		t.Errorf("Expected old key to stop working")
+	}
+
+	next, nextSecret, _ := rotateAPIKey(account.Id, key.Id, time.Minute*10)
+	if _, valid := authenticateAPIKey(secret, "192.0.2.1"); !valid {
+		t.Errorf("Expected old key to work during the grace period")
+	}
+
+	if _, valid := authenticateAPIKey(nextSecret, "192.0.2.1"); !valid {
+		t.Errorf("Expected new key %v to work", next.Id)
+	}
+
+	stored, _ := serviceAccountManager.GetServiceAccount(account.Id)
+	graceEnd, _ := time.Parse(time.RFC3339, stored.Keys[stored.findKey(key.Id)].Expires)
+	if graceEnd.After(time.Now().Add(time.Minute * 11)) {
+		t.Errorf("Expected old key to expire after the grace period got %v", graceEnd)
+	}
+
+	if _, _, passed := rotateAPIKey(account.Id, "missing", 0); passed {
+		t.Errorf("Expected missing key to not be rotated")
+	}
+}
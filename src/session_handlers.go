@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// RefreshRequest is a refresh token to exchange for new tokens or to revoke.
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// HandleRefreshToken handles the refresh token web request.
+// The refresh token is used up and a new access token and refresh token are returned.
+func HandleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got token refresh request")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.RefreshToken) == 0 {
+		logManager.LogPrintln("Invalid refresh request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	token, passed := refreshTokens(userManager, req.RefreshToken)
+	if !passed {
+		logManager.LogPrintln("Failed to refresh token")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(token); err != nil {
+		panic(err)
+	}
+}
+
+// HandleLogout handles the logout web request.
+// The access token used for the request is revoked, along with the refresh token if one is provided.
+func HandleLogout(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got logout request")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	token := getRequestToken(r)
+	if !userManager.ValidateUser(token) {
+		logManager.LogPrintf("Invalid Token %v used", token)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		logManager.LogPrintln("Invalid logout request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	revoked := []string{token}
+	if len(req.RefreshToken) > 0 {
+		revoked = append(revoked, req.RefreshToken)
+	}
+
+	if !revokeTokens(userManager, GetTokenUser(token), revoked...) {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandleRevokeSessions handles the revoke sessions web request.
+// Every access token and refresh token of the user is revoked, users can revoke their own sessions.
+func HandleRevokeSessions(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got revoke sessions request")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	principal, valid := authenticateRequest(w, r)
+	if !valid {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	userId, err := strconv.ParseInt(vars["userId"], 10, 64)
+
+	if err != nil {
+		logManager.LogPrintf("Error converting userId %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !principal.hasPermission(availablePermissions.modifyUser) && !principal.isUser(userId) {
+		logManager.LogPrintf("The %v does not allow for revoking sessions", principal)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if _, found := userManager.GetUser(userId); !found {
+		logManager.LogPrintf("User %v not found\n", userId)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !revokeAllTokens(userManager, userId) {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
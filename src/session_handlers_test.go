@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func login(t *testing.T, emailAddress string, password string) TokenResponse {
+	r, _ := http.NewRequest("POST", "/sona/v1/authenticate", strings.NewReader(fmt.Sprintf(`{"emailAddress": "%v", "password": "%v"}`, emailAddress, password)))
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 200 {
+		t.Fatalf("Expected 200 status code got %v", w.Result())
+	}
+
+	var token TokenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &token); err != nil {
+		t.Fatalf("Failed to convert response %v error %v", w.Body, err)
+	}
+
+	return token
+}
+
+func refresh(refreshToken string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("POST", "/sona/v1/authenticate/refresh", strings.NewReader(fmt.Sprintf(`{"refreshToken": "%v"}`, refreshToken)))
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func getSelf(token string, userId int64) int {
+	r, _ := http.NewRequest("GET", fmt.Sprintf("/sona/v1/users/%v", userId), nil)
+	r.Header.Set("X-Sona-Token", token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+	return w.Result().StatusCode
+}
+
+func revokeSessions(token string, userId int64) int {
+	r, _ := http.NewRequest("DELETE", fmt.Sprintf("/sona/v1/users/%v/sessions", userId), nil)
+	r.Header.Set("X-Sona-Token", token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+	return w.Result().StatusCode
+}
+
+func TestAuthenticationReturnsRefreshToken(t *testing.T) {
+	setup()
+	token := login(t, "a@b.c", "1234")
+
+	if len(token.Token) == 0 || len(token.RefreshToken) == 0 || token.UserId != user1.Id {
+		t.Fatalf("Expected access and refresh token got %v", token)
+	}
+
+	expires, err := time.Parse(time.RFC3339, token.Expires)
+	if err != nil || expires.Before(time.Now().Add(tokenSigner.Expiration-time.Minute)) {
+		t.Errorf("Expected token to expire in %v got %v", tokenSigner.Expiration, token.Expires)
+	}
+
+	if getSelf(token.RefreshToken, user1.Id) != 403 {
+		t.Errorf("Expected refresh token to not be accepted as an access token")
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	setup()
+	token := login(t, "a@b.c", "1234")
+
+	w := refresh(token.RefreshToken)
+	if w.Result().StatusCode != 200 {
+		t.Fatalf("Expected 200 status code got %v", w.Result())
+	}
+
+	var refreshed TokenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &refreshed); err != nil {
+		t.Fatalf("Failed to convert response %v error %v", w.Body, err)
+	}
+
+	if refreshed.RefreshToken == token.RefreshToken || refreshed.Token == token.Token {
+		t.Errorf("Expected new tokens got %v", refreshed)
+	}
+
+	if getSelf(refreshed.Token, user1.Id) != 200 || getSelf(token.Token, user1.Id) != 200 {
+		t.Errorf("Expected both access tokens to be valid")
+	}
+}
+
+func TestReusedRefreshTokenRevokesSessions(t *testing.T) {
+	setup()
+	token := login(t, "a@b.c", "1234")
+	other := login(t, "a@b.c", "1234")
+
+	w := refresh(token.RefreshToken)
+	var refreshed TokenResponse
+	json.Unmarshal(w.Body.Bytes(), &refreshed)
+
+	if w = refresh(token.RefreshToken); w.Result().StatusCode != 403 {
+		t.Errorf("Expected reused refresh token to be rejected got %v", w.Result())
+	}
+
+	for _, access := range []string{token.Token, other.Token, refreshed.Token} {
+		if getSelf(access, user1.Id) != 403 {
+			t.Errorf("Expected every session to be revoked")
+		}
+	}
+
+	if w = refresh(refreshed.RefreshToken); w.Result().StatusCode != 403 {
+		t.Errorf("Expected refresh tokens to be revoked got %v", w.Result())
+	}
+}
+
+func TestInvalidRefreshToken(t *testing.T) {
+	setup()
+	token := login(t, "a@b.c", "1234")
+	expired, _ := tokenSigner.SignRefresh(user1.Id, time.Now().Add(-time.Minute))
+	userManager.SetTokens(user1.Id, []string{token.Token, token.RefreshToken, expired})
+
+	for _, refreshToken := range []string{token.Token, expired, "bad"} {
+		if w := refresh(refreshToken); w.Result().StatusCode != 403 {
+			t.Errorf("Expected refresh token %v to be rejected got %v", refreshToken, w.Result())
+		}
+	}
+
+	if w := refresh(""); w.Result().StatusCode != 400 {
+		t.Errorf("Expected 400 status code got %v", w.Result())
+	}
+}
+
+func TestLogout(t *testing.T) {
+	setup()
+	token := login(t, "a@b.c", "1234")
+	other := login(t, "a@b.c", "1234")
+
+	r, _ := http.NewRequest("POST", "/sona/v1/logout", strings.NewReader(fmt.Sprintf(`{"refreshToken": "%v"}`, token.RefreshToken)))
+	r.Header.Set("X-Sona-Token", token.Token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 200 {
+		t.Fatalf("Expected 200 status code got %v", w.Result())
+	}
+
+	if getSelf(token.Token, user1.Id) != 403 {
+		t.Errorf("Expected access token to be revoked")
+	}
+
+	if getSelf(other.Token, user1.Id) != 200 {
+		t.Errorf("Expected other sessions to remain")
+	}
+
+	if w = refresh(token.RefreshToken); w.Result().StatusCode != 403 {
+		t.Errorf("Expected refresh token to be revoked got %v", w.Result())
+	}
+}
+
+func TestLogoutWithoutBody(t *testing.T) {
+	setup()
+	token := login(t, "a@b.c", "1234")
+
+	r, _ := http.NewRequest("POST", "/sona/v1/logout", http.NoBody)
+	r.Header.Set("X-Sona-Token", token.Token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 200 || getSelf(token.Token, user1.Id) != 403 {
+		t.Errorf("Expected access token to be revoked got %v", w.Result())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 403 {
+		t.Errorf("Expected 403 status code got %v", w.Result())
+	}
+}
+
+func TestRevokeSessions(t *testing.T) {
+	setup()
+	userManager.AddUser(&AddUser{EmailAddress: "d@e.f", UserName: "Admin", Password: "5678"})
+	admin, _ := userManager.GetUserByEmail("d@e.f")
+	userManager.SetPermissions(admin.Id, []string{availablePermissions.modifyUser})
+
+	token := login(t, "a@b.c", "1234")
+	adminToken := login(t, "d@e.f", "5678")
+
+	if revokeSessions(token.Token, admin.Id) != 401 {
+		t.Errorf("Expected user to not be able to revoke other sessions")
+	}
+
+	if status := revokeSessions(adminToken.Token, user1.Id); status != 200 {
+		t.Fatalf("Expected 200 status code got %v", status)
+	}
+
+	if getSelf(token.Token, user1.Id) != 403 || refresh(token.RefreshToken).Result().StatusCode != 403 {
+		t.Errorf("Expected sessions to be revoked")
+	}
+
+	if getSelf(adminToken.Token, admin.Id) != 200 {
+		t.Errorf("Expected admin session to remain")
+	}
+
+	if status := revokeSessions(adminToken.Token, 42); status != 404 {
+		t.Errorf("Expected 404 status code got %v", status)
+	}
+
+	if status := revokeSessions(adminToken.Token, admin.Id); status != 200 || getSelf(adminToken.Token, admin.Id) != 403 {
+		t.Errorf("Expected users to be able to revoke their own sessions got %v", status)
+	}
+}
+
+func TestReclaimExpiredTokens(t *testing.T) {
+	setup()
+	token := login(t, "a@b.c", "1234")
+	expired, _ := tokenSigner.Sign(user1.Id, time.Now().Add(-time.Minute))
+	expiredRefresh, _ := tokenSigner.SignRefresh(user1.Id, time.Now().Add(-time.Minute))
+	userManager.SetTokens(user1.Id, []string{expired, token.Token, expiredRefresh, "legacy", token.RefreshToken})
+
+	if reclaimed := reclaimExpiredTokens(userManager); reclaimed != 3 {
+		t.Errorf("Expected 3 tokens to be reclaimed got %v", reclaimed)
+	}
+
+	tokens, _ := userManager.GetTokens(user1.Id)
+	if len(tokens) != 2 || tokens[0] != token.Token || tokens[1] != token.RefreshToken {
+		t.Errorf("Expected only active tokens to remain got %v", tokens)
+	}
+}
+
+func TestReclaimTokensWhileUsersChange(t *testing.T) {
+	setup()
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			reclaimExpiredTokens(userManager)
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		userManager.AddUser(&AddUser{EmailAddress: fmt.Sprintf("user%v@b.c", i), Password: "1234"})
+		login(t, "a@b.c", "1234")
+	}
+
+	<-done
+}
+
+func TestTokenExpirationConfigured(t *testing.T) {
+	setup()
+	defer func() {
+		tokenSigner = NewRandomTokenSigner()
+	}()
+
+	tokenSigner.Expiration = time.Minute
+	tokenSigner.RefreshExpiration = time.Hour
+	token := login(t, "a@b.c", "1234")
+
+	access, _ := tokenSigner.Parse(token.Token)
+	refreshClaims, _ := tokenSigner.Parse(token.RefreshToken)
+	if access.ExpiresAt.Sub(access.IssuedAt.Time) != time.Minute || refreshClaims.ExpiresAt.Sub(refreshClaims.IssuedAt.Time) != time.Hour {
+		t.Errorf("Expected configured expirations got %v and %v", access.ExpiresAt, refreshClaims.ExpiresAt)
+	}
+}
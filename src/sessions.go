@@ -0,0 +1,211 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenLock keeps changes to the stored tokens of a user from overwriting each other.
+var tokenLock sync.Mutex
+
+// isTokenActive checks if a stored token can still be used.
+// Tokens that no longer parse, like tokens signed with a key that has been removed, can never be used again.
+func isTokenActive(token string) bool {
+	claims, valid := tokenSigner.Parse(token)
+	if !valid {
+		return false
+	}
+
+	return claims.ExpiresAt == nil || !claims.ExpiresAt.Before(time.Now())
+}
+
+// updateTokens changes the tokens stored for a user.
+// Tokens that can no longer be used are removed with every change.
+func updateTokens(manager UserManager, userId int64, change func(tokens []string) []string) bool {
+	tokenLock.Lock()
+	defer tokenLock.Unlock()
+
+	tokens, passed := manager.GetTokens(userId)
+	if !passed {
+		return false
+	}
+
+	updated := activeTokens(change(tokens))
+	if sameTokens(tokens, updated) {
+		return true
+	}
+
+	return manager.SetTokens(userId, updated)
+}
+
+func activeTokens(tokens []string) []string {
+	retVal := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		if isTokenActive(token) {
+			retVal = append(retVal, token)
+		}
+	}
+
+	return retVal
+}
+
+func sameTokens(tokens []string, other []string) bool {
+	if len(tokens) != len(other) {
+		return false
+	}
+
+	for i, token := range tokens {
+		if other[i] != token {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsToken(tokens []string, token string) bool {
+	for _, t := range tokens {
+		if t == token {
+			return true
+		}
+	}
+
+	return false
+}
+
+// issueTokens creates and stores a new access token and refresh token for a user.
+func issueTokens(manager UserManager, user User) (TokenResponse, bool) {
+	response, passed := GenerateToken(user)
+	if !passed {
+		return TokenResponse{UserId: -1}, false
+	}
+
+	stored := updateTokens(manager, user.Id, func(tokens []string) []string {
+		return append(tokens, response.Token, response.RefreshToken)
+	})
+
+	if !stored {
+		logManager.LogPrintf("Unable to store tokens for user %v\n", user.Id)
+		return TokenResponse{UserId: -1}, false
+	}
+
+	return response, true
+}
+
+// validateToken checks that an access token is stored for its user and has not expired.
+func validateToken(manager UserManager, token string) bool {
+	userId := GetTokenUser(token)
+	if userId < 0 {
+		return false
+	}
+
+	tokens, _ := manager.GetTokens(userId)
+	if !containsToken(tokens, token) {
+		logManager.LogPrintf("Token not found for user %v", userId)
+		return false
+	}
+
+	expired := TokenExpired(token)
+	logManager.LogPrintf("Token expired %v", expired)
+
+	if expired {
+		revokeTokens(manager, userId, token)
+	}
+
+	return !expired
+}
+
+// refreshTokens exchanges a refresh token for a new access token and refresh token.
+// Each refresh token can only be used once, if a refresh token that has already been used is presented again it may have been stolen so every session of the user is revoked.
+func refreshTokens(manager UserManager, refreshToken string) (TokenResponse, bool) {
+	userId := GetRefreshTokenUser(refreshToken)
+	if userId < 0 {
+		return TokenResponse{UserId: -1}, false
+	}
+
+	user, found := manager.GetUser(userId)
+	if !found {
+		return TokenResponse{UserId: -1}, false
+	}
+
+	stored := false
+	passed := updateTokens(manager, userId, func(tokens []string) []string {
+		stored = containsToken(tokens, refreshToken)
+		return removeTokens(tokens, refreshToken)
+	})
+
+	if !passed {
+		logManager.LogPrintf("Unable to remove refresh token for user %v\n", userId)
+		return TokenResponse{UserId: -1}, false
+	}
+
+	if !stored {
+		logManager.LogPrintf("Refresh token reused for user %v, revoking all sessions\n", userId)
+		revokeAllTokens(manager, userId)
+		return TokenResponse{UserId: -1}, false
+	}
+
+	return issueTokens(manager, user)
+}
+
+// revokeTokens removes tokens from a user so they can no longer be used.
+func revokeTokens(manager UserManager, userId int64, revoked ...string) bool {
+	return updateTokens(manager, userId, func(tokens []string) []string {
+		return removeTokens(tokens, revoked...)
+	})
+}
+
+// revokeAllTokens removes every token of a user, ending all of their sessions.
+func revokeAllTokens(manager UserManager, userId int64) bool {
+	return updateTokens(manager, userId, func(tokens []string) []string {
+		return make([]string, 0)
+	})
+}
+
+func removeTokens(tokens []string, removed ...string) []string {
+	retVal := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		if !containsToken(removed, token) {
+			retVal = append(retVal, token)
+		}
+	}
+
+	return retVal
+}
+
+// reclaimExpiredTokens removes the tokens that can no longer be used from every user and returns how many were removed.
+func reclaimExpiredTokens(manager UserManager) int {
+	users, passed := manager.GetUsers()
+	if !passed {
+		logManager.LogPrintln("Unable to get users to reclaim tokens")
+		return 0
+	}
+
+	reclaimed := 0
+	for _, user := range users {
+		removed := 0
+		passed := updateTokens(manager, user.Id, func(tokens []string) []string {
+			active := activeTokens(tokens)
+			removed = len(tokens) - len(active)
+			return active
+		})
+
+		if !passed {
+			logManager.LogPrintf("Unable to reclaim tokens of user %v\n", user.Id)
+			continue
+		}
+
+		reclaimed += removed
+	}
+
+	return reclaimed
+}
+
+// reclaimTokensPeriodically removes expired tokens on an interval.
+func reclaimTokensPeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		if reclaimed := reclaimExpiredTokens(userManager); reclaimed > 0 {
+			logManager.LogPrintf("Reclaimed %v expired tokens\n", reclaimed)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 )
 
@@ -10,6 +11,12 @@ type MySQLManager struct {
 	Connection *sql.DB
 }
 
+// sqlExecutor is satisfied by both *sql.DB and *sql.Tx so queries can run inside or outside of a transaction.
+type sqlExecutor interface {
+	Prepare(query string) (*sql.Stmt, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
 func (manager MySQLManager) Initialize() {
 	if !manager.hasTable("Incidents") {
 		logManager.LogPrintln("Unable to find incident table creating now")
@@ -25,6 +32,9 @@ func (manager MySQLManager) Initialize() {
 		logManager.LogPrintln("Unable to find attachment table creating now")
 		manager.createAttachmentTable()
 	}
+
+	manager.addAttachmentMetadataColumns()
+	manager.addAttachmentIdColumn()
 }
 
 func (manager MySQLManager) hasTable(tableName string) bool {
@@ -88,9 +98,20 @@ func (manager MySQLManager) createAttributeTable() {
 func (manager MySQLManager) createAttachmentTable() {
 	stmt, err := manager.Connection.Prepare("CREATE TABLE IncidentAttachments (" +
 		"IncidentId INT UNSIGNED NOT NULL, " +
+		"AttachmentId VARCHAR(255) NOT NULL, " +
 		"FileName VARCHAR(255), " +
 		"TimeStampString VARCHAR(255), " +
-		"PRIMARY KEY(IncidentId, FileName), " +
+		"Size BIGINT, " +
+		"ContentType VARCHAR(255), " +
+		"Checksum VARCHAR(64), " +
+		"UploaderId BIGINT, " +
+		"Version INT, " +
+		"StorageVersion VARCHAR(1024), " +
+		"Versions TEXT, " +
+		"ScanStatus VARCHAR(16), " +
+		"ScanSignature VARCHAR(512), " +
+		"ServiceAccountId VARCHAR(255), " +
+		"PRIMARY KEY(IncidentId, AttachmentId), " +
 		"FOREIGN KEY (IncidentId) " +
 		"	REFERENCES Incidents(Id))")
 
@@ -106,6 +127,71 @@ func (manager MySQLManager) createAttachmentTable() {
 	logManager.LogPrintf("Created Attribute Table: %v\n", res)
 }
 
+// addAttachmentMetadataColumns adds the attachment metadata columns to attachment tables
+// created before attachments recorded their size, content type, checksum and uploader.
+func (manager MySQLManager) addAttachmentMetadataColumns() {
+	columns := []struct {
+		name       string
+		definition string
+	}{
+		{"Size", "BIGINT"},
+		{"ContentType", "VARCHAR(255)"},
+		{"Checksum", "VARCHAR(64)"},
+		{"UploaderId", "BIGINT"},
+		{"Version", "INT"},
+		{"StorageVersion", "VARCHAR(1024)"},
+		{"Versions", "TEXT"},
+		{"ScanStatus", "VARCHAR(16)"},
+		{"ScanSignature", "VARCHAR(512)"},
+		{"ServiceAccountId", "VARCHAR(255)"},
+	}
+
+	for _, column := range columns {
+		if manager.hasColumn("IncidentAttachments", column.name) {
+			continue
+		}
+
+		logManager.LogPrintf("Adding column %v to attachment table\n", column.name)
+		_, err := manager.Connection.Exec(fmt.Sprintf("ALTER TABLE IncidentAttachments ADD COLUMN %v %v", column.name, column.definition))
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// addAttachmentIdColumn keys attachment tables created before attachments had generated ids by id.
+// Existing attachments use their file name as their id, which is also where their content is stored.
+func (manager MySQLManager) addAttachmentIdColumn() {
+	if manager.hasColumn("IncidentAttachments", "AttachmentId") {
+		return
+	}
+
+	logManager.LogPrintln("Adding column AttachmentId to attachment table")
+	statements := []string{
+		"ALTER TABLE IncidentAttachments ADD COLUMN AttachmentId VARCHAR(255)",
+		"UPDATE IncidentAttachments SET AttachmentId = FileName",
+		"ALTER TABLE IncidentAttachments MODIFY AttachmentId VARCHAR(255) NOT NULL, DROP PRIMARY KEY, ADD PRIMARY KEY(IncidentId, AttachmentId)",
+	}
+
+	for _, statement := range statements {
+		if _, err := manager.Connection.Exec(statement); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (manager MySQLManager) hasColumn(tableName string, columnName string) bool {
+	rows, err := manager.Connection.Query(fmt.Sprintf("SHOW COLUMNS FROM %v LIKE '%v'", tableName, columnName))
+
+	if err != nil {
+		logManager.LogPrintf("Got error %v\n", err)
+		return false
+	}
+	defer rows.Close()
+
+	return rows.Next()
+}
+
 func (manager MySQLManager) AddIncident(incident *Incident) bool {
 	stmt, err := manager.Connection.Prepare("INSERT INTO Incidents (Type, Description, Reporter, State) " +
 		"VALUES (?, ?, ?, ?);")
@@ -134,6 +220,10 @@ func (manager MySQLManager) AddIncident(incident *Incident) bool {
 }
 
 func (manager MySQLManager) GetIncident(incidentId int) (Incident, bool) {
+	return manager.getIncident(manager.Connection, incidentId)
+}
+
+func (manager MySQLManager) getIncident(db sqlExecutor, incidentId int) (Incident, bool) {
 	retVal := Incident{"", 0, "", "", "", nil}
 	var (
 		id           int64
@@ -145,7 +235,7 @@ func (manager MySQLManager) GetIncident(incidentId int) (Incident, bool) {
 		attvalue     sql.NullString
 	)
 
-	rows, err := manager.Connection.Query("SELECT Id, Type, Description, Reporter, State, AttributeName, AttributeValue "+
+	rows, err := db.Query("SELECT Id, Type, Description, Reporter, State, AttributeName, AttributeValue "+
 		"FROM Incidents LEFT JOIN IncidentAttributes "+
 		"ON IncidentId = Id "+
 		"WHERE Id = ?", incidentId)
@@ -171,7 +261,7 @@ func (manager MySQLManager) GetIncident(incidentId int) (Incident, bool) {
 	}
 
 	logManager.LogPrintf("got incident: %v\n", retVal)
-	return retVal, true
+	return retVal, retVal.Id != 0
 }
 
 func (manager MySQLManager) GetIncidents(filter *FilterRequest) ([]Incident, bool) {
@@ -247,7 +337,7 @@ func (manager MySQLManager) queryIncidentsWithFilter(filter *FilterRequest) (*sq
 				buffer.WriteString("AND ")
 			}
 			buffer.WriteString(complexFilter.Property + convertToSQLComparisonType(complexFilter))
-			args = append(args, complexFilter.Value)
+			args = append(args, convertToSQLComparisonValue(complexFilter))
 		}
 	}
 
@@ -272,18 +362,87 @@ func convertToSQLComparisonType(filter Filter) string {
 		return " != ? "
 	}
 
+	if isContainsComparision(filter) {
+		return " LIKE CONCAT('%', ?, '%') "
+	}
+
 	return " IN(?) "
 }
 
+// convertToSQLComparisonValue escapes the wildcards in a contains filter so they match literally.
+func convertToSQLComparisonValue(filter Filter) string {
+	if isContainsComparision(filter) {
+		return escapeSQLLike(filter.Value)
+	}
+
+	return filter.Value
+}
+
 func (manager MySQLManager) UpdateIncident(id int, incident IncidentUpdate) bool {
-	inc, pass := manager.GetIncident(id)
+	return manager.updateIncident(manager.Connection, id, incident)
+}
+
+// UpdateIncidents applies the same update to a set of incidents in a single transaction.
+// Each incident is locked and its state checked against the allowed transitions inside the transaction, so a state changed by another request since the update was checked is not overwritten.
+// If any incident fails to update none of the incidents will be updated.
+func (manager MySQLManager) UpdateIncidents(ids []int, update IncidentUpdate) map[int]bool {
+	results := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		results[id] = false
+	}
+
+	tx, err := manager.Connection.Begin()
+	if err != nil {
+		logManager.LogPrintf("Error occurred when starting bulk update %v", err)
+		return results
+	}
+
+	for _, id := range ids {
+		if !manager.lockIncidentTransition(tx, id, update) || !manager.updateIncident(tx, id, update) {
+			logManager.LogPrintf("Unable to update incident %v rolling back bulk update", id)
+			tx.Rollback()
+			return results
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		logManager.LogPrintf("Error occurred when committing bulk update %v", err)
+		return results
+	}
+
+	for _, id := range ids {
+		results[id] = true
+	}
+
+	return results
+}
+
+// lockIncidentTransition locks an incident until the transaction ends and checks that its current state can move to the updated state.
+func (manager MySQLManager) lockIncidentTransition(tx *sql.Tx, id int, update IncidentUpdate) bool {
+	var state string
+	err := tx.QueryRow("SELECT State FROM Incidents WHERE Id = ? FOR UPDATE", id).Scan(&state)
+	if err != nil {
+		logManager.LogPrintf("Error occurred when locking incident %v %v", id, err)
+		return false
+	}
+
+	if !canTransitionIncident(state, update.State) {
+		logManager.LogPrintf("Incident %v cannot move from %v to %v", id, state, update.State)
+		return false
+	}
+
+	return true
+}
+
+func (manager MySQLManager) updateIncident(db sqlExecutor, id int, incident IncidentUpdate) bool {
+	inc, pass := manager.getIncident(db, id)
 
 	if !pass {
 		return false
 	}
 
 	if len(incident.Attributes) > 0 {
-		if !manager.updateAttributes(inc, incident) {
+		if !manager.updateAttributes(db, inc, incident) {
 			return false
 		}
 	}
@@ -292,7 +451,7 @@ func (manager MySQLManager) UpdateIncident(id int, incident IncidentUpdate) bool
 		return true
 	}
 
-	stmt, err := manager.Connection.Prepare("UPDATE Incidents SET State = ? , Descrption = ?, Reporter = ? WHERE Id = ?")
+	stmt, err := db.Prepare("UPDATE Incidents SET State = ?, Description = ?, Reporter = ? WHERE Id = ?")
 	if err != nil {
 		logManager.LogPrintf("Error occurred when preparing update attribute %v", err)
 		return false
@@ -308,18 +467,18 @@ func (manager MySQLManager) UpdateIncident(id int, incident IncidentUpdate) bool
 	return true
 }
 
-func (manager MySQLManager) updateAttributes(original Incident, update IncidentUpdate) bool {
+func (manager MySQLManager) updateAttributes(db sqlExecutor, original Incident, update IncidentUpdate) bool {
 	for i, value := range update.Attributes {
 		if val, ok := original.Attributes[i]; ok {
 			if val == value {
 				continue
 			}
 
-			if !manager.updateAttribute(value, i, original.Id) {
+			if !manager.updateAttribute(db, value, i, original.Id) {
 				return false
 			}
 		} else {
-			if !manager.addAttribute(value, i, original.Id) {
+			if !manager.addAttribute(db, value, i, original.Id) {
 				return false
 			}
 		}
@@ -331,15 +490,15 @@ func (manager MySQLManager) updateAttributes(original Incident, update IncidentU
 			continue
 		}
 
-		if !manager.removeAttribute(i, original.Id) {
+		if !manager.removeAttribute(db, i, original.Id) {
 			return false
 		}
 	}
 	return true
 }
 
-func (manager MySQLManager) updateAttribute(value string, name string, id int64) bool {
-	stmt, err := manager.Connection.Prepare("UPDATE IncidentAttributes SET AttributeValue = ? WHERE IncidentId = ? AND AttributeName = ?")
+func (manager MySQLManager) updateAttribute(db sqlExecutor, value string, name string, id int64) bool {
+	stmt, err := db.Prepare("UPDATE IncidentAttributes SET AttributeValue = ? WHERE IncidentId = ? AND AttributeName = ?")
 	if err != nil {
 		logManager.LogPrintf("Error occurred when preparing update attribute %v", err)
 		return false
@@ -355,8 +514,8 @@ func (manager MySQLManager) updateAttribute(value string, name string, id int64)
 	return true
 }
 
-func (manager MySQLManager) addAttribute(value string, name string, id int64) bool {
-	stmt, err := manager.Connection.Prepare("INSERT INTO IncidentAttributes (IncidentId, AttributeName, AttributeValue) " +
+func (manager MySQLManager) addAttribute(db sqlExecutor, value string, name string, id int64) bool {
+	stmt, err := db.Prepare("INSERT INTO IncidentAttributes (IncidentId, AttributeName, AttributeValue) " +
 		"VALUES (?, ?, ?);")
 	if err != nil {
 		logManager.LogPrintf("Error occurred when preparing add attribute %v", err)
@@ -373,8 +532,8 @@ func (manager MySQLManager) addAttribute(value string, name string, id int64) bo
 	return true
 }
 
-func (manager MySQLManager) removeAttribute(name string, id int64) bool {
-	stmt, err := manager.Connection.Prepare("DELETE FROM IncidentAttributes WHERE IncidentId = ? AND AttributeName = ?")
+func (manager MySQLManager) removeAttribute(db sqlExecutor, name string, id int64) bool {
+	stmt, err := db.Prepare("DELETE FROM IncidentAttributes WHERE IncidentId = ? AND AttributeName = ?")
 	if err != nil {
 		logManager.LogPrintf("Error occurred when preparing add attribute %v", err)
 		return false
@@ -391,15 +550,22 @@ func (manager MySQLManager) removeAttribute(name string, id int64) bool {
 }
 
 func (manager MySQLManager) AddAttachment(incidentId int, attachment Attachment) bool {
-	stmt, err := manager.Connection.Prepare("INSERT INTO IncidentAttachments (IncidentId, FileName, TimeStampString) " +
-		"VALUES (?, ?, ?);")
+	versions, err := json.Marshal(attachment.Versions)
+	if err != nil {
+		logManager.LogPrintf("Unable to convert attachment versions %v", err)
+		return false
+	}
+
+	stmt, err := manager.Connection.Prepare("INSERT INTO IncidentAttachments (IncidentId, AttachmentId, FileName, TimeStampString, Size, ContentType, Checksum, UploaderId, Version, StorageVersion, Versions, ScanStatus, ScanSignature, ServiceAccountId) " +
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);")
 
 	if err != nil {
 		logManager.LogPrintf("Error occurred when preparing add attachment %v", err)
 		return false
 	}
 
-	_, err = stmt.Exec(incidentId, attachment.FileName, attachment.Time)
+	_, err = stmt.Exec(incidentId, attachment.getId(), attachment.FileName, attachment.Time, attachment.Size, attachment.ContentType, attachment.Checksum, attachment.UploaderId,
+		attachment.getVersion(), attachment.StorageVersion, string(versions), attachment.ScanStatus, attachment.ScanSignature, attachment.ServiceAccountId)
 
 	if err != nil {
 		logManager.LogPrintf("Error occurred when executing add attachment %v", err)
@@ -409,14 +575,53 @@ func (manager MySQLManager) AddAttachment(incidentId int, attachment Attachment)
 	return true
 }
 
+// UpdateAttachment replaces the metadata and versions of an attachment.
+func (manager MySQLManager) UpdateAttachment(incidentId int, attachment Attachment) bool {
+	versions, err := json.Marshal(attachment.Versions)
+	if err != nil {
+		logManager.LogPrintf("Unable to convert attachment versions %v", err)
+		return false
+	}
+
+	stmt, err := manager.Connection.Prepare("UPDATE IncidentAttachments SET FileName = ?, TimeStampString = ?, Size = ?, ContentType = ?, Checksum = ?, UploaderId = ?, " +
+		"Version = ?, StorageVersion = ?, Versions = ?, ScanStatus = ?, ScanSignature = ?, ServiceAccountId = ? WHERE IncidentId = ? AND AttachmentId = ?")
+
+	if err != nil {
+		logManager.LogPrintf("Error occurred when preparing update attachment %v", err)
+		return false
+	}
+
+	_, err = stmt.Exec(attachment.FileName, attachment.Time, attachment.Size, attachment.ContentType, attachment.Checksum, attachment.UploaderId,
+		attachment.getVersion(), attachment.StorageVersion, string(versions), attachment.ScanStatus, attachment.ScanSignature, attachment.ServiceAccountId, incidentId, attachment.getId())
+
+	if err != nil {
+		logManager.LogPrintf("Error occurred when executing update attachment %v", err)
+		return false
+	}
+
+	return true
+}
+
 func (manager MySQLManager) GetAttachments(incidentId int) ([]Attachment, bool) {
 	attachments := make([]Attachment, 0)
 	var (
-		fileName  string
-		timestamp string
+		attachmentId string
+		fileName     string
+		timestamp    string
+		size         sql.NullInt64
+		contentType  sql.NullString
+		checksum     sql.NullString
+		uploaderId   sql.NullInt64
+		version      sql.NullInt64
+		storage      sql.NullString
+		versions     sql.NullString
+		scanStatus   sql.NullString
+		signature    sql.NullString
+		account      sql.NullString
 	)
 
-	rows, err := manager.Connection.Query("SELECT FileName, TimeStampString FROM IncidentAttachments WHERE IncidentId = ?", incidentId)
+	// Attachments added before metadata was recorded have null metadata columns.
+	rows, err := manager.Connection.Query("SELECT AttachmentId, FileName, TimeStampString, Size, ContentType, Checksum, UploaderId, Version, StorageVersion, Versions, ScanStatus, ScanSignature, ServiceAccountId FROM IncidentAttachments WHERE IncidentId = ?", incidentId)
 
 	if err != nil {
 		logManager.LogPrintf("Error occurred when preparing get %v\n", err)
@@ -425,25 +630,46 @@ func (manager MySQLManager) GetAttachments(incidentId int) ([]Attachment, bool)
 
 	defer rows.Close()
 	for rows.Next() {
-		err := rows.Scan(&fileName, &timestamp)
+		err := rows.Scan(&attachmentId, &fileName, &timestamp, &size, &contentType, &checksum, &uploaderId, &version, &storage, &versions, &scanStatus, &signature, &account)
 		if err != nil {
 			logManager.LogPrintln(err)
 		}
 
-		attachments = append(attachments, Attachment{fileName, timestamp})
+		attachment := Attachment{
+			Id:               attachmentId,
+			FileName:         fileName,
+			Time:             timestamp,
+			Size:             size.Int64,
+			ContentType:      contentType.String,
+			Checksum:         checksum.String,
+			UploaderId:       uploaderId.Int64,
+			Version:          int(version.Int64),
+			StorageVersion:   storage.String,
+			ScanStatus:       scanStatus.String,
+			ScanSignature:    signature.String,
+			ServiceAccountId: account.String,
+		}
+
+		if len(versions.String) > 0 {
+			if err := json.Unmarshal([]byte(versions.String), &attachment.Versions); err != nil {
+				logManager.LogPrintln(err)
+			}
+		}
+
+		attachments = append(attachments, attachment)
 	}
 
 	return attachments, true
 }
 
-func (manager MySQLManager) RemoveAttachment(incidentId int, fileName string) bool {
-	stmt, err := manager.Connection.Prepare("DELETE FROM IncidentAttachments WHERE IncidentId = ? AND FileName = ?")
+func (manager MySQLManager) RemoveAttachment(incidentId int, attachmentId string) bool {
+	stmt, err := manager.Connection.Prepare("DELETE FROM IncidentAttachments WHERE IncidentId = ? AND AttachmentId = ?")
 	if err != nil {
 		logManager.LogPrintf("Error occurred when preparing remove attachment %v", err)
 		return false
 	}
 
-	_, err = stmt.Exec(incidentId, fileName)
+	_, err = stmt.Exec(incidentId, attachmentId)
 
 	if err != nil {
 		logManager.LogPrintf("Error occurred when executing remove attachment %v", err)
@@ -0,0 +1,17 @@
+package main
+
+import "testing"
+
+func TestConvertToSQLComparisonValue(t *testing.T) {
+	filters := map[Filter]string{
+		{"Description", "contains", "100%_done\\"}: "100\\%\\_done\\\\",
+		{"Description", "equals", "100%_done"}:     "100%_done",
+		{"Description", "notequals", "_"}:          "_",
+	}
+
+	for filter, expected := range filters {
+		if value := convertToSQLComparisonValue(filter); value != expected {
+			t.Errorf("Expected %v to be %v got %v", filter, expected, value)
+		}
+	}
+}
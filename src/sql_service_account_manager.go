@@ -0,0 +1,150 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+)
+
+// MySQLServiceAccountManager stores service accounts in the same mysql database as users.
+// The keys of an account are stored as json with the account.
+type MySQLServiceAccountManager struct {
+	Connection *sql.DB
+}
+
+// Initialize creates the service account table if it does not already exist.
+func (manager MySQLServiceAccountManager) Initialize() {
+	tables := MySQLManager{manager.Connection}
+	if tables.hasTable("ServiceAccounts") {
+		return
+	}
+
+	logManager.LogPrintln("Unable to find service account table creating now")
+	res, err := manager.Connection.Exec("CREATE TABLE ServiceAccounts (" +
+		"Id VARCHAR(36) NOT NULL PRIMARY KEY, " +
+		"Name VARCHAR(255) NOT NULL, " +
+		"Description TEXT, " +
+		"Permissions TEXT, " +
+		"ApiKeys MEDIUMTEXT)")
+
+	if err != nil {
+		panic(err)
+	}
+
+	logManager.LogPrintf("Created service account table: %v\n", res)
+}
+
+func (manager MySQLServiceAccountManager) AddServiceAccount(account ServiceAccount) bool {
+	keys, err := json.Marshal(account.Keys)
+	if err != nil {
+		logManager.LogPrintf("Unable to convert service account keys %v\n", err)
+		return false
+	}
+
+	_, err = manager.Connection.Exec("INSERT INTO ServiceAccounts (Id, Name, Description, Permissions, ApiKeys) VALUES (?, ?, ?, ?, ?)",
+		account.Id, account.Name, account.Description, strings.Join(account.Permissions, ","), string(keys))
+
+	if err != nil {
+		logManager.LogPrintf("Error occurred when adding service account %v\n", err)
+		return false
+	}
+
+	return true
+}
+
+func (manager MySQLServiceAccountManager) GetServiceAccount(id string) (ServiceAccount, bool) {
+	rows, err := manager.Connection.Query("SELECT Id, Name, Description, Permissions, ApiKeys "+
+		"FROM ServiceAccounts "+
+		"WHERE Id = ?", id)
+
+	if err != nil {
+		logManager.LogPrintf("Error occurred when getting service account %v\n", err)
+		return ServiceAccount{}, false
+	}
+
+	accounts, passed := scanServiceAccounts(rows)
+	if !passed || len(accounts) == 0 {
+		return ServiceAccount{}, false
+	}
+
+	return accounts[0], true
+}
+
+func (manager MySQLServiceAccountManager) GetServiceAccounts() ([]ServiceAccount, bool) {
+	rows, err := manager.Connection.Query("SELECT Id, Name, Description, Permissions, ApiKeys " +
+		"FROM ServiceAccounts " +
+		"ORDER BY Name, Id")
+
+	if err != nil {
+		logManager.LogPrintf("Error occurred when getting service accounts %v\n", err)
+		return nil, false
+	}
+
+	return scanServiceAccounts(rows)
+}
+
+func scanServiceAccounts(rows *sql.Rows) ([]ServiceAccount, bool) {
+	defer rows.Close()
+
+	retVal := make([]ServiceAccount, 0)
+	for rows.Next() {
+		var (
+			account     ServiceAccount
+			description sql.NullString
+			permissions sql.NullString
+			keys        sql.NullString
+		)
+
+		if err := rows.Scan(&account.Id, &account.Name, &description, &permissions, &keys); err != nil {
+			logManager.LogPrintln(err)
+			return nil, false
+		}
+
+		account.Description = description.String
+		account.Permissions = make([]string, 0)
+		if len(permissions.String) > 0 {
+			account.Permissions = strings.Split(permissions.String, ",")
+		}
+
+		account.Keys = make([]APIKey, 0)
+		if len(keys.String) > 0 {
+			if err := json.Unmarshal([]byte(keys.String), &account.Keys); err != nil {
+				logManager.LogPrintf("Unable to read keys of service account %v %v\n", account.Id, err)
+				return nil, false
+			}
+		}
+
+		retVal = append(retVal, account)
+	}
+
+	return retVal, rows.Err() == nil
+}
+
+func (manager MySQLServiceAccountManager) UpdateServiceAccount(account ServiceAccount) bool {
+	keys, err := json.Marshal(account.Keys)
+	if err != nil {
+		logManager.LogPrintf("Unable to convert service account keys %v\n", err)
+		return false
+	}
+
+	_, err = manager.Connection.Exec("UPDATE ServiceAccounts SET Name = ?, Description = ?, Permissions = ?, ApiKeys = ? WHERE Id = ?",
+		account.Name, account.Description, strings.Join(account.Permissions, ","), string(keys), account.Id)
+
+	if err != nil {
+		logManager.LogPrintf("Error occurred when updating service account %v\n", err)
+		return false
+	}
+
+	return true
+}
+
+func (manager MySQLServiceAccountManager) RemoveServiceAccount(id string) bool {
+	res, err := manager.Connection.Exec("DELETE FROM ServiceAccounts WHERE Id = ?", id)
+	if err != nil {
+		logManager.LogPrintf("Error occurred when removing service account %v\n", err)
+		return false
+	}
+
+	removed, err := res.RowsAffected()
+	return err == nil && removed > 0
+}
@@ -21,6 +21,8 @@ func (manager MySQLUserManager) Initialize() {
 		logManager.LogPrintln("Unable to find tokens table creating now")
 		manager.createTokenTable()
 	}
+
+	manager.widenTokenColumn()
 }
 
 func (manager MySQLUserManager) hasTable(tableName string) bool {
@@ -66,7 +68,7 @@ func (manager MySQLUserManager) createUserTable() {
 func (manager MySQLUserManager) createTokenTable() {
 	stmt, err := manager.Connection.Prepare("CREATE TABLE Tokens (" +
 		"Id INT UNSIGNED NOT NULL PRIMARY KEY, " +
-		"Tokens VARCHAR(1048))")
+		"Tokens MEDIUMTEXT)")
 
 	if err != nil {
 		panic(err)
@@ -80,6 +82,27 @@ func (manager MySQLUserManager) createTokenTable() {
 	logManager.LogPrintf("Created Token Table: %v\n", res)
 }
 
+// widenTokenColumn converts token tables created when tokens were short enough to fit in a VARCHAR, signed tokens are much longer.
+func (manager MySQLUserManager) widenTokenColumn() {
+	var columnType string
+	err := manager.Connection.QueryRow("SELECT DATA_TYPE FROM information_schema.COLUMNS " +
+		"WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'Tokens' AND COLUMN_NAME = 'Tokens'").Scan(&columnType)
+
+	if err != nil {
+		logManager.LogPrintf("Unable to find the type of the tokens column %v\n", err)
+		return
+	}
+
+	if !strings.EqualFold(columnType, "varchar") {
+		return
+	}
+
+	logManager.LogPrintln("Widening tokens column")
+	if _, err := manager.Connection.Exec("ALTER TABLE Tokens MODIFY Tokens MEDIUMTEXT"); err != nil {
+		panic(err)
+	}
+}
+
 func (manager MySQLUserManager) AddUser(user *AddUser) (bool, User) {
 	stmt, err := manager.Connection.Prepare("INSERT INTO Users (EmailAddress, UserName, FirstName, LastName, Gender, Permissions) " +
 		"VALUES (?, ?, ?, ?, ?, ?);")
@@ -114,7 +137,7 @@ func (manager MySQLUserManager) AddUser(user *AddUser) (bool, User) {
 		Permissions:  permissions,
 	}
 
-	manager.SetUserPassword(usr, createPasswordHash(usr, user.Password))
+	manager.SetUserPassword(usr, user.Password)
 
 	logManager.LogPrintf("Created new user: %v\n", usr)
 	return true, usr
@@ -214,6 +237,174 @@ func (manager MySQLUserManager) GetUserByEmail(emailAddress string) (User, bool)
 	return retVal, retVal.Id != -1
 }
 
+func (manager MySQLUserManager) GetUsers() ([]User, bool) {
+	rows, err := manager.Connection.Query("SELECT Id, UserName, FirstName, LastName, EmailAddress, Gender, Permissions " +
+		"FROM Users " +
+		"ORDER BY Id")
+
+	if err != nil {
+		logManager.LogPrintf("Error occurred when preparing get users %v\n", err)
+		return make([]User, 0), false
+	}
+
+	defer rows.Close()
+	retVal := scanUsers(rows)
+	logManager.LogPrintf("got users: %v\n", len(retVal))
+	return retVal, true
+}
+
+// sqlUserColumns maps user properties to the columns they are stored in.
+var sqlUserColumns = map[string]string{
+	"id":           "CAST(Id AS CHAR)",
+	"username":     "COALESCE(UserName, '')",
+	"firstname":    "COALESCE(FirstName, '')",
+	"lastname":     "COALESCE(LastName, '')",
+	"gender":       "COALESCE(Gender, '')",
+	"emailaddress": "COALESCE(EmailAddress, '')",
+}
+
+// ListUsers finds a page of the users matching the query.
+// Comparisons rely on the case insensitive collation MySQL uses by default.
+func (manager MySQLUserManager) ListUsers(query UserQuery) (UserPage, bool) {
+	args := make([]interface{}, 0)
+	where := "WHERE " + buildSQLUserFilter(query.Filter, &args) + " "
+
+	var total int
+	if err := manager.Connection.QueryRow("SELECT COUNT(*) FROM Users "+where, args...).Scan(&total); err != nil {
+		logManager.LogPrintf("Error occurred when counting users %v\n", err)
+		return UserPage{}, false
+	}
+
+	direction := ""
+	if query.Descending {
+		direction = " DESC"
+	}
+
+	order := "Id" + direction
+	if column, ok := sqlUserColumns[strings.ToLower(query.Sort)]; ok && !strings.EqualFold(query.Sort, "id") {
+		order = column + direction + ", " + order
+	}
+
+	rows, err := manager.Connection.Query("SELECT Id, UserName, FirstName, LastName, EmailAddress, Gender, Permissions "+
+		"FROM Users "+
+		where+
+		"ORDER BY "+order+" LIMIT ? OFFSET ?", append(args, query.Limit, query.Offset)...)
+
+	if err != nil {
+		logManager.LogPrintf("Error occurred when listing users %v\n", err)
+		return UserPage{}, false
+	}
+
+	defer rows.Close()
+	return UserPage{total, scanUsers(rows)}, true
+}
+
+func scanUsers(rows *sql.Rows) []User {
+	retVal := make([]User, 0)
+	var (
+		id           int64
+		username     string
+		firstname    string
+		lastname     string
+		emailaddress string
+		gender       string
+		permissions  string
+	)
+
+	for rows.Next() {
+		err := rows.Scan(&id, &username, &firstname, &lastname, &emailaddress, &gender, &permissions)
+		if err != nil {
+			logManager.LogPrintln(err)
+			continue
+		}
+
+		retVal = append(retVal, User{
+			Id:           id,
+			UserName:     username,
+			FirstName:    firstname,
+			LastName:     lastname,
+			EmailAddress: emailaddress,
+			Gender:       gender,
+			Permissions:  strings.Split(permissions, ","),
+		})
+	}
+
+	return retVal
+}
+
+// buildSQLUserFilter converts a filter request to a condition, adding the values it compares to the args.
+// Only known user properties are used as columns, any other property is treated as empty like getUserPropertyValue does.
+func buildSQLUserFilter(filter *FilterRequest, args *[]interface{}) string {
+	if filter == nil {
+		return "TRUE"
+	}
+
+	conditions := make([]string, 0, len(filter.Filters))
+	for _, complexFilter := range filter.Filters {
+		conditions = append(conditions, buildSQLUserComplexFilter(complexFilter, args))
+	}
+
+	return joinSQLConditions(conditions, isOrRequest(filter))
+}
+
+func buildSQLUserComplexFilter(filter ComplexFilter, args *[]interface{}) string {
+	conditions := make([]string, 0)
+	if filter.Children != nil {
+		for _, child := range filter.Children {
+			conditions = append(conditions, buildSQLUserComplexFilter(*child, args))
+		}
+
+		return joinSQLConditions(conditions, isOrFilter(filter))
+	}
+
+	for _, v := range filter.Filter {
+		column, ok := sqlUserColumns[strings.ToLower(v.Property)]
+		if !ok {
+			column = "''"
+		}
+
+		switch {
+		case isEqualsComparision(v):
+			conditions = append(conditions, column+" = ?")
+			*args = append(*args, v.Value)
+		case isContainsComparision(v):
+			conditions = append(conditions, column+" LIKE CONCAT('%', ?, '%')")
+			*args = append(*args, escapeSQLLike(v.Value))
+		case isNotEqualsComparision(v):
+			conditions = append(conditions, column+" != ?")
+			*args = append(*args, v.Value)
+		default:
+			conditions = append(conditions, "FALSE")
+		}
+	}
+
+	return joinSQLConditions(conditions, isOrFilter(filter))
+}
+
+// joinSQLConditions joins conditions the same way filters are evaluated in memory.
+// No conditions are all true, unless they are joined by or.
+func joinSQLConditions(conditions []string, or bool) string {
+	if len(conditions) == 0 {
+		if or {
+			return "FALSE"
+		}
+
+		return "TRUE"
+	}
+
+	junction := " AND "
+	if or {
+		junction = " OR "
+	}
+
+	return "(" + strings.Join(conditions, junction) + ")"
+}
+
+// escapeSQLLike escapes the wildcards in a value so LIKE matches it literally.
+func escapeSQLLike(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(value)
+}
+
 func (manager MySQLUserManager) UpdateUser(userId int64, user *User) bool {
 	usr, pass := manager.GetUser(userId)
 
@@ -231,7 +422,7 @@ func (manager MySQLUserManager) UpdateUser(userId int64, user *User) bool {
 		return false
 	}
 
-	_, err = stmt.Exec(usr.UserName, usr.FirstName, usr.LastName, usr.Gender, strings.Join(usr.Permissions, ","), userId)
+	_, err = stmt.Exec(usr.UserName, usr.FirstName, usr.LastName, usr.Gender, userId)
 
 	if err != nil {
 		logManager.LogPrintf("Error occurred when executing update user %v", err)
@@ -255,22 +446,55 @@ func (manager MySQLUserManager) RemoveUser(userId int64) bool {
 		return false
 	}
 
+	if _, err := manager.Connection.Exec("DELETE FROM Tokens WHERE Id = ?", userId); err != nil {
+		logManager.LogPrintf("Error occurred when removing user tokens %v", err)
+	}
+
 	return true
 }
 
 func (manager MySQLUserManager) SetUserPassword(user User, password string) {
+	manager.SetPasswordHash(user, createPasswordHash(password))
+}
+
+func (manager MySQLUserManager) GetPasswordHash(user User) (string, bool) {
+	var storedPassword sql.NullString
+
+	rows, err := manager.Connection.Query("SELECT Password "+
+		"FROM Users "+
+		"WHERE Id = ?", user.Id)
+
+	if err != nil {
+		logManager.LogPrintf("Error occurred when preparing get password %v\n", err)
+		return "", false
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		if err := rows.Scan(&storedPassword); err != nil {
+			logManager.LogPrintln(err)
+			return "", false
+		}
+	}
+
+	return storedPassword.String, storedPassword.Valid
+}
+
+func (manager MySQLUserManager) SetPasswordHash(user User, hash string) bool {
 	stmt, err := manager.Connection.Prepare("UPDATE Users SET Password = ? WHERE Id = ?")
 	if err != nil {
 		logManager.LogPrintf("Error occurred when preparing update user password %v", err)
-		return
+		return false
 	}
 
-	_, err = stmt.Exec(password, user.Id)
+	_, err = stmt.Exec(hash, user.Id)
 
 	if err != nil {
 		logManager.LogPrintf("Error occurred when executing update user password %v", err)
-		return
+		return false
 	}
+
+	return true
 }
 
 func (manager MySQLUserManager) SetPermissions(userId int64, permissions []string) bool {
@@ -316,127 +540,64 @@ func (manager MySQLUserManager) AuthenticateUser(user User, password string) (bo
 		}
 	}
 
-	auth := createPasswordHash(user, password) == storedPassword
+	auth := checkPassword(user, password, storedPassword, func(hash string) bool {
+		return manager.SetPasswordHash(user, hash)
+	})
 
 	if !auth {
 		return auth, TokenResponse{}
 	}
 
-	token := GenerateToken(user)
-	tokens, found := manager.reconcileUserTokens(user.Id, token.Token)
-
-	if found {
-		manager.updateTokens(user.Id, tokens)
-	} else {
-		manager.setTokens(user.Id, tokens)
-	}
-
-	return auth, token
-}
-
-func (manager MySQLUserManager) reconcileUserTokens(userId int64, newToken string) (string, bool) {
-	tokens, found := manager.getTokens(userId)
-	reconciledTokens := make([]string, 0)
-	reconciledTokens = append(reconciledTokens, newToken)
-
-	for _, token := range tokens {
-		if !TokenExpired(token) {
-			reconciledTokens = append(reconciledTokens, token)
-		}
-	}
-
-	return strings.Join(reconciledTokens, ","), found
+	token, issued := issueTokens(manager, user)
+	return issued, token
 }
 
-func (manager MySQLUserManager) getTokens(userId int64) ([]string, bool) {
-	var (
-		id          int64
-		storedToken string
-	)
+func (manager MySQLUserManager) GetTokens(userId int64) ([]string, bool) {
+	var storedTokens sql.NullString
 
-	rows, err := manager.Connection.Query("SELECT Id, Tokens "+
+	err := manager.Connection.QueryRow("SELECT Tokens "+
 		"FROM Tokens "+
-		"WHERE Id = ?", userId)
+		"WHERE Id = ?", userId).Scan(&storedTokens)
+
+	if err == sql.ErrNoRows {
+		return make([]string, 0), true
+	}
 
 	if err != nil {
-		logManager.LogPrintf("Error occurred when preparing get tokens %v\n", err)
+		logManager.LogPrintf("Error occurred when getting tokens %v\n", err)
 		return make([]string, 0), false
 	}
 
-	defer rows.Close()
-	for rows.Next() {
-		err := rows.Scan(&id, &storedToken)
-		if err != nil {
-			logManager.LogPrintln(err)
+	tokens := make([]string, 0)
+	for _, token := range strings.Split(storedTokens.String, ",") {
+		if len(token) > 0 {
+			tokens = append(tokens, token)
 		}
 	}
 
-	return strings.Split(storedToken, ","), id != 0
+	return tokens, true
 }
 
-func (manager MySQLUserManager) updateTokens(userId int64, tokens string) {
-	stmt, err := manager.Connection.Prepare("UPDATE Tokens SET Tokens = ? WHERE Id = ?")
-	if err != nil {
-		logManager.LogPrintf("Error occurred when preparing update user tokens %v", err)
-		return
-	}
-
-	_, err = stmt.Exec(tokens, userId)
-
+func (manager MySQLUserManager) SetTokens(userId int64, tokens []string) bool {
+	stmt, err := manager.Connection.Prepare("INSERT INTO Tokens (Id, Tokens) VALUES (?, ?) " +
+		"ON DUPLICATE KEY UPDATE Tokens = VALUES(Tokens)")
 	if err != nil {
-		logManager.LogPrintf("Error occurred when executing update user tokens %v", err)
-	}
-}
-
-func (manager MySQLUserManager) setTokens(userId int64, tokens string) {
-	stmt, err := manager.Connection.Prepare("INSERT INTO Tokens (Id, Tokens) VALUES (?, ?)")
-	if err != nil {
-		logManager.LogPrintf("Error occurred when preparing add user tokens %v", err)
-		return
+		logManager.LogPrintf("Error occurred when preparing set user tokens %v", err)
+		return false
 	}
 
-	_, err = stmt.Exec(userId, tokens)
+	_, err = stmt.Exec(userId, strings.Join(tokens, ","))
 
 	if err != nil {
-		logManager.LogPrintf("Error occurred when executing add user tokens %v", err)
-	}
-}
-
-func (manager MySQLUserManager) ValidateUser(token string) bool {
-	userId := GetTokenUser(token)
-	tokens, _ := manager.getTokens(userId)
-	found := -1
-
-	for i, v := range tokens {
-		if v == token {
-			found = i
-		}
-	}
-
-	if found == -1 {
-		logManager.LogPrintf("Token not found for user %v", userId)
+		logManager.LogPrintf("Error occurred when executing set user tokens %v", err)
 		return false
 	}
 
-	expired := TokenExpired(token)
-	logManager.LogPrintf("Token expired %v", expired)
-	go manager.pruneTokens(userId, tokens)
-
-	return !expired
+	return true
 }
 
-func (manager MySQLUserManager) pruneTokens(userId int64, tokens []string) {
-	prunedTokens := make([]string, 0)
-
-	for _, v := range tokens {
-		if !TokenExpired(v) {
-			prunedTokens = append(prunedTokens, v)
-		}
-	}
-
-	if len(tokens) != len(prunedTokens) {
-		manager.setTokens(userId, strings.Join(prunedTokens, ","))
-	}
+func (manager MySQLUserManager) ValidateUser(token string) bool {
+	return validateToken(manager, token)
 }
 
 // CleanUp will do any required cleanup actions on the user manager.
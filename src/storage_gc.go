@@ -0,0 +1,191 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// storageGCGracePeriod is how long after being uploaded a version is left alone by garbage collection.
+// The file of a version uploaded around the time the files are listed may not have been stored yet.
+var storageGCGracePeriod = time.Hour
+
+// MissingFile describes a version of an attachment whose file could not be loaded.
+// The Reason is set when the version was left out for another reason, like being quarantined.
+type MissingFile struct {
+	IncidentId   int64  `json:"incidentId"`
+	AttachmentId string `json:"attachmentId"`
+	Version      int    `json:"version"`
+	Reason       string `json:"reason,omitempty"`
+}
+
+// StorageGCReport lists the files stored without an attachment and the attachment versions stored without a file.
+// When Repaired is true the orphaned files have been deleted and the missing versions removed from their attachments.
+type StorageGCReport struct {
+	Orphaned []StoredFile  `json:"orphaned"`
+	Missing  []MissingFile `json:"missing"`
+	Repaired bool          `json:"repaired"`
+}
+
+// collectStorageGarbage compares the stored files to the attachments of every incident.
+// A false is returned if the file manager cannot list its files or the attachments cannot be found.
+func collectStorageGarbage(repair bool) (StorageGCReport, bool) {
+	report := StorageGCReport{make([]StoredFile, 0), make([]MissingFile, 0), repair}
+	cutoff := time.Now().Add(-storageGCGracePeriod)
+	listable, ok := fileManager.(ListableFileManager)
+	if !ok {
+		logManager.LogPrintln("Unable to collect garbage, the file manager cannot list files")
+		return report, false
+	}
+
+	files, passed := listable.ListFiles()
+	if !passed {
+		logManager.LogPrintln("Unable to list stored files")
+		return report, false
+	}
+
+	incidents, passed := incidentManager.GetIncidents(nil)
+	if !passed {
+		logManager.LogPrintln("Unable to get incidents to collect garbage")
+		return report, false
+	}
+
+	stored := make(map[StoredFile]bool)
+	for _, file := range files {
+		stored[file] = true
+	}
+
+	expected := make(map[StoredFile]bool)
+	for _, incident := range incidents {
+		attachments, passed := incidentManager.GetAttachments(int(incident.Id))
+		if !passed {
+			logManager.LogPrintf("Unable to get attachments of incident %v to collect garbage\n", incident.Id)
+			return report, false
+		}
+
+		incidentId := strconv.FormatInt(incident.Id, 10)
+		for _, attachment := range attachments {
+			for _, version := range attachment.getVersions() {
+				expected[StoredFile{incidentId, attachment.getVersionKey(version)}] = true
+				for _, name := range previewGenerator.getPreviewNames(attachment, version) {
+					expected[StoredFile{incidentId, name}] = true
+				}
+			}
+
+			missing, checked := getMissingVersions(incident.Id, attachment, stored, cutoff)
+			if !checked {
+				logManager.LogPrintf("Unable to check the files of attachment %v of incident %v, skipping it\n", attachment.getId(), incident.Id)
+				continue
+			}
+
+			for _, version := range missing {
+				report.Missing = append(report.Missing, MissingFile{incident.Id, attachment.getId(), version.Version, ""})
+			}
+
+			if repair && len(missing) > 0 {
+				repairAttachment(incident.Id, attachment, missing)
+			}
+		}
+	}
+
+	for _, file := range files {
+		if expected[file] || isUploadFile(file, stored) {
+			continue
+		}
+
+		report.Orphaned = append(report.Orphaned, file)
+		if repair && !fileManager.DeleteFile(file.Incident, file.FileName) {
+			logManager.LogPrintf("Unable to delete orphaned file %v/%v\n", file.Incident, file.FileName)
+		}
+	}
+
+	if repair {
+		userUploadUsage.Reset()
+	}
+
+	return report, true
+}
+
+// isUploadFile checks if a file belongs to a resumable upload that has not completed yet.
+func isUploadFile(file StoredFile, stored map[StoredFile]bool) bool {
+	if strings.HasSuffix(file.FileName, ".upload") {
+		return true
+	}
+
+	index := strings.LastIndex(file.FileName, ".chunk")
+	if index < 0 {
+		return false
+	}
+
+	if _, err := strconv.Atoi(file.FileName[index+len(".chunk"):]); err != nil {
+		return false
+	}
+
+	return stored[StoredFile{file.Incident, getUploadInfoName(file.FileName[:index])}]
+}
+
+// getMissingVersions returns the versions of an attachment whose file is not in the stored files.
+// A file that fails to load may only be unavailable for a moment, so only files that were not listed are missing.
+// Versions uploaded after the cutoff are not checked, their files may have been stored after the files were listed.
+// Versions kept by the file manager are not listed, so a false is returned if one of them cannot be loaded since it may not be missing.
+func getMissingVersions(incidentId int64, attachment Attachment, stored map[StoredFile]bool, cutoff time.Time) ([]AttachmentVersion, bool) {
+	incident := strconv.FormatInt(incidentId, 10)
+	missing := make([]AttachmentVersion, 0)
+	for _, version := range attachment.getVersions() {
+		if uploaded, err := time.Parse(time.RFC3339, version.Time); err == nil && uploaded.After(cutoff) {
+			continue
+		}
+
+		if _, versioned := fileManager.(VersionedFileManager); versioned && len(version.StorageVersion) > 0 {
+			_, _, found, closer := loadAttachmentVersion(incidentId, attachment, version)
+			if !found {
+				return nil, false
+			}
+
+			closer()
+			continue
+		}
+
+		if !stored[StoredFile{incident, attachment.getVersionKey(version)}] {
+			missing = append(missing, version)
+		}
+	}
+
+	return missing, true
+}
+
+// repairAttachment removes the missing versions from an attachment.
+// If the current version is missing the newest remaining version becomes current, and if every version is missing the attachment is removed.
+func repairAttachment(incidentId int64, attachment Attachment, missing []AttachmentVersion) {
+	isMissing := make(map[int]bool)
+	for _, version := range missing {
+		isMissing[version.Version] = true
+	}
+
+	remaining := make([]AttachmentVersion, 0)
+	for _, version := range attachment.getVersions() {
+		if !isMissing[version.Version] {
+			remaining = append(remaining, version)
+		}
+	}
+
+	incident := strconv.FormatInt(incidentId, 10)
+	for _, version := range missing {
+		for _, name := range previewGenerator.getPreviewNames(attachment, version) {
+			fileManager.DeleteFile(incident, name)
+		}
+	}
+
+	if len(remaining) == 0 {
+		if !incidentManager.RemoveAttachment(int(incidentId), attachment.getId()) {
+			logManager.LogPrintf("Unable to remove attachment %v of incident %v\n", attachment.getId(), incidentId)
+		}
+		return
+	}
+
+	attachment.setCurrentVersion(remaining[len(remaining)-1])
+	attachment.Versions = remaining[:len(remaining)-1]
+	if !incidentManager.UpdateAttachment(int(incidentId), attachment) {
+		logManager.LogPrintf("Unable to update attachment %v of incident %v\n", attachment.getId(), incidentId)
+	}
+}
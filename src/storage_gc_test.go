@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func collectGarbage(token string, repair bool) *httptest.ResponseRecorder {
+	url := "/sona/v1/storage/gc"
+	if repair {
+		url += "?repair=true"
+	}
+
+	r, _ := http.NewRequest("POST", url, nil)
+	r.Header.Set("X-Sona-Token", token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func readGCReport(t *testing.T, w *httptest.ResponseRecorder) StorageGCReport {
+	var report StorageGCReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil || w.Result().StatusCode != 200 {
+		t.Fatalf("Expected report got %v %v", w.Result(), err)
+	}
+
+	return report
+}
+
+// setupGCTest uploads an attachment with two versions and checks versions as soon as they are uploaded.
+func setupGCTest(t *testing.T) (string, Attachment) {
+	gracePeriod := storageGCGracePeriod
+	storageGCGracePeriod = 0
+	t.Cleanup(func() {
+		storageGCGracePeriod = gracePeriod
+	})
+
+	return setupMigrationTest(t)
+}
+
+func TestCollectStorageGarbage(t *testing.T) {
+	token, attachment := setupGCTest(t)
+	fileManager.SaveFile("0", "stray", strings.NewReader("left behind"))
+	fileManager.SaveFile("0", "upload.upload", strings.NewReader("{}"))
+	fileManager.SaveFile("0", "upload.chunk0", strings.NewReader("in progress"))
+	fileManager.SaveFile("0", "expired.chunk0", strings.NewReader("abandoned"))
+	fileManager.DeleteFile("0", attachment.Id+".v2")
+
+	report := readGCReport(t, collectGarbage(token, false))
+
+	if len(report.Orphaned) != 2 || report.Orphaned[0].FileName != "expired.chunk0" || report.Orphaned[1].FileName != "stray" {
+		t.Errorf("Unexpected orphaned files %v", report.Orphaned)
+	}
+
+	if len(report.Missing) != 1 || report.Missing[0] != (MissingFile{0, attachment.Id, 2, ""}) {
+		t.Errorf("Unexpected missing files %v", report.Missing)
+	}
+
+	if _, _, found, _ := fileManager.LoadFile("0", "stray"); !found {
+		t.Errorf("Expected report not to delete files")
+	}
+}
+
+func TestRepairStorageGarbage(t *testing.T) {
+	token, attachment := setupGCTest(t)
+	fileManager.SaveFile("0", "stray", strings.NewReader("left behind"))
+	fileManager.DeleteFile("0", attachment.Id+".v2")
+
+	if report := readGCReport(t, collectGarbage(token, true)); !report.Repaired || len(report.Orphaned) != 1 || len(report.Missing) != 1 {
+		t.Fatalf("Unexpected report %v", report)
+	}
+
+	if _, _, found, _ := fileManager.LoadFile("0", "stray"); found {
+		t.Errorf("Expected orphaned file to be deleted")
+	}
+
+	attachments, _ := incidentManager.GetAttachments(0)
+	if len(attachments) != 1 || attachments[0].getVersion() != 1 || len(attachments[0].Versions) != 0 {
+		t.Fatalf("Expected first version to become current got %v", attachments)
+	}
+
+	if w := downloadAttachment(token, attachment.Id, nil); w.Body.String() != "first run" {
+		t.Errorf("Unexpected content %v", w.Body)
+	}
+
+	if report := readGCReport(t, collectGarbage(token, false)); len(report.Orphaned) != 0 || len(report.Missing) != 0 {
+		t.Errorf("Expected nothing left to repair got %v", report)
+	}
+}
+
+func TestRepairRemovesAttachmentWithoutFiles(t *testing.T) {
+	token, attachment := setupGCTest(t)
+	fileManager.DeleteFile("0", attachment.Id)
+	fileManager.DeleteFile("0", attachment.Id+".v2")
+
+	readGCReport(t, collectGarbage(token, true))
+
+	if attachments, _ := incidentManager.GetAttachments(0); len(attachments) != 0 {
+		t.Errorf("Expected attachment to be removed got %v", attachments)
+	}
+}
+
+// UnavailableFileManager lists the files of a local file manager but cannot load them.
+type UnavailableFileManager struct {
+	LocalFileManager
+}
+
+func (manager UnavailableFileManager) LoadFile(incident string, fileName string) (io.ReadSeeker, os.FileInfo, bool, func()) {
+	return nil, nil, false, nil
+}
+
+func TestRepairKeepsAttachmentsThatFailToLoad(t *testing.T) {
+	token, _ := setupGCTest(t)
+	fileManager = UnavailableFileManager{fileManager.(LocalFileManager)}
+
+	if report := readGCReport(t, collectGarbage(token, true)); len(report.Missing) != 0 {
+		t.Errorf("Expected files that fail to load not to be missing got %v", report)
+	}
+
+	if attachments, _ := incidentManager.GetAttachments(0); len(attachments) != 1 || len(attachments[0].Versions) != 1 {
+		t.Errorf("Expected attachment to be kept got %v", attachments)
+	}
+}
+
+func TestRepairSkipsRecentUploads(t *testing.T) {
+	token, attachment := setupMigrationTest(t)
+	fileManager.DeleteFile("0", attachment.Id+".v2")
+
+	if report := readGCReport(t, collectGarbage(token, true)); len(report.Missing) != 0 {
+		t.Errorf("Expected recent uploads not to be checked got %v", report)
+	}
+
+	if attachments, _ := incidentManager.GetAttachments(0); len(attachments) != 1 || attachments[0].getVersion() != 2 {
+		t.Errorf("Expected attachment to be kept got %v", attachments)
+	}
+}
+
+func TestCollectStorageGarbageNotListable(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.master)
+	fileManager = struct{ FileManager }{fileManager}
+
+	if w := collectGarbage(token, false); w.Result().StatusCode != 409 {
+		t.Errorf("Expected 409 status code got %v", w.Result())
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// HandleMigrateStorage handles the start storage migration web request.
+// Every attachment is copied to the configured migration target in the background.
+func HandleMigrateStorage(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got Migrate Storage request")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	if !validateRequest(w, r, availablePermissions.master) {
+		return
+	}
+
+	if migrationTarget == nil {
+		logManager.LogPrintln("Unable to migrate attachments, no migration target is configured")
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	job := storageMigrations.NewStorageMigrationJob()
+	go job.Run(fileManager, migrationTarget)
+
+	data, err := job.Status()
+	if err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("Location", "/sona/v1/storage/migrations/"+job.Id)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(data)
+}
+
+// HandleGetStorageMigration handles the get storage migration status web request.
+func HandleGetStorageMigration(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got Storage Migration status request")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	if !validateRequest(w, r, availablePermissions.master) {
+		return
+	}
+
+	job, found := storageMigrations.GetStorageMigrationJob(mux.Vars(r)["jobId"])
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	data, err := job.Status()
+	if err != nil {
+		panic(err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// HandleCollectStorageGarbage handles the storage garbage collection web request.
+// Orphaned files and missing versions are reported, and repaired when the repair query parameter is true.
+func HandleCollectStorageGarbage(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got Collect Storage Garbage request")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if !validateRequest(w, r, availablePermissions.master) {
+		return
+	}
+
+	if _, ok := fileManager.(ListableFileManager); !ok {
+		logManager.LogPrintln("Unable to collect garbage, the file manager cannot list files")
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	report, passed := collectStorageGarbage(r.URL.Query().Get("repair") == "true")
+	if !passed {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	guuid "github.com/google/uuid"
+)
+
+const (
+	migrationPending   = "pending"
+	migrationRunning   = "running"
+	migrationCompleted = "completed"
+	migrationFailed    = "failed"
+)
+
+// migrationTarget is the file manager attachments are migrated to, if one is configured.
+var migrationTarget FileManager
+
+// StorageMigrationJob tracks the progress of copying every attachment to another file manager.
+// Files already copied with the same content are skipped, so a failed or interrupted migration can be run again to resume it.
+type StorageMigrationJob struct {
+	lock      sync.Mutex
+	Id        string   `json:"id"`
+	State     string   `json:"state"`
+	Total     int      `json:"total"`
+	Processed int      `json:"processed"`
+	Copied    int      `json:"copied"`
+	Skipped   int      `json:"skipped"`
+	Failed    int      `json:"failed"`
+	Errors    []string `json:"errors"`
+	Started   string   `json:"started"`
+	Finished  string   `json:"finished,omitempty"`
+}
+
+// StorageMigrationManager keeps track of the migrations that have been started.
+// Jobs are only kept in memory and will be lost when the server restarts.
+type StorageMigrationManager struct {
+	lock sync.Mutex
+	jobs map[string]*StorageMigrationJob
+}
+
+var storageMigrations = &StorageMigrationManager{jobs: make(map[string]*StorageMigrationJob)}
+
+// migrationFile is a single file to copy.
+// Optional files, like previews that have not been created yet, are skipped if they do not exist.
+type migrationFile struct {
+	incident string
+	fileName string
+	checksum string
+	optional bool
+	load     func() (io.ReadSeeker, os.FileInfo, bool, func())
+}
+
+// NewStorageMigrationJob creates and tracks a new pending migration.
+func (manager *StorageMigrationManager) NewStorageMigrationJob() *StorageMigrationJob {
+	job := &StorageMigrationJob{
+		Id:      guuid.New().String(),
+		State:   migrationPending,
+		Errors:  make([]string, 0),
+		Started: time.Now().Format(time.RFC3339),
+	}
+
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	manager.jobs[job.Id] = job
+	return job
+}
+
+// GetStorageMigrationJob finds a migration by its id.
+func (manager *StorageMigrationManager) GetStorageMigrationJob(id string) (*StorageMigrationJob, bool) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	job, ok := manager.jobs[id]
+	return job, ok
+}
+
+// Status converts the current state of the job to json.
+func (job *StorageMigrationJob) Status() ([]byte, error) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	return json.Marshal(job)
+}
+
+func (job *StorageMigrationJob) update(change func()) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	change()
+}
+
+func (job *StorageMigrationJob) recordError(message string) {
+	logManager.LogPrintf("Migration %v: %v\n", job.Id, message)
+	job.update(func() {
+		job.Failed++
+		job.Errors = append(job.Errors, message)
+	})
+}
+
+// Run copies every version and preview of every attachment from the source to the target.
+// Each copy is read back from the target and checked against the content of the source.
+func (job *StorageMigrationJob) Run(source FileManager, target FileManager) {
+	job.update(func() {
+		job.State = migrationRunning
+	})
+
+	files, passed := job.getMigrationFiles(source)
+	if !passed {
+		job.update(func() {
+			job.Errors = append(job.Errors, "unable to get attachments")
+			job.State = migrationFailed
+			job.Finished = time.Now().Format(time.RFC3339)
+		})
+		return
+	}
+
+	job.update(func() {
+		job.Total = len(files)
+	})
+
+	for _, file := range files {
+		copied, err := migrateFile(file, target)
+		switch {
+		case err != nil:
+			job.recordError(fmt.Sprintf("unable to migrate %v/%v %v", file.incident, file.fileName, err))
+		case copied:
+			job.update(func() {
+				job.Copied++
+			})
+		default:
+			job.update(func() {
+				job.Skipped++
+			})
+		}
+
+		job.update(func() {
+			job.Processed++
+		})
+	}
+
+	job.update(func() {
+		job.State = migrationCompleted
+		job.Finished = time.Now().Format(time.RFC3339)
+	})
+}
+
+// getMigrationFiles finds every file stored for the attachments of every incident.
+// Versions kept by a versioned file manager, other than the current version, have no name of their own to be copied to so they are recorded as errors.
+func (job *StorageMigrationJob) getMigrationFiles(source FileManager) ([]migrationFile, bool) {
+	incidents, passed := incidentManager.GetIncidents(nil)
+	if !passed {
+		logManager.LogPrintln("Unable to get incidents to migrate")
+		return nil, false
+	}
+
+	versioned, isVersioned := source.(VersionedFileManager)
+	files := make([]migrationFile, 0)
+	for _, incident := range incidents {
+		incidentId := strconv.FormatInt(incident.Id, 10)
+		attachments, passed := incidentManager.GetAttachments(int(incident.Id))
+		if !passed {
+			logManager.LogPrintf("Unable to get attachments of incident %v to migrate\n", incident.Id)
+			return nil, false
+		}
+
+		for _, attachment := range attachments {
+			for _, version := range attachment.getVersions() {
+				file := migrationFile{incident: incidentId, fileName: attachment.getVersionKey(version), checksum: version.Checksum}
+				switch {
+				case len(version.StorageVersion) == 0 || !isVersioned:
+					file.load = func() (io.ReadSeeker, os.FileInfo, bool, func()) {
+						return source.LoadFile(file.incident, file.fileName)
+					}
+				case version.Version == attachment.getVersion():
+					storageVersion := version.StorageVersion
+					file.load = func() (io.ReadSeeker, os.FileInfo, bool, func()) {
+						return versioned.LoadFileVersion(file.incident, file.fileName, storageVersion)
+					}
+				default:
+					job.recordError(fmt.Sprintf("version %v of attachment %v of incident %v is kept by the file manager and cannot be migrated", version.Version, attachment.getId(), incident.Id))
+					continue
+				}
+
+				files = append(files, file)
+				for _, name := range previewGenerator.getPreviewNames(attachment, version) {
+					preview := migrationFile{incident: incidentId, fileName: name, optional: true}
+					preview.load = func() (io.ReadSeeker, os.FileInfo, bool, func()) {
+						return source.LoadFile(preview.incident, preview.fileName)
+					}
+
+					files = append(files, preview)
+				}
+			}
+		}
+	}
+
+	return files, true
+}
+
+// migrateFile copies a file to the target unless the target already has the same content.
+// A true is returned if the file was copied.
+func migrateFile(file migrationFile, target FileManager) (bool, error) {
+	reader, _, found, closer := file.load()
+	if !found {
+		if file.optional {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("file not found")
+	}
+	defer closer()
+
+	expected := file.checksum
+	if len(expected) == 0 {
+		sum, err := hashFile(reader)
+		if err != nil {
+			return false, err
+		}
+
+		if _, err := reader.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+
+		expected = sum
+	}
+
+	if sum, found := hashStoredFile(target, file.incident, file.fileName); found && sum == expected {
+		return false, nil
+	}
+
+	hash := sha256.New()
+	if _, saved := target.SaveFile(file.incident, file.fileName, io.TeeReader(reader, hash)); !saved {
+		return false, fmt.Errorf("unable to save file")
+	}
+
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != expected {
+		return true, fmt.Errorf("expected checksum %v but the source has %v", expected, sum)
+	}
+
+	if sum, found := hashStoredFile(target, file.incident, file.fileName); !found || sum != expected {
+		return true, fmt.Errorf("copy does not match the source")
+	}
+
+	return true, nil
+}
+
+// hashStoredFile returns the hex encoded SHA-256 checksum of a stored file.
+func hashStoredFile(manager FileManager, incident string, fileName string) (string, bool) {
+	file, _, found, closer := manager.LoadFile(incident, fileName)
+	if !found {
+		return "", false
+	}
+	defer closer()
+
+	sum, err := hashFile(file)
+	return sum, err == nil
+}
+
+func hashFile(file io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
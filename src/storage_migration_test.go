@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setupMigrationTest(t *testing.T) (string, Attachment) {
+	token := setupAttachmentTest(t, availablePermissions.master)
+	attachment := readUploadedAttachment(t, uploadAttachment(token, "app.log", "first run"))
+	uploadAttachmentVersion(token, attachment.Id, "app.log", "second run")
+	waitForBackgroundWork()
+	return token, attachment
+}
+
+func TestMigrateStorage(t *testing.T) {
+	token, attachment := setupMigrationTest(t)
+	target := LocalFileManager{t.TempDir()}
+
+	job := storageMigrations.NewStorageMigrationJob()
+	job.Run(fileManager, target)
+
+	if job.State != migrationCompleted || job.Copied != 4 || job.Failed != 0 {
+		t.Fatalf("Expected both versions and previews to be copied got %+v", job)
+	}
+
+	fileManager = target
+	w := downloadAttachment(token, attachment.Id, nil)
+	if w.Result().StatusCode != 200 || w.Body.String() != "second run" {
+		t.Errorf("Expected migrated attachment got %v %v", w.Result(), w.Body)
+	}
+
+	if content := readFile(t, target, "0", attachment.Id); content != "first run" {
+		t.Errorf("Unexpected first version %v", content)
+	}
+}
+
+func TestMigrateStorageResumes(t *testing.T) {
+	_, attachment := setupMigrationTest(t)
+	target := LocalFileManager{t.TempDir()}
+	storageMigrations.NewStorageMigrationJob().Run(fileManager, target)
+	target.SaveFile("0", attachment.Id, strings.NewReader("partial"))
+
+	job := storageMigrations.NewStorageMigrationJob()
+	job.Run(fileManager, target)
+
+	if job.Copied != 1 || job.Skipped != 3 || job.Failed != 0 {
+		t.Errorf("Expected only the changed file to be copied got %+v", job)
+	}
+
+	if content := readFile(t, target, "0", attachment.Id); content != "first run" {
+		t.Errorf("Unexpected content %v", content)
+	}
+}
+
+func TestMigrateStorageMissingFile(t *testing.T) {
+	_, attachment := setupMigrationTest(t)
+	fileManager.DeleteFile("0", attachment.Id)
+
+	job := storageMigrations.NewStorageMigrationJob()
+	job.Run(fileManager, LocalFileManager{t.TempDir()})
+
+	if job.State != migrationCompleted || job.Failed != 1 || len(job.Errors) != 1 {
+		t.Errorf("Expected missing file to fail got %+v", job)
+	}
+}
+
+func TestMigrateStorageHandler(t *testing.T) {
+	token, _ := setupMigrationTest(t)
+	migrationTarget = LocalFileManager{t.TempDir()}
+	t.Cleanup(func() {
+		migrationTarget = nil
+	})
+
+	r, _ := http.NewRequest("POST", "/sona/v1/storage/migrations", nil)
+	r.Header.Set("X-Sona-Token", token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 202 {
+		t.Fatalf("Expected 202 status code got %v", w.Result())
+	}
+
+	var job StorageMigrationJob
+	for i := 0; i < 100 && job.State != migrationCompleted; i++ {
+		time.Sleep(time.Millisecond * 10)
+		r, _ = http.NewRequest("GET", w.Header().Get("Location"), nil)
+		r.Header.Set("X-Sona-Token", token)
+		status := httptest.NewRecorder()
+		router.ServeHTTP(status, r)
+		json.NewDecoder(status.Body).Decode(&job)
+	}
+
+	if job.State != migrationCompleted || job.Copied != 4 {
+		t.Errorf("Expected migration to complete got %v %v", job.State, job.Errors)
+	}
+}
+
+func TestMigrateStorageWithoutTarget(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.master)
+
+	r, _ := http.NewRequest("POST", "/sona/v1/storage/migrations", nil)
+	r.Header.Set("X-Sona-Token", token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 409 {
+		t.Errorf("Expected 409 status code got %v", w.Result())
+	}
+}
@@ -1,73 +1,235 @@
 package main
 
 import (
-	b64 "encoding/base64"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
 	"strconv"
-	"strings"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	guuid "github.com/google/uuid"
 )
 
+const (
+	hs256Algorithm = "HS256"
+	eddsaAlgorithm = "EdDSA"
+)
+
+const (
+	defaultTokenExpiration        = time.Hour * 3
+	defaultRefreshTokenExpiration = time.Hour * 24 * 30
+)
+
+// refreshAudience is the audience of refresh tokens, they can only be exchanged for new tokens and are never accepted as access tokens.
+const refreshAudience = "refresh"
+
+// TokenResponse is the access token and refresh token issued to a user.
+// The Expires is when the access token expires, formatted as RFC3339.
 type TokenResponse struct {
-	Token  string `json:"token"`
-	UserId int64  `json:"userId"`
+	Token        string `json:"token"`
+	UserId       int64  `json:"userId"`
+	RefreshToken string `json:"refreshToken,omitempty"`
+	Expires      string `json:"expires,omitempty"`
 }
 
-func GenerateToken(user User) TokenResponse {
-	now := time.Now()
-	timeout := now.Add(time.Hour * time.Duration(3))
+// TokenKey is a key access tokens are signed and checked with.
+// HS256 keys are a shared secret, EdDSA keys are an ed25519 private key made from a 32 byte seed.
+type TokenKey struct {
+	Algorithm string
+	sign      interface{}
+	verify    interface{}
+}
+
+// TokenSigner signs access tokens as JWTs and checks them.
+// Tokens are signed with the Active key and name it in their kid header, other keys are kept so tokens signed before the active key changed can still be checked.
+// Tokens only identify the user, permissions are always read from the current user.
+// The Expiration is how long access tokens last and the RefreshExpiration is how long refresh tokens last.
+type TokenSigner struct {
+	Active            string
+	Keys              map[string]TokenKey
+	Expiration        time.Duration
+	RefreshExpiration time.Duration
+}
+
+var tokenSigner = NewRandomTokenSigner()
+
+// NewTokenKey creates a signing key for an algorithm.
+func NewTokenKey(algorithm string, key []byte) (TokenKey, error) {
+	switch algorithm {
+	case hs256Algorithm:
+		if len(key) < 32 {
+			return TokenKey{}, fmt.Errorf("HS256 keys must be at least 32 bytes, it is %v bytes", len(key))
+		}
+
+		return TokenKey{algorithm, key, key}, nil
+	case eddsaAlgorithm:
+		if len(key) != ed25519.SeedSize {
+			return TokenKey{}, fmt.Errorf("EdDSA keys must be a %v byte seed, it is %v bytes", ed25519.SeedSize, len(key))
+		}
+
+		private := ed25519.NewKeyFromSeed(key)
+		return TokenKey{algorithm, private, private.Public()}, nil
+	}
+
+	return TokenKey{}, fmt.Errorf("unknown token algorithm %v", algorithm)
+}
+
+// NewTokenSigner creates a signer that signs tokens with the active key.
+func NewTokenSigner(active string, keys map[string]TokenKey) (*TokenSigner, error) {
+	if _, found := keys[active]; !found {
+		return nil, fmt.Errorf("active token key %v is not defined", active)
+	}
+
+	return &TokenSigner{active, keys, defaultTokenExpiration, defaultRefreshTokenExpiration}, nil
+}
+
+// NewRandomTokenSigner creates a signer with a random HS256 key, so tokens stop working when the server restarts.
+func NewRandomTokenSigner() *TokenSigner {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+
+	key, _ := NewTokenKey(hs256Algorithm, secret)
+	return &TokenSigner{"random", map[string]TokenKey{"random": key}, defaultTokenExpiration, defaultRefreshTokenExpiration}
+}
+
+// Sign creates an access token for a user that expires at the given time.
+func (signer *TokenSigner) Sign(userId int64, expires time.Time) (string, error) {
+	return signer.sign(userId, nil, expires)
+}
+
+// SignRefresh creates a refresh token for a user that expires at the given time.
+func (signer *TokenSigner) SignRefresh(userId int64, expires time.Time) (string, error) {
+	return signer.sign(userId, jwt.ClaimStrings{refreshAudience}, expires)
+}
+
+func (signer *TokenSigner) sign(userId int64, audience jwt.ClaimStrings, expires time.Time) (string, error) {
+	key := signer.Keys[signer.Active]
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), jwt.RegisteredClaims{
+		Subject:   strconv.FormatInt(userId, 10),
+		Audience:  audience,
+		ID:        guuid.New().String(),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		ExpiresAt: jwt.NewNumericDate(expires),
+	})
+	token.Header["kid"] = signer.Active
+
+	return token.SignedString(key.sign)
+}
+
+// Parse checks the signature of a token and returns its claims.
+// The expiration is not checked so expired tokens can still be identified and removed.
+func (signer *TokenSigner) Parse(token string) (*jwt.RegisteredClaims, bool) {
+	claims := &jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(parsed *jwt.Token) (interface{}, error) {
+		kid, _ := parsed.Header["kid"].(string)
+		key, found := signer.Keys[kid]
+		if !found {
+			return nil, fmt.Errorf("unknown token key %v", kid)
+		}
+
+		if parsed.Method.Alg() != key.Algorithm {
+			return nil, fmt.Errorf("token key %v does not use %v", kid, parsed.Method.Alg())
+		}
 
-	id := guuid.New().String()
+		return key.verify, nil
+	}, jwt.WithValidMethods([]string{hs256Algorithm, eddsaAlgorithm}), jwt.WithoutClaimsValidation())
+
+	if err != nil {
+		return nil, false
+	}
+
+	return claims, true
+}
+
+// GenerateToken creates a new access token and refresh token for a user.
+func GenerateToken(user User) (TokenResponse, bool) {
+	now := time.Now()
+	timeout := now.Add(tokenSigner.Expiration)
 	logManager.LogPrintf("Token will expire at %v\n", timeout)
 
-	permissions := strings.Join(user.Permissions, ",")
-	val := strconv.FormatInt(user.Id, 10) + ":" + id + ":" + strconv.FormatInt(timeout.UnixNano(), 10) + ":" + permissions
-	return TokenResponse{b64.StdEncoding.EncodeToString([]byte(val)), user.Id}
+	token, err := tokenSigner.Sign(user.Id, timeout)
+	if err != nil {
+		logManager.LogPrintf("Unable to sign token %v\n", err)
+		return TokenResponse{UserId: user.Id}, false
+	}
+
+	refresh, err := tokenSigner.SignRefresh(user.Id, now.Add(tokenSigner.RefreshExpiration))
+	if err != nil {
+		logManager.LogPrintf("Unable to sign refresh token %v\n", err)
+		return TokenResponse{UserId: user.Id}, false
+	}
+
+	return TokenResponse{token, user.Id, refresh, timeout.Format(time.RFC3339)}, true
 }
 
+// GetTokenUser returns the user an access token belongs to, or -1 if it is not a valid access token.
 func GetTokenUser(token string) int64 {
-	decoded, _ := b64.StdEncoding.DecodeString(token)
-	vals := strings.Split(string(decoded), ":")
-
-	if len(vals) < 4 {
+	claims, valid := tokenSigner.Parse(token)
+	if !valid || isRefreshToken(claims) {
 		return -1
 	}
 
-	retVal, _ := strconv.ParseInt(vals[0], 10, 64)
-
-	return retVal
+	return getClaimsUser(claims)
 }
 
-func TokenExpired(token string) bool {
-	decoded, _ := b64.StdEncoding.DecodeString(token)
-	vals := strings.Split(string(decoded), ":")
+// GetRefreshTokenUser returns the user a refresh token belongs to, or -1 if it is not a valid refresh token or it has expired.
+func GetRefreshTokenUser(token string) int64 {
+	claims, valid := tokenSigner.Parse(token)
+	if !valid || !isRefreshToken(claims) || claims.ExpiresAt == nil || claims.ExpiresAt.Before(time.Now()) {
+		return -1
+	}
 
-	if len(vals) < 4 {
-		return false
+	return getClaimsUser(claims)
+}
+
+func isRefreshToken(claims *jwt.RegisteredClaims) bool {
+	for _, audience := range claims.Audience {
+		if audience == refreshAudience {
+			return true
+		}
 	}
 
-	timestamp, err := strconv.ParseInt(vals[2], 10, 64)
+	return false
+}
 
+func getClaimsUser(claims *jwt.RegisteredClaims) int64 {
+	retVal, err := strconv.ParseInt(claims.Subject, 10, 64)
 	if err != nil {
-		logManager.LogFatal(err)
+		return -1
+	}
+
+	return retVal
+}
+
+func TokenExpired(token string) bool {
+	claims, valid := tokenSigner.Parse(token)
+	if !valid || claims.ExpiresAt == nil {
 		return false
 	}
 
-	return timestamp < time.Now().UnixNano()
+	return claims.ExpiresAt.Before(time.Now())
 }
 
+// HasPermission checks the current permissions of the user a token belongs to.
 func HasPermission(token string, permission string) bool {
-	decoded, _ := b64.StdEncoding.DecodeString(token)
-	vals := strings.Split(string(decoded), ":")
+	return userHasPermission(GetTokenUser(token), permission)
+}
 
-	if len(vals) < 4 {
+// userHasPermission checks the current permissions of a user.
+func userHasPermission(userId int64, permission string) bool {
+	if userId < 0 {
 		return false
 	}
 
-	permissions := strings.Split(vals[3], ",")
+	user, found := userManager.GetUser(userId)
+	if !found {
+		return false
+	}
 
-	for _, p := range permissions {
+	for _, p := range user.Permissions {
 		if p == permission || p == availablePermissions.master {
 			return true
 		}
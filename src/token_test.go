@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	b64 "encoding/base64"
+	"testing"
+	"time"
+)
+
+func createTestTokenSigner(t *testing.T, active string, ids ...string) *TokenSigner {
+	keys := make(map[string]TokenKey)
+	for _, id := range ids {
+		algorithm := hs256Algorithm
+		if id == "ed" {
+			algorithm = eddsaAlgorithm
+		}
+
+		key, err := NewTokenKey(algorithm, bytes.Repeat([]byte(id[:1]), 32))
+		if err != nil {
+			t.Fatalf("Unable to create key %v", err)
+		}
+
+		keys[id] = key
+	}
+
+	signer, err := NewTokenSigner(active, keys)
+	if err != nil {
+		t.Fatalf("Unable to create signer %v", err)
+	}
+
+	return signer
+}
+
+func TestTokenIdentifiesUser(t *testing.T) {
+	for _, algorithm := range []string{"hs", "ed"} {
+		tokenSigner = createTestTokenSigner(t, algorithm, algorithm)
+		token, err := tokenSigner.Sign(7, time.Now().Add(time.Hour))
+
+		if err != nil || GetTokenUser(token) != 7 || TokenExpired(token) {
+			t.Errorf("Expected %v token for user 7 got %v %v", algorithm, GetTokenUser(token), err)
+		}
+	}
+
+	tokenSigner = NewRandomTokenSigner()
+}
+
+func TestTokenExpired(t *testing.T) {
+	token, _ := tokenSigner.Sign(7, time.Now().Add(-time.Minute))
+
+	if !TokenExpired(token) || GetTokenUser(token) != 7 {
+		t.Errorf("Expected expired token for user 7")
+	}
+}
+
+func TestForgedTokensRejected(t *testing.T) {
+	other, _ := createTestTokenSigner(t, "hs", "hs").Sign(0, time.Now().Add(time.Hour))
+	legacy := b64.StdEncoding.EncodeToString([]byte("0:id:9999999999999999999:*"))
+	unsigned := "eyJhbGciOiJub25lIiwidHlwIjoiSldUIn0.eyJzdWIiOiIwIn0."
+
+	for _, token := range []string{other, legacy, unsigned, ""} {
+		if GetTokenUser(token) != -1 {
+			t.Errorf("Expected token %v to be rejected", token)
+		}
+	}
+}
+
+func TestTokenKeyRotation(t *testing.T) {
+	defer func() {
+		tokenSigner = NewRandomTokenSigner()
+	}()
+
+	tokenSigner = createTestTokenSigner(t, "old", "old")
+	token, _ := tokenSigner.Sign(3, time.Now().Add(time.Hour))
+
+	tokenSigner = createTestTokenSigner(t, "new", "old", "new")
+	if GetTokenUser(token) != 3 {
+		t.Errorf("Expected token signed with the old key to be accepted")
+	}
+
+	tokenSigner = createTestTokenSigner(t, "new", "new")
+	if GetTokenUser(token) != -1 {
+		t.Errorf("Expected token signed with a removed key to be rejected")
+	}
+}
+
+func TestTokenAlgorithmMustMatchKey(t *testing.T) {
+	defer func() {
+		tokenSigner = NewRandomTokenSigner()
+	}()
+
+	signer := createTestTokenSigner(t, "ed", "ed")
+	public := []byte(signer.Keys["ed"].verify.(ed25519.PublicKey))
+	token, err := (&TokenSigner{Active: "ed", Keys: map[string]TokenKey{"ed": {hs256Algorithm, public, public}}}).Sign(0, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Unable to sign token %v", err)
+	}
+
+	tokenSigner = signer
+	if GetTokenUser(token) != -1 {
+		t.Errorf("Expected token using the wrong algorithm to be rejected")
+	}
+}
+
+func TestPermissionsReadFromCurrentUser(t *testing.T) {
+	setup()
+	userManager.SetPermissions(user1.Id, []string{availablePermissions.viewIncident})
+	_, token := user1.Authenticate("1234")
+
+	if !HasPermission(token.Token, availablePermissions.viewIncident) {
+		t.Fatalf("Expected permission to be granted")
+	}
+
+	userManager.SetPermissions(user1.Id, []string{})
+	if HasPermission(token.Token, availablePermissions.viewIncident) {
+		t.Errorf("Expected removed permission to be denied")
+	}
+
+	userManager.SetPermissions(user1.Id, []string{availablePermissions.master})
+	if !HasPermission(token.Token, availablePermissions.modifyUser) {
+		t.Errorf("Expected master permission to grant everything")
+	}
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	b64 "encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// transferVersion is the version of the archive format written by an export.
+const transferVersion = 1
+
+const (
+	manifestEntry    = "manifest.json"
+	usersEntry       = "users.ndjson"
+	incidentsEntry   = "incidents.ndjson"
+	attachmentsEntry = "attachments.ndjson"
+	attachmentsDir   = "attachments"
+)
+
+const (
+	tarArchive   = "tar"
+	tarGzArchive = "tar.gz"
+	zipArchive   = "zip"
+)
+
+// TransferManifest describes the content of an export archive.
+type TransferManifest struct {
+	Version        int           `json:"version"`           // The version of the archive format.
+	Created        string        `json:"created"`           // The time the archive was created.
+	Users          int           `json:"users"`             // The number of users in the archive.
+	Incidents      int           `json:"incidents"`         // The number of incidents in the archive.
+	Attachments    int           `json:"attachments"`       // The number of attachments in the archive.
+	PasswordHashes bool          `json:"passwordHashes"`    // If the users include their password hashes.
+	Missing        []MissingFile `json:"missing,omitempty"` // The attachment versions left out of the archive because they were quarantined or could not be loaded.
+}
+
+// TransferUser is a user as it is written to an export archive.
+type TransferUser struct {
+	User
+	PasswordHash string `json:"passwordHash,omitempty"` // The base64 encoded password hash.
+}
+
+// TransferAttachment is the metadata of an attachment as it is written to an export archive.
+type TransferAttachment struct {
+	IncidentId int64 `json:"incidentId"` // The incident the attachment belongs to.
+	Attachment
+	Path string `json:"path"` // The location of the attachment content in the archive.
+}
+
+// getVersionPath returns the location of a version of the attachment in the archive.
+// The current version is always at Path and previous versions are next to it with the version number appended.
+func (attachment TransferAttachment) getVersionPath(version AttachmentVersion) string {
+	if version.Version == attachment.getVersion() {
+		return attachment.Path
+	}
+
+	return fmt.Sprintf("%v.v%v", attachment.Path, version.Version)
+}
+
+// archiveWriter writes entries to an export archive.
+type archiveWriter interface {
+	WriteEntry(name string, size int64, content io.Reader) error
+	Close() error
+}
+
+type tarArchiveWriter struct {
+	gzip   *gzip.Writer
+	writer *tar.Writer
+}
+
+func (a *tarArchiveWriter) WriteEntry(name string, size int64, content io.Reader) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	}
+
+	if err := a.writer.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err := io.CopyN(a.writer, content, size)
+	return err
+}
+
+func (a *tarArchiveWriter) Close() error {
+	if err := a.writer.Close(); err != nil {
+		return err
+	}
+
+	if a.gzip != nil {
+		return a.gzip.Close()
+	}
+
+	return nil
+}
+
+type zipArchiveWriter struct {
+	writer *zip.Writer
+}
+
+func (a *zipArchiveWriter) WriteEntry(name string, size int64, content io.Reader) error {
+	entry, err := a.writer.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(entry, content)
+	return err
+}
+
+func (a *zipArchiveWriter) Close() error {
+	return a.writer.Close()
+}
+
+func newArchiveWriter(format string, w io.Writer) archiveWriter {
+	switch format {
+	case zipArchive:
+		return &zipArchiveWriter{zip.NewWriter(w)}
+	case tarGzArchive:
+		compressed := gzip.NewWriter(w)
+		return &tarArchiveWriter{compressed, tar.NewWriter(compressed)}
+	}
+
+	return &tarArchiveWriter{nil, tar.NewWriter(w)}
+}
+
+// exportArchive writes users, incidents and attachments to an archive.
+// Only the incidents matching the filter, and their attachments, are written.
+// Password hashes are only written when includePasswords is set.
+// The attachment versions that are quarantined or whose content could not be loaded are left out of the archive, listed in the manifest and returned.
+func exportArchive(archive archiveWriter, filter *FilterRequest, includePasswords bool) ([]MissingFile, error) {
+	users, passed := userManager.GetUsers()
+	if !passed {
+		return nil, fmt.Errorf("unable to get users")
+	}
+
+	incidents, passed := incidentManager.GetIncidents(filter)
+	if !passed {
+		return nil, fmt.Errorf("unable to get incidents")
+	}
+
+	var userData, incidentData, attachmentData bytes.Buffer
+	userEncoder := json.NewEncoder(&userData)
+	for _, user := range users {
+		transfer := TransferUser{User: user}
+		if includePasswords {
+			if hash, found := userManager.GetPasswordHash(user); found {
+				transfer.PasswordHash = b64.StdEncoding.EncodeToString([]byte(hash))
+			}
+		}
+
+		if err := userEncoder.Encode(transfer); err != nil {
+			return nil, err
+		}
+	}
+
+	attachments := make([]TransferAttachment, 0)
+	incidentEncoder := json.NewEncoder(&incidentData)
+	attachmentEncoder := json.NewEncoder(&attachmentData)
+	for _, incident := range incidents {
+		if err := incidentEncoder.Encode(incident); err != nil {
+			return nil, err
+		}
+
+		attached, _ := incidentManager.GetAttachments(int(incident.Id))
+		for _, attachment := range attached {
+			attachment.Id = attachment.getId()
+			transfer := TransferAttachment{
+				incident.Id,
+				attachment,
+				path.Join(attachmentsDir, strconv.FormatInt(incident.Id, 10), attachment.Id),
+			}
+
+			if err := attachmentEncoder.Encode(transfer); err != nil {
+				return nil, err
+			}
+			attachments = append(attachments, transfer)
+		}
+	}
+
+	entries := []struct {
+		name string
+		data []byte
+	}{
+		{usersEntry, userData.Bytes()},
+		{incidentsEntry, incidentData.Bytes()},
+		{attachmentsEntry, attachmentData.Bytes()},
+	}
+
+	for _, entry := range entries {
+		if err := archive.WriteEntry(entry.name, int64(len(entry.data)), bytes.NewReader(entry.data)); err != nil {
+			return nil, err
+		}
+	}
+
+	missing := make([]MissingFile, 0)
+	for _, attachment := range attachments {
+		notLoaded, err := exportAttachment(archive, attachment)
+		if err != nil {
+			return nil, err
+		}
+		missing = append(missing, notLoaded...)
+	}
+
+	// The manifest is written last so it can list the attachment versions that could not be loaded.
+	manifest, err := json.Marshal(TransferManifest{
+		transferVersion,
+		time.Now().Format(time.RFC3339),
+		len(users),
+		len(incidents),
+		len(attachments),
+		includePasswords,
+		missing,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := archive.WriteEntry(manifestEntry, int64(len(manifest)), bytes.NewReader(manifest)); err != nil {
+		return nil, err
+	}
+
+	return missing, archive.Close()
+}
+
+// exportAttachment writes every version of an attachment to an archive.
+// Versions that have not been found to be clean by the scanner are not exported, so they cannot be downloaded through an export.
+func exportAttachment(archive archiveWriter, attachment TransferAttachment) ([]MissingFile, error) {
+	missing := make([]MissingFile, 0)
+	for _, version := range attachment.getVersions() {
+		if version.isQuarantined() {
+			missing = append(missing, MissingFile{attachment.IncidentId, attachment.Id, version.Version, version.getQuarantineProblem().Detail})
+			continue
+		}
+
+		written, err := writeAttachmentVersionEntry(archive, attachment.IncidentId, attachment.Attachment, version, attachment.getVersionPath(version))
+		if err != nil {
+			return nil, err
+		}
+
+		if !written {
+			missing = append(missing, MissingFile{attachment.IncidentId, attachment.Id, version.Version, "The file could not be loaded."})
+		}
+	}
+
+	return missing, nil
+}
+
+// writeAttachmentVersionEntry streams the content of a version of an attachment into an archive.
+// A false is returned without writing anything if the content could not be loaded.
+func writeAttachmentVersionEntry(archive archiveWriter, incidentId int64, attachment Attachment, version AttachmentVersion, path string) (bool, error) {
+	file, _, passed, closer := loadAttachmentVersion(incidentId, attachment, version)
+	if closer != nil {
+		defer closer()
+	}
+
+	if !passed || file == nil {
+		logManager.LogPrintf("Unable to load attachment %v version %v for incident %v\n", attachment.FileName, version.Version, incidentId)
+		return false, nil
+	}
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	return true, archive.WriteEntry(path, size, file)
+}
+
+// importArchive provides access to the entries of an uploaded archive.
+type importArchive interface {
+	Open(name string) (io.ReadCloser, error)
+	Close() error
+}
+
+type zipImportArchive struct {
+	reader *zip.ReadCloser
+	files  map[string]*zip.File
+}
+
+func (a *zipImportArchive) Open(name string) (io.ReadCloser, error) {
+	file, ok := a.files[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return file.Open()
+}
+
+func (a *zipImportArchive) Close() error {
+	return a.reader.Close()
+}
+
+// dirImportArchive is a tar archive that has been extracted into a directory.
+type dirImportArchive struct {
+	root string
+}
+
+func (a *dirImportArchive) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(a.root, filepath.FromSlash(name)))
+}
+
+func (a *dirImportArchive) Close() error {
+	return os.RemoveAll(a.root)
+}
+
+// uploadedImportArchive owns the uploaded file an archive was opened from.
+// The file is removed once the archive is closed, since zip archives are read from it until the import is done.
+type uploadedImportArchive struct {
+	importArchive
+	file string
+}
+
+func (a *uploadedImportArchive) Close() error {
+	err := a.importArchive.Close()
+	if removeErr := os.Remove(a.file); err == nil && !os.IsNotExist(removeErr) {
+		err = removeErr
+	}
+
+	return err
+}
+
+// openImportArchive opens a zip, tar or gzipped tar archive.
+// The archive type is found from the content of the file instead of its name.
+func openImportArchive(file string) (importArchive, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	magic, _ := reader.Peek(4)
+
+	if bytes.Equal(magic, []byte("PK\x03\x04")) {
+		zipReader, err := zip.OpenReader(file)
+		if err != nil {
+			return nil, err
+		}
+
+		files := make(map[string]*zip.File, len(zipReader.File))
+		for _, entry := range zipReader.File {
+			files[path.Clean(entry.Name)] = entry
+		}
+
+		return &zipImportArchive{zipReader, files}, nil
+	}
+
+	var content io.Reader = reader
+	if len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		compressed, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer compressed.Close()
+		content = compressed
+	}
+
+	return extractTarArchive(content)
+}
+
+func extractTarArchive(content io.Reader) (importArchive, error) {
+	root, err := os.MkdirTemp("", "sona-import")
+	if err != nil {
+		return nil, err
+	}
+
+	archive := &dirImportArchive{root}
+	reader := tar.NewReader(content)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			archive.Close()
+			return nil, err
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Clean(header.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			archive.Close()
+			return nil, fmt.Errorf("invalid archive entry %v", header.Name)
+		}
+
+		target := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+			archive.Close()
+			return nil, err
+		}
+
+		f, err := os.Create(target)
+		if err != nil {
+			archive.Close()
+			return nil, err
+		}
+
+		_, err = io.Copy(f, reader)
+		f.Close()
+		if err != nil {
+			archive.Close()
+			return nil, err
+		}
+	}
+
+	return archive, nil
+}
+
+// readImportEntry decodes each json line of an archive entry.
+// A missing entry is treated as an empty one.
+func readImportEntry(archive importArchive, name string, handle func(decoder *json.Decoder) error) error {
+	entry, err := archive.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	defer entry.Close()
+
+	decoder := json.NewDecoder(entry)
+	for decoder.More() {
+		if err := handle(decoder); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// exportMissingTrailer is the trailer holding the number of attachment versions left out of an export because they were quarantined or could not be loaded.
+const exportMissingTrailer = "X-Sona-Missing-Files"
+
+// HandleExport handles the export web request.
+// The archive is streamed to the client as it is written.
+func HandleExport(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got Export request")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if !validateRequest(w, r, availablePermissions.master) {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if len(format) == 0 {
+		format = tarArchive
+	}
+
+	contentType := getArchiveContentType(format)
+	if len(contentType) == 0 {
+		logManager.LogPrintf("Unsupported export format %v\n", format)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	filter, passed := convertFilter(r)
+	if !passed {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	includePasswords := r.URL.Query().Get("passwords") == "true"
+	fileName := fmt.Sprintf("sona-export-%v.%v", time.Now().UTC().Format("20060102T150405Z"), format)
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%v\"", fileName))
+	w.Header().Set("Trailer", exportMissingTrailer)
+	w.WriteHeader(http.StatusOK)
+
+	missing, err := exportArchive(newArchiveWriter(format, w), filter, includePasswords)
+	if err != nil {
+		logManager.LogPrintf("Export failed %v\n", err)
+		return
+	}
+
+	if len(missing) > 0 {
+		logManager.LogPrintf("Export is missing %v attachment versions %v\n", len(missing), missing)
+	}
+
+	w.Header().Set(exportMissingTrailer, strconv.Itoa(len(missing)))
+}
+
+// HandleGetAttachmentArchive handles the download all attachments web request.
+// The archive is streamed to the client as each attachment is read from the file manager.
+func HandleGetAttachmentArchive(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got attachment archive request")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if !validateRequest(w, r, availablePermissions.viewIncident) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	incidentId, err := strconv.Atoi(vars["incidentId"])
+	if err != nil {
+		logManager.LogPrintf("Error converting incidentId %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	format := negotiateArchiveFormat(r)
+	if len(format) == 0 {
+		logManager.LogPrintf("Unable to provide attachments as %v\n", r.Header.Get("Accept"))
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+
+	incident, found := incidentManager.GetIncident(incidentId)
+	if !found {
+		logManager.LogPrintf("Got invalid attachment archive request for %v.\n", incidentId)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	attachments, passed := incidentManager.GetAttachments(incidentId)
+	if !passed {
+		logManager.LogPrintf("Unable to get attachments for incident %v.\n", incidentId)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	fileName := fmt.Sprintf("incident-%v-attachments.%v", incidentId, format)
+
+	w.Header().Set("Content-Type", getArchiveContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%v\"", fileName))
+	w.Header().Set("Vary", "Accept")
+	w.WriteHeader(http.StatusOK)
+
+	if err := writeIncidentArchive(newArchiveWriter(format, w), incident, attachments); err != nil {
+		logManager.LogPrintf("Attachment archive of incident %v failed %v\n", incidentId, err)
+	}
+}
+
+func getArchiveContentType(format string) string {
+	switch format {
+	case tarArchive:
+		return "application/x-tar"
+	case tarGzArchive:
+		return "application/gzip"
+	case zipArchive:
+		return "application/zip"
+	}
+
+	return ""
+}
+
+// HandleImport handles the import web request.
+// The archive is stored before the import is started in the background.
+func HandleImport(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got Import request")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	if !validateRequest(w, r, availablePermissions.master) {
+		return
+	}
+
+	conflict := r.URL.Query().Get("conflict")
+	if len(conflict) == 0 {
+		conflict = conflictSkip
+	}
+
+	if conflict != conflictSkip && conflict != conflictOverwrite && conflict != conflictFail {
+		logManager.LogPrintf("Invalid conflict policy %v\n", conflict)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	upload, err := os.CreateTemp("", "sona-import-*")
+	if err != nil {
+		logManager.LogPrintf("Unable to store import %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = io.Copy(upload, r.Body)
+	upload.Close()
+	if err != nil {
+		logManager.LogPrintf("Unable to store import %v\n", err)
+		os.Remove(upload.Name())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	archive, err := openImportArchive(upload.Name())
+	if err != nil {
+		logManager.LogPrintf("Invalid import archive %v\n", err)
+		os.Remove(upload.Name())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// The job owns the upload from here and removes it once the import is done.
+	job := importJobs.NewImportJob(conflict)
+	go job.Run(&uploadedImportArchive{archive, upload.Name()})
+
+	data, err := job.Status()
+	if err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("Location", "/sona/v1/import/"+job.Id)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(data)
+}
+
+// HandleGetImport handles the get import status web request.
+func HandleGetImport(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got Import status request")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	if !validateRequest(w, r, availablePermissions.master) {
+		return
+	}
+
+	job, found := importJobs.GetImportJob(mux.Vars(r)["jobId"])
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	data, err := job.Status()
+	if err != nil {
+		panic(err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
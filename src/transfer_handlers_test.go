@@ -0,0 +1,333 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func runExport(t *testing.T, token string, query string) []byte {
+	r, _ := http.NewRequest("GET", "/sona/v1/export"+query, nil)
+	r.Header.Set("X-Sona-Token", token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 200 {
+		t.Fatalf("Expected 200 status code got %v", w.Result())
+	}
+
+	return w.Body.Bytes()
+}
+
+func runImport(t *testing.T, token string, archive []byte) *ImportJob {
+	r, _ := http.NewRequest("POST", "/sona/v1/import", bytes.NewBuffer(archive))
+	r.Header.Set("X-Sona-Token", token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 202 {
+		t.Fatalf("Expected 202 status code got %v", w.Result())
+	}
+
+	location := w.Result().Header.Get("Location")
+	for i := 0; i < 100; i++ {
+		r, _ = http.NewRequest("GET", location, nil)
+		r.Header.Set("X-Sona-Token", token)
+		w = httptest.NewRecorder()
+
+		router.ServeHTTP(w, r)
+
+		job := new(ImportJob)
+		if err := json.Unmarshal(w.Body.Bytes(), job); err != nil {
+			t.Fatalf("Failed to convert response %v error %v", w.Body, err)
+		}
+
+		if job.State == importCompleted || job.State == importFailed {
+			return job
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("Import did not finish")
+	return nil
+}
+
+func TestExportAndImport(t *testing.T) {
+	for _, format := range []string{tarArchive, tarGzArchive, zipArchive} {
+		setup()
+		fileManager = LocalFileManager{t.TempDir()}
+		user1.Permissions = append(user1.Permissions, availablePermissions.master)
+		userManager.SetPermissions(user1.Id, user1.Permissions)
+		_, other := userManager.AddUser(&AddUser{EmailAddress: "d@e.f", UserName: "Other", Password: "5678"})
+
+		attributes := make(map[string]string, 0)
+		attributes["assignee"] = "1"
+		incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", attributes})
+		attached, _ := attachFile(0, "notes.txt", strings.NewReader("some notes"), "", 0)
+		attachFileVersion(0, attached, "notes.txt", strings.NewReader("more notes"), "", 0)
+		_, token := user1.Authenticate("1234")
+
+		archive := runExport(t, token.Token, "?passwords=true&format="+format)
+
+		setup()
+		fileManager = LocalFileManager{t.TempDir()}
+		user1.Permissions = append(user1.Permissions, availablePermissions.master)
+		userManager.SetPermissions(user1.Id, user1.Permissions)
+		incidentManager.AddIncident(&Incident{"Incident", 0, "Existing", "Tester", "open", make(map[string]string, 0)})
+		_, token = user1.Authenticate("1234")
+
+		job := runImport(t, token.Token, archive)
+
+		if job.State != importCompleted {
+			t.Fatalf("Expected %v import to complete got %v", format, job)
+		}
+
+		if job.Users.Skipped != 1 || job.Users.Created != 1 || job.Incidents.Created != 1 || job.Attachments.Created != 1 {
+			t.Errorf("Unexpected %v import counts %v", format, job)
+		}
+
+		if job.IncidentIds["0"] != 1 {
+			t.Errorf("Expected incident 0 to be imported as 1 got %v", job.IncidentIds)
+		}
+
+		imported, found := userManager.GetUserByEmail(other.EmailAddress)
+		if !found {
+			t.Fatalf("Expected user %v to be imported", other.EmailAddress)
+		}
+
+		if passed, _ := imported.Authenticate("5678"); !passed {
+			t.Errorf("Expected imported user to keep their password")
+		}
+
+		inc, _ := incidentManager.GetIncident(1)
+		if inc.Description != "Test" || inc.Attributes["assignee"] != "1" {
+			t.Errorf("Unexpected imported incident %v", inc)
+		}
+
+		attachments, _ := incidentManager.GetAttachments(1)
+		if len(attachments) != 1 || attachments[0].FileName != "notes.txt" {
+			t.Fatalf("Expected attachment to be imported got %v", attachments)
+		}
+
+		file, _, passed, closer := fileManager.LoadFile("1", attachments[0].Id)
+		if !passed {
+			t.Fatalf("Expected attachment to be imported")
+		}
+
+		content, _ := io.ReadAll(file)
+		closer()
+		if string(content) != "some notes" {
+			t.Errorf("Expected attachment content got %v", string(content))
+		}
+
+		if attachments[0].Version != 2 || len(attachments[0].Versions) != 1 {
+			t.Fatalf("Expected attachment versions to be imported got %v", attachments[0])
+		}
+
+		file, _, _, closer = loadAttachmentVersion(1, attachments[0], attachments[0].getCurrentVersion())
+		content, _ = io.ReadAll(file)
+		closer()
+		if string(content) != "more notes" {
+			t.Errorf("Expected current attachment content got %v", string(content))
+		}
+	}
+}
+
+func TestExportWithMissingAttachment(t *testing.T) {
+	setup()
+	root := t.TempDir()
+	fileManager = LocalFileManager{root}
+	user1.Permissions = append(user1.Permissions, availablePermissions.master)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
+	attached, _ := attachFile(0, "notes.txt", strings.NewReader("some notes"), "", 0)
+	_, token := user1.Authenticate("1234")
+
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			os.Remove(path)
+		}
+		return nil
+	})
+
+	r, _ := http.NewRequest("GET", "/sona/v1/export?format=zip", nil)
+	r.Header.Set("X-Sona-Token", token.Token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().Trailer.Get(exportMissingTrailer) != "1" {
+		t.Errorf("Expected the missing attachment to be reported got %v", w.Result().Trailer)
+	}
+
+	archive := w.Body.Bytes()
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("Expected a complete archive got %v", err)
+	}
+
+	var manifest TransferManifest
+	for _, file := range reader.File {
+		if strings.HasPrefix(file.Name, attachmentsDir+"/") {
+			t.Errorf("Expected missing attachment to be left out got %v", file.Name)
+		}
+
+		if file.Name == manifestEntry {
+			entry, _ := file.Open()
+			json.NewDecoder(entry).Decode(&manifest)
+			entry.Close()
+		}
+	}
+
+	if len(manifest.Missing) != 1 || manifest.Missing[0].AttachmentId != attached.Id || manifest.Missing[0].IncidentId != 0 {
+		t.Errorf("Expected manifest to list the missing attachment got %v", manifest)
+	}
+
+	job := runImport(t, token.Token, archive)
+	if job.State != importCompleted || job.Attachments.Failed != 1 || job.Attachments.Created != 0 {
+		t.Errorf("Expected missing attachment to fail to import got %v", job)
+	}
+}
+
+func TestExportWithInfectedAttachment(t *testing.T) {
+	setup()
+	fileManager = LocalFileManager{t.TempDir()}
+	user1.Permissions = append(user1.Permissions, availablePermissions.master)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	incidentManager.AddIncident(&Incident{"Incident", 0, "Test", "Tester", "open", make(map[string]string, 0)})
+	attached, _ := attachFile(0, "notes.txt", strings.NewReader("some notes"), "", 0)
+	attached, _ = attachFileVersion(0, attached, "notes.txt", strings.NewReader("infected notes"), "", 0)
+	infected := attached.getCurrentVersion()
+	infected.ScanStatus = scanInfected
+	infected.ScanSignature = "Eicar-Test-Signature"
+	attached.updateVersion(infected)
+	incidentManager.UpdateAttachment(0, attached)
+	_, token := user1.Authenticate("1234")
+
+	archive := runExport(t, token.Token, "?format=zip")
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("Expected a complete archive got %v", err)
+	}
+
+	var manifest TransferManifest
+	attachments := make([]string, 0)
+	for _, file := range reader.File {
+		if strings.HasPrefix(file.Name, attachmentsDir+"/") {
+			attachments = append(attachments, file.Name)
+		}
+
+		if file.Name == manifestEntry {
+			entry, _ := file.Open()
+			json.NewDecoder(entry).Decode(&manifest)
+			entry.Close()
+		}
+	}
+
+	if len(attachments) != 1 || !strings.HasSuffix(attachments[0], ".v1") {
+		t.Errorf("Expected only the clean version to be exported got %v", attachments)
+	}
+
+	if len(manifest.Missing) != 1 || manifest.Missing[0].Version != 2 || !strings.Contains(manifest.Missing[0].Reason, "Eicar-Test-Signature") {
+		t.Errorf("Expected manifest to list the infected version got %v", manifest)
+	}
+}
+
+func TestImportRemovesUpload(t *testing.T) {
+	setup()
+	user1.Permissions = append(user1.Permissions, availablePermissions.master)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	_, token := user1.Authenticate("1234")
+	archive := runExport(t, token.Token, "?format=zip")
+
+	t.Setenv("TMPDIR", t.TempDir())
+	job := runImport(t, token.Token, archive)
+	if job.State != importCompleted {
+		t.Fatalf("Expected import to complete got %v", job)
+	}
+
+	for i := 0; i < 100; i++ {
+		uploads, _ := filepath.Glob(filepath.Join(os.TempDir(), "sona-import-*"))
+		if len(uploads) == 0 {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("Expected the uploaded archive to be removed once the import finished")
+}
+
+func TestExportWithoutPasswords(t *testing.T) {
+	setup()
+	user1.Permissions = append(user1.Permissions, availablePermissions.master)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	_, token := user1.Authenticate("1234")
+
+	archive := runExport(t, token.Token, "?format=tar")
+
+	if bytes.Contains(archive, []byte("\"passwordHash\":")) {
+		t.Errorf("Expected export to not contain password hashes")
+	}
+}
+
+func TestExportWithInvalidPermissions(t *testing.T) {
+	setup()
+	_, token := user1.Authenticate("1234")
+
+	r, _ := http.NewRequest("GET", "/sona/v1/export", nil)
+	r.Header.Set("X-Sona-Token", token.Token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 401 {
+		t.Errorf("Expected 401 status code got %v", w.Result())
+	}
+}
+
+func TestImportWithInvalidConflictPolicy(t *testing.T) {
+	setup()
+	user1.Permissions = append(user1.Permissions, availablePermissions.master)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	_, token := user1.Authenticate("1234")
+
+	r, _ := http.NewRequest("POST", "/sona/v1/import?conflict=merge", bytes.NewBuffer(nil))
+	r.Header.Set("X-Sona-Token", token.Token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 400 {
+		t.Errorf("Expected 400 status code got %v", w.Result())
+	}
+}
+
+func TestGetImportWithUnknownId(t *testing.T) {
+	setup()
+	user1.Permissions = append(user1.Permissions, availablePermissions.master)
+	userManager.SetPermissions(user1.Id, user1.Permissions)
+	_, token := user1.Authenticate("1234")
+
+	r, _ := http.NewRequest("GET", "/sona/v1/import/unknown", nil)
+	r.Header.Set("X-Sona-Token", token.Token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 404 {
+		t.Errorf("Expected 404 status code got %v", w.Result())
+	}
+}
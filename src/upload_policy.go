@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	problemFileTooLarge          = "urn:sona:problem:file-too-large"
+	problemIncidentQuotaExceeded = "urn:sona:problem:incident-quota-exceeded"
+	problemUserQuotaExceeded     = "urn:sona:problem:user-quota-exceeded"
+	problemTypeNotAllowed        = "urn:sona:problem:type-not-allowed"
+)
+
+// ProblemDetails describes why a request was rejected in the format of RFC 7807.
+// The Limit and Usage are set when a size limit or quota was exceeded.
+type ProblemDetails struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Limit  int64  `json:"limit,omitempty"`
+	Usage  int64  `json:"usage,omitempty"`
+}
+
+// writeProblem responds with the details of a problem.
+func writeProblem(w http.ResponseWriter, problem *ProblemDetails) {
+	logManager.LogPrintf("Rejected request %v: %v\n", problem.Type, problem.Detail)
+
+	data, err := json.Marshal(problem)
+	if err != nil {
+		w.WriteHeader(problem.Status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(problem.Status)
+	w.Write(data)
+}
+
+// UploadPolicy defines the attachments that can be uploaded.
+// A size of 0 is not limited.
+// Types are MIME types detected from the content of a file, a type like image/* matches every image type.
+// Extensions are matched against the name of a file.
+// If any types or extensions are allowed anything else is denied.
+type UploadPolicy struct {
+	MaxFileSize       int64
+	MaxIncidentSize   int64
+	MaxUserSize       int64
+	AllowedTypes      []string
+	DeniedTypes       []string
+	AllowedExtensions []string
+	DeniedExtensions  []string
+}
+
+var uploadPolicy UploadPolicy
+
+// NewUploadPolicy creates the upload policy from the upload configuration.
+func NewUploadPolicy(config UploadConfig) UploadPolicy {
+	return UploadPolicy{
+		MaxFileSize:       config.MaxFileSize,
+		MaxIncidentSize:   config.MaxIncidentSize,
+		MaxUserSize:       config.MaxUserSize,
+		AllowedTypes:      normalizePolicyValues(config.AllowedTypes, ""),
+		DeniedTypes:       normalizePolicyValues(config.DeniedTypes, ""),
+		AllowedExtensions: normalizePolicyValues(config.AllowedExtensions, "."),
+		DeniedExtensions:  normalizePolicyValues(config.DeniedExtensions, "."),
+	}
+}
+
+func normalizePolicyValues(values []string, prefix string) []string {
+	normalized := make([]string, 0, len(values))
+	for _, value := range values {
+		value = strings.ToLower(strings.TrimSpace(value))
+		if len(value) == 0 {
+			continue
+		}
+
+		if !strings.HasPrefix(value, prefix) {
+			value = prefix + value
+		}
+
+		normalized = append(normalized, value)
+	}
+
+	return normalized
+}
+
+// matchesContentType checks a content type against types like image/png, image/* or */*.
+// Parameters such as the charset are ignored.
+func matchesContentType(patterns []string, contentType string) bool {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	}
+
+	contentType = strings.ToLower(contentType)
+	for _, pattern := range patterns {
+		if pattern == contentType || pattern == "*/*" {
+			return true
+		}
+
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func typeNotAllowed(detail string) *ProblemDetails {
+	return &ProblemDetails{
+		Type:   problemTypeNotAllowed,
+		Title:  "File type not allowed",
+		Status: http.StatusUnsupportedMediaType,
+		Detail: detail,
+	}
+}
+
+// checkFileName makes sure the extension of a file is allowed.
+func (policy UploadPolicy) checkFileName(fileName string) *ProblemDetails {
+	extension := strings.ToLower(filepath.Ext(fileName))
+	denied := slices.Contains(policy.DeniedExtensions, extension)
+	if denied || (len(policy.AllowedExtensions) > 0 && !slices.Contains(policy.AllowedExtensions, extension)) {
+		return typeNotAllowed(fmt.Sprintf("Files with the extension %q cannot be uploaded.", extension))
+	}
+
+	return nil
+}
+
+// checkContentType makes sure the type sniffed from a file is allowed.
+// Files whose type cannot be detected are application/octet-stream, which is only allowed when listed by name rather than by a wildcard.
+func (policy UploadPolicy) checkContentType(contentType string) *ProblemDetails {
+	denied := matchesContentType(policy.DeniedTypes, contentType)
+	allowed := matchesContentType(policy.AllowedTypes, contentType)
+	if contentType == defaultContentType {
+		allowed = slices.Contains(policy.AllowedTypes, defaultContentType)
+	}
+
+	if denied || (len(policy.AllowedTypes) > 0 && !allowed) {
+		return typeNotAllowed(fmt.Sprintf("Files of type %v cannot be uploaded.", contentType))
+	}
+
+	return nil
+}
+
+// uploadLimit is the most bytes that can be uploaded and the problem to report if more is uploaded.
+// A negative number of bytes is not limited.
+type uploadLimit struct {
+	bytes   int64
+	problem ProblemDetails
+}
+
+func (limit uploadLimit) exceededBy(size int64) bool {
+	return limit.bytes >= 0 && size > limit.bytes
+}
+
+// getUploadLimit finds the tightest of the size limit and the quotas of the incident and uploader.
+// Bytes reserved by uploads that are still being saved count towards the quotas.
+func (policy UploadPolicy) getUploadLimit(incidentId int, uploader Principal) uploadLimit {
+	userUploadUsage.lock.Lock()
+	defer userUploadUsage.lock.Unlock()
+
+	return userUploadUsage.getLimit(policy, incidentId, uploader, 0)
+}
+
+// getLimit finds the upload limit while the usage is locked.
+// The owned bytes are already reserved by the upload being checked, so they are not counted against it.
+func (usage *UserUploadUsage) getLimit(policy UploadPolicy, incidentId int, uploader Principal, owned int64) uploadLimit {
+	limit := uploadLimit{bytes: -1}
+	tighten := func(max int64, usage int64, problem ProblemDetails) {
+		if max <= 0 {
+			return
+		}
+
+		remaining := max - usage
+		if remaining < 0 {
+			remaining = 0
+		}
+
+		if limit.bytes < 0 || remaining < limit.bytes {
+			problem.Status = http.StatusRequestEntityTooLarge
+			problem.Limit = max
+			problem.Usage = usage
+			limit = uploadLimit{remaining, problem}
+		}
+	}
+
+	tighten(policy.MaxFileSize, 0, ProblemDetails{
+		Type:   problemFileTooLarge,
+		Title:  "File too large",
+		Detail: fmt.Sprintf("Files can be at most %v bytes.", policy.MaxFileSize),
+	})
+
+	if policy.MaxIncidentSize > 0 {
+		used := getIncidentUsage(incidentId).Bytes + usage.incidents[incidentId] - owned
+		tighten(policy.MaxIncidentSize, used, ProblemDetails{
+			Type:   problemIncidentQuotaExceeded,
+			Title:  "Incident quota exceeded",
+			Detail: fmt.Sprintf("Incident %v has %v of %v bytes of attachments.", incidentId, used, policy.MaxIncidentSize),
+		})
+	}
+
+	if policy.MaxUserSize > 0 {
+		if !usage.loaded {
+			usage.load()
+		}
+
+		used := usage.users[uploader] + usage.reserved[uploader] - owned
+		tighten(policy.MaxUserSize, used, ProblemDetails{
+			Type:   problemUserQuotaExceeded,
+			Title:  "User quota exceeded",
+			Detail: fmt.Sprintf("The %v has uploaded %v of %v bytes of attachments.", uploader, used, policy.MaxUserSize),
+		})
+	}
+
+	return limit
+}
+
+// checkUpload makes sure a file of a known name and size can be uploaded.
+func (policy UploadPolicy) checkUpload(incidentId int, uploader Principal, fileName string, size int64) *ProblemDetails {
+	if problem := policy.checkFileName(fileName); problem != nil {
+		return problem
+	}
+
+	if limit := policy.getUploadLimit(incidentId, uploader); limit.exceededBy(size) {
+		return &limit.problem
+	}
+
+	return nil
+}
+
+// sanitizeFileName reduces an uploaded file name to just its name.
+// Any directories, including ones that would escape the storage path, and control characters are removed.
+func sanitizeFileName(fileName string) string {
+	fileName = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+
+		return r
+	}, fileName)
+
+	fileName = strings.ReplaceAll(fileName, "\\", "/")
+	fileName = strings.TrimSpace(fileName[strings.LastIndex(fileName, "/")+1:])
+	if fileName == "." || fileName == ".." || len(fileName) == 0 {
+		return "file"
+	}
+
+	return fileName
+}
+
+// IncidentUsage describes the storage used by the attachments of an incident.
+// The Bytes include every version of each attachment.
+// The MaxBytes is the quota of the incident, 0 if there is no quota.
+type IncidentUsage struct {
+	Files    int   `json:"files"`
+	Bytes    int64 `json:"bytes"`
+	MaxBytes int64 `json:"maxBytes"`
+}
+
+// getIncidentUsage adds up the storage used by the attachments of an incident.
+func getIncidentUsage(incidentId int) IncidentUsage {
+	usage := IncidentUsage{MaxBytes: uploadPolicy.MaxIncidentSize}
+	attachments, _ := incidentManager.GetAttachments(incidentId)
+	for _, attachment := range attachments {
+		usage.Files++
+		for _, version := range attachment.getVersions() {
+			usage.Bytes += version.Size
+		}
+	}
+
+	return usage
+}
+
+// uploadReservationSize is how many bytes an upload reserves at a time as it is saved.
+const uploadReservationSize int64 = 1 << 20
+
+// UserUploadUsage keeps track of how many bytes of attachments each user and service account has uploaded.
+// Finding this needs every attachment to be read, so it is only done the first time it is needed and then kept up to date.
+// Uploads that are still being saved reserve bytes for their uploader and incident, so uploads running at the same time cannot go over a quota together.
+type UserUploadUsage struct {
+	lock      sync.Mutex
+	loaded    bool
+	users     map[Principal]int64
+	reserved  map[Principal]int64
+	incidents map[int]int64
+}
+
+// uploadReservation is the bytes set aside for an upload until it is saved or fails.
+type uploadReservation struct {
+	incidentId int
+	uploader   Principal
+	bytes      int64
+}
+
+var userUploadUsage = &UserUploadUsage{}
+
+func (usage *UserUploadUsage) load() {
+	usage.users = make(map[Principal]int64)
+	incidents, _ := incidentManager.GetIncidents(nil)
+	for _, incident := range incidents {
+		attachments, _ := incidentManager.GetAttachments(int(incident.Id))
+		for _, attachment := range attachments {
+			for _, version := range attachment.getVersions() {
+				usage.users[version.getUploader()] += version.Size
+			}
+		}
+	}
+
+	usage.loaded = true
+}
+
+// Reserve makes sure an upload has at least size bytes reserved.
+// More bytes are reserved than needed so the quotas are not checked on every read.
+// If the bytes would break the policy nothing more is reserved and the problem is returned.
+func (usage *UserUploadUsage) Reserve(policy UploadPolicy, reservation *uploadReservation, size int64) *ProblemDetails {
+	if size <= reservation.bytes {
+		return nil
+	}
+
+	usage.lock.Lock()
+	defer usage.lock.Unlock()
+
+	limit := usage.getLimit(policy, reservation.incidentId, reservation.uploader, reservation.bytes)
+	if limit.exceededBy(size) {
+		return &limit.problem
+	}
+
+	bytes := size + uploadReservationSize
+	if limit.bytes >= 0 && bytes > limit.bytes {
+		bytes = limit.bytes
+	}
+
+	if usage.reserved == nil {
+		usage.reserved = make(map[Principal]int64)
+		usage.incidents = make(map[int]int64)
+	}
+
+	usage.reserved[reservation.uploader] += bytes - reservation.bytes
+	usage.incidents[reservation.incidentId] += bytes - reservation.bytes
+	reservation.bytes = bytes
+	return nil
+}
+
+// Release gives back the bytes reserved for an upload once it has been saved or has failed.
+func (usage *UserUploadUsage) Release(reservation *uploadReservation) {
+	usage.lock.Lock()
+	defer usage.lock.Unlock()
+
+	if reservation.bytes == 0 {
+		return
+	}
+
+	usage.reserved[reservation.uploader] -= reservation.bytes
+	usage.incidents[reservation.incidentId] -= reservation.bytes
+	if usage.reserved[reservation.uploader] == 0 {
+		delete(usage.reserved, reservation.uploader)
+	}
+
+	if usage.incidents[reservation.incidentId] == 0 {
+		delete(usage.incidents, reservation.incidentId)
+	}
+
+	reservation.bytes = 0
+}
+
+// Add records an upload by a user or service account.
+func (usage *UserUploadUsage) Add(uploader Principal, bytes int64) {
+	usage.lock.Lock()
+	defer usage.lock.Unlock()
+
+	if usage.loaded {
+		usage.users[uploader] += bytes
+	}
+}
+
+// RemoveAttachment records that every version of an attachment was removed.
+func (usage *UserUploadUsage) RemoveAttachment(attachment Attachment) {
+	usage.lock.Lock()
+	defer usage.lock.Unlock()
+
+	if !usage.loaded {
+		return
+	}
+
+	for _, version := range attachment.getVersions() {
+		usage.users[version.getUploader()] -= version.Size
+	}
+}
+
+// Reset forgets the usage so it is found again the next time it is needed.
+// This should be used when attachments are added without being uploaded, for example by an import.
+// The reservations of uploads that are still being saved are kept.
+func (usage *UserUploadUsage) Reset() {
+	usage.lock.Lock()
+	defer usage.lock.Unlock()
+
+	usage.loaded = false
+	usage.users = nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func uploadAttachment(token string, fileName string, content string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("uploadfile", fileName)
+	part.Write([]byte(content))
+	form.Close()
+
+	r, _ := http.NewRequest("POST", "/sona/v1/incidents/0/attachment", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.Header.Set("X-Sona-Token", token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func readProblem(t *testing.T, w *httptest.ResponseRecorder) ProblemDetails {
+	if w.Header().Get("Content-Type") != "application/problem+json" {
+		t.Fatalf("Expected problem details got %v", w.Result())
+	}
+
+	var problem ProblemDetails
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("Failed to convert response %v error %v", w.Body, err)
+	}
+
+	return problem
+}
+
+func TestUploadLargerThanMaxFileSize(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	uploadPolicy = UploadPolicy{MaxFileSize: 4}
+
+	w := uploadAttachment(token, "notes.txt", "hello")
+
+	if w.Result().StatusCode != 413 {
+		t.Fatalf("Expected 413 status code got %v", w.Result())
+	}
+
+	if problem := readProblem(t, w); problem.Type != problemFileTooLarge || problem.Limit != 4 {
+		t.Errorf("Unexpected problem %v", problem)
+	}
+
+	if attachments, _ := incidentManager.GetAttachments(0); len(attachments) != 0 {
+		t.Errorf("Expected no attachments got %v", attachments)
+	}
+
+	if files, _ := filepath.Glob(filepath.Join(fileManager.(LocalFileManager).Root, "incidents", "0", "*")); len(files) != 0 {
+		t.Errorf("Expected partial upload to be removed got %v", files)
+	}
+}
+
+func TestUploadOverIncidentQuota(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	uploadPolicy = UploadPolicy{MaxIncidentSize: 8}
+
+	if w := uploadAttachment(token, "notes.txt", "hello"); w.Result().StatusCode != 200 {
+		t.Fatalf("Expected 200 status code got %v", w.Result())
+	}
+
+	w := uploadAttachment(token, "more.txt", "hello")
+
+	if w.Result().StatusCode != 413 {
+		t.Fatalf("Expected 413 status code got %v", w.Result())
+	}
+
+	if problem := readProblem(t, w); problem.Type != problemIncidentQuotaExceeded || problem.Usage != 5 {
+		t.Errorf("Unexpected problem %v", problem)
+	}
+}
+
+func TestUploadOverUserQuota(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	uploadPolicy = UploadPolicy{MaxUserSize: 8}
+	attachFile(1, "other.txt", strings.NewReader("hello"), "", user1.Id)
+
+	w := uploadAttachment(token, "notes.txt", "hello")
+
+	if w.Result().StatusCode != 413 {
+		t.Fatalf("Expected 413 status code got %v", w.Result())
+	}
+
+	if problem := readProblem(t, w); problem.Type != problemUserQuotaExceeded || problem.Usage != 5 {
+		t.Errorf("Unexpected problem %v", problem)
+	}
+}
+
+func TestConcurrentUploadsOverUserQuota(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	uploadPolicy = UploadPolicy{MaxUserSize: 1000}
+	file, upload := io.Pipe()
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		if _, problem, ok := attachUpload(1, "first.txt", file, "", userPrincipal(user1.Id)); !ok || problem != nil {
+			t.Errorf("Expected first upload to be stored got %v", problem)
+		}
+	}()
+
+	upload.Write([]byte(strings.Repeat("a", 600)))
+
+	w := uploadAttachment(token, "notes.txt", "hello")
+	if w.Result().StatusCode != 413 || readProblem(t, w).Type != problemUserQuotaExceeded {
+		t.Fatalf("Expected upload to be rejected while the first upload is saved got %v", w.Result())
+	}
+
+	upload.Close()
+	<-done
+
+	if w := uploadAttachment(token, "large.txt", strings.Repeat("b", 401)); w.Result().StatusCode != 413 {
+		t.Errorf("Expected 413 status code got %v", w.Result())
+	}
+
+	if w := uploadAttachment(token, "notes.txt", strings.Repeat("c", 400)); w.Result().StatusCode != 200 {
+		t.Errorf("Expected reservations to be released got %v", w.Result())
+	}
+}
+
+func TestUploadDeniedType(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	uploadPolicy = UploadPolicy{AllowedTypes: []string{"text/*"}}
+
+	// The content is a png even though the name says otherwise.
+	w := uploadAttachment(token, "notes.txt", "\x89PNG\r\n\x1a\n")
+
+	if w.Result().StatusCode != 415 {
+		t.Fatalf("Expected 415 status code got %v", w.Result())
+	}
+
+	if problem := readProblem(t, w); problem.Type != problemTypeNotAllowed {
+		t.Errorf("Unexpected problem %v", problem)
+	}
+
+	if w := uploadAttachment(token, "notes.txt", "hello"); w.Result().StatusCode != 200 {
+		t.Errorf("Expected text to be allowed got %v", w.Result())
+	}
+}
+
+func TestUploadUndetectedTypeIgnoresDeclaredType(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	uploadPolicy = UploadPolicy{AllowedTypes: []string{"image/*", "application/*"}}
+	executable := "MZ\x90\x00\x03\x00\x00\x00\x04\x00"
+
+	if w := uploadAttachment(token, "picture.png", executable); w.Result().StatusCode != 415 {
+		t.Errorf("Expected extension to not be trusted got %v", w.Result())
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", `form-data; name="uploadfile"; filename="picture"`)
+	header.Set("Content-Type", "image/png")
+	part, _ := form.CreatePart(header)
+	part.Write([]byte(executable))
+	form.Close()
+
+	r, _ := http.NewRequest("POST", "/sona/v1/incidents/0/attachment", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.Header.Set("X-Sona-Token", token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	if w.Result().StatusCode != 415 {
+		t.Errorf("Expected declared type to not be trusted got %v", w.Result())
+	}
+
+	token = setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	uploadPolicy = UploadPolicy{AllowedTypes: []string{"application/octet-stream"}}
+	if w := uploadAttachment(token, "picture.png", executable); w.Result().StatusCode != 200 {
+		t.Errorf("Expected explicitly allowed undetected type to be uploaded got %v", w.Result())
+	}
+}
+
+func TestUploadDeniedExtension(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	uploadPolicy = UploadPolicy{DeniedExtensions: []string{".exe"}}
+
+	w := uploadAttachment(token, "setup.EXE", "hello")
+
+	if w.Result().StatusCode != 415 {
+		t.Errorf("Expected 415 status code got %v", w.Result())
+	}
+}
+
+func TestUploadSanitizesFileName(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+
+	w := uploadAttachment(token, "..\\..\\secret.txt", "hello")
+
+	if w.Result().StatusCode != 200 {
+		t.Fatalf("Expected 200 status code got %v", w.Result())
+	}
+
+	attachments, _ := incidentManager.GetAttachments(0)
+	if len(attachments) != 1 || attachments[0].FileName != "secret.txt" {
+		t.Errorf("Expected sanitized file name got %v", attachments)
+	}
+}
+
+func TestLocalFileManagerRejectsEscapingPaths(t *testing.T) {
+	root := t.TempDir()
+	manager := LocalFileManager{filepath.Join(root, "files")}
+
+	if _, saved := manager.SaveFile("0", "../../escaped.txt", strings.NewReader("hello")); saved {
+		t.Errorf("Expected save outside of the root to fail")
+	}
+
+	if _, saved := manager.SaveFile("..", "escaped.txt", strings.NewReader("hello")); saved {
+		t.Errorf("Expected save outside of the root to fail")
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "escaped.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected no file outside of the root")
+	}
+}
+
+func TestGetIncidentUsage(t *testing.T) {
+	token := setupAttachmentTest(t, availablePermissions.modifyIncident, availablePermissions.viewIncident)
+	uploadPolicy = UploadPolicy{MaxIncidentSize: 100}
+	attachment, _ := attachFile(0, "notes.txt", strings.NewReader("hello"), "", user1.Id)
+	attachFileVersion(0, attachment, "notes.txt", strings.NewReader("hello world"), "", user1.Id)
+
+	r, _ := http.NewRequest("GET", "/sona/v1/incidents/0/usage", nil)
+	r.Header.Set("X-Sona-Token", token)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, r)
+
+	var usage IncidentUsage
+	if err := json.Unmarshal(w.Body.Bytes(), &usage); err != nil {
+		t.Fatalf("Failed to convert response %v error %v", w.Body, err)
+	}
+
+	if usage.Files != 1 || usage.Bytes != 16 || usage.MaxBytes != 100 {
+		t.Errorf("Unexpected usage %v", usage)
+	}
+}
+
+func TestSanitizeFileName(t *testing.T) {
+	expected := map[string]string{
+		"notes.txt":            "notes.txt",
+		"../../etc/passwd":     "passwd",
+		"C:\\temp\\report.pdf": "report.pdf",
+		"..":                   "file",
+		"bad\x00name.txt":      "badname.txt",
+	}
+
+	for name, sanitized := range expected {
+		if actual := sanitizeFileName(name); actual != sanitized {
+			t.Errorf("Expected %q to be sanitized to %q got %q", name, sanitized, actual)
+		}
+	}
+}
@@ -64,10 +64,8 @@ func HandleUpdateUser(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
 
-	token := r.Header.Get("X-Sona-Token")
-	if !userManager.ValidateUser(token) {
-		logManager.LogPrintf("Invalid Token %v used", token)
-		w.WriteHeader(http.StatusForbidden)
+	principal, valid := authenticateRequest(w, r)
+	if !valid {
 		return
 	}
 
@@ -81,8 +79,8 @@ func HandleUpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !HasPermission(token, availablePermissions.modifyUser) && GetTokenUser(token) != userId {
-		logManager.LogPrintf("Token %v does not allow for modify user", token)
+	if !principal.hasPermission(availablePermissions.modifyUser) && !principal.isUser(userId) {
+		logManager.LogPrintf("The %v does not allow for modify user", principal)
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
@@ -161,10 +159,8 @@ func HandleGetUser(w http.ResponseWriter, r *http.Request) {
 	logManager.LogPrintln("Got user state request")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	token := r.Header.Get("X-Sona-Token")
-	if !userManager.ValidateUser(token) {
-		logManager.LogPrintf("Invalid Token %v used", token)
-		w.WriteHeader(http.StatusForbidden)
+	principal, valid := authenticateRequest(w, r)
+	if !valid {
 		return
 	}
 
@@ -177,8 +173,8 @@ func HandleGetUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !HasPermission(token, availablePermissions.viewUser) && GetTokenUser(token) != userId {
-		logManager.LogPrintf("Token %v does not allow for view user", token)
+	if !principal.hasPermission(availablePermissions.viewUser) && !principal.isUser(userId) {
+		logManager.LogPrintf("The %v does not allow for view user", principal)
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
@@ -199,6 +195,41 @@ func HandleGetUser(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNotFound)
 }
 
+// HandleGetUsers handles the list users web request.
+func HandleGetUsers(w http.ResponseWriter, r *http.Request) {
+	logManager.LogPrintln("Got users request")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+
+	if !validateRequest(w, r, availablePermissions.viewUser) {
+		return
+	}
+
+	filter, validFilter := convertFilter(r)
+	limit, validLimit := getQueryInt(r, "limit", defaultUserLimit)
+	offset, validOffset := getQueryInt(r, "offset", 0)
+	sortBy := r.URL.Query().Get("sort")
+	order := r.URL.Query().Get("order")
+
+	if !validFilter || !validLimit || !validOffset || (len(sortBy) > 0 && !isUserSortProperty(sortBy)) || (order != "" && order != "asc" && order != "desc") {
+		logManager.LogPrintf("Invalid users request %v\n", r.URL.RawQuery)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	page, ok := userManager.ListUsers(UserQuery{filter, sortBy, order == "desc", limit, offset})
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	logManager.LogPrintf("Found %v users\n", page.Total)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		panic(err)
+	}
+}
+
 func HandleDeleteUser(w http.ResponseWriter, r *http.Request) {
 	logManager.LogPrintln("Got user delete request")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -229,10 +260,8 @@ func HandleChangePassword(w http.ResponseWriter, r *http.Request) {
 	logManager.LogPrintln("Got user password change request.")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	token := r.Header.Get("X-Sona-Token")
-	if !userManager.ValidateUser(token) {
-		logManager.LogPrintf("Invalid Token %v used", token)
-		w.WriteHeader(http.StatusForbidden)
+	principal, valid := authenticateRequest(w, r)
+	if !valid {
 		return
 	}
 
@@ -246,8 +275,8 @@ func HandleChangePassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !HasPermission(token, availablePermissions.master) && GetTokenUser(token) != userId {
-		logManager.LogPrintf("Token %v does not allow for modify user", token)
+	if !principal.hasPermission(availablePermissions.master) && !principal.isUser(userId) {
+		logManager.LogPrintf("The %v does not allow for modify user", principal)
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 
 	"encoding/json"
@@ -20,7 +21,7 @@ func userTestSetup() {
 	}
 
 	userManager = RuntimeUserManager{make(map[int64]*User), make(map[int64]string), make(map[int64][]string), make([]string, 0)}
-	hookManager = HookManager{make([]WebHook, 0), make([]WebHook, 0), make([]WebHook, 0), make([]WebHook, 0), make([]WebHook, 0)}
+	hookManager = HookManager{make([]WebHook, 0), make([]WebHook, 0), make([]WebHook, 0), make([]WebHook, 0), make([]WebHook, 0), make([]WebHook, 0), make([]WebHook, 0)}
 }
 
 func TestCreateUser(t *testing.T) {
@@ -86,3 +87,106 @@ func TestCreateUserWithBadData(t *testing.T) {
 		t.Errorf("Expected 400 status code got %v", w.Result())
 	}
 }
+
+func setupListUsersTest(permissions ...string) string {
+	userTestSetup()
+	for _, name := range []string{"Carol", "alice", "Bob", "Dave"} {
+		userManager.AddUser(&AddUser{EmailAddress: name + "@example.com", UserName: name, FirstName: name, Password: "1234"})
+	}
+
+	userManager.SetPermissions(0, permissions)
+	usr, _ := userManager.GetUser(0)
+	_, token := usr.Authenticate("1234")
+	return token.Token
+}
+
+func listUsers(token string, query string) (UserPage, *httptest.ResponseRecorder) {
+	r, _ := http.NewRequest("GET", "/sona/v1/users?"+query, nil)
+	r.Header.Set("X-Sona-Token", token)
+	w := httptest.NewRecorder()
+
+	usrRouter.ServeHTTP(w, r)
+
+	var page UserPage
+	json.Unmarshal(w.Body.Bytes(), &page)
+	return page, w
+}
+
+func getUserNames(page UserPage) []string {
+	names := make([]string, 0, len(page.Users))
+	for _, usr := range page.Users {
+		names = append(names, usr.UserName)
+	}
+
+	return names
+}
+
+func TestListUsers(t *testing.T) {
+	token := setupListUsersTest(availablePermissions.viewUser)
+
+	page, w := listUsers(token, "sort=username&limit=2&offset=1")
+
+	if w.Result().StatusCode != 200 {
+		t.Fatalf("Expected 200 status code got %v", w.Result())
+	}
+
+	if names := getUserNames(page); page.Total != 4 || len(names) != 2 || names[0] != "Bob" || names[1] != "Carol" {
+		t.Errorf("Unexpected page %v of %v", names, page.Total)
+	}
+
+	page, _ = listUsers(token, "order=desc")
+	if names := getUserNames(page); len(names) != 4 || names[0] != "Dave" || names[3] != "Carol" {
+		t.Errorf("Expected users by descending id got %v", names)
+	}
+}
+
+func TestListUsersWithFilter(t *testing.T) {
+	token := setupListUsersTest(availablePermissions.viewUser)
+	filter := `{"union":"or","complexfilters":[{"filters":[{"property":"username","comparison":"equals","value":"ALICE"}]},{"filters":[{"property":"emailaddress","comparison":"contains","value":"DAVE"}]}]}`
+
+	page, _ := listUsers(token, "filter="+url.QueryEscape(filter))
+
+	if names := getUserNames(page); page.Total != 2 || len(names) != 2 || names[0] != "alice" || names[1] != "Dave" {
+		t.Errorf("Unexpected users %v", names)
+	}
+}
+
+func TestListUsersInvalid(t *testing.T) {
+	token := setupListUsersTest(availablePermissions.viewUser)
+
+	for _, query := range []string{"sort=password", "order=up", "limit=-1", "filter=nope"} {
+		if _, w := listUsers(token, query); w.Result().StatusCode != 400 {
+			t.Errorf("Expected 400 status code for %v got %v", query, w.Result())
+		}
+	}
+}
+
+func TestListUsersWithoutPermission(t *testing.T) {
+	token := setupListUsersTest()
+
+	if _, w := listUsers(token, ""); w.Result().StatusCode != 401 {
+		t.Errorf("Expected 401 status code got %v", w.Result())
+	}
+}
+
+func TestBuildSQLUserFilter(t *testing.T) {
+	args := make([]interface{}, 0)
+	filter := FilterRequest{
+		Junction: "or",
+		Filters: []ComplexFilter{
+			{Filter: []Filter{{"username", "equals", "bob"}, {"emailaddress; DROP TABLE Users", "contains", "50%"}}},
+			{Junction: "or", Children: []*ComplexFilter{{Filter: []Filter{{"id", "notequals", "1"}}}}},
+		},
+	}
+
+	condition := buildSQLUserFilter(&filter, &args)
+
+	expected := "((COALESCE(UserName, '') = ? AND '' LIKE CONCAT('%', ?, '%')) OR ((CAST(Id AS CHAR) != ?)))"
+	if condition != expected {
+		t.Errorf("Expected %v got %v", expected, condition)
+	}
+
+	if len(args) != 3 || args[0] != "bob" || args[1] != "50\\%" || args[2] != "1" {
+		t.Errorf("Unexpected args %v", args)
+	}
+}
@@ -4,10 +4,16 @@ type UserManager interface {
 	AddUser(user *AddUser) (bool, User)
 	GetUser(userId int64) (User, bool)
 	GetUserByEmail(emailAddress string) (User, bool)
+	GetUsers() ([]User, bool)
+	ListUsers(query UserQuery) (UserPage, bool)
 	UpdateUser(userId int64, user *User) bool
 	RemoveUser(userId int64) bool
 	SetUserPassword(user User, password string)
+	GetPasswordHash(user User) (string, bool)
+	SetPasswordHash(user User, hash string) bool
 	SetPermissions(userId int64, permissions []string) bool
 	AuthenticateUser(user User, password string) (bool, TokenResponse)
 	ValidateUser(token string) bool
+	GetTokens(userId int64) ([]string, bool)
+	SetTokens(userId int64, tokens []string) bool
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+const defaultUserLimit = 50
+
+// UserQuery describes which users to list and the order to list them in.
+// The Sort is a user property like those used by filters, users are sorted by id when it is empty.
+type UserQuery struct {
+	Filter     *FilterRequest
+	Sort       string
+	Descending bool
+	Limit      int
+	Offset     int
+}
+
+// UserPage is a page of listed users.
+// The Total is the number of matching users before the limit and offset are applied.
+type UserPage struct {
+	Total int    `json:"total"`
+	Users []User `json:"users"`
+}
+
+// userSortProperties are the user properties that users can be sorted by.
+var userSortProperties = []string{"id", "username", "firstname", "lastname", "gender", "emailaddress"}
+
+func isUserSortProperty(property string) bool {
+	for _, v := range userSortProperties {
+		if strings.EqualFold(v, property) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// queryUsers filters, sorts and pages users in memory.
+func queryUsers(users []User, query UserQuery) UserPage {
+	matches := make([]User, 0, len(users))
+	for _, user := range users {
+		if userInFilterRequest(user, query.Filter) {
+			matches = append(matches, user)
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if query.Descending {
+			i, j = j, i
+		}
+
+		return compareUsers(matches[i], matches[j], query.Sort) < 0
+	})
+
+	page := UserPage{len(matches), make([]User, 0)}
+	for i := query.Offset; i < len(matches) && len(page.Users) < query.Limit; i++ {
+		page.Users = append(page.Users, matches[i])
+	}
+
+	return page
+}
+
+// compareUsers orders two users by a property, ignoring case, and then by id.
+func compareUsers(a User, b User, property string) int {
+	if len(property) > 0 && !strings.EqualFold(property, "id") {
+		if c := strings.Compare(strings.ToLower(getUserPropertyValue(property, a)), strings.ToLower(getUserPropertyValue(property, b))); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case a.Id < b.Id:
+		return -1
+	case a.Id > b.Id:
+		return 1
+	}
+
+	return 0
+}
+
+func userInFilterRequest(user User, filter *FilterRequest) bool {
+	if filter == nil {
+		return true
+	}
+
+	if isOrRequest(filter) {
+		for _, k := range filter.Filters {
+			if userInComplexFilter(user, k) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for _, k := range filter.Filters {
+		if !userInComplexFilter(user, k) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func userInComplexFilter(user User, filter ComplexFilter) bool {
+	if filter.Children != nil {
+		if isOrFilter(filter) {
+			for _, v := range filter.Children {
+				if userInComplexFilter(user, *v) {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		for _, v := range filter.Children {
+			if !userInComplexFilter(user, *v) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if isOrFilter(filter) {
+		for _, v := range filter.Filter {
+			if userInFilter(user, v) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for _, v := range filter.Filter {
+		if !userInFilter(user, v) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func userInFilter(user User, filter Filter) bool {
+	val := getUserPropertyValue(filter.Property, user)
+	if isEqualsComparision(filter) {
+		return strings.EqualFold(filter.Value, val)
+	}
+
+	if isContainsComparision(filter) {
+		return strings.Contains(strings.ToLower(val), strings.ToLower(filter.Value))
+	}
+
+	if isNotEqualsComparision(filter) {
+		return !strings.EqualFold(filter.Value, val)
+	}
+
+	return false
+}
@@ -1,27 +1,139 @@
 package main
 
-import "net/http"
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Principal is who made a request, either a user with an access token or a service account with an API key.
+// Requests made by a service account have a UserId of -1.
+type Principal struct {
+	UserId           int64  `json:"userId"`
+	ServiceAccountId string `json:"serviceAccountId,omitempty"`
+}
+
+// userPrincipal is the principal of requests made by a user.
+func userPrincipal(userId int64) Principal {
+	return Principal{UserId: userId}
+}
+
+// isUser checks if the principal is the given user.
+func (principal Principal) isUser(userId int64) bool {
+	return len(principal.ServiceAccountId) == 0 && principal.UserId == userId
+}
+
+// hasPermission checks the current permissions of the user or service account.
+func (principal Principal) hasPermission(permission string) bool {
+	if len(principal.ServiceAccountId) == 0 {
+		return userHasPermission(principal.UserId, permission)
+	}
+
+	account, found := serviceAccountManager.GetServiceAccount(principal.ServiceAccountId)
+	return found && account.hasPermission(permission)
+}
+
+func (principal Principal) String() string {
+	if len(principal.ServiceAccountId) > 0 {
+		return "service account " + principal.ServiceAccountId
+	}
+
+	return fmt.Sprintf("user %v", principal.UserId)
+}
 
 func validateRequest(w http.ResponseWriter, r *http.Request, permission string) bool {
+	_, valid := validatePrincipal(w, r, permission)
+	return valid
+}
+
+// validatePrincipal checks a request was made by a user or service account with the permission and returns who made it.
+func validatePrincipal(w http.ResponseWriter, r *http.Request, permission string) (Principal, bool) {
+	principal, valid := authenticateRequest(w, r)
+	if !valid {
+		return principal, false
+	}
+
+	if !principal.hasPermission(permission) {
+		logManager.LogPrintf("The %v does not allow for %v", principal, permission)
+		w.WriteHeader(http.StatusUnauthorized)
+		return principal, false
+	}
+
+	return principal, true
+}
+
+// authenticateRequest finds who made a request from its access token or API key.
+// A 403 is written if the request cannot be authenticated.
+func authenticateRequest(w http.ResponseWriter, r *http.Request) (Principal, bool) {
+	token := getRequestToken(r)
+
+	if isAPIKey(token) {
+		return authenticateAPIKeyRequest(w, r, token)
+	}
+
+	if !userManager.ValidateUser(token) {
+		logManager.LogPrintf("Invalid Token %v used", token)
+		w.WriteHeader(http.StatusForbidden)
+		return Principal{UserId: -1}, false
+	}
+
+	return userPrincipal(GetTokenUser(token)), true
+}
+
+// authenticateAPIKeyRequest checks a request made with the API key of a service account.
+// Keys are secret so they are never logged.
+func authenticateAPIKeyRequest(w http.ResponseWriter, r *http.Request, token string) (Principal, bool) {
+	account, valid := authenticateAPIKey(token, getClientAddress(r))
+	if !valid {
+		logManager.LogPrintln("Invalid API key used")
+		w.WriteHeader(http.StatusForbidden)
+		return Principal{UserId: -1}, false
+	}
+
+	return Principal{UserId: -1, ServiceAccountId: account.Id}, true
+}
+
+// getRequestToken returns the token of a request from its headers or token query parameter.
+// API keys are long lived so they are ignored in the query parameter, where they would end up in logs and browser history.
+func getRequestToken(r *http.Request) string {
 	token := r.Header.Get("X-Sona-Token")
 	param := r.URL.Query()["token"]
 
+	if len(token) == 0 {
+		token = getBearerToken(r)
+	}
+
 	if len(token) == 0 && param != nil {
+		if isAPIKey(param[0]) {
+			logManager.LogPrintln("Ignoring API key sent as a query parameter")
+			return ""
+		}
+
 		logManager.LogPrintf("Using query parameter over header")
 		token = param[0]
 	}
 
-	if !userManager.ValidateUser(token) {
-		logManager.LogPrintf("Invalid Token %v used", token)
-		w.WriteHeader(http.StatusForbidden)
-		return false
+	return token
+}
+
+// getBearerToken returns the token of an Authorization: Bearer header.
+func getBearerToken(r *http.Request) string {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return ""
 	}
 
-	if !HasPermission(token, permission) {
-		logManager.LogPrintf("Token %v does not allow for %v", token, permission)
-		w.WriteHeader(http.StatusUnauthorized)
-		return false
+	return strings.TrimSpace(token)
+}
+
+// getClientAddress returns the address a request was made from.
+// Forwarding headers can be set by the client so they are not trusted.
+func getClientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
 	}
 
-	return true
+	return host
 }